@@ -5,7 +5,6 @@ go 1.22.6
 toolchain go1.23.6
 
 require (
-	github.com/hybridgroup/mjpeg v0.0.0-20140228234708-4680f319790e
 	github.com/warthog618/go-gpiocdev v0.9.1
 	gobot.io/x/gobot/v2 v2.5.0
 	gocv.io/x/gocv v0.40.0
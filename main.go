@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 
@@ -10,6 +11,9 @@ import (
 
 func main() {
 
+	profile := flag.String("profile", string(robot.ProfileFromEnv()), "hardware profile to run against: hardware or simulated (env GIZMATRON_PROFILE)")
+	flag.Parse()
+
 	serverlog := log.New(os.Stdout, "http: ", log.LstdFlags)
 	robotlog := log.New(os.Stdout, "ROBOT: ", log.LstdFlags)
 	log.Println("Starting Gizmatron")
@@ -22,10 +26,11 @@ func main() {
 		though it may initialize without the use of some components.
 		This is here so we can go figure out what any other catastophic event happend.
 	*/
-	bot, oops := robot.InitRobot(robotlog)
+	bot, oops := robot.InitRobotWithProfile(robotlog, robot.HardwareProfile(*profile))
 	if oops != nil {
 		log.Println("something real bad happened try to initialize the bot ... going down ...")
 		log.Println(oops)
+		os.Exit(1)
 	}
 
 	/*  Seems like we have a bot to work with */
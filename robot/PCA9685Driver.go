@@ -1,8 +1,10 @@
 package robot
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"periph.io/x/conn/v3/i2c"
@@ -16,13 +18,58 @@ const (
 	PCA9685_MODE1    = 0x00
 	PCA9685_PRESCALE = 0xFE
 	LED0_ON_L        = 0x06
+	ALL_LED_ON_L     = 0xFA // Writes here go to every channel at once
+	ALL_LED_OFF_H    = 0xFD
+
+	ledFullOff = 0x10 // LEDn_OFF_H bit 4, holds the output low no matter the counts
+
+	generalCallAddress = 0x00 // I2C general call, every chip on the bus listens
+	swrst              = 0x06 // General call software reset, puts every PCA9685 back to its power on state
 )
 
+// I2CBus is the transport the PCA9685Driver talks to the chip through.
+// On the Pi this is a periph.io device on the default I2C bus, but anything
+// that can write bytes and do a write-then-read transaction will do,
+// e.g. the FakePCA9685 used by the tests.
+type I2CBus interface {
+	// Tx writes w and then reads len(r) bytes into r.
+	Tx(w, r []byte) error
+	// Write sends b to the device, the first byte being the register.
+	Write(b []byte) (int, error)
+	// Close releases the underlying bus.
+	Close() error
+}
+
+// GeneralCaller is implemented by buses that can send an I2C general call.
+// The driver needs it for a software reset, without it resets fall back to rewriting MODE1.
+type GeneralCaller interface {
+	GeneralCall(b []byte) error
+}
+
+// ErrNoGeneralCall is returned by SoftwareReset when the bus can't send a general call.
+var ErrNoGeneralCall = errors.New("i2c bus can't send a general call")
+
+// periphBus adapts a periph.io i2c.Dev and its bus to the I2CBus interface.
+type periphBus struct {
+	dev *i2c.Dev
+	bus i2c.BusCloser
+}
+
+func (p *periphBus) Tx(w, r []byte) error        { return p.dev.Tx(w, r) }
+func (p *periphBus) Write(b []byte) (int, error) { return p.dev.Write(b) }
+func (p *periphBus) Close() error                { return p.bus.Close() }
+
+// GeneralCall writes b to the general call address of the bus.
+func (p *periphBus) GeneralCall(b []byte) error {
+	return p.bus.Tx(generalCallAddress, b, nil)
+}
+
 // PCA9685Driver represents our custom driver
 type PCA9685Driver struct {
-	dev           *i2c.Dev
-	bus           i2c.BusCloser
-	currentAngles [5]int // Keep track of the last angle for each channel
+	dev           I2CBus
+	angleMux      sync.Mutex
+	currentAngles [5]int         // Keep track of the last angle for each channel
+	calibration   ArmCalibration // How each joint maps onto its servo
 }
 
 // NewPCA9685Driver initializes the I2C bus and connects to the PCA9685 device.
@@ -43,9 +90,16 @@ func NewPCA9685Driver() (*PCA9685Driver, error) {
 	// Create a new device object for communication.
 	dev := &i2c.Dev{Addr: PCA9685_ADDRESS, Bus: bus}
 
+	return NewPCA9685DriverOnBus(&periphBus{dev: dev, bus: bus})
+}
+
+// NewPCA9685DriverOnBus connects to a PCA9685 through an already opened bus.
+// This is how the driver is pointed at a fake chip when there is no Pi around.
+func NewPCA9685DriverOnBus(bus I2CBus) (*PCA9685Driver, error) {
+
 	driver := &PCA9685Driver{
-		dev: dev,
-		bus: bus,
+		dev:         bus,
+		calibration: DefaultArmCalibration(),
 	}
 	// Initialize all angles to a neutral position (e.g., 90 degrees)
 	for i := range driver.currentAngles {
@@ -66,7 +120,7 @@ func NewPCA9685Driver() (*PCA9685Driver, error) {
 
 // Close cleans up and closes the I2C bus connection.
 func (d *PCA9685Driver) Close() {
-	d.bus.Close()
+	d.dev.Close()
 }
 
 // writeRegister is a helper to write a byte to a specific register.
@@ -134,32 +188,69 @@ func (d *PCA9685Driver) SetPWM(channel int, on, off uint16) error {
 	return err
 }
 
-// setServoPulse is an internal helper that converts an angle to a PWM pulse and sets it instantly.
+// SoftwareReset puts the chip back to its power on state with a general call SWRST.
+// Note that this resets every PCA9685 on the bus, and leaves every output full off.
+func (d *PCA9685Driver) SoftwareReset() error {
+	caller, ok := d.dev.(GeneralCaller)
+	if !ok {
+		return ErrNoGeneralCall
+	}
+	if err := caller.GeneralCall([]byte{swrst}); err != nil {
+		return err
+	}
+	// The oscillator needs a moment after a reset
+	time.Sleep(1 * time.Millisecond)
+	return nil
+}
+
+// AllOff sets the full off bit on every channel, cutting the PWM to all servos at once.
+// The servos go limp until the next SetPWM on their channel, which clears the bit.
+func (d *PCA9685Driver) AllOff() error {
+	return d.writeRegister(ALL_LED_OFF_H, ledFullOff)
+}
+
+// SetCalibration replaces the calibration used to turn joint angles into servo pulses.
+func (d *PCA9685Driver) SetCalibration(cal ArmCalibration) {
+	d.angleMux.Lock()
+	defer d.angleMux.Unlock()
+	d.calibration = cal
+}
+
+// Calibration returns the calibration in use.
+func (d *PCA9685Driver) Calibration() ArmCalibration {
+	d.angleMux.Lock()
+	defer d.angleMux.Unlock()
+	return d.calibration
+}
+
+// setServoPulse is an internal helper that converts a joint angle to a PWM pulse and sets it instantly.
+// The pulse comes from the joint's calibration, its limits are left to the caller.
 func (d *PCA9685Driver) setServoPulse(channel int, angle int) error {
-	if angle < 0 || angle > 180 {
-		return fmt.Errorf("angle out of range (0-180)")
+	if channel < 0 || channel >= len(d.currentAngles) {
+		return fmt.Errorf("no servo on channel %d (0-%d)", channel, len(d.currentAngles)-1)
 	}
-	// These are typical pulse widths for a standard servo.
-	servoMin := 150 // Min pulse length (out of 4096)
-	servoMax := 600 // Max pulse length (out of 4096)
 
-	pulseLength := servoMin + int(float64(servoMax-servoMin)*float64(angle)/180.0)
+	pulseLength, err := d.Calibration().Joints[channel].Pulse(angle)
+	if err != nil {
+		return err
+	}
 
-	return d.SetPWM(channel, 0, uint16(pulseLength))
+	return d.SetPWM(channel, 0, pulseLength)
 }
 
 // ServoWrite moves a servo to a specific angle at a given speed.
 // Speed is the delay in milliseconds between each 1-degree step.
 // Smaller speed value means faster movement.
+// The angle has to be inside the joint's calibrated limits.
 func (d *PCA9685Driver) ServoWrite(channel int, angle int, speed time.Duration) error {
-	if channel < 0 || channel > 15 {
-		return fmt.Errorf("channel out of range (0-15)")
+	if channel < 0 || channel >= len(d.currentAngles) {
+		return fmt.Errorf("no servo on channel %d (0-%d)", channel, len(d.currentAngles)-1)
 	}
-	if angle < 0 || angle > 180 {
-		return fmt.Errorf("angle out of range (0-180)")
+	if joint := d.Calibration().Joints[channel]; !joint.Allows(angle) {
+		return &JointLimitError{Joint: channel, Angle: angle, Min: joint.MinAngle, Max: joint.MaxAngle}
 	}
 
-	startAngle := d.currentAngles[channel]
+	startAngle := d.CurrentAngles()[channel]
 	endAngle := angle
 
 	// Determine the direction of movement
@@ -169,6 +260,7 @@ func (d *PCA9685Driver) ServoWrite(channel int, angle int, speed time.Duration)
 			if err := d.setServoPulse(channel, i); err != nil {
 				return err
 			}
+			d.setCurrentAngle(channel, i)
 			time.Sleep(speed * time.Millisecond)
 		}
 	} else {
@@ -177,11 +269,26 @@ func (d *PCA9685Driver) ServoWrite(channel int, angle int, speed time.Duration)
 			if err := d.setServoPulse(channel, i); err != nil {
 				return err
 			}
+			d.setCurrentAngle(channel, i)
 			time.Sleep(speed * time.Millisecond)
 		}
 	}
 
 	// Update the current angle for the channel
-	d.currentAngles[channel] = angle
+	d.setCurrentAngle(channel, angle)
 	return nil
 }
+
+// CurrentAngles returns the last angle written to each servo.
+// While a servo is stepping this follows it one degree at a time.
+func (d *PCA9685Driver) CurrentAngles() [5]int {
+	d.angleMux.Lock()
+	defer d.angleMux.Unlock()
+	return d.currentAngles
+}
+
+func (d *PCA9685Driver) setCurrentAngle(channel int, angle int) {
+	d.angleMux.Lock()
+	defer d.angleMux.Unlock()
+	d.currentAngles[channel] = angle
+}
@@ -0,0 +1,157 @@
+package robot
+
+import (
+	"testing"
+)
+
+func newTestDriver(t *testing.T) (*PCA9685Driver, *FakePCA9685) {
+	t.Helper()
+	chip := NewFakePCA9685()
+	driver, err := NewPCA9685DriverOnBus(chip)
+	if err != nil {
+		t.Fatalf("Could not create driver on fake bus: %v", err)
+	}
+	return driver, chip
+}
+
+func TestNewPCA9685DriverOnBus_WakesChip(t *testing.T) {
+	driver, chip := newTestDriver(t)
+
+	if chip.Mode1() != 0x00 {
+		t.Errorf("MODE1 = %#x, want 0x00", chip.Mode1())
+	}
+	for i, angle := range driver.currentAngles {
+		if angle != 90 {
+			t.Errorf("currentAngles[%d] = %d, want 90", i, angle)
+		}
+	}
+}
+
+func TestSetPWMFreq(t *testing.T) {
+	tests := []struct {
+		freq     float64
+		prescale byte
+	}{
+		{50, 121},
+		{60, 101},
+		{200, 30},
+		{1000, 5},
+	}
+
+	for _, tt := range tests {
+		driver, chip := newTestDriver(t)
+		if err := driver.SetPWMFreq(tt.freq); err != nil {
+			t.Fatalf("SetPWMFreq(%v) returned error: %v", tt.freq, err)
+		}
+		if chip.Prescale() != tt.prescale {
+			t.Errorf("SetPWMFreq(%v) prescale = %d, want %d", tt.freq, chip.Prescale(), tt.prescale)
+		}
+		if chip.Mode1()&mode1Sleep != 0 {
+			t.Errorf("SetPWMFreq(%v) left the chip asleep, MODE1 = %#x", tt.freq, chip.Mode1())
+		}
+		if chip.Mode1()&mode1AI == 0 {
+			t.Errorf("SetPWMFreq(%v) did not enable auto-increment, MODE1 = %#x", tt.freq, chip.Mode1())
+		}
+	}
+}
+
+func TestSetPWMFreq_SleepsBeforePrescale(t *testing.T) {
+	driver, chip := newTestDriver(t)
+	chip.ResetWrites()
+
+	if err := driver.SetPWMFreq(50); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := chip.Writes()
+	asleep := false
+	for _, w := range writes {
+		if w.Register == PCA9685_MODE1 {
+			asleep = w.Value&mode1Sleep != 0
+		}
+		if w.Register == PCA9685_PRESCALE && !asleep {
+			t.Fatalf("PRESCALE written while the chip was awake: %v", writes)
+		}
+	}
+}
+
+func TestSetPWM(t *testing.T) {
+	driver, chip := newTestDriver(t)
+	if err := driver.SetPWMFreq(50); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := driver.SetPWM(3, 0x0102, 0x0304); err != nil {
+		t.Fatalf("SetPWM returned error: %v", err)
+	}
+
+	on, off := chip.Channel(3)
+	if on != 0x0102 || off != 0x0304 {
+		t.Errorf("channel 3 on/off = %#x/%#x, want 0x102/0x304", on, off)
+	}
+	// Untouched channels stay at their power on full off
+	if on, off := chip.Channel(2); on != 0 || off != 0x1000 {
+		t.Errorf("channel 2 was touched: on/off = %#x/%#x", on, off)
+	}
+}
+
+func TestSetPWM_ChannelOutOfRange(t *testing.T) {
+	driver, _ := newTestDriver(t)
+
+	for _, channel := range []int{-1, 16} {
+		if err := driver.SetPWM(channel, 0, 100); err == nil {
+			t.Errorf("SetPWM(%d) should return an error", channel)
+		}
+	}
+}
+
+func TestServoWrite(t *testing.T) {
+	driver, chip := newTestDriver(t)
+	if err := driver.SetPWMFreq(50); err != nil {
+		t.Fatal(err)
+	}
+	chip.ResetWrites()
+
+	if err := driver.ServoWrite(1, 95, 0); err != nil {
+		t.Fatalf("ServoWrite returned error: %v", err)
+	}
+
+	// 90 -> 95 is stepped one degree at a time
+	history := chip.ChannelHistory(1)
+	want := []uint16{375, 377, 380, 382, 385, 387}
+	if len(history) != len(want) {
+		t.Fatalf("channel 1 pulses = %v, want %v", history, want)
+	}
+	for i := range want {
+		if history[i] != want[i] {
+			t.Errorf("channel 1 pulses = %v, want %v", history, want)
+			break
+		}
+	}
+	if driver.currentAngles[1] != 95 {
+		t.Errorf("currentAngles[1] = %d, want 95", driver.currentAngles[1])
+	}
+}
+
+func TestServoWrite_AngleOutOfRange(t *testing.T) {
+	driver, chip := newTestDriver(t)
+	chip.ResetWrites()
+
+	for _, angle := range []int{-1, 181} {
+		if err := driver.ServoWrite(0, angle, 0); err == nil {
+			t.Errorf("ServoWrite(0, %d) should return an error", angle)
+		}
+	}
+	if len(chip.Writes()) != 0 {
+		t.Errorf("out of range ServoWrite still wrote to the chip: %v", chip.Writes())
+	}
+}
+
+func TestClose(t *testing.T) {
+	driver, _ := newTestDriver(t)
+	driver.Close()
+
+	if err := driver.SetPWM(0, 0, 100); err == nil {
+		t.Error("SetPWM after Close should return an error")
+	}
+}
@@ -1,9 +1,10 @@
 package robot
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
-	"math"
+	"sync"
 	"time"
 )
 
@@ -45,6 +46,12 @@ const (
 	JOINT_4_SERVO = 4
 )
 
+// defaultArmSpeed is 10ms per degree
+const defaultArmSpeed = 10
+
+// ErrEmergencyStop is returned by every motion command while the e-stop is engaged.
+var ErrEmergencyStop = errors.New("arm emergency stop is engaged")
+
 type cords struct {
 	x float64
 	y float64
@@ -60,11 +67,23 @@ type Arm struct {
 	driver            *PCA9685Driver
 	x_max             int
 	y_max             int
-	speed             time.Duration // speed in ms
+	speed             time.Duration // speed in ms per degree, caps the joints' max velocity
+	L0                float64       // Height of the shoulder (joint 1) above the table
 	L1                float64       // Length of the first link
 	L2                float64       // Length of the second link
 	L3                float64       // Length of the third link
+	L4                float64       // Length from the wrist (joint 4) to the camera
 	jointTargetAngles [5]int        // Target degrees for each joint
+	Elbow             ElbowConfig   // Elbow configuration used by SolveIK and MoveToTarget
+
+	motionMux    sync.Mutex         // held for the whole of a move, one move at a time
+	powerCut     bool               // an e-stop cut the servos' power, guarded by motionMux
+	stopMux      sync.Mutex         // guards cancelMotion and estopped
+	cancelMotion context.CancelFunc // cancels the move in flight, if any
+	estopped     bool               // latched by EmergencyStop, cleared by ClearEmergencyStop
+
+	recordMux sync.Mutex       // guards recorder
+	recorder  *routineRecorder // set while the arm is being taught
 }
 
 func InitArm() (*Arm, error) {
@@ -76,6 +95,13 @@ func InitArm() (*Arm, error) {
 		return nil, err
 	}
 	//defer arm_driver.Close()
+	arm_driver.SetCalibration(loadArmCalibration())
+
+	return NewArm(arm_driver)
+}
+
+// NewArm builds the arm on top of an already connected driver and moves it to its initial position.
+func NewArm(arm_driver *PCA9685Driver) (*Arm, error) {
 
 	a := &Arm{
 
@@ -83,17 +109,14 @@ func InitArm() (*Arm, error) {
 		driver: arm_driver,
 		x_max:  20,
 		y_max:  20,
-		speed:  10,   // default speed of 10ms per degree
+		speed:  defaultArmSpeed,
+		L0:     3.0,  // Height of the shoulder above the table
 		L1:     10.3, // Length of the first link
 		L2:     2.8,  // Length of the second link (initialize as needed)
 		L3:     10.3, // Length of the third link (initialize as needed)
-		jointTargetAngles: [5]int{ // Initial target angles
-			90,  // BASE_SERVO 3.0cm
-			0,   // JOINT_1_SERVO 10.4cm
-			0,   // JOINT_2_SERVO 2.8cm
-			180, // JOINT_3_SERVO 10.4cm
-			180, // JOINT_4_SERVO 2.3cm
-		},
+		L4:     2.3,  // Wrist to camera
+		// Initial target angles, the calibrated home of each joint
+		jointTargetAngles: arm_driver.Calibration().HomeAngles(),
 	}
 
 	// Initialize the driver
@@ -101,7 +124,8 @@ func InitArm() (*Arm, error) {
 	// set the PWM Frequency
 	log.Println("Setting PWM frequency to 50Hz...")
 	if err := a.driver.SetPWMFreq(50); err != nil {
-		log.Fatalf("Could not set PWM frequency: %v", err)
+		log.Printf("Could not set PWM frequency: %v", err)
+		return nil, err
 	}
 
 	for i, degree := range a.jointTargetAngles {
@@ -112,10 +136,10 @@ func InitArm() (*Arm, error) {
 		// so we need to manually set them here.
 		// This is important for the first run to ensure the arm starts at the correct position.
 		log.Printf("Setting initial angle for servo %d to %d degrees", i, degree)
-		a.driver.currentAngles[i] = degree // Initialize current angles
+		a.driver.setCurrentAngle(i, degree) // Initialize current angles
 	}
 
-	log.Println("Arm Position: ", a.driver.currentAngles)
+	log.Println("Arm Position: ", a.driver.CurrentAngles())
 	a.State = true
 	a.IsOperational = true
 	return a, nil
@@ -127,42 +151,194 @@ func (a *Arm) SetSpeed(speed time.Duration) {
 	log.Printf("Arm movement speed set to %v milliseconds", a.speed)
 }
 
+// Calibration returns the joint calibration the arm is driven with.
+func (a *Arm) Calibration() ArmCalibration {
+	if a.driver == nil {
+		return DefaultArmCalibration()
+	}
+	return a.driver.Calibration()
+}
+
 /* Update servo*/
-func (a *Arm) UpdateArm() error {
-	// Update this servo
-	for i, degree := range a.jointTargetAngles {
+// UpdateArm moves the arm to its target angles. Cancelling ctx stops it where it is.
+func (a *Arm) UpdateArm(ctx context.Context) error {
+	return a.moveTo(ctx, a.jointTargetAngles)
+}
 
-		log.Printf("Setting servo %d from %d degrees to %d degrees at %d rate", i, a.driver.currentAngles[i], degree, a.speed)
-		if err := a.driver.ServoWrite(i, int(degree), a.speed); err != nil {
+// moveTo moves every joint together to targets, one move at a time.
+// The move stops between two ticks when ctx is cancelled, CancelMotion is called or the e-stop is engaged.
+func (a *Arm) moveTo(ctx context.Context, targets [5]int) error {
+	return a.move(ctx, targets, 1)
+}
 
-			// TODO: Keep track of servos that fail to move
-			// and return an error at the end of the function
-			// so that we can retry them later
-			log.Printf("Error! moving servo: %v\n", err)
+// move is moveTo with every joint's velocity and acceleration scaled down by velocityScale.
+// It is recorded into the routine being taught, if any.
+func (a *Arm) move(ctx context.Context, targets [5]int, velocityScale float64) error {
+	return a.moveAfter(ctx, targets, velocityScale, func() error {
+		a.recordMove(targets, velocityScale)
+		return nil
+	})
+}
+
+// moveAfter is move, calling before once it holds motionMux and has checked the
+// e-stop and ctx, so nothing can slip in between before and the move.
+// It isn't recorded, unless before does it.
+func (a *Arm) moveAfter(ctx context.Context, targets [5]int, velocityScale float64, before func() error) error {
+
+	// The e-stop wins over anything wrong with the move
+	if a.EmergencyStopped() {
+		return ErrEmergencyStop
+	}
+
+	// Check every target before anything moves, so a bad target
+	// can't leave the arm half way between two positions
+	cal := a.Calibration()
+	for i, degree := range targets {
+		if joint := cal.Joints[i]; !joint.Allows(degree) {
+			log.Printf("Error! joint %d target %d is outside its limits", i, degree)
+			return &JointLimitError{Joint: i, Angle: degree, Min: joint.MinAngle, Max: joint.MaxAngle}
+		}
+	}
+
+	a.motionMux.Lock()
+	defer a.motionMux.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	a.stopMux.Lock()
+	if a.estopped {
+		a.stopMux.Unlock()
+		return ErrEmergencyStop
+	}
+	a.cancelMotion = cancel
+	a.stopMux.Unlock()
+	defer func() {
+		a.stopMux.Lock()
+		a.cancelMotion = nil
+		a.stopMux.Unlock()
+	}()
+
+	if before != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := before(); err != nil {
 			return err
 		}
-		log.Printf("Joint %d current degree: %d", i, a.driver.currentAngles[i])
-		//time.Sleep(time.Duration(1000*speed) * time.Nanosecond)
+	}
+
+	if a.powerCut {
+		// Every servo went limp, not just the ones this move turns, so they
+		// are all driven back to where they were before anything moves
+		log.Printf("Powering the servos back on at %v", a.driver.CurrentAngles())
+		for i, angle := range a.driver.CurrentAngles() {
+			if err := a.driver.setServoPulse(i, angle); err != nil {
+				log.Printf("Error! could not power joint %d back on: %v", i, err)
+				return err
+			}
+		}
+		a.powerCut = false
+	}
 
+	a.jointTargetAngles = targets
+
+	// Move every joint together, from wherever the servos are now
+	velocity, accel := a.motionLimits()
+	for i := range velocity {
+		velocity[i] *= velocityScale
+		accel[i] *= velocityScale
+	}
+	trajectory := PlanTrajectory(a.driver.CurrentAngles(), targets, velocity, accel)
+
+	log.Printf("Moving arm from %v to %v over %v", trajectory.Start, trajectory.End, trajectory.Duration)
+	if err := a.followTrajectory(ctx, trajectory); err != nil {
+		if ctx.Err() != nil {
+			// Stay where we stopped rather than pick the move up again later
+			a.jointTargetAngles = a.driver.CurrentAngles()
+			log.Printf("Arm move interrupted at %v", a.jointTargetAngles)
+			if a.EmergencyStopped() {
+				return ErrEmergencyStop
+			}
+		}
+		log.Printf("Error! moving arm: %v\n", err)
+		return err
 	}
+	log.Println("Arm Position: ", a.driver.CurrentAngles())
 
 	return nil
 }
 
-/* Put Arm in Start Position */
-func (a *Arm) Start() error {
+// CancelMotion stops the move in flight, if any, and leaves the arm where it is.
+// Unlike EmergencyStop the arm can be moved again straight away.
+func (a *Arm) CancelMotion() {
+	a.stopMux.Lock()
+	defer a.stopMux.Unlock()
+	if a.cancelMotion != nil {
+		a.cancelMotion()
+	}
+}
 
-	log.Println("Starting Arm...")
+// EmergencyStop halts the arm and latches, every motion command fails with
+// ErrEmergencyStop until ClearEmergencyStop is called.
+// With cutPower the PWM to every servo is switched off as well and the arm goes limp,
+// otherwise the servos hold wherever they stopped.
+func (a *Arm) EmergencyStop(cutPower bool) error {
+
+	log.Printf("EMERGENCY STOP! cut power: %v", cutPower)
 
-	a.jointTargetAngles = [5]int{
-		90,  // BASE_SERVO
-		30,  // JOINT_1_SERVO
-		30,  // JOINT_2_SERVO
-		130, // JOINT_3_SERVO
-		130, // JOINT_4_SERVO
+	a.stopMux.Lock()
+	a.estopped = true
+	if a.cancelMotion != nil {
+		a.cancelMotion()
 	}
+	a.stopMux.Unlock()
 
-	err := a.UpdateArm()
+	// Wait for the move in flight to notice, it won't touch the servos again after this
+	a.motionMux.Lock()
+	defer a.motionMux.Unlock()
+	a.IsRunning = false
+
+	if cutPower {
+		a.powerCut = true
+		if err := a.driver.AllOff(); err != nil {
+			log.Printf("Error! could not cut servo power: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ClearEmergencyStop releases the e-stop so the arm can be moved again.
+// If power was cut the servos stay limp until the next move, which first
+// drives every one of them back to the last angle it was driven to.
+func (a *Arm) ClearEmergencyStop() {
+	a.stopMux.Lock()
+	defer a.stopMux.Unlock()
+	if a.estopped {
+		log.Println("Emergency stop cleared")
+	}
+	a.estopped = false
+}
+
+// EmergencyStopped reports whether the e-stop is engaged.
+func (a *Arm) EmergencyStopped() bool {
+	a.stopMux.Lock()
+	defer a.stopMux.Unlock()
+	return a.estopped
+}
+
+/* Put Arm in Start Position */
+func (a *Arm) Start(ctx context.Context) error {
+	return a.StartAt(ctx, DefaultStartAngles)
+}
+
+// StartAt moves the arm to a start position and marks it running.
+func (a *Arm) StartAt(ctx context.Context, angles [5]int) error {
+
+	log.Println("Starting Arm...")
+
+	err := a.moveTo(ctx, angles)
 	if err != nil {
 		log.Printf("Failed to start arm: %v", err)
 		return err
@@ -173,22 +349,20 @@ func (a *Arm) Start() error {
 }
 
 /* Put Arm in Stop Position */
-func (a *Arm) Stop() error {
-
-	log.Println("Stopping Arm...")
-
+func (a *Arm) Stop(ctx context.Context) error {
 	// Set the arm to a default position
 	// This is the position we want the arm to be in when it is not running
 	// It should be a safe position that does not interfere with any objects
 	// or cause any damage to the arm or the environment
-	a.jointTargetAngles = [5]int{
-		90,  // BASE_SERVO
-		0,   // JOINT_1_SERVO
-		0,   // JOINT_2_SERVO
-		180, // JOINT_3_SERVO
-		180, // JOINT_4_SERVO
-	}
-	err := a.UpdateArm()
+	return a.StopAt(ctx, a.Calibration().HomeAngles())
+}
+
+// StopAt parks the arm at a stop position and marks it stopped.
+func (a *Arm) StopAt(ctx context.Context, angles [5]int) error {
+
+	log.Println("Stopping Arm...")
+
+	err := a.moveTo(ctx, angles)
 	if err != nil {
 		log.Printf("failed to stop arm: %v", err)
 		return err
@@ -197,25 +371,105 @@ func (a *Arm) Stop() error {
 	return nil
 }
 
-/* TODO: Impliment reset */
-func (a *Arm) Reset() error { return nil }
+// MoveToJoints moves the arm to the given joint angles.
+func (a *Arm) MoveToJoints(ctx context.Context, angles [5]int) error {
+	return a.moveTo(ctx, angles)
+}
 
-func (a *Arm) MoveToTarget(x, y, z float64) error {
+/*
+Reset recovers the arm after the PCA9685 has lost its settings, e.g. after a brown-out.
+
+The chip gets a software reset and its PWM frequency back, which leaves every servo
+limp. Where the arm ended up is unknown, so each joint is woken up at the last angle it
+was driven to, wrist first, and brought home on its own at a fraction of its usual speed.
+*/
+func (a *Arm) Reset(ctx context.Context) error {
+
+	log.Println("Resetting Arm...")
+
+	if a.EmergencyStopped() {
+		return ErrEmergencyStop
+	}
+
+	if err := a.resetDriver(); err != nil {
+		log.Printf("Error! could not reset the arm driver: %v", err)
+		a.err = err
+		a.IsOperational = false
+		return err
+	}
+
+	home := a.Calibration().HomeAngles()
+	for _, joint := range []int{JOINT_4_SERVO, JOINT_3_SERVO, JOINT_2_SERVO, JOINT_1_SERVO, BASE_SERVO} {
+		angles := a.driver.CurrentAngles()
+		last := angles[joint]
+		// Woken as part of the move, an e-stop can't come between the two and be undone
+		wake := func() error {
+			if err := a.driver.setServoPulse(joint, last); err != nil {
+				log.Printf("Error! could not wake joint %d: %v", joint, err)
+				return err
+			}
+			return nil
+		}
+		angles[joint] = home[joint]
+		if err := a.moveAfter(ctx, angles, resetVelocityScale, wake); err != nil {
+			log.Printf("Error! could not re-home joint %d: %v", joint, err)
+			return err
+		}
+	}
+
+	log.Println("Arm Position: ", a.driver.CurrentAngles())
+	a.err = nil
+	a.State = true
+	a.IsOperational = true
+	a.IsRunning = false
+	return nil
+}
+
+// resetVelocityScale is how much slower than usual joints move when re-homing after a reset
+const resetVelocityScale = 0.25
+
+// resetDriver software resets the PCA9685 and sets it back up for servos.
+func (a *Arm) resetDriver() error {
+	// Nothing else may talk to the chip while it resets
+	a.motionMux.Lock()
+	defer a.motionMux.Unlock()
+	// Every servo is limp after this anyway, Reset wakes them one at a time
+	a.powerCut = false
+
+	if err := a.driver.SoftwareReset(); err != nil {
+		// Without a general call the best we can do is wake the chip back up
+		log.Printf("Warning!! PCA9685 software reset failed, rewriting MODE1: %v", err)
+		if err := a.driver.writeRegister(PCA9685_MODE1, 0x00); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Setting PWM frequency to 50Hz...")
+	return a.driver.SetPWMFreq(50)
+}
+
+func (a *Arm) MoveToTarget(ctx context.Context, x, y, z float64) error {
+	return a.MoveToPose(ctx, Pose{X: x, Y: y, Z: z}, a.Elbow)
+}
+
+// MoveToPose moves the camera to the target position, looking at target.Pitch.
+// target.Yaw is ignored, the base always turns to face (x, y).
+func (a *Arm) MoveToPose(ctx context.Context, target Pose, elbow ElbowConfig) error {
 
 	// Clean method to move the arm to a target position
 
-	log.Printf("Moving arm to target position: x=%.2f, y=%.2f, z=%.2f", x, y, z)
+	log.Printf("Moving arm to target position: x=%.2f, y=%.2f, z=%.2f pitch=%.2f elbow=%v", target.X, target.Y, target.Z, target.Pitch, elbow)
 
 	// Solve the Inverse Kinematics for the arm
-	err := a.SolveIK(x, y, z)
+	angles, err := a.InverseKinematics(target, elbow)
 	if err != nil {
-		log.Printf("Error solving IK for ShowHappy: %v", err)
+		log.Printf("Error solving IK: %v", err)
 		return err
 	}
 
 	// Update the arm with the new angles
-	if err := a.UpdateArm(); err != nil {
-		log.Printf("Error updating arm for ShowHappy: %v", err)
+	if err := a.moveTo(ctx, angles); err != nil {
+		log.Printf("Error updating arm: %v", err)
 		return err
 	}
 	log.Println("Arm moved to target position successfully")
@@ -223,28 +477,14 @@ func (a *Arm) MoveToTarget(x, y, z float64) error {
 	return nil
 }
 
+// SolveIK solves for the joint angles that put the camera at (x, y, z), level with the ground,
+// and makes them the arm's new target angles.
 func (a *Arm) SolveIK(x, y, z float64) error {
 
-	// Solve the Inverse Kinematics for the arm
-
-	// For now we'll just assume the base servo is at 90 degrees
-	// I'll solve for that later
-	a.jointTargetAngles[BASE_SERVO] = 90 // Set the base servo to 90 degrees
-
-	// Calculate the base angle in radians the height should be half our z value
-	baseAngleRad := math.Asin((z / 2.0) / a.L1)
-
-	if math.IsNaN(baseAngleRad) {
-		log.Printf("Error calculating base angle")
-		return fmt.Errorf("invalid base angle calculation")
+	angles, err := a.InverseKinematics(Pose{X: x, Y: y, Z: z}, a.Elbow)
+	if err != nil {
+		return err
 	}
-
-	baseAngle := baseAngleRad * (180 / math.Pi) // Convert to degrees
-
-	a.jointTargetAngles[JOINT_1_SERVO] = int(baseAngle)
-	a.jointTargetAngles[JOINT_2_SERVO] = int(baseAngle)       // should remain parallel to the ground as base angle is adjusted
-	a.jointTargetAngles[JOINT_3_SERVO] = int(180 - baseAngle) // The second elbow is the opposite of the base angle
-	a.jointTargetAngles[JOINT_4_SERVO] = int(180 - baseAngle) // should also be parallel to the ground
-
+	a.jointTargetAngles = angles
 	return nil
 }
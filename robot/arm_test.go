@@ -0,0 +1,283 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestArm(t *testing.T) (*Arm, *FakePCA9685) {
+	t.Helper()
+	driver, chip := newTestDriver(t)
+	arm, err := NewArm(driver)
+	if err != nil {
+		t.Fatalf("NewArm returned error: %v", err)
+	}
+	arm.SetSpeed(0)
+	arm.driver.SetCalibration(fastCalibration())
+	return arm, chip
+}
+
+// fastCalibration is the default calibration with motion limits high enough that moves finish in a few ticks
+func fastCalibration() ArmCalibration {
+	cal := DefaultArmCalibration()
+	for i := range cal.Joints {
+		cal.Joints[i].MaxVelocity = 10000
+		cal.Joints[i].MaxAcceleration = 1000000
+	}
+	return cal
+}
+
+func pulseFor(angle int) uint16 {
+	return uint16(150 + int(450.0*float64(angle)/180.0))
+}
+
+func TestNewArm_InitialPosition(t *testing.T) {
+	arm, chip := newTestArm(t)
+
+	if !arm.IsOperational {
+		t.Error("arm should be operational")
+	}
+	if chip.Prescale() != 121 {
+		t.Errorf("prescale = %d, want 121 (50Hz)", chip.Prescale())
+	}
+
+	want := [5]int{90, 0, 0, 180, 180}
+	for i, angle := range want {
+		if arm.driver.currentAngles[i] != angle {
+			t.Errorf("joint %d angle = %d, want %d", i, arm.driver.currentAngles[i], angle)
+		}
+		if _, off := chip.Channel(i); off != pulseFor(angle) {
+			t.Errorf("joint %d pulse = %d, want %d", i, off, pulseFor(angle))
+		}
+	}
+}
+
+func TestArmStartStop(t *testing.T) {
+	arm, chip := newTestArm(t)
+
+	if err := arm.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if !arm.IsRunning {
+		t.Error("arm should be running after Start")
+	}
+	for i, angle := range [5]int{90, 30, 30, 130, 130} {
+		if _, off := chip.Channel(i); off != pulseFor(angle) {
+			t.Errorf("after Start joint %d pulse = %d, want %d", i, off, pulseFor(angle))
+		}
+	}
+
+	if err := arm.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop returned error: %v", err)
+	}
+	if arm.IsRunning {
+		t.Error("arm should not be running after Stop")
+	}
+	for i, angle := range [5]int{90, 0, 0, 180, 180} {
+		if _, off := chip.Channel(i); off != pulseFor(angle) {
+			t.Errorf("after Stop joint %d pulse = %d, want %d", i, off, pulseFor(angle))
+		}
+	}
+}
+
+func TestUpdateArm_StopsOnFailedServo(t *testing.T) {
+	arm, chip := newTestArm(t)
+	chip.ResetWrites()
+
+	arm.jointTargetAngles = [5]int{90, 200, 10, 180, 180}
+	if err := arm.UpdateArm(context.Background()); err == nil {
+		t.Fatal("UpdateArm should fail for an out of range joint")
+	}
+	if len(chip.ChannelHistory(2)) != 0 {
+		t.Error("joints after the failed one should not move")
+	}
+}
+
+// startSlowMove starts a move that takes the default motion limits a couple of seconds
+func startSlowMove(t *testing.T, arm *Arm, ctx context.Context) <-chan error {
+	t.Helper()
+	arm.driver.SetCalibration(DefaultArmCalibration())
+	done := make(chan error, 1)
+	go func() { done <- arm.moveTo(ctx, [5]int{0, 90, 90, 90, 90}) }()
+	time.Sleep(5 * trajectoryTick)
+	return done
+}
+
+func waitForMove(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("move did not stop")
+		return nil
+	}
+}
+
+func TestUpdateArm_Cancelled(t *testing.T) {
+	arm, _ := newTestArm(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startSlowMove(t, arm, ctx)
+	cancel()
+
+	if err := waitForMove(t, done); !errors.Is(err, context.Canceled) {
+		t.Fatalf("move returned %v, want context.Canceled", err)
+	}
+	stopped := arm.driver.CurrentAngles()
+	if stopped == [5]int{90, 0, 0, 180, 180} || stopped == [5]int{0, 90, 90, 90, 90} {
+		t.Errorf("arm should have stopped part way, it is at %v", stopped)
+	}
+	if arm.jointTargetAngles != stopped {
+		t.Errorf("targets = %v, want where the arm stopped %v", arm.jointTargetAngles, stopped)
+	}
+}
+
+func TestCancelMotion(t *testing.T) {
+	arm, _ := newTestArm(t)
+
+	done := startSlowMove(t, arm, context.Background())
+	arm.CancelMotion()
+	if err := waitForMove(t, done); err == nil {
+		t.Fatal("cancelled move should return an error")
+	}
+
+	// Not latched, the arm moves again straight away
+	arm.driver.SetCalibration(fastCalibration())
+	if err := arm.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop after CancelMotion returned %v", err)
+	}
+}
+
+func TestEmergencyStop_Latches(t *testing.T) {
+	arm, chip := newTestArm(t)
+
+	done := startSlowMove(t, arm, context.Background())
+	if err := arm.EmergencyStop(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForMove(t, done); !errors.Is(err, ErrEmergencyStop) {
+		t.Fatalf("interrupted move returned %v, want ErrEmergencyStop", err)
+	}
+
+	// Nothing moves while latched
+	chip.ResetWrites()
+	if err := arm.Start(context.Background()); !errors.Is(err, ErrEmergencyStop) {
+		t.Fatalf("Start while e-stopped returned %v, want ErrEmergencyStop", err)
+	}
+	if len(chip.Writes()) != 0 {
+		t.Error("no servo should be written while the e-stop is engaged")
+	}
+	if chip.FullOff(BASE_SERVO) {
+		t.Error("servo power should only be cut when asked to")
+	}
+
+	arm.ClearEmergencyStop()
+	arm.driver.SetCalibration(fastCalibration())
+	if err := arm.Start(context.Background()); err != nil {
+		t.Fatalf("Start after clearing the e-stop returned %v", err)
+	}
+}
+
+func TestEmergencyStop_CutPower(t *testing.T) {
+	arm, chip := newTestArm(t)
+
+	if err := arm.EmergencyStop(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		if !chip.FullOff(i) {
+			t.Errorf("channel %d should be full off", i)
+		}
+	}
+
+	// The next move turns every servo back on, even the ones it doesn't turn
+	arm.ClearEmergencyStop()
+	angles := arm.driver.CurrentAngles()
+	angles[BASE_SERVO] += 10
+	if err := arm.MoveToJoints(context.Background(), angles); err != nil {
+		t.Fatal(err)
+	}
+	for i := range angles {
+		if chip.FullOff(i) {
+			t.Errorf("joint %d is still limp after the first move", i)
+		}
+	}
+}
+
+func TestEmergencyStop_BeforeJointLimits(t *testing.T) {
+	arm, _ := newTestArm(t)
+	arm.EmergencyStop(false)
+	if err := arm.MoveToJoints(context.Background(), [5]int{999, 0, 0, 0, 0}); !errors.Is(err, ErrEmergencyStop) {
+		t.Errorf("a bad move while e-stopped returned %v, want ErrEmergencyStop", err)
+	}
+}
+
+func TestArmReset_AfterBrownOut(t *testing.T) {
+	arm, chip := newTestArm(t)
+	if err := arm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A brown-out puts the chip back to its power on state
+	chip.GeneralCall([]byte{swrst})
+	arm.err = errors.New("lost the chip")
+
+	if err := arm.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset returned error: %v", err)
+	}
+	if chip.Resets() != 2 {
+		t.Errorf("chip saw %d software resets, want 2", chip.Resets())
+	}
+	if chip.Prescale() != 121 {
+		t.Errorf("prescale = %d, want 121 (50Hz)", chip.Prescale())
+	}
+	for i, angle := range arm.Calibration().HomeAngles() {
+		if _, off := chip.Channel(i); off != pulseFor(angle) {
+			t.Errorf("after Reset joint %d pulse = %#x, want %#x", i, off, pulseFor(angle))
+		}
+	}
+	if arm.err != nil || !arm.IsOperational || arm.IsRunning {
+		t.Errorf("after Reset err = %v, operational = %v, running = %v", arm.err, arm.IsOperational, arm.IsRunning)
+	}
+}
+
+// busWithoutGeneralCall hides the fake's general call
+type busWithoutGeneralCall struct{ I2CBus }
+
+func TestArmReset_WithoutGeneralCall(t *testing.T) {
+	chip := NewFakePCA9685()
+	driver, err := NewPCA9685DriverOnBus(busWithoutGeneralCall{chip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm, err := NewArm(driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm.driver.SetCalibration(fastCalibration())
+
+	if err := arm.driver.SoftwareReset(); !errors.Is(err, ErrNoGeneralCall) {
+		t.Errorf("SoftwareReset returned %v, want ErrNoGeneralCall", err)
+	}
+	if err := arm.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset should fall back to rewriting MODE1: %v", err)
+	}
+	if chip.Resets() != 0 {
+		t.Error("no general call should have reached the chip")
+	}
+}
+
+func TestArmReset_EmergencyStopped(t *testing.T) {
+	arm, chip := newTestArm(t)
+	arm.EmergencyStop(false)
+
+	if err := arm.Reset(context.Background()); !errors.Is(err, ErrEmergencyStop) {
+		t.Errorf("Reset returned %v, want ErrEmergencyStop", err)
+	}
+	if chip.Resets() != 0 {
+		t.Error("the chip should not be reset while the e-stop is engaged")
+	}
+}
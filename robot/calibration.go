@@ -0,0 +1,184 @@
+package robot
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+	Joint calibration
+
+	Every servo is a little different and every joint on the arm can only swing
+	so far before it hits something. A JointCalibration describes one joint:
+
+	  - the PWM pulse (out of 4096) the servo sees at 0 and 180 degrees
+	  - the range of angles the joint is allowed to move through
+	  - an offset, added to the angle before it goes to the servo, to trim the zero
+	  - whether the servo is mounted backwards
+	  - the home angle the arm starts at and parks in
+	  - how fast the joint may move and how hard it may accelerate
+
+	Angles everywhere else in the code (the arm, IK, the api) are joint angles,
+	the calibration is what turns them into servo angles and pulses.
+*/
+
+// JointCalibration describes how one joint maps to its servo and how far it may move.
+type JointCalibration struct {
+	Name     string `json:"name"`
+	MinPulse int    `json:"min_pulse"` // pulse at servo angle 0
+	MaxPulse int    `json:"max_pulse"` // pulse at servo angle 180
+	MinAngle int    `json:"min_angle"` // lowest joint angle allowed
+	MaxAngle int    `json:"max_angle"` // highest joint angle allowed
+	Offset   int    `json:"offset"`    // added to the joint angle to get the servo angle
+	Inverted bool   `json:"inverted"`  // servo turns the opposite way to the joint
+	Home     int    `json:"home"`      // joint angle the arm starts at and parks in
+
+	MaxVelocity     float64 `json:"max_velocity"`     // degrees per second
+	MaxAcceleration float64 `json:"max_acceleration"` // degrees per second per second
+}
+
+// Motion limits used when a calibration doesn't give any
+const (
+	DefaultMaxVelocity     = 90.0  // degrees per second
+	DefaultMaxAcceleration = 360.0 // degrees per second per second
+)
+
+// ArmCalibration is the calibration for all five joints, indexed by servo channel.
+type ArmCalibration struct {
+	Joints [5]JointCalibration `json:"joints"`
+}
+
+// DefaultArmCalibration is what every arm used before calibration existed:
+// 150-600 pulses, 0-180 degrees and the stop position as home.
+func DefaultArmCalibration() ArmCalibration {
+	names := [5]string{"base", "joint1", "joint2", "joint3", "joint4"}
+	homes := [5]int{90, 0, 0, 180, 180}
+
+	var cal ArmCalibration
+	for i := range cal.Joints {
+		cal.Joints[i] = JointCalibration{
+			Name:     names[i],
+			MinPulse: 150,
+			MaxPulse: 600,
+			MinAngle: 0,
+			MaxAngle: 180,
+			Home:     homes[i],
+
+			MaxVelocity:     DefaultMaxVelocity,
+			MaxAcceleration: DefaultMaxAcceleration,
+		}
+	}
+	return cal
+}
+
+// LoadArmCalibration reads and validates a JSON calibration file.
+func LoadArmCalibration(path string) (ArmCalibration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ArmCalibration{}, err
+	}
+
+	var cal ArmCalibration
+	if err := json.Unmarshal(data, &cal); err != nil {
+		return ArmCalibration{}, fmt.Errorf("invalid calibration file %v: %w", path, err)
+	}
+	// Motion limits are optional in the file
+	for i := range cal.Joints {
+		if cal.Joints[i].MaxVelocity == 0 {
+			cal.Joints[i].MaxVelocity = DefaultMaxVelocity
+		}
+		if cal.Joints[i].MaxAcceleration == 0 {
+			cal.Joints[i].MaxAcceleration = DefaultMaxAcceleration
+		}
+	}
+	if err := cal.Validate(); err != nil {
+		return ArmCalibration{}, fmt.Errorf("invalid calibration file %v: %w", path, err)
+	}
+	return cal, nil
+}
+
+// loadArmCalibration loads the file named by GIZMATRON_ARM_CALIBRATION.
+// The arm should always come up, so a missing or broken file falls back to the defaults.
+func loadArmCalibration() ArmCalibration {
+	path := os.Getenv("GIZMATRON_ARM_CALIBRATION")
+	if path == "" {
+		return DefaultArmCalibration()
+	}
+
+	cal, err := LoadArmCalibration(path)
+	if err != nil {
+		log.Printf("Warning!! Could not load arm calibration, using defaults: %v", err)
+		return DefaultArmCalibration()
+	}
+	log.Printf("Loaded arm calibration from %v", path)
+	return cal
+}
+
+// Validate checks that every joint's numbers make sense.
+func (c ArmCalibration) Validate() error {
+	for i, j := range c.Joints {
+		if j.MinPulse < 0 || j.MaxPulse > 4095 || j.MinPulse >= j.MaxPulse {
+			return fmt.Errorf("joint %d: pulse range %d-%d must be inside 0-4095 and increasing", i, j.MinPulse, j.MaxPulse)
+		}
+		if j.MinAngle < 0 || j.MaxAngle > 180 || j.MinAngle > j.MaxAngle {
+			return fmt.Errorf("joint %d: angle range %d-%d must be inside 0-180 and increasing", i, j.MinAngle, j.MaxAngle)
+		}
+		if !j.Allows(j.Home) {
+			return fmt.Errorf("joint %d: home %d is outside its limits %d-%d", i, j.Home, j.MinAngle, j.MaxAngle)
+		}
+		if j.MaxVelocity <= 0 || j.MaxAcceleration <= 0 {
+			return fmt.Errorf("joint %d: max velocity %v and max acceleration %v must be positive", i, j.MaxVelocity, j.MaxAcceleration)
+		}
+		for _, angle := range []int{j.MinAngle, j.MaxAngle} {
+			if servo := j.ServoAngle(angle); servo < 0 || servo > 180 {
+				return fmt.Errorf("joint %d: offset %d puts angle %d at servo angle %d", i, j.Offset, angle, servo)
+			}
+		}
+	}
+	return nil
+}
+
+// HomeAngles returns the home angle of every joint.
+func (c ArmCalibration) HomeAngles() [5]int {
+	var home [5]int
+	for i, j := range c.Joints {
+		home[i] = j.Home
+	}
+	return home
+}
+
+// Allows reports whether the joint may move to angle.
+func (j JointCalibration) Allows(angle int) bool {
+	return angle >= j.MinAngle && angle <= j.MaxAngle
+}
+
+// ServoAngle converts a joint angle into the angle the servo has to turn to.
+func (j JointCalibration) ServoAngle(angle int) int {
+	if j.Inverted {
+		angle = 180 - angle
+	}
+	return angle + j.Offset
+}
+
+// Pulse converts a joint angle into the PWM pulse for the servo.
+func (j JointCalibration) Pulse(angle int) (uint16, error) {
+	servo := j.ServoAngle(angle)
+	if servo < 0 || servo > 180 {
+		return 0, fmt.Errorf("servo angle out of range (0-180): %d", servo)
+	}
+	return uint16(j.MinPulse + int(float64(j.MaxPulse-j.MinPulse)*float64(servo)/180.0)), nil
+}
+
+// JointLimitError is returned when a joint is asked to move outside its calibrated limits.
+type JointLimitError struct {
+	Joint int
+	Angle int
+	Min   int
+	Max   int
+}
+
+func (e *JointLimitError) Error() string {
+	return fmt.Sprintf("joint %d angle %d is outside its limits (%d-%d)", e.Joint, e.Angle, e.Min, e.Max)
+}
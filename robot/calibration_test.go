@@ -0,0 +1,177 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultArmCalibration(t *testing.T) {
+	cal := DefaultArmCalibration()
+	if err := cal.Validate(); err != nil {
+		t.Fatalf("default calibration is invalid: %v", err)
+	}
+	if cal.HomeAngles() != [5]int{90, 0, 0, 180, 180} {
+		t.Errorf("default home = %v, want [90 0 0 180 180]", cal.HomeAngles())
+	}
+}
+
+func TestJointCalibrationPulse(t *testing.T) {
+	tests := []struct {
+		name  string
+		joint JointCalibration
+		angle int
+		want  uint16
+	}{
+		{"default zero", JointCalibration{MinPulse: 150, MaxPulse: 600}, 0, 150},
+		{"default middle", JointCalibration{MinPulse: 150, MaxPulse: 600}, 90, 375},
+		{"default full", JointCalibration{MinPulse: 150, MaxPulse: 600}, 180, 600},
+		{"custom range", JointCalibration{MinPulse: 100, MaxPulse: 500}, 90, 300},
+		{"offset", JointCalibration{MinPulse: 150, MaxPulse: 600, Offset: 10}, 80, 375},
+		{"inverted", JointCalibration{MinPulse: 150, MaxPulse: 600, Inverted: true}, 0, 600},
+		{"inverted with offset", JointCalibration{MinPulse: 150, MaxPulse: 600, Inverted: true, Offset: -10}, 100, 325},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.joint.Pulse(tt.angle)
+		if err != nil {
+			t.Errorf("%s: Pulse(%d) returned error: %v", tt.name, tt.angle, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Pulse(%d) = %d, want %d", tt.name, tt.angle, got, tt.want)
+		}
+	}
+
+	joint := JointCalibration{MinPulse: 150, MaxPulse: 600, Offset: 10}
+	if _, err := joint.Pulse(175); err == nil {
+		t.Error("Pulse should refuse servo angles past 180")
+	}
+}
+
+func TestArmCalibrationValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(j *JointCalibration)
+	}{
+		{"backwards pulses", func(j *JointCalibration) { j.MinPulse, j.MaxPulse = 600, 150 }},
+		{"pulse too big", func(j *JointCalibration) { j.MaxPulse = 5000 }},
+		{"backwards angles", func(j *JointCalibration) { j.MinAngle, j.MaxAngle = 120, 60 }},
+		{"angle past 180", func(j *JointCalibration) { j.MaxAngle = 200 }},
+		{"home outside limits", func(j *JointCalibration) { j.MinAngle, j.MaxAngle, j.Home = 10, 170, 0 }},
+		{"offset past the servo", func(j *JointCalibration) { j.Offset = 20 }},
+	}
+
+	for _, tt := range tests {
+		cal := DefaultArmCalibration()
+		tt.change(&cal.Joints[2])
+		if err := cal.Validate(); err == nil {
+			t.Errorf("%s: Validate should return an error", tt.name)
+		}
+	}
+}
+
+func TestLoadArmCalibration(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.json")
+	os.WriteFile(good, []byte(`{"joints": [
+		{"name": "base", "min_pulse": 140, "max_pulse": 610, "min_angle": 30, "max_angle": 150, "home": 90},
+		{"name": "joint1", "min_pulse": 150, "max_pulse": 600, "min_angle": 0, "max_angle": 180, "home": 0},
+		{"name": "joint2", "min_pulse": 150, "max_pulse": 600, "min_angle": 0, "max_angle": 180, "home": 0, "inverted": true},
+		{"name": "joint3", "min_pulse": 150, "max_pulse": 600, "min_angle": 0, "max_angle": 175, "home": 175, "offset": 5},
+		{"name": "joint4", "min_pulse": 150, "max_pulse": 600, "min_angle": 0, "max_angle": 180, "home": 180}
+	]}`), 0644)
+
+	cal, err := LoadArmCalibration(good)
+	if err != nil {
+		t.Fatalf("LoadArmCalibration returned error: %v", err)
+	}
+	if cal.Joints[BASE_SERVO].MinAngle != 30 || cal.Joints[BASE_SERVO].MinPulse != 140 {
+		t.Errorf("base joint = %+v", cal.Joints[BASE_SERVO])
+	}
+	if !cal.Joints[JOINT_2_SERVO].Inverted || cal.Joints[JOINT_3_SERVO].Offset != 5 {
+		t.Errorf("joints 2 and 3 = %+v %+v", cal.Joints[JOINT_2_SERVO], cal.Joints[JOINT_3_SERVO])
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"joints": [{"min_pulse": 600, "max_pulse": 150}]}`), 0644)
+	if _, err := LoadArmCalibration(bad); err == nil {
+		t.Error("LoadArmCalibration should reject an invalid calibration")
+	}
+
+	if _, err := LoadArmCalibration(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("LoadArmCalibration should fail on a missing file")
+	}
+}
+
+func TestServoWrite_EnforcesCalibration(t *testing.T) {
+	driver, chip := newTestDriver(t)
+	if err := driver.SetPWMFreq(50); err != nil {
+		t.Fatal(err)
+	}
+
+	cal := DefaultArmCalibration()
+	cal.Joints[1].MinAngle, cal.Joints[1].MaxAngle = 20, 160
+	cal.Joints[1].Home = 90
+	cal.Joints[1].Inverted = true
+	driver.SetCalibration(cal)
+	chip.ResetWrites()
+
+	var limitErr *JointLimitError
+	if err := driver.ServoWrite(1, 10, 0); !errors.As(err, &limitErr) {
+		t.Fatalf("ServoWrite past the limit returned %v, want a JointLimitError", err)
+	}
+	if len(chip.Writes()) != 0 {
+		t.Error("ServoWrite past the limit still wrote to the chip")
+	}
+
+	if err := driver.ServoWrite(1, 90, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.ServoWrite(1, 60, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Inverted, so joint angle 60 is servo angle 120
+	if _, off := chip.Channel(1); off != 450 {
+		t.Errorf("channel 1 pulse = %d, want 450", off)
+	}
+}
+
+func TestUpdateArm_ChecksEveryTargetFirst(t *testing.T) {
+	arm, chip := newTestArm(t)
+
+	cal := DefaultArmCalibration()
+	cal.Joints[JOINT_4_SERVO].MinAngle = 90
+	arm.driver.SetCalibration(cal)
+	chip.ResetWrites()
+
+	arm.jointTargetAngles = [5]int{120, 30, 30, 130, 45}
+	var limitErr *JointLimitError
+	if err := arm.UpdateArm(context.Background()); !errors.As(err, &limitErr) || limitErr.Joint != JOINT_4_SERVO {
+		t.Fatalf("UpdateArm returned %v, want a JointLimitError for joint 4", err)
+	}
+	if len(chip.Writes()) != 0 {
+		t.Error("no joint should move when any target is outside its limits")
+	}
+}
+
+func TestInverseKinematics_RespectsCalibration(t *testing.T) {
+	arm, _ := newTestArm(t)
+	target := Pose{X: 0, Y: 20, Z: 8} // straight to the left, base at 180
+
+	if _, err := arm.InverseKinematics(target, ElbowAuto); err != nil {
+		t.Fatalf("target should be reachable with the default calibration: %v", err)
+	}
+
+	cal := DefaultArmCalibration()
+	cal.Joints[BASE_SERVO].MaxAngle = 150
+	arm.driver.SetCalibration(cal)
+
+	var unreachable *UnreachableError
+	if _, err := arm.InverseKinematics(target, ElbowAuto); !errors.As(err, &unreachable) {
+		t.Errorf("InverseKinematics past the base limit returned %v, want an UnreachableError", err)
+	}
+}
@@ -2,6 +2,8 @@ package robot
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -12,9 +14,9 @@ import (
 	"os/exec"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hybridgroup/mjpeg"
 	"gocv.io/x/gocv"
 )
 
@@ -22,34 +24,79 @@ import (
 type CameraBackend string
 
 const (
-	BackendGStreamer CameraBackend = "gstreamer"
-	BackendV4L2      CameraBackend = "v4l2"
-	BackendAuto      CameraBackend = "auto"
+	BackendGStreamer   CameraBackend = "gstreamer"
+	BackendV4L2        CameraBackend = "v4l2"
+	BackendAuto        CameraBackend = "auto"
+	BackendSimulated   CameraBackend = "simulated"
+	BackendFile        CameraBackend = "file"        // plays GIZMATRON_CAMERA_FILE, a video or a directory of images
+	BackendTestPattern CameraBackend = "testpattern" // draws moving shapes, and a face with GIZMATRON_CAMERA_TESTPATTERN_FACE
 )
 
+// Virtual reports whether the backend makes up its frames instead of reading a camera.
+func (b CameraBackend) Virtual() bool {
+	return b == BackendSimulated || b == BackendFile || b == BackendTestPattern
+}
+
+// FrameSource is where the camera pulls its frames from.
+// *gocv.VideoCapture satisfies it, virtual backends provide their own.
+type FrameSource interface {
+	Read(m *gocv.Mat) bool
+	Set(prop gocv.VideoCaptureProperties, param float64)
+	Close() error
+}
+
 // CameraConfig holds camera configuration
 type CameraConfig struct {
 	Backend CameraBackend
-	Device  int // V4L2 device number (0, 1, etc.)
-	Width   int // Frame width
-	Height  int // Frame height
-	FPS     int // Frames per second
+	Device  int     // V4L2 device number (0, 1, etc.)
+	Width   int     // Frame width
+	Height  int     // Frame height
+	FPS     int     // Frames per second
+	HFOV    float64 // Horizontal field of view in degrees
+	VFOV    float64 // Vertical field of view in degrees
+
+	Undistort bool // Take the lens distortion out of frames the camera has a calibration for
+
+	File            string // Video file or image directory for the file backend
+	TestPatternFace bool   // Draw a face in the test pattern
+
+	StallTimeout    time.Duration // No frame for this long and the camera is reopened
+	MaxReadFailures int           // This many failed reads in a row and the camera is reopened
+	ReconnectMax    time.Duration // Longest wait between attempts to reopen the camera
 }
 
 type Cam struct {
-	IsOperational bool
-	IsRunning     bool
-	DetectFaces   bool
+	isOperational bool         // webcam is open, only the supervisor touches these once started
+	detectFaces   atomic.Bool  // turned on and off with SetDetectFaces
+	faceRequests  atomic.Int32 // how many others need the faces found, see requestFaces
 	err           error
-	Webcam        *gocv.VideoCapture
-	ImgMat        gocv.Mat
-	Stream        *mjpeg.Stream
-	Buf           []byte
+	webcam        FrameSource
+	Frames        *FrameHub         // every frame read from the camera, see FrameHub
+	Motion        *MotionDetector   // looks for motion in every frame while it's enabled
+	Faces         *FaceDetector     // finds the faces in every frame while DetectingFaces
+	Recognizer    *FaceRecognizer   // puts names to the faces found
+	Objects       *ObjectDetector   // looks for objects every so often while it's enabled
+	Markers       *MarkerDetector   // looks for ArUco markers and QR codes every so often while it's enabled
+	Calibrations  *CalibrationStore // the camera's intrinsics, by backend and resolution
+	Calibrator    *CameraCalibrator // takes a calibration from views of a chessboard
+	Undistort     *Undistorter      // takes the lens distortion out of frames while it's enabled
+	Events        *EventBus         // where what the camera notices is published, nil for nowhere
 	//Img *image.Image
-	mux        sync.Mutex
-	StopStream chan bool
-	Config     CameraConfig
-	Backend    CameraBackend // Actual backend in use
+	mux     sync.Mutex
+	Config  CameraConfig
+	Backend CameraBackend // Actual backend in use
+
+	faceMux  sync.Mutex
+	faceSubs map[chan FaceDetection]struct{}
+
+	// The capture supervisor, see camera_watchdog.go
+	runMux    sync.Mutex
+	cancel    context.CancelFunc
+	done      chan struct{}
+	healthMux sync.Mutex
+	health    CameraHealth
+	onHealth  func(CameraHealth)          // told when the camera's state changes
+	opener    func() (FrameSource, error) // opens the camera, open_wecam when nil
 }
 
 // loadCameraConfig loads camera configuration from environment variables
@@ -60,6 +107,12 @@ func loadCameraConfig() CameraConfig {
 		Width:   640,
 		Height:  480,
 		FPS:     30,
+		HFOV:    62.2, // Pi Camera Module v2
+		VFOV:    48.8,
+
+		StallTimeout:    DefaultCameraStallTimeout,
+		MaxReadFailures: DefaultCameraMaxReadFailures,
+		ReconnectMax:    DefaultCameraReconnectMax,
 	}
 
 	// Load backend preference
@@ -95,6 +148,58 @@ func loadCameraConfig() CameraConfig {
 		}
 	}
 
+	// Load field of view, face tracking needs it to turn pixels into angles
+	if hfov := os.Getenv("GIZMATRON_CAMERA_HFOV"); hfov != "" {
+		if f, err := strconv.ParseFloat(hfov, 64); err == nil && f > 0 {
+			config.HFOV = f
+		}
+	}
+	if vfov := os.Getenv("GIZMATRON_CAMERA_VFOV"); vfov != "" {
+		if f, err := strconv.ParseFloat(vfov, 64); err == nil && f > 0 {
+			config.VFOV = f
+		}
+	}
+
+	// Load undistortion, it needs a calibration, see camera_calibrator.go
+	if undistort := os.Getenv("GIZMATRON_CAMERA_UNDISTORT"); undistort != "" {
+		if u, err := strconv.ParseBool(undistort); err == nil {
+			config.Undistort = u
+		} else {
+			log.Printf("Warning!! GIZMATRON_CAMERA_UNDISTORT %q is not true or false, using %v", undistort, config.Undistort)
+		}
+	}
+
+	// Load virtual backend settings
+	config.File = os.Getenv("GIZMATRON_CAMERA_FILE")
+	if face := os.Getenv("GIZMATRON_CAMERA_TESTPATTERN_FACE"); face != "" {
+		if f, err := strconv.ParseBool(face); err == nil {
+			config.TestPatternFace = f
+		}
+	}
+
+	// Load watchdog settings
+	if stall := os.Getenv("GIZMATRON_CAMERA_STALL_MS"); stall != "" {
+		if ms, err := strconv.Atoi(stall); err == nil && ms > 0 {
+			config.StallTimeout = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Warning!! GIZMATRON_CAMERA_STALL_MS %q is not a positive number of ms, using %v", stall, config.StallTimeout)
+		}
+	}
+	if failures := os.Getenv("GIZMATRON_CAMERA_MAX_READ_FAILURES"); failures != "" {
+		if n, err := strconv.Atoi(failures); err == nil && n > 0 {
+			config.MaxReadFailures = n
+		} else {
+			log.Printf("Warning!! GIZMATRON_CAMERA_MAX_READ_FAILURES %q is not a positive number, using %v", failures, config.MaxReadFailures)
+		}
+	}
+	if reconnect := os.Getenv("GIZMATRON_CAMERA_RECONNECT_MAX_MS"); reconnect != "" {
+		if ms, err := strconv.Atoi(reconnect); err == nil && ms > 0 {
+			config.ReconnectMax = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Printf("Warning!! GIZMATRON_CAMERA_RECONNECT_MAX_MS %q is not a positive number of ms, using %v", reconnect, config.ReconnectMax)
+		}
+	}
+
 	return config
 }
 
@@ -133,16 +238,13 @@ func InitCam() (*Cam, error) {
 	config := loadCameraConfig()
 
 	c := &Cam{
-		DetectFaces:   false,
-		IsOperational: false,
-		IsRunning:     false,
-		Config:        config,
+		Config: config,
 	}
 
 	//c.open_wecam()
 	//defer c.Webcam.Close()
 	/*
-		if c.IsOperational {
+		if c.isOperational {
 
 			resp, err := http.Get("http://localhost:9090/api/v1/ping")
 			if err != nil {
@@ -158,16 +260,71 @@ func InitCam() (*Cam, error) {
 		}
 	*/
 
-	/* Image matrix */
-	c.ImgMat = gocv.NewMat()
-	defer c.ImgMat.Close()
+	/* Frames are published here for anyone who wants them */
+	c.Frames = NewFrameHub()
+
+	motion, err := NewMotionDetector(loadMotionConfig())
+	if err != nil {
+		log.Printf("Warning!! Motion detection config is invalid, it is off: %v", err)
+		motion, _ = NewMotionDetector(MotionConfig{})
+	}
+	c.Motion = motion
+
+	faces, err := NewFaceDetector(loadFaceDetectorConfig())
+	if err != nil {
+		log.Printf("Warning!! Face detector config is invalid, using the defaults: %v", err)
+		faces, _ = NewFaceDetector(FaceDetectorConfig{})
+	}
+	c.Faces = faces
+	c.Recognizer = NewFaceRecognizer(loadRecognitionConfig(), loadPeopleStore())
+
+	objects, err := NewObjectDetector(loadObjectDetectorConfig())
+	if err != nil {
+		log.Printf("Warning!! Object detector config is invalid, it is off: %v", err)
+		objects, _ = NewObjectDetector(ObjectDetectorConfig{})
+	}
+	c.Objects = objects
+
+	markers, err := NewMarkerDetector(loadMarkerConfig())
+	if err != nil {
+		log.Printf("Warning!! Marker detector config is invalid, it is off: %v", err)
+		markers, _ = NewMarkerDetector(MarkerConfig{})
+	}
+	c.Markers = markers
+	c.Calibrations = loadCalibrationStore()
+	c.Calibrator = NewCameraCalibrator()
+	c.Undistort = NewUndistorter(config.Undistort)
 
-	c.StopStream = make(chan bool)
-	//defer close(c.StopStream)
 	log.Printf("Camera Ready ...")
 	return c, nil
 }
 
+// Intrinsics returns the calibration of the camera in use for frames of the given size, if it has been calibrated.
+func (c *Cam) Intrinsics(frame image.Point) (CameraIntrinsics, bool) {
+	if c.Calibrations == nil {
+		return CameraIntrinsics{}, false
+	}
+	return c.Calibrations.Get(c.backend(), frame.X, frame.Y)
+}
+
+// backend is the backend calibrations are kept under, the one in use
+func (c *Cam) backend() CameraBackend {
+	if c.Backend == "" {
+		// The virtual backends don't record which one is in use
+		return c.Config.Backend
+	}
+	return c.Backend
+}
+
+// view is what is known about the camera for frames of the given size
+func (c *Cam) view(frame image.Point) cameraView {
+	view := cameraView{HFOV: c.Config.HFOV, VFOV: c.Config.VFOV}
+	if intrinsics, ok := c.Intrinsics(frame); ok {
+		view.Intrinsics = &intrinsics
+	}
+	return view
+}
+
 // tryOpenGStreamer attempts to open camera using GStreamer pipeline
 func (c *Cam) tryOpenGStreamer() error {
 	log.Printf("CAMERA: Attempting to open with GStreamer + libcamera...")
@@ -178,19 +335,19 @@ func (c *Cam) tryOpenGStreamer() error {
 
 	log.Printf("CAMERA: Using GStreamer pipeline: %s", pipelineStr)
 
-	var err error
 	// GoCV detects GStreamer pipelines automatically from the string format
-	c.Webcam, err = gocv.OpenVideoCapture(pipelineStr)
+	webcam, err := gocv.OpenVideoCapture(pipelineStr)
 	if err != nil {
 		return fmt.Errorf("GStreamer pipeline failed: %w", err)
 	}
+	c.webcam = webcam
 
 	// Verify we can read a frame
 	testMat := gocv.NewMat()
 	defer testMat.Close()
-	if ok := c.Webcam.Read(&testMat); !ok || testMat.Empty() {
-		c.Webcam.Close()
-		c.Webcam = nil
+	if ok := c.webcam.Read(&testMat); !ok || testMat.Empty() {
+		c.webcam.Close()
+		c.webcam = nil
 		return fmt.Errorf("GStreamer opened but cannot read frames")
 	}
 
@@ -203,23 +360,23 @@ func (c *Cam) tryOpenGStreamer() error {
 func (c *Cam) tryOpenV4L2(deviceNum int) error {
 	log.Printf("CAMERA: Attempting to open V4L2 device %d...", deviceNum)
 
-	var err error
-	c.Webcam, err = gocv.OpenVideoCapture(deviceNum)
+	webcam, err := gocv.OpenVideoCapture(deviceNum)
 	if err != nil {
 		return fmt.Errorf("V4L2 device %d failed: %w", deviceNum, err)
 	}
+	c.webcam = webcam
 
 	// Set camera properties
-	c.Webcam.Set(gocv.VideoCaptureFrameWidth, float64(c.Config.Width))
-	c.Webcam.Set(gocv.VideoCaptureFrameHeight, float64(c.Config.Height))
-	c.Webcam.Set(gocv.VideoCaptureFPS, float64(c.Config.FPS))
+	c.webcam.Set(gocv.VideoCaptureFrameWidth, float64(c.Config.Width))
+	c.webcam.Set(gocv.VideoCaptureFrameHeight, float64(c.Config.Height))
+	c.webcam.Set(gocv.VideoCaptureFPS, float64(c.Config.FPS))
 
 	// Verify we can read a frame
 	testMat := gocv.NewMat()
 	defer testMat.Close()
-	if ok := c.Webcam.Read(&testMat); !ok || testMat.Empty() {
-		c.Webcam.Close()
-		c.Webcam = nil
+	if ok := c.webcam.Read(&testMat); !ok || testMat.Empty() {
+		c.webcam.Close()
+		c.webcam = nil
 		return fmt.Errorf("V4L2 device %d opened but cannot read frames", deviceNum)
 	}
 
@@ -229,7 +386,7 @@ func (c *Cam) tryOpenV4L2(deviceNum int) error {
 }
 
 func (c *Cam) open_wecam() {
-	if c.Webcam != nil && c.IsOperational {
+	if c.webcam != nil && c.isOperational {
 		log.Println("CAMERA: Already operational")
 		return
 	}
@@ -244,20 +401,42 @@ func (c *Cam) open_wecam() {
 		// User explicitly wants GStreamer
 		if err := c.tryOpenGStreamer(); err != nil {
 			log.Printf("CAMERA: GStreamer failed (explicit): %v", err)
-			c.IsOperational = false
+			c.isOperational = false
 			return
 		}
-		c.IsOperational = true
+		c.isOperational = true
 		return
 
 	case BackendV4L2:
 		// User explicitly wants V4L2
 		if err := c.tryOpenV4L2(c.Config.Device); err != nil {
 			log.Printf("CAMERA: V4L2 failed (explicit): %v", err)
-			c.IsOperational = false
+			c.isOperational = false
+			return
+		}
+		c.isOperational = true
+		return
+
+	case BackendSimulated:
+		// No camera at all, frames are generated
+		c.openSimulated()
+		c.isOperational = true
+		return
+
+	case BackendTestPattern:
+		// No camera either, frames are drawn
+		c.openTestPattern()
+		c.isOperational = true
+		return
+
+	case BackendFile:
+		// Recorded footage played over and over
+		if err := c.openFile(); err != nil {
+			log.Printf("CAMERA: File backend failed: %v", err)
+			c.isOperational = false
 			return
 		}
-		c.IsOperational = true
+		c.isOperational = true
 		return
 
 	case BackendAuto:
@@ -267,7 +446,7 @@ func (c *Cam) open_wecam() {
 		// Try GStreamer if supported
 		if detectGStreamerSupport() {
 			if err := c.tryOpenGStreamer(); err == nil {
-				c.IsOperational = true
+				c.isOperational = true
 				return
 			} else {
 				lastErr = err
@@ -278,7 +457,7 @@ func (c *Cam) open_wecam() {
 		// Try V4L2 device 0 (most common)
 		if detectV4L2Device(0) {
 			if err := c.tryOpenV4L2(0); err == nil {
-				c.IsOperational = true
+				c.isOperational = true
 				return
 			} else {
 				lastErr = err
@@ -289,7 +468,7 @@ func (c *Cam) open_wecam() {
 		// Try V4L2 device 1 (alternative USB camera)
 		if detectV4L2Device(1) {
 			if err := c.tryOpenV4L2(1); err == nil {
-				c.IsOperational = true
+				c.isOperational = true
 				return
 			} else {
 				lastErr = err
@@ -299,94 +478,58 @@ func (c *Cam) open_wecam() {
 
 		// All attempts failed
 		log.Printf("CAMERA: All camera backends failed. Last error: %v", lastErr)
-		c.IsOperational = false
+		c.isOperational = false
 		return
 	}
 
 	log.Println("CAMERA: Camera is now operational")
-	c.IsOperational = true
+	c.isOperational = true
 }
 
 func (c *Cam) Stop() {
 	/* Stop the camera and the stream */
 	log.Printf("Closing Camera ....")
 
-	c.StopStream <- true
-	c.IsRunning = false
-
-	if c.Webcam != nil {
-		c.Webcam.Close()
-		c.Webcam = nil
+	// Nothing to wait for if the camera was never started
+	c.runMux.Lock()
+	cancel, done := c.cancel, c.done
+	c.runMux.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
 	}
-	c.IsOperational = false
+	if c.webcam != nil {
+		c.webcam.Close()
+		c.webcam = nil
+	}
+	c.isOperational = false
 	log.Printf("Camera Closed")
 
 }
 
 func (c *Cam) Start() {
-	/* Start reading from the camera to the Buffer */
-	log.Printf("Starting Camera stream ...")
-	c.open_wecam()
-	defer c.Webcam.Close()
-
-	// prepare image matrix
-	c.ImgMat = gocv.NewMat()
-	defer c.ImgMat.Close()
-
-	// create the mjpeg stream
-	//c.Stream = mjpeg.NewStream()
-	if c.IsOperational && c.Webcam != nil {
-
-		log.Printf("Camera is operational, starting stream ...")
-		for {
-			select {
-			case <-c.StopStream:
-				log.Printf("Recieved Stop signal, Stopping Camera Stream..")
-				return
-
-			default:
-
-				log.Println("Reading from Camera")
-				c.Webcam.Set(gocv.VideoCaptureFrameWidth, 600)
-				c.Webcam.Set(gocv.VideoCaptureFrameHeight, 600)
-
-				if ok := c.Webcam.Read(&c.ImgMat); !ok {
-
-					log.Printf("Error !! Cannot read from Camera Device: %v", ok)
-				}
-
-				if c.ImgMat.Empty() {
-					log.Printf("Image Matrix is empty, moving forward ")
-				}
-
-				if !c.ImgMat.Empty() {
-					c.IsRunning = true
-					//c.mux.Lock()
-
-					if c.DetectFaces {
-						c.FaceDetect()
-					}
-
-					// resize the image to to make sure it fits into the stream
-					log.Println("Resizing image")
-					gocv.Resize(c.ImgMat, &c.ImgMat, image.Point{600, 600}, 0, 0, gocv.InterpolationDefault)
-					//buf, img_err := gocv.IMEncode(".jpg", c.ImgMat)
-					//c.ImgMat.ConvertTo(&c.ImgMat, gocv.MatTypeCV8UC3)
-					buf, img_err := gocv.IMEncodeWithParams(".jpg", c.ImgMat, []int{gocv.IMWriteJpegQuality, 95})
-					if img_err != nil {
-						log.Printf("Error encoding image: %v", img_err)
-					}
-					defer buf.Close()
-					c.Buf = buf.GetBytes()
-					//c.Stream.UpdateJPEG(c.Buf)
-					//	//c.mux.Unlock()
-
-					// Sleep for a short duration to control the frame rate
-					time.Sleep(33 * time.Millisecond) // ~30 FPS
-				}
-			}
-		}
+	/* Start reading from the camera and publishing the frames, until Stop */
+	c.runMux.Lock()
+	if c.cancel != nil {
+		c.runMux.Unlock()
+		log.Printf("Camera stream is already running")
+		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	c.cancel, c.done = cancel, done
+	c.runMux.Unlock()
+
+	defer func() {
+		c.runMux.Lock()
+		c.cancel, c.done = nil, nil
+		c.runMux.Unlock()
+		close(done)
+	}()
+
+	// This is the only goroutine that reads the camera, everyone else subscribes to c.Frames
+	log.Printf("Starting Camera stream ...")
+	c.supervise(ctx)
 }
 
 func (c *Cam) Restart() {
@@ -417,7 +560,12 @@ func (c *Cam) StreamToServer() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		part.Write(c.Buf)
+		if frame := c.Frames.Latest(); frame != nil {
+			if jpeg, err := frame.JPEG(); err == nil {
+				part.Write(jpeg)
+			}
+			frame.Release()
+		}
 		writer.Close()
 
 		//bufferReader := &CustomBufferReader{buf: bytes.NewBuffer(c.Buf)}
@@ -448,127 +596,186 @@ func (c *Cam) StreamToServer() {
 	}
 }
 
-func (c *Cam) FaceDetect() {
-
-	//log.Printf("Detecting Faces")
+// FaceDetect finds the faces in img, puts names to the ones it knows and draws
+// a box around each one, labeled with its name or its confidence.
+func (c *Cam) FaceDetect(img *gocv.Mat) []Face {
+	if c.Faces == nil || img.Empty() {
+		return nil
+	}
 
 	// color for the rect when faces detected
 	blue := color.RGBA{0, 0, 255, 0}
 
-	// load classifier to recognize faces
-	classifier := gocv.NewCascadeClassifier()
-	defer classifier.Close()
+	faces := c.Faces.Detect(*img)
+	if c.Recognizer != nil {
+		for _, face := range c.Recognizer.Recognize(*img, faces) {
+			c.Events.Publish(EventPersonSeen, face)
+		}
+	}
+	c.Faces.record(faces)
 
-	/*
-		TODO: I need a better way of pointing to this classifier model file.
+	for _, face := range faces {
+		gocv.Rectangle(img, face.Box, blue, 3)
+		label := fmt.Sprintf("face %.2f", face.Confidence)
+		if face.Name != "" {
+			label = fmt.Sprintf("%s %.2f", face.Name, face.Similarity)
+		}
+		gocv.PutText(img, label, image.Pt(face.Box.Min.X, max(face.Box.Min.Y-6, 12)), gocv.FontHersheySimplex, 0.5, blue, 1)
+	}
+	return faces
+}
 
-		var base_path string = os.Getenv("GOPATH") + "/src/"
-		var project_path string = base_path + "gocv.io/x/gocv/data/"
-		var xmlFile string = project_path + "haarcascade_frontalface_default.xml"
+// SetDetectFaces turns face detection on and off.
+func (c *Cam) SetDetectFaces(on bool) {
+	c.detectFaces.Store(on)
+}
 
-		if !classifier.Load(xmlFile) {
-			fmt.Printf("Error reading cascade file: %v\n", xmlFile)
-			return
-		}
-	*/
+// DetectingFaces tells whether faces are looked for in every frame, because
+// face detection is on or because something like face tracking needs them.
+func (c *Cam) DetectingFaces() bool {
+	return c.detectFaces.Load() || c.faceRequests.Load() > 0
+}
 
-	// TODO: This is cheap, and I need a better way. This is not the way.
-	if !classifier.Load("/home/ara/opencv/data/haarcascades/haarcascade_frontalface_default.xml") {
-		fmt.Println("Error: Could not load Haar Cascade classifier")
-		return
+// requestFaces keeps faces being detected, whatever SetDetectFaces says,
+// until the returned func is called.
+func (c *Cam) requestFaces() func() {
+	c.faceRequests.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.faceRequests.Add(-1) })
 	}
+}
 
-	if !c.ImgMat.Empty() {
+// SubscribeFaces returns a channel of the faces found in every frame while
+// DetectingFaces. Only the latest detection is kept, a slow reader just
+// misses frames. Call the returned func to unsubscribe.
+func (c *Cam) SubscribeFaces() (<-chan FaceDetection, func()) {
+	ch := make(chan FaceDetection, 1)
 
-		//c.mux.Lock()
+	c.faceMux.Lock()
+	if c.faceSubs == nil {
+		c.faceSubs = make(map[chan FaceDetection]struct{})
+	}
+	c.faceSubs[ch] = struct{}{}
+	c.faceMux.Unlock()
 
-		// detect faces
-		rects := classifier.DetectMultiScale(c.ImgMat)
-		//fmt.Printf("found %d faces\n", len(rects))
+	return ch, func() {
+		c.faceMux.Lock()
+		delete(c.faceSubs, ch)
+		c.faceMux.Unlock()
+	}
+}
 
-		// draw a rectangle around each face on the original image,
-		for _, r := range rects {
-			gocv.Rectangle(&c.ImgMat, r, blue, 3)
-			// TODO: add text identifing as "Human face"
+func (c *Cam) publishFaces(d FaceDetection) {
+	c.faceMux.Lock()
+	defer c.faceMux.Unlock()
+	for ch := range c.faceSubs {
+		// Replace whatever the subscriber hasn't read yet
+		select {
+		case <-ch:
+		default:
 		}
-
+		ch <- d
 	}
 }
 
-/* Takes picture saves as .jpeg*/
-func (c *Cam) TakePicture() {
+/*
+Takes picture saves as .jpeg
+
+Once the camera is started the supervisor owns the device, so the picture is
+its latest frame, or ErrCameraNotRunning if there isn't one yet. Otherwise the
+camera is opened just for the picture.
+*/
+func (c *Cam) TakePicture() error {
 
 	// TODO: serve jpeg to frontend
 
 	fmt.Println("Taking Picture")
 
+	if c.Started() {
+		frame := c.Frames.Latest()
+		if frame == nil {
+			fmt.Println("No image on device")
+			return ErrCameraNotRunning
+		}
+		defer frame.Release()
+		gocv.IMWrite("image.jpg", frame.Mat)
+		return nil
+	}
+
 	// Use the new backend-aware camera opening
-	if c.Webcam == nil || c.IsOperational == false {
+	if c.webcam == nil || c.isOperational == false {
 		c.open_wecam()
-		if !c.IsOperational {
+		if !c.isOperational {
 			fmt.Println("Error: Could not open camera")
-			return
+			return fmt.Errorf("could not open the %v camera", c.Config.Backend)
 		}
 	}
-	defer c.Webcam.Close()
+	defer func() {
+		c.webcam.Close()
+		c.webcam = nil
+		c.isOperational = false
+	}()
 
-	if ok := c.Webcam.Read(&c.ImgMat); !ok {
+	img := gocv.NewMat()
+	defer img.Close()
+	if ok := c.webcam.Read(&img); !ok {
 		fmt.Println("Cannot read from Device")
-		return
+		return errors.New("cannot read from the camera")
 	}
 
-	if !c.ImgMat.Empty() {
-		if c.DetectFaces {
-			c.FaceDetect()
-		}
+	if img.Empty() {
 		fmt.Println("No image on device")
-		gocv.IMWrite("image.jpg", c.ImgMat)
-		return
+		return errors.New("the camera gave an empty frame")
+	}
+	if c.DetectingFaces() {
+		c.FaceDetect(&img)
 	}
+	gocv.IMWrite("image.jpg", img)
+	return nil
 }
 
 /* NOTE: This is for testing and debugging/troubleshooting */
 func (c *Cam) RunCamera() {
 
+	// The supervisor owns the camera once it's started
+	if c.Started() {
+		fmt.Println("Error: Camera is already started")
+		return
+	}
+
 	// Use the new backend-aware camera opening
-	if c.Webcam == nil {
+	if c.webcam == nil {
 		c.open_wecam()
-		if !c.IsOperational {
+		if !c.isOperational {
 			fmt.Println("Error: Could not open camera")
 			return
 		}
 	}
-	defer c.Webcam.Close()
-
-	// prepare image matrix
-	img := gocv.NewMat()
-	defer img.Close()
+	defer c.webcam.Close()
 
 	// Loop to read the frames from the webcam
 	for {
 
-		c.IsRunning = true
-		if !img.Closed() {
+		img := gocv.NewMat()
+		if ok := c.webcam.Read(&img); !ok {
 
-			if ok := c.Webcam.Read(&img); !ok {
+			log.Printf("Error !! Cannot read from Camera Device: %v", ok)
+			c.isOperational = false
+			img.Close()
 
-				log.Printf("Error !! Cannot read from Camera Device: %v", ok)
-				c.IsOperational = false
-
-				continue
-			}
-
-			if img.Empty() {
-				continue
-			}
-
-			buf, _ := gocv.IMEncode(".jpg", img)
-			c.Buf = buf.GetBytes()
+			continue
+		}
 
-			// Sleep for a short duration to control the frame rate
-			time.Sleep(33 * time.Millisecond) // ~30 FPS
+		if img.Empty() {
+			img.Close()
+			continue
 		}
 
+		c.Frames.Publish(img, nil)
+
+		// Sleep for a short duration to control the frame rate
+		time.Sleep(33 * time.Millisecond) // ~30 FPS
 	}
 }
 
@@ -579,17 +786,12 @@ func (c *Cam) RunCamInWindow() {
 
 	window := gocv.NewWindow("Webcam Video")
 	defer window.Close()
-	if c.IsOperational && c.IsRunning {
-		for {
-
-			if c.ImgMat.Empty() {
-				continue
-			}
-
-			if !c.ImgMat.Empty() {
-				window.IMShow(c.ImgMat)
-			}
-
+	if c.Started() {
+		sub := c.Frames.Subscribe(1, DropOldest)
+		defer sub.Close()
+		for frame := range sub.Frames() {
+			window.IMShow(frame.Mat)
+			frame.Release()
 		}
 	}
 }
@@ -0,0 +1,219 @@
+package robot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Camera calibration
+
+	A camera's intrinsics are its focal lengths and optical centre in pixels,
+	the camera matrix, and how its lens bends straight lines, the distortion
+	coefficients. They are what it takes to turn where something is in the
+	picture into where it is in front of the camera.
+
+	They only hold for one camera at one resolution, so they are kept in a
+	JSON file, GIZMATRON_CAMERA_CALIBRATION (camera_calibration.json by
+	default), keyed by the camera backend and the frame size. The file is
+	written when a calibration is taken, see camera_calibrator.go, and can be
+	edited by hand.
+*/
+
+// CameraIntrinsics are one camera's calibration at one resolution.
+type CameraIntrinsics struct {
+	Backend      CameraBackend `json:"backend"`
+	Width        int           `json:"width"`
+	Height       int           `json:"height"`
+	CameraMatrix [9]float64    `json:"camera_matrix"` // fx 0 cx, 0 fy cy, 0 0 1, row by row, in pixels
+	Distortion   []float64     `json:"distortion"`    // k1 k2 p1 p2 k3, OpenCV's order
+	Error        float64       `json:"error"`         // RMS reprojection error of the calibration, pixels
+	Frames       int           `json:"frames"`        // how many views it was calibrated from
+	Calibrated   time.Time     `json:"calibrated"`
+}
+
+func calibrationKey(backend CameraBackend, width, height int) string {
+	return fmt.Sprintf("%s@%dx%d", backend, width, height)
+}
+
+func (c CameraIntrinsics) key() string {
+	return calibrationKey(c.Backend, c.Width, c.Height)
+}
+
+// valid reports whether c could be used, a file edited by hand may not be
+func (c CameraIntrinsics) valid() bool {
+	return c.Width > 0 && c.Height > 0 && c.CameraMatrix[0] > 0 && c.CameraMatrix[4] > 0
+}
+
+// ray is the direction, x right, y down and z forward, the camera sees pixel p along
+func (c CameraIntrinsics) ray(p image.Point) (x, y float64) {
+	fx, cx, fy, cy := c.CameraMatrix[0], c.CameraMatrix[2], c.CameraMatrix[4], c.CameraMatrix[5]
+	return (float64(p.X) - cx) / fx, (float64(p.Y) - cy) / fy
+}
+
+// mats returns the camera matrix and distortion coefficients as OpenCV wants them, for the caller to close
+func (c CameraIntrinsics) mats() (gocv.Mat, gocv.Mat) {
+	matrix := gocv.NewMatWithSize(3, 3, gocv.MatTypeCV64F)
+	for i, v := range c.CameraMatrix {
+		matrix.SetDoubleAt(i/3, i%3, v)
+	}
+	distortion := gocv.NewMatWithSize(1, max(len(c.Distortion), 4), gocv.MatTypeCV64F)
+	for i := 0; i < max(len(c.Distortion), 4); i++ {
+		v := 0.0
+		if i < len(c.Distortion) {
+			v = c.Distortion[i]
+		}
+		distortion.SetDoubleAt(0, i, v)
+	}
+	return matrix, distortion
+}
+
+// CalibrationStore holds the camera calibrations, keyed by backend and resolution.
+type CalibrationStore struct {
+	mux          sync.Mutex
+	path         string
+	calibrations map[string]CameraIntrinsics
+}
+
+// NewCalibrationStore loads the calibrations saved at path. A missing file just means the camera hasn't been calibrated.
+func NewCalibrationStore(path string) (*CalibrationStore, error) {
+	s := &CalibrationStore{path: path, calibrations: make(map[string]CameraIntrinsics)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+
+	var calibrations []CameraIntrinsics
+	if err := json.Unmarshal(data, &calibrations); err != nil {
+		return s, fmt.Errorf("invalid calibration file %v: %w", path, err)
+	}
+	for _, c := range calibrations {
+		if !c.valid() {
+			log.Printf("Warning!! skipping calibration %v in %v: it has no focal length", c.key(), path)
+			continue
+		}
+		s.calibrations[c.key()] = c
+	}
+	return s, nil
+}
+
+// loadCalibrationStore loads the file named by GIZMATRON_CAMERA_CALIBRATION.
+// The robot should always come up, so a broken file leaves the camera uncalibrated.
+func loadCalibrationStore() *CalibrationStore {
+	path := os.Getenv("GIZMATRON_CAMERA_CALIBRATION")
+	if path == "" {
+		path = "camera_calibration.json"
+	}
+
+	calibrations, err := NewCalibrationStore(path)
+	if err != nil {
+		log.Printf("Warning!! Could not load the camera calibration, the camera is uncalibrated: %v", err)
+	}
+	return calibrations
+}
+
+// Get returns the calibration of backend at width x height, if it has been calibrated.
+func (s *CalibrationStore) Get(backend CameraBackend, width, height int) (CameraIntrinsics, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	c, ok := s.calibrations[calibrationKey(backend, width, height)]
+	return c, ok
+}
+
+// List returns every calibration, by key.
+func (s *CalibrationStore) List() []CameraIntrinsics {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	calibrations := make([]CameraIntrinsics, 0, len(s.calibrations))
+	for _, c := range s.calibrations {
+		calibrations = append(calibrations, c)
+	}
+	sort.Slice(calibrations, func(i, j int) bool { return calibrations[i].key() < calibrations[j].key() })
+	return calibrations
+}
+
+// Put saves c, replacing any calibration of the same backend and resolution, and writes the store out.
+func (s *CalibrationStore) Put(c CameraIntrinsics) error {
+	if !c.valid() {
+		return fmt.Errorf("%w: %v has no focal length", ErrInvalidCalibration, c.key())
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	previous, existed := s.calibrations[c.key()]
+	s.calibrations[c.key()] = c
+	if err := s.writeLocked(); err != nil {
+		// Keep memory and disk the same
+		if existed {
+			s.calibrations[c.key()] = previous
+		} else {
+			delete(s.calibrations, c.key())
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete forgets the calibration of backend at width x height and writes the store out.
+func (s *CalibrationStore) Delete(backend CameraBackend, width, height int) (CameraIntrinsics, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	key := calibrationKey(backend, width, height)
+	c, ok := s.calibrations[key]
+	if !ok {
+		return CameraIntrinsics{}, fmt.Errorf("%w: %v", ErrCalibrationNotFound, key)
+	}
+	delete(s.calibrations, key)
+	if err := s.writeLocked(); err != nil {
+		s.calibrations[key] = c
+		return CameraIntrinsics{}, err
+	}
+	return c, nil
+}
+
+// writeLocked saves every calibration, to a temporary file first so a crash can't leave half a file behind.
+func (s *CalibrationStore) writeLocked() error {
+	calibrations := make([]CameraIntrinsics, 0, len(s.calibrations))
+	for _, c := range s.calibrations {
+		calibrations = append(calibrations, c)
+	}
+	sort.Slice(calibrations, func(i, j int) bool { return calibrations[i].key() < calibrations[j].key() })
+	data, err := json.MarshalIndent(calibrations, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".camera_calibration-*.json")
+	if err != nil {
+		return fmt.Errorf("could not save the camera calibration: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save the camera calibration: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save the camera calibration: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not save the camera calibration: %w", err)
+	}
+	return nil
+}
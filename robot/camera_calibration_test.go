@@ -0,0 +1,77 @@
+package robot
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewCalibrationStore(t *testing.T) {
+	dir := t.TempDir()
+
+	calibrations, err := NewCalibrationStore(filepath.Join(dir, "missing.json"))
+	if err != nil || len(calibrations.List()) != 0 {
+		t.Fatalf("missing file = %v, %v", calibrations.List(), err)
+	}
+
+	path := filepath.Join(dir, "camera_calibration.json")
+	data := `[
+		{"backend": "v4l2", "width": 640, "height": 480, "camera_matrix": [600, 0, 320, 0, 600, 240, 0, 0, 1], "distortion": [0.1, -0.2, 0, 0, 0]},
+		{"backend": "v4l2", "width": 1280, "height": 720, "camera_matrix": [0, 0, 0, 0, 0, 0, 0, 0, 0]}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	calibrations, err = NewCalibrationStore(path)
+	if err != nil {
+		t.Fatalf("NewCalibrationStore returned error: %v", err)
+	}
+	if got := calibrations.List(); len(got) != 1 {
+		t.Errorf("loaded %+v, want the one with a focal length", got)
+	}
+	c, ok := calibrations.Get(BackendV4L2, 640, 480)
+	if !ok || c.Distortion[1] != -0.2 {
+		t.Errorf("Get = %+v, %v", c, ok)
+	}
+	if _, ok := calibrations.Get(BackendGStreamer, 640, 480); ok {
+		t.Error("a calibration for another backend was used")
+	}
+	if _, ok := calibrations.Get(BackendV4L2, 1280, 720); ok {
+		t.Error("a calibration without a focal length was used")
+	}
+	if x, y := c.ray(image.Pt(920, 240)); x != 1 || y != 0 {
+		t.Errorf("ray = %v, %v, want 1, 0", x, y)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCalibrationStore(path); err == nil {
+		t.Error("a broken file loaded")
+	}
+}
+
+func TestCam_Intrinsics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "camera_calibration.json")
+	data := `[{"backend": "testpattern", "width": 640, "height": 480, "camera_matrix": [600, 0, 320, 0, 600, 240, 0, 0, 1]}]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	calibrations, err := NewCalibrationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cam{Config: CameraConfig{Backend: BackendTestPattern, HFOV: 62.2}, Calibrations: calibrations}
+	if _, ok := c.Intrinsics(image.Pt(640, 480)); !ok {
+		t.Error("no calibration for the configured backend")
+	}
+	if view := c.view(image.Pt(320, 240)); view.Intrinsics != nil || view.HFOV != 62.2 {
+		t.Errorf("view at another resolution = %+v", view)
+	}
+	c.Backend = BackendV4L2
+	if _, ok := c.Intrinsics(image.Pt(640, 480)); ok {
+		t.Error("the calibration of the configured backend was used for the one in use")
+	}
+}
@@ -0,0 +1,453 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Calibrating the camera
+
+	A calibration is taken from a chessboard printed flat and held in front of
+	the camera in different places and at different angles:
+
+	  1. Start a session with the board: its inner corners across and down,
+	     one fewer than its squares, and the side of a square in mm.
+	  2. Capture views. While a capture is waiting every frame, as the lens saw
+	     it before it is undistorted or drawn on, is searched for the board in
+	     the background. A view is kept at most every calibrationViewInterval
+	     and only if the board has moved since the last one.
+	  3. Finish, which solves for the camera matrix and distortion with
+	     OpenCV's calibrateCamera and saves them for the backend and
+	     resolution the views came from, see camera_calibration.go.
+
+	ChArUco boards would be better, they don't need to be wholly in view, but
+	gocv has no binding for them.
+
+	With undistortion on, frames from a camera with a calibration at their
+	resolution are remapped so straight lines are straight. Everything after
+	that, the markers' poses included, sees a camera with the same camera
+	matrix and no distortion.
+*/
+
+// Calibration defaults, the board is OpenCV's sample chessboard
+const (
+	DefaultBoardCols     = 9    // inner corners across
+	DefaultBoardRows     = 6    // inner corners down
+	DefaultBoardSquareMm = 25.0 // side of a square
+
+	MinCalibrationViews = 10 // fewer and the distortion is guesswork
+	MaxCalibrationViews = 50
+
+	calibrationViewInterval   = 500 * time.Millisecond // between views kept, to give the board time to move
+	calibrationCaptureTimeout = 2 * time.Minute
+	calibrationMinMove        = 0.05 // of the frame's diagonal, how far the corners must move between views
+)
+
+var (
+	ErrInvalidCalibration  = errors.New("invalid calibration")
+	ErrCalibrationNotFound = errors.New("no such calibration")
+	ErrNotCalibrating      = errors.New("the camera is not being calibrated")
+	ErrCalibrationBusy     = errors.New("views are already being captured")
+)
+
+// CalibrationBoard is the chessboard a calibration is taken from. Zero values mean the defaults.
+type CalibrationBoard struct {
+	Cols     int     `json:"cols"`      // inner corners across
+	Rows     int     `json:"rows"`      // inner corners down
+	SquareMm float64 `json:"square_mm"` // side of a square
+}
+
+// withDefaults fills in the zero values and checks the rest
+func (b CalibrationBoard) withDefaults() (CalibrationBoard, error) {
+	if b.Cols == 0 {
+		b.Cols = DefaultBoardCols
+	}
+	if b.Rows == 0 {
+		b.Rows = DefaultBoardRows
+	}
+	if b.SquareMm == 0 {
+		b.SquareMm = DefaultBoardSquareMm
+	}
+	if b.Cols < 3 || b.Rows < 3 || b.Cols == b.Rows {
+		// A square board can be found either way round, which spoils the calibration
+		return b, fmt.Errorf("%w: the board must have at least 3 inner corners each way and a different number across and down, not %dx%d", ErrInvalidCalibration, b.Cols, b.Rows)
+	}
+	if b.SquareMm < 0 {
+		return b, fmt.Errorf("%w: square_mm must be positive", ErrInvalidCalibration)
+	}
+	return b, nil
+}
+
+func (b CalibrationBoard) size() image.Point { return image.Pt(b.Cols, b.Rows) }
+
+// corners is where each inner corner is on the board, in mm, in the order OpenCV finds them
+func (b CalibrationBoard) corners() []gocv.Point3f {
+	corners := make([]gocv.Point3f, 0, b.Cols*b.Rows)
+	for y := 0; y < b.Rows; y++ {
+		for x := 0; x < b.Cols; x++ {
+			corners = append(corners, gocv.Point3f{X: float32(float64(x) * b.SquareMm), Y: float32(float64(y) * b.SquareMm)})
+		}
+	}
+	return corners
+}
+
+// CalibrationSession is a calibration being taken.
+type CalibrationSession struct {
+	Board   CalibrationBoard `json:"board"`
+	Backend CameraBackend    `json:"backend"`
+	Frame   image.Point      `json:"frame"`  // size of the frames the views came from, set by the first
+	Views   int              `json:"views"`  // views kept so far
+	Wanted  int              `json:"wanted"` // views the capture under way is waiting for, Views when there isn't one
+	Started time.Time        `json:"started"`
+}
+
+// CalibrationStatus is the session under way, if there is one, and the calibrations saved.
+type CalibrationStatus struct {
+	Session      *CalibrationSession `json:"session,omitempty"`
+	Calibrations []CameraIntrinsics  `json:"calibrations"`
+	Undistort    bool                `json:"undistort"`
+}
+
+// CameraCalibrator takes a calibration from views of a chessboard, see the top of this file.
+type CameraCalibrator struct {
+	mux      sync.Mutex
+	session  *CalibrationSession
+	views    [][]gocv.Point2f
+	capture  chan struct{} // closed when the capture under way has its views, or is stopped
+	running  bool          // a frame is being searched for the board
+	lastView time.Time
+
+	// calibrate solves for the intrinsics, calibrateViews unless a test swaps it
+	calibrate func(board CalibrationBoard, frame image.Point, views [][]gocv.Point2f) (CameraIntrinsics, error)
+}
+
+func NewCameraCalibrator() *CameraCalibrator {
+	return &CameraCalibrator{calibrate: calibrateViews}
+}
+
+// Start starts a session for backend with board, throwing away any session under way.
+func (c *CameraCalibrator) Start(board CalibrationBoard, backend CameraBackend) (CalibrationSession, error) {
+	board, err := board.withDefaults()
+	if err != nil {
+		return CalibrationSession{}, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.endCaptureLocked()
+	c.session = &CalibrationSession{Board: board, Backend: backend, Started: time.Now()}
+	c.views = nil
+	return *c.session, nil
+}
+
+// Session returns the session under way, if there is one.
+func (c *CameraCalibrator) Session() (CalibrationSession, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.session == nil {
+		return CalibrationSession{}, false
+	}
+	return *c.session, true
+}
+
+// Capture asks for n more views. The channel is closed when they are in or the capture is stopped.
+func (c *CameraCalibrator) Capture(n int) (CalibrationSession, <-chan struct{}, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.session == nil {
+		return CalibrationSession{}, nil, ErrNotCalibrating
+	}
+	if c.capture != nil {
+		return CalibrationSession{}, nil, ErrCalibrationBusy
+	}
+	if n <= 0 || c.session.Views+n > MaxCalibrationViews {
+		return CalibrationSession{}, nil, fmt.Errorf("%w: capture 1-%d views, the session has %d of at most %d", ErrInvalidCalibration, MaxCalibrationViews-c.session.Views, c.session.Views, MaxCalibrationViews)
+	}
+	c.session.Wanted = c.session.Views + n
+	c.capture = make(chan struct{})
+	return *c.session, c.capture, nil
+}
+
+// StopCapture gives up on the views still wanted, the ones already kept stay.
+func (c *CameraCalibrator) StopCapture() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.endCaptureLocked()
+}
+
+func (c *CameraCalibrator) endCaptureLocked() {
+	if c.capture != nil {
+		close(c.capture)
+		c.capture = nil
+	}
+	if c.session != nil {
+		c.session.Wanted = c.session.Views
+	}
+}
+
+// Cancel throws away the session under way.
+func (c *CameraCalibrator) Cancel() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.session == nil {
+		return ErrNotCalibrating
+	}
+	c.endCaptureLocked()
+	c.session, c.views = nil, nil
+	return nil
+}
+
+// Offer hands the calibrator a frame. While views are wanted, and it isn't already searching
+// one, it searches a copy for the board in the background. img is not kept.
+func (c *CameraCalibrator) Offer(img gocv.Mat) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	session := c.session
+	if session == nil || c.capture == nil || c.running || time.Since(c.lastView) < calibrationViewInterval {
+		return
+	}
+	c.running = true
+	frame := img.Clone()
+	size := image.Pt(img.Cols(), img.Rows())
+
+	go func() {
+		defer frame.Close()
+		corners, found := findBoard(frame, session.Board)
+
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		c.running = false
+		if !found || c.session != session {
+			return
+		}
+		if err := c.addLocked(size, corners); err != nil {
+			log.Printf("CAMERA: Calibration view skipped: %v", err)
+		}
+	}()
+}
+
+// addLocked keeps a view of the board, unless the frame size changed or the board hasn't moved
+func (c *CameraCalibrator) addLocked(frame image.Point, corners []gocv.Point2f) error {
+	session := c.session
+	if session.Frame == (image.Point{}) {
+		session.Frame = frame
+	}
+	if frame != session.Frame {
+		return fmt.Errorf("the frame is %v, the session's views are %v", frame, session.Frame)
+	}
+	if len(c.views) > 0 {
+		if moved := boardMoved(c.views[len(c.views)-1], corners, frame); moved < calibrationMinMove {
+			return fmt.Errorf("the board has hardly moved since the last view")
+		}
+	}
+
+	c.views = append(c.views, corners)
+	c.lastView = time.Now()
+	session.Views++
+	if session.Views >= session.Wanted {
+		c.endCaptureLocked()
+	}
+	return nil
+}
+
+// Finish solves for the intrinsics from the session's views, hands them to save and,
+// once they are saved, ends the session. It fails, leaving the session as it was,
+// if views are being captured or there aren't enough of them.
+func (c *CameraCalibrator) Finish(save func(CameraIntrinsics) error) (CameraIntrinsics, error) {
+	c.mux.Lock()
+	session := c.session
+	switch {
+	case session == nil:
+		c.mux.Unlock()
+		return CameraIntrinsics{}, ErrNotCalibrating
+	case c.capture != nil:
+		c.mux.Unlock()
+		return CameraIntrinsics{}, ErrCalibrationBusy
+	case session.Views < MinCalibrationViews:
+		c.mux.Unlock()
+		return CameraIntrinsics{}, fmt.Errorf("%w: %d views, at least %d are needed", ErrInvalidCalibration, session.Views, MinCalibrationViews)
+	}
+	board, frame, views := session.Board, session.Frame, slices.Clone(c.views)
+	c.mux.Unlock()
+
+	// Solving takes a while, frames carry on meanwhile
+	intrinsics, err := c.calibrate(board, frame, views)
+	if err != nil {
+		return CameraIntrinsics{}, err
+	}
+	intrinsics.Backend, intrinsics.Frames, intrinsics.Calibrated = session.Backend, len(views), time.Now()
+	if err := save(intrinsics); err != nil {
+		return CameraIntrinsics{}, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.session == session {
+		c.session, c.views = nil, nil
+	}
+	return intrinsics, nil
+}
+
+// boardMoved is how far the corners moved between two views, on average, as a fraction of the frame's diagonal
+func boardMoved(a, b []gocv.Point2f, frame image.Point) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 1
+	}
+	var sum float64
+	for i := range a {
+		sum += math.Hypot(float64(a[i].X-b[i].X), float64(a[i].Y-b[i].Y))
+	}
+	return sum / float64(len(a)) / math.Hypot(float64(frame.X), float64(frame.Y))
+}
+
+// findBoard looks for board's inner corners in img, to a fraction of a pixel
+func findBoard(img gocv.Mat, board CalibrationBoard) ([]gocv.Point2f, bool) {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(img, &gray, gocv.ColorBGRToGray)
+
+	corners := gocv.NewMat()
+	defer corners.Close()
+	if !gocv.FindChessboardCorners(gray, board.size(), &corners, gocv.CalibCBAdaptiveThresh|gocv.CalibCBNormalizeImage|gocv.CalibCBFastCheck) {
+		return nil, false
+	}
+	gocv.CornerSubPix(gray, &corners, image.Pt(11, 11), image.Pt(-1, -1), gocv.NewTermCriteria(gocv.Count|gocv.EPS, 30, 0.001))
+
+	points := gocv.NewPoint2fVectorFromMat(corners)
+	defer points.Close()
+	return points.ToPoints(), true
+}
+
+// calibrateViews solves for the camera matrix and distortion with OpenCV
+func calibrateViews(board CalibrationBoard, frame image.Point, views [][]gocv.Point2f) (CameraIntrinsics, error) {
+	objectPoints := gocv.NewPoints3fVector()
+	defer objectPoints.Close()
+	imagePoints := gocv.NewPoints2fVector()
+	defer imagePoints.Close()
+	corners := board.corners()
+	for _, view := range views {
+		object := gocv.NewPoint3fVectorFromPoints(corners)
+		objectPoints.Append(object)
+		object.Close()
+		found := gocv.NewPoint2fVectorFromPoints(view)
+		imagePoints.Append(found)
+		found.Close()
+	}
+
+	matrix, distortion := gocv.NewMat(), gocv.NewMat()
+	defer matrix.Close()
+	defer distortion.Close()
+	rvecs, tvecs := gocv.NewMat(), gocv.NewMat()
+	defer rvecs.Close()
+	defer tvecs.Close()
+	rms := gocv.CalibrateCamera(objectPoints, imagePoints, frame, &matrix, &distortion, &rvecs, &tvecs, 0)
+
+	intrinsics := CameraIntrinsics{Width: frame.X, Height: frame.Y, Error: rms}
+	if matrix.Rows() != 3 || matrix.Cols() != 3 {
+		return intrinsics, fmt.Errorf("%w: OpenCV found no camera matrix", ErrInvalidCalibration)
+	}
+	for i := range intrinsics.CameraMatrix {
+		intrinsics.CameraMatrix[i] = matrix.GetDoubleAt(i/3, i%3)
+	}
+	for i := 0; i < distortion.Total(); i++ {
+		// A row or a column, depending on the OpenCV version
+		if distortion.Rows() == 1 {
+			intrinsics.Distortion = append(intrinsics.Distortion, distortion.GetDoubleAt(0, i))
+		} else {
+			intrinsics.Distortion = append(intrinsics.Distortion, distortion.GetDoubleAt(i, 0))
+		}
+	}
+	if !intrinsics.valid() || math.IsNaN(rms) {
+		return intrinsics, fmt.Errorf("%w: OpenCV found no usable solution, try views with the board at more angles", ErrInvalidCalibration)
+	}
+	return intrinsics, nil
+}
+
+// Undistorter removes the lens distortion from frames the camera has a calibration for.
+type Undistorter struct {
+	mux        sync.Mutex
+	enabled    bool
+	intrinsics CameraIntrinsics // the calibration the maps are for
+	maps       bool
+	map1, map2 gocv.Mat
+}
+
+func NewUndistorter(enabled bool) *Undistorter {
+	return &Undistorter{enabled: enabled}
+}
+
+// Enabled reports whether frames are being undistorted.
+func (u *Undistorter) Enabled() bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.enabled
+}
+
+// SetEnabled turns undistortion on or off.
+func (u *Undistorter) SetEnabled(enabled bool) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.enabled = enabled
+	if !enabled {
+		u.closeMapsLocked()
+	}
+}
+
+func (u *Undistorter) closeMapsLocked() {
+	if u.maps {
+		u.map1.Close()
+		u.map2.Close()
+		u.maps = false
+	}
+}
+
+// Apply replaces img with its undistorted self, when undistortion is on, and reports whether it did.
+// The maps that take the distortion out are worked out once per calibration.
+func (u *Undistorter) Apply(img *gocv.Mat, intrinsics CameraIntrinsics) bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if !u.enabled {
+		return false
+	}
+
+	if !u.maps || !sameIntrinsics(u.intrinsics, intrinsics) {
+		u.closeMapsLocked()
+		matrix, distortion := intrinsics.mats()
+		defer matrix.Close()
+		defer distortion.Close()
+		rectify := gocv.NewMat() // none
+		defer rectify.Close()
+
+		u.map1, u.map2 = gocv.NewMat(), gocv.NewMat()
+		gocv.InitUndistortRectifyMap(matrix, distortion, rectify, matrix, image.Pt(intrinsics.Width, intrinsics.Height), int(gocv.MatTypeCV16SC2), u.map1, u.map2)
+		u.intrinsics, u.maps = intrinsics, true
+	}
+
+	undistorted := gocv.NewMat()
+	gocv.Remap(*img, &undistorted, &u.map1, &u.map2, gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+	img.Close()
+	*img = undistorted
+	return true
+}
+
+func sameIntrinsics(a, b CameraIntrinsics) bool {
+	return a.key() == b.key() && a.CameraMatrix == b.CameraMatrix && slices.Equal(a.Distortion, b.Distortion)
+}
+
+// undistorted is the camera an undistorted frame looks like it came from
+func (c CameraIntrinsics) undistorted() CameraIntrinsics {
+	c.Distortion = nil
+	return c
+}
@@ -0,0 +1,231 @@
+package robot
+
+import (
+	"errors"
+	"image"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// boardView is a board of 4x3 corners seen face on, 20 pixels apart, with its first corner at (x, y)
+func boardView(x, y float32) []gocv.Point2f {
+	var corners []gocv.Point2f
+	for row := float32(0); row < 3; row++ {
+		for col := float32(0); col < 4; col++ {
+			corners = append(corners, gocv.Point2f{X: x + col*20, Y: y + row*20})
+		}
+	}
+	return corners
+}
+
+func TestCalibrationBoard_WithDefaults(t *testing.T) {
+	board, err := CalibrationBoard{}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults returned error: %v", err)
+	}
+	if board.Cols != DefaultBoardCols || board.Rows != DefaultBoardRows || board.SquareMm != DefaultBoardSquareMm {
+		t.Errorf("defaults = %+v", board)
+	}
+	corners := board.corners()
+	if len(corners) != 54 || corners[1] != (gocv.Point3f{X: 25}) || corners[53] != (gocv.Point3f{X: 200, Y: 125}) {
+		t.Errorf("corners = %v", corners)
+	}
+
+	for _, bad := range []CalibrationBoard{
+		{Cols: 2, Rows: 5},
+		{Cols: 7, Rows: 7},
+		{SquareMm: -1},
+	} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidCalibration) {
+			t.Errorf("%+v: err = %v, want %v", bad, err, ErrInvalidCalibration)
+		}
+	}
+}
+
+func TestBoardMoved(t *testing.T) {
+	frame := image.Pt(300, 400) // a diagonal of 500
+	if moved := boardMoved(boardView(0, 0), boardView(30, 40), frame); !near(moved, 0.1) {
+		t.Errorf("moved = %v, want 0.1", moved)
+	}
+	if moved := boardMoved(boardView(0, 0), boardView(0, 0)[:4], frame); moved != 1 {
+		t.Errorf("moved between different boards = %v, want 1", moved)
+	}
+}
+
+func TestCameraCalibrator(t *testing.T) {
+	c := NewCameraCalibrator()
+	if _, _, err := c.Capture(5); !errors.Is(err, ErrNotCalibrating) {
+		t.Errorf("Capture without a session err = %v, want %v", err, ErrNotCalibrating)
+	}
+
+	if _, err := c.Start(CalibrationBoard{Cols: 4, Rows: 3, SquareMm: 10}, BackendV4L2); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, MaxCalibrationViews + 1} {
+		if _, _, err := c.Capture(n); !errors.Is(err, ErrInvalidCalibration) {
+			t.Errorf("Capture(%d) err = %v, want %v", n, err, ErrInvalidCalibration)
+		}
+	}
+	_, done, err := c.Capture(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Capture(2); !errors.Is(err, ErrCalibrationBusy) {
+		t.Errorf("second Capture err = %v, want %v", err, ErrCalibrationBusy)
+	}
+
+	frame := image.Pt(640, 480)
+	c.mux.Lock()
+	first := c.addLocked(frame, boardView(100, 100))
+	still := c.addLocked(frame, boardView(101, 100))
+	resized := c.addLocked(image.Pt(1280, 720), boardView(300, 100))
+	second := c.addLocked(frame, boardView(300, 100))
+	c.mux.Unlock()
+	if first != nil || still == nil || resized == nil || second != nil {
+		t.Errorf("add = %v, %v, %v, %v, want the board that didn't move and the other frame size skipped", first, still, resized, second)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("the capture isn't done with all its views")
+	}
+	if session, _ := c.Session(); session.Views != 2 || session.Wanted != 2 || session.Frame != frame {
+		t.Errorf("session = %+v", session)
+	}
+
+	// Too few views to solve for anything
+	save := func(CameraIntrinsics) error { return nil }
+	if _, err := c.Finish(save); !errors.Is(err, ErrInvalidCalibration) {
+		t.Errorf("Finish err = %v, want %v", err, ErrInvalidCalibration)
+	}
+
+	c.mux.Lock()
+	for i := 0; len(c.views) < MinCalibrationViews; i++ {
+		c.views = append(c.views, boardView(float32(i*50), 0))
+		c.session.Views++
+	}
+	c.mux.Unlock()
+	c.calibrate = func(board CalibrationBoard, frame image.Point, views [][]gocv.Point2f) (CameraIntrinsics, error) {
+		return CameraIntrinsics{Width: frame.X, Height: frame.Y, CameraMatrix: [9]float64{500, 0, 320, 0, 500, 240, 0, 0, 1}}, nil
+	}
+
+	// A calibration that can't be saved leaves the session to try again
+	if _, err := c.Finish(func(CameraIntrinsics) error { return errors.New("disk full") }); err == nil {
+		t.Error("Finish didn't pass on the save's error")
+	}
+	if _, ok := c.Session(); !ok {
+		t.Fatal("a failed save ended the session")
+	}
+
+	var saved CameraIntrinsics
+	intrinsics, err := c.Finish(func(c CameraIntrinsics) error { saved = c; return nil })
+	if err != nil {
+		t.Fatalf("Finish returned error: %v", err)
+	}
+	if intrinsics.Backend != BackendV4L2 || intrinsics.Frames != MinCalibrationViews || intrinsics.key() != "v4l2@640x480" || saved.key() != intrinsics.key() {
+		t.Errorf("intrinsics = %+v, saved %+v", intrinsics, saved)
+	}
+	if _, ok := c.Session(); ok {
+		t.Error("the session is still under way")
+	}
+	if err := c.Cancel(); !errors.Is(err, ErrNotCalibrating) {
+		t.Errorf("Cancel err = %v, want %v", err, ErrNotCalibrating)
+	}
+}
+
+func TestCameraCalibrator_Cancel(t *testing.T) {
+	c := NewCameraCalibrator()
+	c.Start(CalibrationBoard{}, BackendV4L2)
+	_, done, _ := c.Capture(5)
+	if err := c.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("cancelling didn't stop the capture")
+	}
+	if _, ok := c.Session(); ok {
+		t.Error("the session is still under way")
+	}
+}
+
+func TestCalibrationStore_Put(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "camera_calibration.json")
+	calibrations, err := NewCalibrationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := CameraIntrinsics{Backend: BackendV4L2, Width: 640, Height: 480, CameraMatrix: [9]float64{600, 0, 320, 0, 600, 240, 0, 0, 1}, Distortion: []float64{0.1, -0.2, 0, 0, 0}}
+	if err := calibrations.Put(c); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	if err := calibrations.Put(CameraIntrinsics{Backend: BackendV4L2, Width: 320, Height: 240}); !errors.Is(err, ErrInvalidCalibration) {
+		t.Errorf("Put without a focal length err = %v, want %v", err, ErrInvalidCalibration)
+	}
+	reloaded, err := NewCalibrationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.Get(BackendV4L2, 640, 480); !ok || !sameIntrinsics(got, c) {
+		t.Errorf("reloaded %+v, %v", got, ok)
+	}
+
+	if _, err := reloaded.Delete(BackendV4L2, 1280, 720); !errors.Is(err, ErrCalibrationNotFound) {
+		t.Errorf("Delete of nothing err = %v, want %v", err, ErrCalibrationNotFound)
+	}
+	if _, err := reloaded.Delete(BackendV4L2, 640, 480); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if reloaded, _ := NewCalibrationStore(path); len(reloaded.List()) != 0 {
+		t.Errorf("still saved: %+v", reloaded.List())
+	}
+
+	// Memory and disk stay the same when the file can't be written
+	broken, _ := NewCalibrationStore(filepath.Join(t.TempDir(), "missing", "camera_calibration.json"))
+	if err := broken.Put(c); err == nil || len(broken.List()) != 0 {
+		t.Errorf("Put = %v, calibrations %+v", err, broken.List())
+	}
+}
+
+func TestUndistorter(t *testing.T) {
+	c := CameraIntrinsics{Backend: BackendV4L2, Width: 640, Height: 480, CameraMatrix: [9]float64{600, 0, 320, 0, 600, 240, 0, 0, 1}, Distortion: []float64{0.1}}
+	img := gocv.NewMat()
+	defer img.Close()
+
+	u := NewUndistorter(false)
+	if u.Apply(&img, c) {
+		t.Error("undistorted while off")
+	}
+	u.SetEnabled(true)
+	if !u.Apply(&img, c) || !u.maps {
+		t.Error("didn't undistort while on")
+	}
+	recalibrated := c
+	recalibrated.Distortion = []float64{0.2}
+	if u.Apply(&img, recalibrated); !sameIntrinsics(u.intrinsics, recalibrated) {
+		t.Error("the maps weren't remade for a new calibration")
+	}
+	u.SetEnabled(false)
+	if u.maps {
+		t.Error("the maps were kept after turning it off")
+	}
+
+	if undistorted := c.undistorted(); undistorted.Distortion != nil || c.Distortion == nil {
+		t.Errorf("undistorted = %+v", undistorted)
+	}
+}
+
+func TestLoadCameraConfig_Undistort(t *testing.T) {
+	t.Setenv("GIZMATRON_CAMERA_UNDISTORT", "true")
+	if !loadCameraConfig().Undistort {
+		t.Error("undistortion is off")
+	}
+	t.Setenv("GIZMATRON_CAMERA_UNDISTORT", "sometimes")
+	if loadCameraConfig().Undistort {
+		t.Error("undistortion is on")
+	}
+}
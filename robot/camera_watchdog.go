@@ -0,0 +1,327 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Camera watchdog
+
+	While the camera is started a supervisor keeps it going. A reader
+	goroutine reads the device and hands each frame over; the supervisor
+	publishes them. If no frame arrives for the stall timeout, or too many
+	reads in a row fail, the device is given up on and opened again from
+	scratch with the same backend detection as the first time, waiting a
+	little longer after each failed attempt:
+
+	  500ms, 1s, 2s, 4s ... up to the reconnect max (30s by default)
+
+	The wait goes back to 500ms once the camera has produced frames again.
+	A stalled read can't be interrupted, so a stalled device is left to its
+	reader goroutine, which closes it if the read ever returns.
+*/
+
+const (
+	DefaultCameraStallTimeout    = 2 * time.Second
+	DefaultCameraMaxReadFailures = 10
+	DefaultCameraReconnectMax    = 30 * time.Second
+
+	cameraReconnectMin = 500 * time.Millisecond
+)
+
+var (
+	ErrCameraNotRunning = errors.New("camera is not running")
+
+	errCameraStalled = errors.New("camera stalled")
+)
+
+// CameraState is what the camera supervisor is doing.
+type CameraState string
+
+const (
+	CameraStopped      CameraState = "stopped"
+	CameraStarting     CameraState = "starting"     // opened, waiting for the first frame
+	CameraStreaming    CameraState = "running"      // frames are coming in
+	CameraReconnecting CameraState = "reconnecting" // the camera failed and is being opened again
+)
+
+// CameraHealth is how the camera has been doing since it was started.
+type CameraHealth struct {
+	State        CameraState `json:"state"`
+	Frames       uint64      `json:"frames"`
+	ReadFailures int         `json:"read_failures"` // in a row, right now
+	Reconnects   int         `json:"reconnects"`
+	LastFrame    *time.Time  `json:"last_frame,omitempty"`
+	LastError    string      `json:"last_error,omitempty"`
+}
+
+// Started reports whether the camera has been started and not stopped, it may be reconnecting.
+func (c *Cam) Started() bool {
+	c.runMux.Lock()
+	defer c.runMux.Unlock()
+	return c.cancel != nil
+}
+
+// Health reports how the camera is doing.
+func (c *Cam) Health() CameraHealth {
+	c.healthMux.Lock()
+	defer c.healthMux.Unlock()
+	health := c.health
+	if health.State == "" {
+		health.State = CameraStopped
+	}
+	if health.LastFrame != nil {
+		lastFrame := *health.LastFrame
+		health.LastFrame = &lastFrame
+	}
+	return health
+}
+
+// updateHealth changes the health, anyone watching hears about it if the state or the error changed
+func (c *Cam) updateHealth(update func(h *CameraHealth)) {
+	c.healthMux.Lock()
+	before := c.health
+	update(&c.health)
+	changed := c.health.State != before.State || c.health.LastError != before.LastError || c.health.Reconnects != before.Reconnects
+	health := c.health
+	onHealth := c.onHealth
+	c.healthMux.Unlock()
+
+	if changed && onHealth != nil {
+		onHealth(health)
+	}
+}
+
+// watchdogConfig fills in the watchdog's defaults for anything not configured
+func (config CameraConfig) watchdogConfig() (stall time.Duration, maxFailures int, reconnectMax time.Duration) {
+	stall, maxFailures, reconnectMax = config.StallTimeout, config.MaxReadFailures, config.ReconnectMax
+	if stall <= 0 {
+		stall = DefaultCameraStallTimeout
+	}
+	if maxFailures <= 0 {
+		maxFailures = DefaultCameraMaxReadFailures
+	}
+	if reconnectMax <= 0 {
+		reconnectMax = DefaultCameraReconnectMax
+	}
+	return stall, maxFailures, reconnectMax
+}
+
+// supervise keeps the camera open and reading until ctx is cancelled
+func (c *Cam) supervise(ctx context.Context) {
+	_, _, reconnectMax := c.Config.watchdogConfig()
+	backoff := cameraReconnectMin
+	c.updateHealth(func(h *CameraHealth) { h.State = CameraStarting })
+
+	for {
+		source, err := c.openSource()
+		if err == nil {
+			c.updateHealth(func(h *CameraHealth) { h.State, h.ReadFailures = CameraStarting, 0 })
+
+			var gotFrames bool
+			gotFrames, err = c.capture(ctx, source)
+			// The reader closes the source, whenever it can
+			c.webcam = nil
+			c.isOperational = false
+			if ctx.Err() != nil {
+				c.updateHealth(func(h *CameraHealth) { h.State = CameraStopped })
+				return
+			}
+			if gotFrames {
+				backoff = cameraReconnectMin
+			}
+		}
+
+		log.Printf("CAMERA: %v, reconnecting in %v", err, backoff)
+		c.updateHealth(func(h *CameraHealth) {
+			h.State = CameraReconnecting
+			h.LastError = err.Error()
+			h.Reconnects++
+		})
+
+		select {
+		case <-ctx.Done():
+			c.updateHealth(func(h *CameraHealth) { h.State = CameraStopped })
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, reconnectMax)
+	}
+}
+
+// openSource opens the camera with the configured backend
+func (c *Cam) openSource() (FrameSource, error) {
+	if c.opener != nil {
+		source, err := c.opener()
+		if err != nil {
+			return nil, err
+		}
+		c.webcam = source
+		c.isOperational = true
+		return source, nil
+	}
+
+	c.webcam = nil
+	c.isOperational = false
+	c.open_wecam()
+	if !c.isOperational || c.webcam == nil {
+		return nil, fmt.Errorf("could not open the %v camera", c.Config.Backend)
+	}
+	return c.webcam, nil
+}
+
+type readResult struct {
+	mat gocv.Mat
+	ok  bool
+}
+
+// capture publishes the frames read from source until ctx is cancelled, which returns a nil
+// error, or the source stalls or keeps failing. gotFrames reports whether any frame was read.
+func (c *Cam) capture(ctx context.Context, source FrameSource) (gotFrames bool, err error) {
+	stallTimeout, maxFailures, _ := c.Config.watchdogConfig()
+
+	results := make(chan readResult)
+	quit := make(chan struct{})
+	defer close(quit)
+	go c.read(source, results, quit)
+
+	stall := time.NewTimer(stallTimeout)
+	defer stall.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return gotFrames, nil
+
+		case <-stall.C:
+			return gotFrames, fmt.Errorf("%w: no frame for %v", errCameraStalled, stallTimeout)
+
+		case result := <-results:
+			if !result.ok {
+				failures++
+				c.updateHealth(func(h *CameraHealth) { h.ReadFailures = failures })
+				if failures >= maxFailures {
+					return gotFrames, fmt.Errorf("%d reads in a row failed", failures)
+				}
+				continue
+			}
+
+			failures = 0
+			gotFrames = true
+			stall.Reset(stallTimeout)
+			c.publish(result.mat)
+
+			now := time.Now()
+			c.updateHealth(func(h *CameraHealth) {
+				h.State = CameraStreaming
+				h.Frames++
+				h.ReadFailures = 0
+				h.LastFrame = &now
+			})
+		}
+	}
+}
+
+// read reads source until quit, handing every frame to results. It is the only thing that touches source.
+func (c *Cam) read(source FrameSource, results chan<- readResult, quit <-chan struct{}) {
+	defer source.Close()
+
+	fps := c.Config.FPS
+	if fps <= 0 {
+		fps = 30
+	}
+	interval := time.Second / time.Duration(fps)
+	next := time.Now()
+
+	for {
+		img := gocv.NewMat()
+		ok := source.Read(&img) && !img.Empty()
+		if !ok {
+			img.Close()
+		}
+		select {
+		case results <- readResult{mat: img, ok: ok}:
+		case <-quit:
+			if ok {
+				img.Close()
+			}
+			return
+		}
+
+		// A real camera paces itself, virtual ones would go as fast as they can
+		next = next.Add(interval)
+		wait := time.Until(next)
+		if wait <= 0 {
+			next = time.Now()
+			continue
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// publish undistorts the frame, runs it through motion, object, marker and face detection and hands it to the frame hub
+func (c *Cam) publish(img gocv.Mat) {
+	// Calibration views are of the frame as the lens saw it
+	if c.Calibrator != nil {
+		c.Calibrator.Offer(img)
+	}
+	view := c.view(image.Pt(img.Cols(), img.Rows()))
+	if c.Undistort != nil && view.Intrinsics != nil && c.Undistort.Apply(&img, *view.Intrinsics) {
+		undistorted := view.Intrinsics.undistorted()
+		view.Intrinsics = &undistorted
+	}
+
+	// Motion, objects and markers next, before anything is drawn on the frame
+	var motion MotionResult
+	if c.Motion != nil && c.Motion.Enabled() {
+		var started, stopped bool
+		motion, started, stopped = c.Motion.Detect(img)
+		if started {
+			c.Events.Publish(EventMotionStarted, motion)
+		}
+		if stopped {
+			c.Events.Publish(EventMotionStopped, motion)
+		}
+	}
+	if c.Objects != nil {
+		c.Objects.Offer(img, c.Events)
+	}
+	if c.Markers != nil && c.Markers.Enabled() {
+		c.Markers.Offer(img, view, c.Events)
+	}
+
+	// Draw on the frame while it is still ours, it can't change once published
+	var faces []image.Rectangle
+	if c.DetectingFaces() {
+		faces = faceBoxes(c.FaceDetect(&img))
+		c.publishFaces(FaceDetection{
+			Faces: faces,
+			Frame: image.Point{img.Cols(), img.Rows()},
+			HFOV:  c.Config.HFOV,
+			VFOV:  c.Config.VFOV,
+			At:    time.Now(),
+		})
+	}
+	if c.Motion != nil && c.Motion.Overlay() {
+		drawMotion(&img, motion)
+	}
+	if c.Objects != nil {
+		drawObjects(&img, c.Objects.Overlay())
+	}
+	if c.Markers != nil {
+		drawMarkers(&img, c.Markers.Overlay())
+	}
+	c.Frames.Publish(img, faces)
+}
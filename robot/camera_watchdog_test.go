@@ -0,0 +1,172 @@
+package robot
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// brokenSource never gives a frame, either failing every read or never returning from one
+type brokenSource struct {
+	block  chan struct{} // reads wait on this when set
+	closed atomic.Bool
+}
+
+func (s *brokenSource) Read(m *gocv.Mat) bool {
+	if s.block != nil {
+		<-s.block
+	}
+	return false
+}
+
+func (s *brokenSource) Set(prop gocv.VideoCaptureProperties, param float64) {}
+
+func (s *brokenSource) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func newWatchedCam(config CameraConfig, open func() (FrameSource, error)) *Cam {
+	config.FPS = 100
+	return &Cam{Config: config, Frames: NewFrameHub(), opener: open}
+}
+
+// waitForHealth waits for the camera's health to match, failing the test if it doesn't in time
+func waitForHealth(t *testing.T, c *Cam, match func(CameraHealth) bool) CameraHealth {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		health := c.Health()
+		if match(health) {
+			return health
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("camera health never matched, last %+v", health)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCameraWatchdog_ReconnectsAfterReadFailures(t *testing.T) {
+	var mux sync.Mutex
+	var sources []*brokenSource
+	c := newWatchedCam(CameraConfig{MaxReadFailures: 3, StallTimeout: time.Second}, func() (FrameSource, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		source := &brokenSource{}
+		sources = append(sources, source)
+		return source, nil
+	})
+
+	var notified atomic.Int32
+	c.onHealth = func(CameraHealth) { notified.Add(1) }
+
+	go c.Start()
+	health := waitForHealth(t, c, func(h CameraHealth) bool { return h.Reconnects >= 2 })
+	c.Stop()
+
+	if !strings.Contains(health.LastError, "3 reads in a row failed") {
+		t.Errorf("last error = %q", health.LastError)
+	}
+	if notified.Load() == 0 {
+		t.Error("nobody was told the camera was reconnecting")
+	}
+	if got := c.Health().State; got != CameraStopped {
+		t.Errorf("state after Stop = %v", got)
+	}
+	if c.Started() {
+		t.Error("camera still started after Stop")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(sources) < 2 {
+		t.Fatalf("camera was opened %d times, want a reopen", len(sources))
+	}
+	for i, source := range sources {
+		if !source.closed.Load() {
+			t.Errorf("source %d was never closed", i)
+		}
+	}
+}
+
+func TestCameraWatchdog_DetectsStall(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	c := newWatchedCam(CameraConfig{StallTimeout: 50 * time.Millisecond}, func() (FrameSource, error) {
+		return &brokenSource{block: block}, nil
+	})
+
+	go c.Start()
+	health := waitForHealth(t, c, func(h CameraHealth) bool { return h.Reconnects >= 1 })
+	if health.State != CameraReconnecting || !strings.Contains(health.LastError, errCameraStalled.Error()) {
+		t.Errorf("health = %+v, want reconnecting after a stall", health)
+	}
+
+	// The stalled read can't be interrupted, Stop mustn't wait for it
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on a stalled camera")
+	}
+}
+
+func TestCameraWatchdog_BacksOffWhenOpenFails(t *testing.T) {
+	var opens atomic.Int32
+	c := newWatchedCam(CameraConfig{ReconnectMax: time.Second}, func() (FrameSource, error) {
+		opens.Add(1)
+		return nil, errors.New("no camera here")
+	})
+
+	go c.Start()
+	waitForHealth(t, c, func(h CameraHealth) bool { return h.Reconnects >= 2 })
+	// 500ms then 1s, so a third attempt can't have happened yet
+	time.Sleep(200 * time.Millisecond)
+	c.Stop()
+
+	if got := opens.Load(); got != 2 {
+		t.Errorf("camera opened %d times, want 2", got)
+	}
+	if got := c.Health().LastError; got != "no camera here" {
+		t.Errorf("last error = %q", got)
+	}
+}
+
+func TestCamera_StopWithoutStart(t *testing.T) {
+	c := newWatchedCam(CameraConfig{}, nil)
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		c.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked with nothing running")
+	}
+}
+
+func TestLoadCameraConfig_Watchdog(t *testing.T) {
+	t.Setenv("GIZMATRON_CAMERA_STALL_MS", "750")
+	t.Setenv("GIZMATRON_CAMERA_MAX_READ_FAILURES", "bad")
+	t.Setenv("GIZMATRON_CAMERA_RECONNECT_MAX_MS", "5000")
+
+	config := loadCameraConfig()
+	if config.StallTimeout != 750*time.Millisecond || config.ReconnectMax != 5*time.Second {
+		t.Errorf("config = %+v", config)
+	}
+	if config.MaxReadFailures != DefaultCameraMaxReadFailures {
+		t.Errorf("max read failures = %d, want the default for a bad value", config.MaxReadFailures)
+	}
+}
@@ -0,0 +1,379 @@
+package robot
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Clips
+
+	The clip recorder keeps the last few seconds of frames in memory, the
+	pre-roll. When something happens, a face appears, motion starts, or a
+	call to the API, it writes a clip: the pre-roll followed by the frames of the
+	next few seconds, the post-roll. So a clip shows what led up to the
+	event, not just what came after.
+
+	Frames are kept as JPEGs, a few hundred KB a second at 640x480 instead of
+	tens of MB as raw Mats. Another event during a clip makes it longer
+	rather than starting a new one, up to the clip's max length.
+
+	Clips are written to the recordings directory as clip-*.avi and are
+	listed, downloaded and rotated along with the recordings.
+*/
+
+// Clip defaults, each can be overridden with GIZMATRON_CLIP* env vars
+const (
+	DefaultClipPreRoll   = 5 * time.Second
+	DefaultClipPostRoll  = 10 * time.Second
+	DefaultClipMaxLength = time.Minute
+
+	clipCheck = 100 * time.Millisecond // how often a clip checks whether its post-roll is over
+)
+
+// Clip triggers
+const (
+	ClipTriggerAPI    = "api"
+	ClipTriggerFace   = "face"
+	ClipTriggerMotion = "motion"
+)
+
+// ClipsConfig is how much a clip keeps either side of its event.
+type ClipsConfig struct {
+	PreRoll   time.Duration // kept in memory before an event, 0 for none
+	PostRoll  time.Duration // recorded after an event
+	MaxLength time.Duration // longest a clip gets however many events there are
+	OnFace    bool          // record a clip when a face appears, while face detection is on
+	OnMotion  bool          // record a clip when motion starts, while motion detection is on
+}
+
+// loadClipsConfig loads the clips config from GIZMATRON_CLIP* env vars
+func loadClipsConfig() ClipsConfig {
+	config := ClipsConfig{
+		PreRoll:   DefaultClipPreRoll,
+		PostRoll:  DefaultClipPostRoll,
+		MaxLength: DefaultClipMaxLength,
+		OnFace:    true,
+		OnMotion:  true,
+	}
+	if preRoll := os.Getenv("GIZMATRON_CLIP_PREROLL_SECONDS"); preRoll != "" {
+		if s, err := strconv.Atoi(preRoll); err == nil && s >= 0 {
+			config.PreRoll = time.Duration(s) * time.Second
+		} else {
+			log.Printf("Warning!! GIZMATRON_CLIP_PREROLL_SECONDS %q is not a number of seconds, using %v", preRoll, config.PreRoll)
+		}
+	}
+	if postRoll := os.Getenv("GIZMATRON_CLIP_POSTROLL_SECONDS"); postRoll != "" {
+		if s, err := strconv.Atoi(postRoll); err == nil && s >= 0 {
+			config.PostRoll = time.Duration(s) * time.Second
+		} else {
+			log.Printf("Warning!! GIZMATRON_CLIP_POSTROLL_SECONDS %q is not a number of seconds, using %v", postRoll, config.PostRoll)
+		}
+	}
+	if maxLength := os.Getenv("GIZMATRON_CLIP_MAX_SECONDS"); maxLength != "" {
+		if s, err := strconv.Atoi(maxLength); err == nil && s > 0 {
+			config.MaxLength = time.Duration(s) * time.Second
+		} else {
+			log.Printf("Warning!! GIZMATRON_CLIP_MAX_SECONDS %q is not a positive number of seconds, using %v", maxLength, config.MaxLength)
+		}
+	}
+	if onFace := os.Getenv("GIZMATRON_CLIP_ON_FACE"); onFace != "" {
+		if f, err := strconv.ParseBool(onFace); err == nil {
+			config.OnFace = f
+		} else {
+			log.Printf("Warning!! GIZMATRON_CLIP_ON_FACE %q is not true or false, using %v", onFace, config.OnFace)
+		}
+	}
+	if onMotion := os.Getenv("GIZMATRON_CLIP_ON_MOTION"); onMotion != "" {
+		if m, err := strconv.ParseBool(onMotion); err == nil {
+			config.OnMotion = m
+		} else {
+			log.Printf("Warning!! GIZMATRON_CLIP_ON_MOTION %q is not true or false, using %v", onMotion, config.OnMotion)
+		}
+	}
+	return config
+}
+
+// ClipsStatus is what the clip recorder has in memory and is doing.
+type ClipsStatus struct {
+	PreRollSeconds  float64    `json:"preroll_seconds"`
+	PostRollSeconds float64    `json:"postroll_seconds"`
+	OnFace          bool       `json:"on_face"`
+	OnMotion        bool       `json:"on_motion"`
+	Buffered        int        `json:"buffered"`         // frames held for the pre-roll
+	BufferedSeconds float64    `json:"buffered_seconds"` // how far back they go
+	Clip            *Recording `json:"clip,omitempty"`   // the clip being written
+}
+
+type bufferedFrame struct {
+	at   time.Time
+	jpeg []byte
+}
+
+// ClipRecorder writes clips of the frames around events.
+type ClipRecorder struct {
+	recorder *Recorder
+	config   ClipsConfig
+
+	mux     sync.Mutex
+	buffer  []bufferedFrame // oldest first, no older than the pre-roll
+	clip    *clipSession
+	sawFace bool
+}
+
+type clipSession struct {
+	recording Recording // guarded by ClipRecorder.mux
+	until     time.Time // when the post-roll ends, guarded by ClipRecorder.mux
+	frames    chan bufferedFrame
+	done      chan struct{} // closed once the clip's file is finished
+}
+
+// NewClipRecorder buffers the frames from hub and writes clips with recorder, until hub is closed.
+// Motion events on events, which may be nil, trigger clips too.
+func NewClipRecorder(hub *FrameHub, recorder *Recorder, events *EventBus, config ClipsConfig) *ClipRecorder {
+	c := &ClipRecorder{recorder: recorder, config: config}
+	go c.run(hub.Subscribe(int(recorder.fps), DropNewest))
+	if events != nil && config.OnMotion {
+		motion, _ := events.Subscribe(4)
+		go c.triggerOn(motion, EventMotionStarted, ClipTriggerMotion)
+	}
+	return c
+}
+
+// triggerOn records a clip for every event of eventType, until events is closed
+func (c *ClipRecorder) triggerOn(events <-chan Event, eventType, reason string) {
+	for event := range events {
+		if event.Type != eventType {
+			continue
+		}
+		if _, err := c.Trigger(reason); err != nil {
+			log.Printf("Error !! Could not record a clip of %v: %v", reason, err)
+		}
+	}
+}
+
+// run buffers frames and feeds them to the clip being written
+func (c *ClipRecorder) run(frames *FrameSubscription) {
+	defer frames.Close()
+	for frame := range frames.Frames() {
+		at, faces := frame.Time, len(frame.Faces) > 0
+
+		c.mux.Lock()
+		wanted := c.config.PreRoll > 0 || c.clip != nil
+		c.mux.Unlock()
+		// Encoding costs, skip it when there's nothing to keep the frame for
+		var jpeg []byte
+		if wanted {
+			var err error
+			if jpeg, err = frame.JPEG(); err != nil {
+				log.Printf("Error !! Could not encode frame %d for clips: %v", frame.Seq, err)
+				wanted = false
+			}
+		}
+		frame.Release()
+
+		c.mux.Lock()
+		if wanted {
+			c.keep(bufferedFrame{at: at, jpeg: jpeg})
+		}
+		appeared := faces && !c.sawFace
+		c.sawFace = faces
+		c.mux.Unlock()
+
+		if appeared && c.config.OnFace {
+			if _, err := c.Trigger(ClipTriggerFace); err != nil {
+				log.Printf("Error !! Could not record a clip of a face: %v", err)
+			}
+		}
+	}
+}
+
+// keep adds a frame to the pre-roll and to the clip being written, with c.mux held
+func (c *ClipRecorder) keep(frame bufferedFrame) {
+	if c.clip != nil {
+		select {
+		case c.clip.frames <- frame:
+		default:
+			log.Printf("Warning!! Clip %v is falling behind, dropped a frame", c.clip.recording.Name)
+		}
+	}
+
+	if c.config.PreRoll <= 0 {
+		return
+	}
+	c.buffer = append(c.buffer, frame)
+	oldest := frame.at.Add(-c.config.PreRoll)
+	drop := 0
+	for drop < len(c.buffer) && c.buffer[drop].at.Before(oldest) {
+		drop++
+	}
+	// Copy down now and then rather than letting the slice creep through memory
+	c.buffer = c.buffer[drop:]
+	if cap(c.buffer) > 2*len(c.buffer)+64 {
+		c.buffer = append([]bufferedFrame(nil), c.buffer...)
+	}
+}
+
+// Trigger records a clip of the pre-roll and the post-roll after now. If a clip is
+// already being written it is made longer instead, and that clip is returned.
+func (c *ClipRecorder) Trigger(reason string) (Recording, error) {
+	now := time.Now()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.clip != nil {
+		c.clip.until = now.Add(c.config.PostRoll)
+		if limit := c.clip.recording.Started.Add(c.config.MaxLength); c.clip.until.After(limit) {
+			c.clip.until = limit
+		}
+		log.Printf("Clip %v extended for %v", c.clip.recording.Name, reason)
+		return c.clip.recording, nil
+	}
+
+	c.recorder.mux.Lock()
+	name, err := c.recorder.reserve("clip", now)
+	c.recorder.mux.Unlock()
+	if err != nil {
+		return Recording{}, err
+	}
+
+	preRoll := append([]bufferedFrame(nil), c.buffer...)
+	started := now
+	if len(preRoll) > 0 {
+		started = preRoll[0].at
+	}
+	session := &clipSession{
+		recording: Recording{Name: name, Active: true, Started: &started, Trigger: reason},
+		until:     now.Add(c.config.PostRoll),
+		// Room for a second or so of frames while the pre-roll is written
+		frames: make(chan bufferedFrame, int(c.recorder.fps)+len(preRoll)),
+		done:   make(chan struct{}),
+	}
+	if limit := started.Add(c.config.MaxLength); session.until.After(limit) {
+		session.until = limit
+	}
+	c.clip = session
+	c.recorder.remember(session.recording)
+
+	log.Printf("Recording clip %v for %v, %d frames of pre-roll", name, reason, len(preRoll))
+	go c.write(session, preRoll)
+	return session.recording, nil
+}
+
+// write writes the pre-roll and then the live frames to the clip's file until the post-roll is over
+func (c *ClipRecorder) write(session *clipSession, preRoll []bufferedFrame) {
+	defer close(session.done)
+
+	path := filepath.Join(c.recorder.config.Dir, session.recording.Name)
+	var writer *gocv.VideoWriter
+	var failure error
+	frames := 0
+
+	writeFrame := func(frame bufferedFrame) {
+		if failure != nil {
+			return
+		}
+		img, err := gocv.IMDecode(frame.jpeg, gocv.IMReadColor)
+		if err != nil {
+			failure = fmt.Errorf("could not decode a frame: %w", err)
+			return
+		}
+		defer img.Close()
+		// The file is opened on the first frame, which gives its size
+		if writer == nil {
+			if writer, err = gocv.VideoWriterFile(path, recordingCodec, c.recorder.fps, img.Cols(), img.Rows(), true); err != nil {
+				failure = fmt.Errorf("could not open %v: %w", path, err)
+				return
+			}
+		}
+		if err := writer.Write(img); err != nil {
+			failure = fmt.Errorf("could not write %v: %w", path, err)
+			return
+		}
+		frames++
+	}
+
+	for _, frame := range preRoll {
+		writeFrame(frame)
+	}
+
+	ticker := time.NewTicker(clipCheck)
+	defer ticker.Stop()
+write:
+	for {
+		select {
+		case frame := <-session.frames:
+			writeFrame(frame)
+		case <-ticker.C:
+			c.mux.Lock()
+			over := failure != nil || time.Now().After(session.until)
+			if over {
+				// Nothing more will be sent once this isn't the clip
+				c.clip = nil
+			}
+			c.mux.Unlock()
+			if over {
+				break write
+			}
+		}
+	}
+	// Whatever was sent before the clip was over still belongs in it
+	for len(session.frames) > 0 {
+		writeFrame(<-session.frames)
+	}
+
+	if writer != nil {
+		if err := writer.Close(); err != nil && failure == nil {
+			failure = fmt.Errorf("could not finish %v: %w", path, err)
+		}
+	}
+
+	now := time.Now()
+	c.mux.Lock()
+	recording := session.recording
+	c.mux.Unlock()
+	recording.Active = false
+	recording.Stopped = &now
+	recording.Frames = frames
+	recording.StopReason = RecordingDuration
+	if info, err := os.Stat(path); err == nil {
+		recording.Bytes = info.Size()
+	}
+	if failure != nil {
+		recording.StopReason = RecordingFailed
+		recording.Error = failure.Error()
+		log.Printf("Error !! Clip %v: %v", recording.Name, failure)
+	}
+	log.Printf("Clip %v finished, %d frames, %d bytes", recording.Name, recording.Frames, recording.Bytes)
+	c.recorder.remember(recording)
+}
+
+// Status reports what the clip recorder is holding and doing.
+func (c *ClipRecorder) Status() ClipsStatus {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	status := ClipsStatus{
+		PreRollSeconds:  c.config.PreRoll.Seconds(),
+		PostRollSeconds: c.config.PostRoll.Seconds(),
+		OnFace:          c.config.OnFace,
+		OnMotion:        c.config.OnMotion,
+		Buffered:        len(c.buffer),
+	}
+	if len(c.buffer) > 0 {
+		status.BufferedSeconds = c.buffer[len(c.buffer)-1].at.Sub(c.buffer[0].at).Seconds()
+	}
+	if c.clip != nil {
+		clip := c.clip.recording
+		status.Clip = &clip
+	}
+	return status
+}
@@ -0,0 +1,120 @@
+package robot
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func newTestClipRecorder(t *testing.T, config ClipsConfig) (*ClipRecorder, *Recorder, *FrameHub) {
+	t.Helper()
+	recorder, hub := newTestRecorder(t, RecordingsConfig{})
+	if config.MaxLength == 0 {
+		config.MaxLength = time.Minute
+	}
+	return NewClipRecorder(hub, recorder, nil, config), recorder, hub
+}
+
+// publishFor publishes a frame every 10ms for d
+func publishFor(hub *FrameHub, d time.Duration, faces []image.Rectangle) {
+	for end := time.Now().Add(d); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		hub.Publish(gocv.NewMat(), faces)
+	}
+}
+
+// waitForClip waits for the clip being written to finish
+func waitForClip(t *testing.T, c *ClipRecorder) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Status().Clip != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("clip never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClipRecorder_PreRollIsBounded(t *testing.T) {
+	c, _, hub := newTestClipRecorder(t, ClipsConfig{PreRoll: 50 * time.Millisecond})
+	publishFor(hub, 200*time.Millisecond, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	status := c.Status()
+	if status.Buffered == 0 || status.Buffered > 10 || status.BufferedSeconds > 0.05 {
+		t.Errorf("status = %+v, want at most 50ms of frames", status)
+	}
+}
+
+func TestClipRecorder_Trigger(t *testing.T) {
+	c, recorder, hub := newTestClipRecorder(t, ClipsConfig{PreRoll: time.Second, PostRoll: 100 * time.Millisecond})
+	publishFor(hub, 60*time.Millisecond, nil)
+	time.Sleep(20 * time.Millisecond)
+	preRoll := c.Status().Buffered
+
+	clip, err := c.Trigger(ClipTriggerAPI)
+	if err != nil {
+		t.Fatalf("Trigger returned error: %v", err)
+	}
+	if !clip.Active || clip.Trigger != ClipTriggerAPI {
+		t.Errorf("clip = %+v", clip)
+	}
+	// Another event while the clip is being written makes it longer
+	if again, err := c.Trigger(ClipTriggerFace); err != nil || again.Name != clip.Name {
+		t.Errorf("second Trigger = %+v, %v, want the same clip", again, err)
+	}
+
+	publishFor(hub, 50*time.Millisecond, nil)
+	waitForClip(t, c)
+
+	list, err := recorder.List()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("List = %+v, %v", list, err)
+	}
+	if got := list[0]; got.Name != clip.Name || got.Active || got.Frames <= preRoll || got.Bytes == 0 || got.Trigger != ClipTriggerAPI {
+		t.Errorf("clip = %+v, want more than the %d frames of pre-roll", got, preRoll)
+	}
+	if _, err := os.Stat(filepath.Join(recorder.config.Dir, clip.Name)); err != nil {
+		t.Errorf("clip file: %v", err)
+	}
+}
+
+func TestClipRecorder_FaceAppears(t *testing.T) {
+	c, recorder, hub := newTestClipRecorder(t, ClipsConfig{PostRoll: 50 * time.Millisecond, OnFace: true})
+	publishFor(hub, 30*time.Millisecond, nil)
+	if c.Status().Clip != nil {
+		t.Fatal("clip recorded with no face")
+	}
+
+	publishFor(hub, 30*time.Millisecond, []image.Rectangle{image.Rect(10, 10, 50, 50)})
+	status := c.Status()
+	if status.Clip == nil || status.Clip.Trigger != ClipTriggerFace {
+		t.Fatalf("status = %+v, want a clip of the face", status)
+	}
+	waitForClip(t, c)
+
+	// The same face staying in view isn't a new event
+	publishFor(hub, 30*time.Millisecond, []image.Rectangle{image.Rect(12, 10, 52, 50)})
+	if c.Status().Clip != nil {
+		t.Error("a face still in view recorded another clip")
+	}
+	if list, _ := recorder.List(); len(list) != 1 {
+		t.Errorf("List = %+v, want one clip", list)
+	}
+}
+
+func TestLoadClipsConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_CLIP_PREROLL_SECONDS", "0")
+	t.Setenv("GIZMATRON_CLIP_POSTROLL_SECONDS", "3")
+	t.Setenv("GIZMATRON_CLIP_MAX_SECONDS", "0")
+	t.Setenv("GIZMATRON_CLIP_ON_FACE", "false")
+
+	config := loadClipsConfig()
+	want := ClipsConfig{PreRoll: 0, PostRoll: 3 * time.Second, MaxLength: DefaultClipMaxLength, OnFace: false, OnMotion: true}
+	if config != want {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+}
@@ -0,0 +1,79 @@
+package robot
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Events
+
+	Things the robot notices, motion starting and stopping, someone it knows
+	coming into view, the objects or markers in view changing, are published
+	as events for anyone who wants to react to them: the clip recorder, the
+	/api/v1/events stream. Subscribers get their own buffered channel and an
+	event is dropped for a subscriber that has fallen behind, so a slow one
+	never holds up whatever published it.
+*/
+
+// Event types
+const (
+	EventMotionStarted  = "motion_started"
+	EventMotionStopped  = "motion_stopped"
+	EventPersonSeen     = "person_seen"     // someone enrolled came into view, the data is their Face
+	EventObjectsChanged = "objects_changed" // the labels of the objects in view changed, the data is the ObjectResult
+	EventMarkersChanged = "markers_changed" // the markers in view changed, the data is the MarkerResult
+)
+
+// Event is something that happened.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// EventBus hands events to every subscriber.
+type EventBus struct {
+	mux  sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewEventBus makes a bus with no subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Publish hands an event to every subscriber. Publishing on a nil bus does nothing.
+func (b *EventBus) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events holding up to buffer of them, and a func to unsubscribe.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	sub := make(chan Event, max(buffer, 1))
+
+	b.mux.Lock()
+	b.subs[sub] = struct{}{}
+	b.mux.Unlock()
+
+	return sub, func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if _, ok := b.subs[sub]; ok {
+			delete(b.subs, sub)
+			close(sub)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package robot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	fast, unsubscribeFast := bus.Subscribe(4)
+	slow, unsubscribeSlow := bus.Subscribe(1)
+	defer unsubscribeSlow()
+
+	bus.Publish(EventMotionStarted, MotionResult{Score: 0.2})
+	bus.Publish(EventMotionStopped, nil)
+
+	for _, want := range []string{EventMotionStarted, EventMotionStopped} {
+		select {
+		case event := <-fast:
+			if event.Type != want || event.Time.IsZero() {
+				t.Errorf("event = %+v, want %v", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %v event", want)
+		}
+	}
+
+	// A subscriber that has fallen behind misses events rather than holding up the bus
+	if event := <-slow; event.Type != EventMotionStarted {
+		t.Errorf("slow subscriber got %v first", event.Type)
+	}
+	select {
+	case event := <-slow:
+		t.Errorf("slow subscriber got %v, it should have been dropped", event.Type)
+	default:
+	}
+
+	unsubscribeFast()
+	unsubscribeFast()
+	if _, ok := <-fast; ok {
+		t.Error("channel still open after unsubscribing")
+	}
+	bus.Publish(EventMotionStarted, nil)
+
+	var none *EventBus
+	none.Publish(EventMotionStarted, nil)
+}
@@ -0,0 +1,434 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Face detection
+
+	The face detector loads its model once, the first time it is asked to look
+	at a frame, and keeps it until it is configured with another. Three kinds
+	of detector run on the CPU:
+
+	  haar   OpenCV's Haar cascade, haarcascade_frontalface_default.xml. Fast and
+	         no extra download, but it misses faces that aren't square on and it
+	         doesn't score what it finds, min_neighbors is its threshold
+	  dnn    the res10 300x300 SSD, a Caffe model and its deploy.prototxt, or any
+	         SSD face model cv::dnn can read that outputs the same detections
+	  yunet  YuNet, face_detection_yunet_2023mar.onnx, which also finds the eyes,
+	         nose and mouth corners
+
+	Detections below the confidence threshold are dropped. A model that can't
+	be loaded is reported in the status and no faces are found until the
+	detector is configured with one that can.
+*/
+
+// Face detectors
+const (
+	FaceDetectorHaar  = "haar"
+	FaceDetectorDNN   = "dnn"
+	FaceDetectorYuNet = "yunet"
+)
+
+// Face detector defaults, each can be overridden with GIZMATRON_FACE_* env vars or the API
+const (
+	DefaultFaceDetector     = FaceDetectorHaar
+	DefaultFaceConfidence   = 0.6
+	DefaultFaceNMS          = 0.3
+	DefaultFaceMinNeighbors = 3
+
+	faceSSDInput = 300 // the res10 SSD looks at frames scaled to 300x300
+)
+
+// Where each detector's model is looked for when no path is configured, in order
+var defaultFaceModels = map[string][]string{
+	FaceDetectorHaar: {
+		"models/haarcascade_frontalface_default.xml",
+		"/usr/share/opencv4/haarcascades/haarcascade_frontalface_default.xml",
+		"/usr/local/share/opencv4/haarcascades/haarcascade_frontalface_default.xml",
+		"/usr/share/opencv/haarcascades/haarcascade_frontalface_default.xml",
+		"/home/ara/opencv/data/haarcascades/haarcascade_frontalface_default.xml",
+	},
+	FaceDetectorDNN:   {"models/res10_300x300_ssd_iter_140000.caffemodel"},
+	FaceDetectorYuNet: {"models/face_detection_yunet_2023mar.onnx"},
+}
+
+// The network description that goes with the default dnn model
+const defaultFaceModelConfig = "models/deploy.prototxt"
+
+var ErrInvalidFaceConfig = errors.New("invalid face detector config")
+
+// FaceDetectorConfig picks the face detector and tunes it. Zero values mean the defaults.
+type FaceDetectorConfig struct {
+	Detector     string  `json:"detector"`      // haar, dnn or yunet
+	Model        string  `json:"model"`         // model file, the first default found when empty
+	ModelConfig  string  `json:"model_config"`  // network description for models that need one, dnn's deploy.prototxt
+	Confidence   float64 `json:"confidence"`    // 0-1, weaker detections are dropped
+	NMS          float64 `json:"nms"`           // 0-1, yunet's overlap threshold for merging detections
+	MinNeighbors int     `json:"min_neighbors"` // haar's threshold, higher finds fewer false faces
+	MinSize      int     `json:"min_size"`      // smallest face, in frame pixels, 0 for any
+}
+
+// withDefaults fills in zero values and checks the ranges.
+func (c FaceDetectorConfig) withDefaults() (FaceDetectorConfig, error) {
+	if c.Detector == "" {
+		c.Detector = DefaultFaceDetector
+	}
+	if c.Confidence == 0 {
+		c.Confidence = DefaultFaceConfidence
+	}
+	if c.NMS == 0 {
+		c.NMS = DefaultFaceNMS
+	}
+	if c.MinNeighbors == 0 {
+		c.MinNeighbors = DefaultFaceMinNeighbors
+	}
+	if _, ok := defaultFaceModels[c.Detector]; !ok {
+		return c, fmt.Errorf("%w: unknown detector %q, want haar, dnn or yunet", ErrInvalidFaceConfig, c.Detector)
+	}
+	if c.Confidence < 0 || c.Confidence > 1 {
+		return c, fmt.Errorf("%w: confidence %v is outside 0-1", ErrInvalidFaceConfig, c.Confidence)
+	}
+	if c.NMS < 0 || c.NMS > 1 {
+		return c, fmt.Errorf("%w: nms %v is outside 0-1", ErrInvalidFaceConfig, c.NMS)
+	}
+	if c.MinNeighbors < 0 {
+		return c, fmt.Errorf("%w: min neighbors %v must be positive", ErrInvalidFaceConfig, c.MinNeighbors)
+	}
+	if c.MinSize < 0 {
+		return c, fmt.Errorf("%w: min size %v must be positive", ErrInvalidFaceConfig, c.MinSize)
+	}
+	if c.Model == "" {
+		c.Model = findFile(defaultFaceModels[c.Detector])
+		if c.Detector == FaceDetectorDNN && c.ModelConfig == "" {
+			c.ModelConfig = defaultFaceModelConfig
+		}
+	}
+	return c, nil
+}
+
+// keep reports whether face is confident and big enough to count
+func (c FaceDetectorConfig) keep(face Face) bool {
+	return face.Confidence >= c.Confidence && face.Box.Dx() >= c.MinSize && face.Box.Dy() >= c.MinSize
+}
+
+// findFile returns the first of paths that exists, or the first one if none do
+func findFile(paths []string) string {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return paths[0]
+}
+
+// loadFaceDetectorConfig loads the face detector config from GIZMATRON_FACE_* env vars
+func loadFaceDetectorConfig() FaceDetectorConfig {
+	config := FaceDetectorConfig{
+		Detector:     DefaultFaceDetector,
+		Confidence:   DefaultFaceConfidence,
+		NMS:          DefaultFaceNMS,
+		MinNeighbors: DefaultFaceMinNeighbors,
+	}
+	if detector := os.Getenv("GIZMATRON_FACE_DETECTOR"); detector != "" {
+		if _, ok := defaultFaceModels[detector]; ok {
+			config.Detector = detector
+		} else {
+			log.Printf("Warning!! GIZMATRON_FACE_DETECTOR %q is not haar, dnn or yunet, using %v", detector, config.Detector)
+		}
+	}
+	config.Model = os.Getenv("GIZMATRON_FACE_MODEL")
+	config.ModelConfig = os.Getenv("GIZMATRON_FACE_MODEL_CONFIG")
+	if confidence := os.Getenv("GIZMATRON_FACE_CONFIDENCE"); confidence != "" {
+		if c, err := strconv.ParseFloat(confidence, 64); err == nil && c > 0 && c <= 1 {
+			config.Confidence = c
+		} else {
+			log.Printf("Warning!! GIZMATRON_FACE_CONFIDENCE %q is not between 0 and 1, using %v", confidence, config.Confidence)
+		}
+	}
+	return config
+}
+
+// Face is a face found in a frame.
+type Face struct {
+	Box        image.Rectangle `json:"box"`                  // frame pixels
+	Confidence float64         `json:"confidence"`           // 0-1, always 1 from haar
+	Landmarks  []image.Point   `json:"landmarks,omitempty"`  // yunet's right eye, left eye, nose tip, right and left mouth corners
+	Name       string          `json:"name,omitempty"`       // who it is, when it is someone enrolled
+	Similarity float64         `json:"similarity,omitempty"` // how alike the face and that person are, -1 to 1
+}
+
+// faceBoxes returns just the boxes of faces
+func faceBoxes(faces []Face) []image.Rectangle {
+	if faces == nil {
+		return nil
+	}
+	boxes := make([]image.Rectangle, len(faces))
+	for i, face := range faces {
+		boxes[i] = face.Box
+	}
+	return boxes
+}
+
+// FaceDetectorStatus is a snapshot of the face detector.
+type FaceDetectorStatus struct {
+	Config FaceDetectorConfig `json:"config"`
+	Loaded bool               `json:"loaded"`          // the model has been loaded
+	Error  string             `json:"error,omitempty"` // why the model couldn't be loaded
+	Faces  []Face             `json:"faces"`           // what the latest frame looked at had in it
+	At     *time.Time         `json:"at,omitempty"`    // when that frame was looked at
+}
+
+// faceModel is a loaded face detection model
+type faceModel interface {
+	detect(img gocv.Mat, config FaceDetectorConfig) []Face
+	Close()
+}
+
+// FaceDetector finds faces in frames with the model it is configured with.
+type FaceDetector struct {
+	mux    sync.Mutex
+	config FaceDetectorConfig
+	model  faceModel // nil until loaded
+	err    error     // why the model couldn't be loaded, it isn't tried again until the next Configure
+	faces  []Face
+	at     time.Time
+
+	load func(FaceDetectorConfig) (faceModel, error) // loads a model, loadFaceModel when nil
+}
+
+// NewFaceDetector makes a detector, its model is loaded the first time it's needed.
+func NewFaceDetector(config FaceDetectorConfig) (*FaceDetector, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &FaceDetector{config: config}, nil
+}
+
+func (d *FaceDetector) loadModel(config FaceDetectorConfig) (faceModel, error) {
+	if d.load != nil {
+		return d.load(config)
+	}
+	return loadFaceModel(config)
+}
+
+// Configure switches the detector to config. The new model is loaded straight
+// away, and if it can't be the detector carries on with the old one.
+func (d *FaceDetector) Configure(config FaceDetectorConfig) (FaceDetectorConfig, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return config, err
+	}
+	model, err := d.loadModel(config)
+	if err != nil {
+		return config, fmt.Errorf("%w: %v", ErrInvalidFaceConfig, err)
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.model != nil {
+		d.model.Close()
+	}
+	d.config, d.model, d.err = config, model, nil
+	d.faces, d.at = nil, time.Time{}
+	log.Printf("Face detection: %v detector, model %v, confidence %v", config.Detector, config.Model, config.Confidence)
+	return config, nil
+}
+
+// Detect finds the faces in img, which it doesn't change.
+// Only the camera's frames are recorded as the latest faces, see record.
+func (d *FaceDetector) Detect(img gocv.Mat) []Face {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.model == nil && d.err == nil {
+		d.model, d.err = d.loadModel(d.config)
+		if d.err != nil {
+			log.Printf("Error !! Could not load the %v face detector, no faces will be found: %v", d.config.Detector, d.err)
+		}
+	}
+	if d.model == nil || img.Empty() {
+		return nil
+	}
+
+	var faces []Face
+	for _, face := range d.model.detect(img, d.config) {
+		if d.config.keep(face) {
+			faces = append(faces, face)
+		}
+	}
+	return faces
+}
+
+// record keeps faces as what the camera's latest frame had in it, for the status
+func (d *FaceDetector) record(faces []Face) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.faces, d.at = append([]Face(nil), faces...), time.Now()
+}
+
+// Status reports the detector's config and what it last found.
+func (d *FaceDetector) Status() FaceDetectorStatus {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	status := FaceDetectorStatus{
+		Config: d.config,
+		Loaded: d.model != nil,
+		Faces:  append([]Face{}, d.faces...),
+	}
+	if d.err != nil {
+		status.Error = d.err.Error()
+	}
+	if !d.at.IsZero() {
+		at := d.at
+		status.At = &at
+	}
+	return status
+}
+
+// Close releases the model.
+func (d *FaceDetector) Close() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.model != nil {
+		d.model.Close()
+		d.model = nil
+	}
+}
+
+// loadFaceModel reads config's model from disk
+func loadFaceModel(config FaceDetectorConfig) (faceModel, error) {
+	if _, err := os.Stat(config.Model); err != nil {
+		return nil, fmt.Errorf("face model: %w", err)
+	}
+
+	switch config.Detector {
+	case FaceDetectorHaar:
+		classifier := gocv.NewCascadeClassifier()
+		if !classifier.Load(config.Model) {
+			classifier.Close()
+			return nil, fmt.Errorf("could not load haar cascade %v", config.Model)
+		}
+		return &haarFaces{classifier: classifier}, nil
+
+	case FaceDetectorDNN:
+		if config.ModelConfig != "" {
+			if _, err := os.Stat(config.ModelConfig); err != nil {
+				return nil, fmt.Errorf("face model config: %w", err)
+			}
+		}
+		net := gocv.ReadNet(config.Model, config.ModelConfig)
+		if net.Empty() {
+			net.Close()
+			return nil, fmt.Errorf("could not load dnn model %v", config.Model)
+		}
+		net.SetPreferableBackend(gocv.NetBackendDefault)
+		net.SetPreferableTarget(gocv.NetTargetCPU)
+		return &ssdFaces{net: net}, nil
+
+	case FaceDetectorYuNet:
+		// The input size is set to each frame's size before it's looked at
+		detector := gocv.NewFaceDetectorYN(config.Model, config.ModelConfig, image.Pt(320, 320))
+		return &yunetFaces{detector: detector}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown detector %q", ErrInvalidFaceConfig, config.Detector)
+}
+
+// haarFaces finds faces with a Haar cascade
+type haarFaces struct {
+	classifier gocv.CascadeClassifier
+}
+
+func (h *haarFaces) detect(img gocv.Mat, config FaceDetectorConfig) []Face {
+	minSize := image.Pt(config.MinSize, config.MinSize)
+	rects := h.classifier.DetectMultiScaleWithParams(img, 1.1, config.MinNeighbors, 0, minSize, image.Point{})
+	faces := make([]Face, len(rects))
+	for i, r := range rects {
+		faces[i] = Face{Box: r, Confidence: 1}
+	}
+	return faces
+}
+
+func (h *haarFaces) Close() {
+	h.classifier.Close()
+}
+
+// ssdFaces finds faces with an SSD network such as res10
+type ssdFaces struct {
+	net gocv.Net
+}
+
+func (s *ssdFaces) detect(img gocv.Mat, config FaceDetectorConfig) []Face {
+	blob := gocv.BlobFromImage(img, 1.0, image.Pt(faceSSDInput, faceSSDInput), gocv.NewScalar(104, 177, 123, 0), false, false)
+	defer blob.Close()
+	s.net.SetInput(blob, "")
+	out := s.net.Forward("")
+	defer out.Close()
+
+	values, err := out.DataPtrFloat32()
+	if err != nil {
+		return nil
+	}
+	detections := parseSSD(values, image.Pt(img.Cols(), img.Rows()), config.Confidence)
+	faces := make([]Face, len(detections))
+	for i, d := range detections {
+		faces[i] = Face{Box: d.Box, Confidence: d.Confidence}
+	}
+	return faces
+}
+
+func (s *ssdFaces) Close() {
+	s.net.Close()
+}
+
+// yunetFaces finds faces and their landmarks with YuNet
+type yunetFaces struct {
+	detector gocv.FaceDetectorYN
+	size     image.Point
+}
+
+func (y *yunetFaces) detect(img gocv.Mat, config FaceDetectorConfig) []Face {
+	if size := image.Pt(img.Cols(), img.Rows()); size != y.size {
+		y.detector.SetInputSize(size)
+		y.size = size
+	}
+	y.detector.SetScoreThreshold(float32(config.Confidence))
+	y.detector.SetNMSThreshold(float32(config.NMS))
+
+	out := gocv.NewMat()
+	defer out.Close()
+	y.detector.Detect(img, &out)
+
+	// Each row is 15 floats: the box as x, y, width, height, five landmarks and the score
+	frame := image.Rectangle{Max: y.size}
+	var faces []Face
+	for r := 0; r < out.Rows(); r++ {
+		x, top := int(out.GetFloatAt(r, 0)), int(out.GetFloatAt(r, 1))
+		box := image.Rect(x, top, x+int(out.GetFloatAt(r, 2)), top+int(out.GetFloatAt(r, 3))).Intersect(frame)
+		if box.Empty() {
+			continue
+		}
+		face := Face{Box: box, Confidence: float64(out.GetFloatAt(r, 14))}
+		for l := 4; l < 14; l += 2 {
+			face.Landmarks = append(face.Landmarks, image.Pt(int(out.GetFloatAt(r, l)), int(out.GetFloatAt(r, l+1))))
+		}
+		faces = append(faces, face)
+	}
+	return faces
+}
+
+func (y *yunetFaces) Close() {
+	y.detector.Close()
+}
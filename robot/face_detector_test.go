@@ -0,0 +1,162 @@
+package robot
+
+import (
+	"errors"
+	"image"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// fakeFaceModel finds the same faces in every frame
+type fakeFaceModel struct {
+	faces  []Face
+	closed bool
+}
+
+func (m *fakeFaceModel) detect(img gocv.Mat, config FaceDetectorConfig) []Face { return m.faces }
+func (m *fakeFaceModel) Close()                                                { m.closed = true }
+
+func TestFaceDetectorConfig_WithDefaults(t *testing.T) {
+	config, err := FaceDetectorConfig{}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults returned error: %v", err)
+	}
+	if config.Detector != FaceDetectorHaar || config.Confidence != DefaultFaceConfidence || config.MinNeighbors != DefaultFaceMinNeighbors || config.Model == "" {
+		t.Errorf("defaults = %+v", config)
+	}
+
+	dnn, _ := FaceDetectorConfig{Detector: FaceDetectorDNN}.withDefaults()
+	if dnn.Model != defaultFaceModels[FaceDetectorDNN][0] || dnn.ModelConfig != defaultFaceModelConfig {
+		t.Errorf("dnn defaults = %+v", dnn)
+	}
+	onnx, _ := FaceDetectorConfig{Detector: FaceDetectorDNN, Model: "face.onnx"}.withDefaults()
+	if onnx.Model != "face.onnx" || onnx.ModelConfig != "" {
+		t.Errorf("a model of its own shouldn't get the default prototxt: %+v", onnx)
+	}
+
+	for _, bad := range []FaceDetectorConfig{
+		{Detector: "lbp"},
+		{Confidence: 1.5},
+		{Confidence: -0.1},
+		{NMS: 2},
+		{MinNeighbors: -1},
+		{MinSize: -10},
+	} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidFaceConfig) {
+			t.Errorf("%+v: err = %v, want %v", bad, err, ErrInvalidFaceConfig)
+		}
+	}
+}
+
+func TestFaceDetectorConfig_Keep(t *testing.T) {
+	config := FaceDetectorConfig{Confidence: 0.6, MinSize: 20}
+	for _, tc := range []struct {
+		face Face
+		want bool
+	}{
+		{Face{Box: image.Rect(0, 0, 40, 40), Confidence: 0.9}, true},
+		{Face{Box: image.Rect(0, 0, 40, 40), Confidence: 0.6}, true},
+		{Face{Box: image.Rect(0, 0, 40, 40), Confidence: 0.5}, false},
+		{Face{Box: image.Rect(0, 0, 40, 10), Confidence: 0.9}, false},
+	} {
+		if got := config.keep(tc.face); got != tc.want {
+			t.Errorf("keep(%+v) = %v, want %v", tc.face, got, tc.want)
+		}
+	}
+}
+
+func TestFaceDetector_LoadsOnce(t *testing.T) {
+	d, err := NewFaceDetector(FaceDetectorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads := 0
+	d.load = func(FaceDetectorConfig) (faceModel, error) {
+		loads++
+		return &fakeFaceModel{}, nil
+	}
+	if d.Status().Loaded {
+		t.Error("model loaded before it was needed")
+	}
+
+	img := gocv.NewMat()
+	defer img.Close()
+	for i := 0; i < 5; i++ {
+		d.Detect(img)
+	}
+	if loads != 1 || !d.Status().Loaded {
+		t.Errorf("model loaded %d times, want once", loads)
+	}
+}
+
+func TestFaceDetector_MissingModel(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.xml")
+	d, err := NewFaceDetector(FaceDetectorConfig{Model: missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := gocv.NewMat()
+	defer img.Close()
+	if faces := d.Detect(img); faces != nil {
+		t.Errorf("Detect = %v, want no faces without a model", faces)
+	}
+	status := d.Status()
+	if status.Loaded || status.Error == "" {
+		t.Errorf("status = %+v, want the load error", status)
+	}
+
+	// A model that can't be loaded leaves the detector as it was
+	if _, err := d.Configure(FaceDetectorConfig{Detector: FaceDetectorYuNet, Model: missing}); !errors.Is(err, ErrInvalidFaceConfig) {
+		t.Errorf("Configure err = %v, want %v", err, ErrInvalidFaceConfig)
+	}
+	if got := d.Status().Config; got.Detector != FaceDetectorHaar || got.Model != missing {
+		t.Errorf("config = %+v, want the old one", got)
+	}
+}
+
+func TestFaceDetector_Configure(t *testing.T) {
+	d, _ := NewFaceDetector(FaceDetectorConfig{})
+	old := &fakeFaceModel{}
+	d.model = old
+	d.load = func(FaceDetectorConfig) (faceModel, error) { return &fakeFaceModel{}, nil }
+
+	config, err := d.Configure(FaceDetectorConfig{Detector: FaceDetectorYuNet, Confidence: 0.8})
+	if err != nil {
+		t.Fatalf("Configure returned error: %v", err)
+	}
+	if config.Detector != FaceDetectorYuNet || config.Confidence != 0.8 || config.NMS != DefaultFaceNMS {
+		t.Errorf("config = %+v", config)
+	}
+	if !old.closed {
+		t.Error("old model wasn't closed")
+	}
+	if status := d.Status(); !status.Loaded || status.Config != config {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestLoadFaceDetectorConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_FACE_DETECTOR", "yunet")
+	t.Setenv("GIZMATRON_FACE_MODEL", "/models/yunet.onnx")
+	t.Setenv("GIZMATRON_FACE_CONFIDENCE", "7")
+
+	config := loadFaceDetectorConfig()
+	want := FaceDetectorConfig{
+		Detector:     FaceDetectorYuNet,
+		Model:        "/models/yunet.onnx",
+		Confidence:   DefaultFaceConfidence,
+		NMS:          DefaultFaceNMS,
+		MinNeighbors: DefaultFaceMinNeighbors,
+	}
+	if config != want {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+
+	t.Setenv("GIZMATRON_FACE_DETECTOR", "lbp")
+	if config := loadFaceDetectorConfig(); config.Detector != DefaultFaceDetector {
+		t.Errorf("detector = %v, want %v", config.Detector, DefaultFaceDetector)
+	}
+}
@@ -0,0 +1,306 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Face recognition
+
+	While face detection is on and someone is enrolled, each face found is
+	turned into an embedding by OpenCV's SFace model and matched against the
+	people enrolled, see people.go. A face that matches well enough is labeled
+	with the person's name and how alike they are.
+
+	SFace wants faces lined up the way it was trained: with YuNet's landmarks
+	the face is rotated and cropped around the eyes and mouth, with the other
+	detectors it is just cropped to its box, which matches less well.
+
+	Recognition runs at most every recognizeInterval, in between faces keep the
+	label of the face they overlap from the last run. When someone known comes
+	into view, or back after not being seen for the cooldown, a person_seen
+	event is published so behaviors can greet them.
+*/
+
+// Face recognition defaults, each can be overridden with GIZMATRON_FACE_* env vars
+const (
+	DefaultFaceRecognitionModel = "models/face_recognition_sface_2021dec.onnx"
+	DefaultFaceMatchThreshold   = 0.363 // SFace's cosine similarity threshold for the same person
+	DefaultPersonSeenCooldown   = time.Minute
+
+	recognizeInterval = 250 * time.Millisecond
+	sfaceInput        = 112 // SFace looks at faces cropped to 112x112
+	labelOverlap      = 0.3 // how much a face has to overlap a labeled one to keep its label
+)
+
+var ErrNoFaceRecognizer = errors.New("face recognizer unavailable")
+
+// RecognitionConfig sets up face recognition.
+type RecognitionConfig struct {
+	Enabled         bool    `json:"enabled"`
+	Model           string  `json:"model"`            // SFace model file
+	Threshold       float64 `json:"threshold"`        // cosine similarity, -1 to 1, a face has to reach to be labeled
+	CooldownSeconds int     `json:"cooldown_seconds"` // someone seen within this long isn't seen again
+}
+
+func (c RecognitionConfig) cooldown() time.Duration {
+	return time.Duration(c.CooldownSeconds) * time.Second
+}
+
+// loadRecognitionConfig loads the face recognition config from GIZMATRON_FACE_* env vars
+func loadRecognitionConfig() RecognitionConfig {
+	config := RecognitionConfig{
+		Enabled:         true,
+		Model:           DefaultFaceRecognitionModel,
+		Threshold:       DefaultFaceMatchThreshold,
+		CooldownSeconds: int(DefaultPersonSeenCooldown.Seconds()),
+	}
+	if enabled := os.Getenv("GIZMATRON_FACE_RECOGNITION"); enabled != "" {
+		if e, err := strconv.ParseBool(enabled); err == nil {
+			config.Enabled = e
+		} else {
+			log.Printf("Warning!! GIZMATRON_FACE_RECOGNITION %q is not true or false, using %v", enabled, config.Enabled)
+		}
+	}
+	if model := os.Getenv("GIZMATRON_FACE_RECOGNITION_MODEL"); model != "" {
+		config.Model = model
+	}
+	if threshold := os.Getenv("GIZMATRON_FACE_MATCH_THRESHOLD"); threshold != "" {
+		if t, err := strconv.ParseFloat(threshold, 64); err == nil && t > -1 && t <= 1 {
+			config.Threshold = t
+		} else {
+			log.Printf("Warning!! GIZMATRON_FACE_MATCH_THRESHOLD %q is not between -1 and 1, using %v", threshold, config.Threshold)
+		}
+	}
+	if cooldown := os.Getenv("GIZMATRON_PERSON_SEEN_COOLDOWN_SECONDS"); cooldown != "" {
+		if s, err := strconv.Atoi(cooldown); err == nil && s >= 0 {
+			config.CooldownSeconds = s
+		} else {
+			log.Printf("Warning!! GIZMATRON_PERSON_SEEN_COOLDOWN_SECONDS %q is not a number of seconds, using %v", cooldown, config.CooldownSeconds)
+		}
+	}
+	return config
+}
+
+// RecognitionStatus is a snapshot of the face recognizer.
+type RecognitionStatus struct {
+	Config RecognitionConfig `json:"config"`
+	Loaded bool              `json:"loaded"`          // the model has been loaded
+	Error  string            `json:"error,omitempty"` // why the model couldn't be loaded
+	People int               `json:"people"`          // how many people are enrolled
+}
+
+// FaceRecognizer puts names to faces.
+type FaceRecognizer struct {
+	People *PeopleStore
+
+	mux     sync.Mutex
+	config  RecognitionConfig
+	model   *gocv.FaceRecognizerSF // nil until loaded
+	err     error                  // why the model couldn't be loaded
+	lastRun time.Time
+	last    []Face               // the faces labeled by the last run
+	seen    map[string]time.Time // when each person was last in view
+
+	embed func(img gocv.Mat, face Face) ([]float32, error) // embeds a face, the model when nil
+}
+
+// NewFaceRecognizer makes a recognizer for the people in people, its model is loaded the first time it's needed.
+func NewFaceRecognizer(config RecognitionConfig, people *PeopleStore) *FaceRecognizer {
+	return &FaceRecognizer{People: people, config: config, seen: make(map[string]time.Time)}
+}
+
+// Status reports the recognizer's config and whether its model is loaded.
+func (r *FaceRecognizer) Status() RecognitionStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	status := RecognitionStatus{Config: r.config, Loaded: r.model != nil, People: r.People.Len()}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+// loadLocked loads the SFace model, with r.mux held
+func (r *FaceRecognizer) loadLocked() error {
+	if r.model != nil {
+		return nil
+	}
+	if _, err := os.Stat(r.config.Model); err != nil {
+		r.err = fmt.Errorf("%w: %v", ErrNoFaceRecognizer, err)
+		return r.err
+	}
+	model := gocv.NewFaceRecognizerSF(r.config.Model, "")
+	r.model, r.err = &model, nil
+	log.Printf("Face recognition: loaded %v", r.config.Model)
+	return nil
+}
+
+// embedLocked turns face in img into an embedding, with r.mux held and the model loaded
+func (r *FaceRecognizer) embedLocked(img gocv.Mat, face Face) ([]float32, error) {
+	if r.embed != nil {
+		return r.embed(img, face)
+	}
+
+	aligned := gocv.NewMat()
+	defer aligned.Close()
+	if len(face.Landmarks) == 5 {
+		// AlignCrop wants the face as YuNet reports it: the box, the landmarks and the score
+		row := gocv.NewMatWithSize(1, 15, gocv.MatTypeCV32F)
+		defer row.Close()
+		values := []int{face.Box.Min.X, face.Box.Min.Y, face.Box.Dx(), face.Box.Dy()}
+		for _, point := range face.Landmarks {
+			values = append(values, point.X, point.Y)
+		}
+		for i, v := range values {
+			row.SetFloatAt(0, i, float32(v))
+		}
+		row.SetFloatAt(0, 14, float32(face.Confidence))
+		r.model.AlignCrop(img, row, &aligned)
+	} else {
+		crop := img.Region(face.Box.Intersect(image.Rect(0, 0, img.Cols(), img.Rows())))
+		defer crop.Close()
+		gocv.Resize(crop, &aligned, image.Pt(sfaceInput, sfaceInput), 0, 0, gocv.InterpolationLinear)
+	}
+	if aligned.Empty() {
+		return nil, fmt.Errorf("%w: could not crop the face at %v", ErrInvalidEnrollment, face.Box)
+	}
+
+	feature := gocv.NewMat()
+	defer feature.Close()
+	r.model.Feature(aligned, &feature)
+	embedding := make([]float32, feature.Total())
+	for i := range embedding {
+		embedding[i] = feature.GetFloatAt(0, i)
+	}
+	if len(embedding) == 0 {
+		return nil, fmt.Errorf("%w: the model returned no embedding", ErrNoFaceRecognizer)
+	}
+	return embedding, nil
+}
+
+// Sample finds the one face in img and returns its embedding, for enrolling someone.
+// It is an error for img to have no face or more than one.
+func (r *FaceRecognizer) Sample(detector *FaceDetector, img gocv.Mat) ([]float32, error) {
+	faces := detector.Detect(img)
+	if len(faces) != 1 {
+		return nil, fmt.Errorf("%w: found %d faces, want exactly one", ErrInvalidEnrollment, len(faces))
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	// Enrolling tries the model again, it may have been put in place since
+	if r.embed == nil {
+		if err := r.loadLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return r.embedLocked(img, faces[0])
+}
+
+// SampleImage is Sample for an encoded picture, a JPEG or PNG.
+func (r *FaceRecognizer) SampleImage(detector *FaceDetector, data []byte) ([]float32, error) {
+	img, err := gocv.IMDecode(data, gocv.IMReadColor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a picture: %v", ErrInvalidEnrollment, err)
+	}
+	defer img.Close()
+	if img.Empty() {
+		return nil, fmt.Errorf("%w: not a picture", ErrInvalidEnrollment)
+	}
+	return r.Sample(detector, img)
+}
+
+// Recognize labels the faces found in img with who they are, and returns the
+// faces of people who have just come into view.
+func (r *FaceRecognizer) Recognize(img gocv.Mat, faces []Face) []Face {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if !r.config.Enabled || len(faces) == 0 || r.People.Len() == 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(r.lastRun) < recognizeInterval {
+		r.carryLabels(faces)
+	} else {
+		if r.embed == nil && r.model == nil {
+			if r.err != nil {
+				return nil
+			}
+			if err := r.loadLocked(); err != nil {
+				log.Printf("Error !! Could not load the face recognizer, faces won't be recognized: %v", err)
+				return nil
+			}
+		}
+		r.lastRun = now
+		for i := range faces {
+			embedding, err := r.embedLocked(img, faces[i])
+			if err != nil {
+				continue
+			}
+			if name, similarity := r.People.Match(embedding); name != "" && similarity >= r.config.Threshold {
+				faces[i].Name, faces[i].Similarity = name, similarity
+			}
+		}
+		r.last = append(r.last[:0], faces...)
+	}
+
+	var arrived []Face
+	for _, face := range faces {
+		if face.Name == "" {
+			continue
+		}
+		if seen, ok := r.seen[face.Name]; !ok || now.Sub(seen) > r.config.cooldown() {
+			arrived = append(arrived, face)
+		}
+		r.seen[face.Name] = now
+	}
+	return arrived
+}
+
+// carryLabels gives each face the label of the face from the last run it overlaps most, with r.mux held
+func (r *FaceRecognizer) carryLabels(faces []Face) {
+	for i := range faces {
+		best := labelOverlap
+		for _, last := range r.last {
+			if last.Name == "" {
+				continue
+			}
+			if overlap := iou(faces[i].Box, last.Box); overlap >= best {
+				faces[i].Name, faces[i].Similarity = last.Name, last.Similarity
+				best = overlap
+			}
+		}
+	}
+}
+
+// iou is the area two rectangles share over the area they cover, 0 to 1
+func iou(a, b image.Rectangle) float64 {
+	shared := a.Intersect(b)
+	if shared.Empty() {
+		return 0
+	}
+	area := func(r image.Rectangle) int { return r.Dx() * r.Dy() }
+	return float64(area(shared)) / float64(area(a)+area(b)-area(shared))
+}
+
+// Close releases the model.
+func (r *FaceRecognizer) Close() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.model != nil {
+		r.model.Close()
+		r.model = nil
+	}
+}
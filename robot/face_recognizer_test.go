@@ -0,0 +1,149 @@
+package robot
+
+import (
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// newTestRecognizer embeds a face as which side of the frame it is on, so
+// faces on the left are ara and on the right are sam
+func newTestRecognizer(t *testing.T) *FaceRecognizer {
+	t.Helper()
+	people, _ := newTestPeopleStore(t)
+	people.Enroll("ara", [][]float32{{1, 0}})
+	people.Enroll("sam", [][]float32{{0, 1}})
+
+	config := RecognitionConfig{Enabled: true, Threshold: DefaultFaceMatchThreshold, CooldownSeconds: 60}
+	r := NewFaceRecognizer(config, people)
+	r.embed = func(img gocv.Mat, face Face) ([]float32, error) {
+		if face.Box.Min.X < 100 {
+			return []float32{1, 0.1}, nil
+		}
+		return []float32{0.1, 1}, nil
+	}
+	return r
+}
+
+func TestFaceRecognizer_Recognize(t *testing.T) {
+	r := newTestRecognizer(t)
+	img := gocv.NewMat()
+	defer img.Close()
+
+	faces := []Face{{Box: image.Rect(10, 10, 60, 60)}, {Box: image.Rect(200, 10, 250, 60)}}
+	arrived := r.Recognize(img, faces)
+	if faces[0].Name != "ara" || faces[1].Name != "sam" || faces[0].Similarity < 0.99 {
+		t.Errorf("faces = %+v, want ara and sam", faces)
+	}
+	if len(arrived) != 2 {
+		t.Errorf("arrived = %+v, want both", arrived)
+	}
+
+	// Between runs the faces keep the labels of the ones they overlap
+	moved := []Face{{Box: image.Rect(215, 12, 265, 62)}, {Box: image.Rect(400, 400, 450, 450)}}
+	if arrived := r.Recognize(img, moved); len(arrived) != 0 {
+		t.Errorf("arrived = %+v, want nobody new", arrived)
+	}
+	if moved[0].Name != "sam" || moved[1].Name != "" {
+		t.Errorf("moved = %+v, want sam and someone unknown", moved)
+	}
+
+	// Still in view isn't arriving again, back after the cooldown is
+	r.lastRun = time.Time{}
+	if arrived := r.Recognize(img, []Face{{Box: image.Rect(10, 10, 60, 60)}}); len(arrived) != 0 {
+		t.Errorf("arrived = %+v, ara never left", arrived)
+	}
+	r.seen["ara"] = time.Now().Add(-2 * time.Minute)
+	r.lastRun = time.Time{}
+	if arrived := r.Recognize(img, []Face{{Box: image.Rect(10, 10, 60, 60)}}); len(arrived) != 1 || arrived[0].Name != "ara" {
+		t.Errorf("arrived = %+v, want ara back", arrived)
+	}
+}
+
+func TestFaceRecognizer_Threshold(t *testing.T) {
+	r := newTestRecognizer(t)
+	r.config.Threshold = 0.999
+	img := gocv.NewMat()
+	defer img.Close()
+
+	faces := []Face{{Box: image.Rect(10, 10, 60, 60)}}
+	if arrived := r.Recognize(img, faces); len(arrived) != 0 || faces[0].Name != "" {
+		t.Errorf("faces = %+v, arrived = %+v, want nobody over the threshold", faces, arrived)
+	}
+}
+
+func TestFaceRecognizer_MissingModel(t *testing.T) {
+	people, _ := newTestPeopleStore(t)
+	people.Enroll("ara", [][]float32{{1, 0}})
+	r := NewFaceRecognizer(RecognitionConfig{Enabled: true, Model: "/no/such/sface.onnx"}, people)
+	img := gocv.NewMat()
+	defer img.Close()
+
+	faces := []Face{{Box: image.Rect(10, 10, 60, 60)}}
+	if arrived := r.Recognize(img, faces); arrived != nil || faces[0].Name != "" {
+		t.Errorf("recognized %+v without a model", faces)
+	}
+	if status := r.Status(); status.Loaded || status.Error == "" || status.People != 1 {
+		t.Errorf("status = %+v, want the load error", status)
+	}
+}
+
+func TestLoadRecognitionConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_FACE_RECOGNITION", "false")
+	t.Setenv("GIZMATRON_FACE_MATCH_THRESHOLD", "0.5")
+	t.Setenv("GIZMATRON_PERSON_SEEN_COOLDOWN_SECONDS", "-3")
+
+	config := loadRecognitionConfig()
+	want := RecognitionConfig{
+		Enabled:         false,
+		Model:           DefaultFaceRecognitionModel,
+		Threshold:       0.5,
+		CooldownSeconds: int(DefaultPersonSeenCooldown.Seconds()),
+	}
+	if config != want {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+}
+
+func TestIOU(t *testing.T) {
+	a := image.Rect(0, 0, 10, 10)
+	for _, tc := range []struct {
+		b    image.Rectangle
+		want float64
+	}{
+		{a, 1},
+		{image.Rect(5, 0, 15, 10), 50.0 / 150},
+		{image.Rect(20, 20, 30, 30), 0},
+	} {
+		if got := iou(a, tc.b); got != tc.want {
+			t.Errorf("iou(%v, %v) = %v, want %v", a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestRobot_EnrollPerson(t *testing.T) {
+	bot := newSimulatedRobot(t)
+
+	for _, tc := range []struct {
+		name    string
+		images  [][]byte
+		capture int
+		want    error
+	}{
+		{"", nil, 1, ErrInvalidPersonName},
+		{"ara", nil, 0, ErrInvalidEnrollment},
+		{"ara", nil, MaxPersonSamples + 1, ErrInvalidEnrollment},
+		{"ara", [][]byte{[]byte("not a picture")}, 0, ErrInvalidEnrollment},
+		{"ara", nil, 3, ErrCameraNotRunning},
+	} {
+		if _, err := bot.EnrollPerson(tc.name, tc.images, tc.capture); !errors.Is(err, tc.want) {
+			t.Errorf("EnrollPerson(%q, %d images, capture %d) err = %v, want %v", tc.name, len(tc.images), tc.capture, err, tc.want)
+		}
+	}
+	if people := bot.People(); len(people) != 0 {
+		t.Errorf("People = %+v, want nobody", people)
+	}
+}
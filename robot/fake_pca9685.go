@@ -0,0 +1,211 @@
+package robot
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MODE1 bits the fake cares about
+const (
+	mode1Restart = 0x80
+	mode1AI      = 0x20 // register auto-increment
+	mode1Sleep   = 0x10
+)
+
+// RegisterWrite is a single register write seen by the FakePCA9685.
+type RegisterWrite struct {
+	Register byte
+	Value    byte
+}
+
+/*
+FakePCA9685 is an in-memory PCA9685 that sits behind the I2CBus interface.
+
+It keeps the 256 byte register file of the chip and records every register
+write in the order it happened, so we can check what the driver (and the Arm
+on top of it) actually told the servos to do without any hardware.
+
+It follows the parts of the datasheet the driver depends on:
+  - multi byte writes only walk the registers when MODE1 auto-increment is set
+  - PRESCALE can only be written while MODE1 has the sleep bit set
+  - the ALL_LED registers write through to every channel
+  - a general call SWRST puts every register back to its power on value,
+    which leaves every channel full off
+*/
+type FakePCA9685 struct {
+	mux       sync.Mutex
+	registers [256]byte
+	writes    []RegisterWrite
+	resets    int
+	closed    bool
+}
+
+// NewFakePCA9685 returns a fake chip in its power on state.
+func NewFakePCA9685() *FakePCA9685 {
+	f := &FakePCA9685{}
+	f.powerOn()
+	return f
+}
+
+// powerOn sets the registers to their power on values
+func (f *FakePCA9685) powerOn() {
+	f.registers = [256]byte{}
+	f.registers[PCA9685_MODE1] = mode1Sleep
+	f.registers[PCA9685_PRESCALE] = 0x1E // 200Hz, the power on default
+	for channel := 0; channel < 16; channel++ {
+		f.registers[LED0_ON_L+4*channel+3] = ledFullOff
+	}
+	f.registers[ALL_LED_OFF_H] = ledFullOff
+}
+
+// Tx writes w, which starts with the register address, then reads from that register into r.
+func (f *FakePCA9685) Tx(w, r []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.closed {
+		return fmt.Errorf("fake pca9685: bus is closed")
+	}
+	if len(w) == 0 {
+		return fmt.Errorf("fake pca9685: no register address")
+	}
+	reg := f.write(w)
+	for i := range r {
+		r[i] = f.registers[reg]
+		if f.registers[PCA9685_MODE1]&mode1AI != 0 {
+			reg++
+		}
+	}
+	return nil
+}
+
+// Write handles a register write, the first byte being the register address.
+func (f *FakePCA9685) Write(b []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.closed {
+		return 0, fmt.Errorf("fake pca9685: bus is closed")
+	}
+	if len(b) == 0 {
+		return 0, fmt.Errorf("fake pca9685: no register address")
+	}
+	f.write(b)
+	return len(b), nil
+}
+
+// GeneralCall handles a write to the general call address, SWRST resets the chip.
+func (f *FakePCA9685) GeneralCall(b []byte) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.closed {
+		return fmt.Errorf("fake pca9685: bus is closed")
+	}
+	if len(b) == 1 && b[0] == swrst {
+		f.powerOn()
+		f.resets++
+	}
+	return nil
+}
+
+// Resets returns how many software resets the chip has seen.
+func (f *FakePCA9685) Resets() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.resets
+}
+
+// Close marks the bus as closed, any further transfers fail.
+func (f *FakePCA9685) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.closed = true
+	return nil
+}
+
+// write stores b[1:] starting at register b[0] and returns the register the pointer ends on.
+func (f *FakePCA9685) write(b []byte) byte {
+	reg := b[0]
+	for i, value := range b[1:] {
+		if i > 0 && f.registers[PCA9685_MODE1]&mode1AI != 0 {
+			reg++
+		}
+		f.writes = append(f.writes, RegisterWrite{Register: reg, Value: value})
+		if reg == PCA9685_PRESCALE && f.registers[PCA9685_MODE1]&mode1Sleep == 0 {
+			// The chip ignores prescale writes unless it is asleep
+			continue
+		}
+		f.registers[reg] = value
+		if reg >= ALL_LED_ON_L && reg <= ALL_LED_OFF_H {
+			for channel := 0; channel < 16; channel++ {
+				f.registers[LED0_ON_L+4*channel+int(reg-ALL_LED_ON_L)] = value
+			}
+		}
+	}
+	return reg
+}
+
+// Register returns the current value of a register.
+func (f *FakePCA9685) Register(reg byte) byte {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.registers[reg]
+}
+
+// Mode1 returns the MODE1 register.
+func (f *FakePCA9685) Mode1() byte { return f.Register(PCA9685_MODE1) }
+
+// Prescale returns the PRESCALE register.
+func (f *FakePCA9685) Prescale() byte { return f.Register(PCA9685_PRESCALE) }
+
+// Channel returns the LEDn_ON and LEDn_OFF counts of a channel.
+func (f *FakePCA9685) Channel(channel int) (on, off uint16) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	base := LED0_ON_L + 4*channel
+	on = uint16(f.registers[base]) | uint16(f.registers[base+1])<<8
+	off = uint16(f.registers[base+2]) | uint16(f.registers[base+3])<<8
+	return on, off
+}
+
+// FullOff reports whether a channel has its full off bit set.
+func (f *FakePCA9685) FullOff(channel int) bool {
+	return f.Register(byte(LED0_ON_L+4*channel+3))&ledFullOff != 0
+}
+
+// Writes returns a copy of every register write seen so far.
+func (f *FakePCA9685) Writes() []RegisterWrite {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	writes := make([]RegisterWrite, len(f.writes))
+	copy(writes, f.writes)
+	return writes
+}
+
+// ChannelHistory returns every LEDn_OFF count written to a channel, in order.
+// For a servo this is the list of pulses it was driven through.
+func (f *FakePCA9685) ChannelHistory(channel int) []uint16 {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	offL := byte(LED0_ON_L + 4*channel + 2)
+	var history []uint16
+	var low byte
+	for _, w := range f.writes {
+		switch w.Register {
+		case offL:
+			low = w.Value
+		case offL + 1:
+			history = append(history, uint16(low)|uint16(w.Value)<<8)
+		}
+	}
+	return history
+}
+
+// ResetWrites forgets the recorded writes, the registers are left alone.
+func (f *FakePCA9685) ResetWrites() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.writes = nil
+}
@@ -0,0 +1,120 @@
+package robot
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+fileSource is a FrameSource that plays a video file, or every image in a
+directory in name order, over and over. It lets the vision pipeline and the
+streaming endpoints run against known footage, e.g. on CI with no camera.
+*/
+type fileSource struct {
+	path   string
+	images []string           // set when path is a directory
+	next   int                // next image to show
+	video  *gocv.VideoCapture // set when path is a video file
+	closed bool
+}
+
+// imageExtensions are the files a directory source plays
+var imageExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".bmp": true}
+
+func newFileSource(path string) (*fileSource, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no file to play, set GIZMATRON_CAMERA_FILE")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		images, err := listImages(path)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSource{path: path, images: images}, nil
+	}
+
+	video, err := gocv.OpenVideoCapture(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open video %v: %w", path, err)
+	}
+	return &fileSource{path: path, video: video}, nil
+}
+
+// listImages returns the images in dir, sorted by name
+func listImages(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, entry := range entries {
+		if !entry.IsDir() && imageExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			images = append(images, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images in %v", dir)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+func (s *fileSource) Read(m *gocv.Mat) bool {
+	if s.closed {
+		return false
+	}
+
+	if s.video != nil {
+		if s.video.Read(m) && !m.Empty() {
+			return true
+		}
+		// End of the video, go round again
+		s.video.Set(gocv.VideoCapturePosFrames, 0)
+		return s.video.Read(m) && !m.Empty()
+	}
+
+	path := s.images[s.next]
+	s.next = (s.next + 1) % len(s.images)
+	img := gocv.IMRead(path, gocv.IMReadColor)
+	defer img.Close()
+	if img.Empty() {
+		log.Printf("CAMERA: Could not read image %v", path)
+		return false
+	}
+	img.CopyTo(m)
+	return true
+}
+
+// Set does nothing, the footage is whatever size it is
+func (s *fileSource) Set(prop gocv.VideoCaptureProperties, param float64) {}
+
+func (s *fileSource) Close() error {
+	s.closed = true
+	if s.video != nil {
+		return s.video.Close()
+	}
+	return nil
+}
+
+// openFile points the camera at the video file or image directory in its config
+func (c *Cam) openFile() error {
+	source, err := newFileSource(c.Config.File)
+	if err != nil {
+		return err
+	}
+	log.Printf("CAMERA: Playing %v", c.Config.File)
+	c.webcam = source
+	c.Backend = BackendFile
+	return nil
+}
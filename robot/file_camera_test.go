@@ -0,0 +1,67 @@
+package robot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListImages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.png", "a.jpg", "c.JPEG", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "d.jpg"), 0o755)
+
+	images, err := listImages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.jpg", "b.png", "c.JPEG"}
+	if len(images) != len(want) {
+		t.Fatalf("images = %v, want %v", images, want)
+	}
+	for i, name := range want {
+		if filepath.Base(images[i]) != name {
+			t.Errorf("image %d = %v, want %v", i, images[i], name)
+		}
+	}
+
+	if _, err := listImages(t.TempDir()); err == nil {
+		t.Error("an empty directory should be refused")
+	}
+}
+
+func TestNewFileSource_Errors(t *testing.T) {
+	if _, err := newFileSource(""); err == nil {
+		t.Error("no file should be refused")
+	}
+	if _, err := newFileSource(filepath.Join(t.TempDir(), "missing.mp4")); err == nil {
+		t.Error("a missing file should be refused")
+	}
+}
+
+func TestOpenWebcam_VirtualBackends(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "frame.jpg"), nil, 0o644)
+
+	for _, tc := range []struct {
+		config CameraConfig
+		ok     bool
+	}{
+		{CameraConfig{Backend: BackendTestPattern, Width: 320, Height: 240}, true},
+		{CameraConfig{Backend: BackendFile, File: dir}, true},
+		{CameraConfig{Backend: BackendFile, File: filepath.Join(dir, "missing")}, false},
+	} {
+		c := &Cam{Config: tc.config}
+		c.open_wecam()
+		if c.isOperational != tc.ok {
+			t.Errorf("%v %q: operational = %v, want %v", tc.config.Backend, tc.config.File, c.isOperational, tc.ok)
+		}
+		if tc.ok && c.Backend != tc.config.Backend {
+			t.Errorf("backend = %v, want %v", c.Backend, tc.config.Backend)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package robot
+
+import (
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Frame hub
+
+	The camera's capture goroutine is the only thing that reads the camera.
+	Every frame it reads is published to a FrameHub, which hands it to every
+	subscriber: MJPEG clients, detectors, recorders. Each subscriber has its
+	own bounded channel and drop policy, so a slow one only ever falls behind
+	itself and never holds up the camera or anyone else.
+
+	Frames are immutable once published and shared by every subscriber, so
+	nobody may draw on a frame's Mat; Clone it first. Mats are C memory, so
+	frames are reference counted: whoever receives a frame must Release it
+	when done, and the Mat is closed once the last reference is released.
+*/
+
+// DropPolicy is what a subscription does with a new frame when its channel is full.
+type DropPolicy int
+
+const (
+	DropOldest DropPolicy = iota // throw away the oldest waiting frame, for live viewing
+	DropNewest                   // throw away the new frame, for consumers that want every frame they can get in order
+)
+
+// DefaultJPEGQuality is the quality frames are encoded at unless asked otherwise
+const DefaultJPEGQuality = 95
+
+// Frame is one frame from the camera. Don't modify it.
+type Frame struct {
+	Seq   uint64            // increases by one for every frame published
+	Time  time.Time         // when the frame was captured
+	Mat   gocv.Mat          // the image, shared by every subscriber
+	Faces []image.Rectangle // faces found in the frame, when face detection is on
+
+	refs    atomic.Int32
+	jpegMux sync.Mutex
+	jpegs   map[jpegOptions]*encodedJPEG
+}
+
+type jpegOptions struct {
+	width   int
+	quality int
+}
+
+type encodedJPEG struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// Retain adds a reference to the frame, for keeping it past the point it would be released.
+func (f *Frame) Retain() *Frame {
+	f.refs.Add(1)
+	return f
+}
+
+// Release drops a reference, the Mat is closed when the last one goes.
+func (f *Frame) Release() {
+	if f.refs.Add(-1) == 0 {
+		f.Mat.Close()
+	}
+}
+
+// JPEG returns the frame encoded at DefaultJPEGQuality, see JPEGAt.
+func (f *Frame) JPEG() ([]byte, error) {
+	return f.JPEGAt(0, DefaultJPEGQuality)
+}
+
+// JPEGAt returns the frame scaled down to width, keeping its aspect ratio, and
+// encoded at quality (1-100). A width of 0, or wider than the frame, keeps its size.
+// Each width and quality is only encoded once however many subscribers ask for it,
+// so clients watching with the same settings share the work.
+func (f *Frame) JPEGAt(width, quality int) ([]byte, error) {
+	if width >= f.Mat.Cols() {
+		width = 0
+	}
+	options := jpegOptions{width: width, quality: quality}
+
+	f.jpegMux.Lock()
+	if f.jpegs == nil {
+		f.jpegs = make(map[jpegOptions]*encodedJPEG)
+	}
+	encoded, ok := f.jpegs[options]
+	if !ok {
+		encoded = &encodedJPEG{}
+		f.jpegs[options] = encoded
+	}
+	f.jpegMux.Unlock()
+
+	// Encode outside the lock so other sizes don't wait on this one
+	encoded.once.Do(func() {
+		encoded.data, encoded.err = encodeJPEG(f.Mat, options)
+	})
+	return encoded.data, encoded.err
+}
+
+func encodeJPEG(mat gocv.Mat, options jpegOptions) ([]byte, error) {
+	img := mat
+	if options.width > 0 {
+		height := mat.Rows() * options.width / mat.Cols()
+		img = gocv.NewMat()
+		defer img.Close()
+		gocv.Resize(mat, &img, image.Point{options.width, height}, 0, 0, gocv.InterpolationArea)
+	}
+
+	buf, err := gocv.IMEncodeWithParams(".jpg", img, []int{gocv.IMWriteJpegQuality, options.quality})
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
+
+// FrameHub fans frames out from the camera to any number of subscribers.
+type FrameHub struct {
+	mux    sync.Mutex
+	seq    uint64
+	latest *Frame
+	subs   map[*FrameSubscription]struct{}
+	closed bool
+}
+
+// NewFrameHub makes a hub with no frames and no subscribers.
+func NewFrameHub() *FrameHub {
+	return &FrameHub{subs: make(map[*FrameSubscription]struct{})}
+}
+
+// Publish hands mat to every subscriber as the next frame. The hub takes mat
+// over, the caller must not use or close it afterwards.
+func (h *FrameHub) Publish(mat gocv.Mat, faces []image.Rectangle) *Frame {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.closed {
+		mat.Close()
+		return nil
+	}
+
+	h.seq++
+	frame := &Frame{Seq: h.seq, Time: time.Now(), Mat: mat, Faces: faces}
+	frame.refs.Store(1) // the hub's, as the latest frame
+
+	for sub := range h.subs {
+		sub.deliver(frame)
+	}
+
+	if h.latest != nil {
+		h.latest.Release()
+	}
+	h.latest = frame
+	return frame
+}
+
+// Latest returns the most recent frame, retained, or nil before the first one.
+// The caller must Release it.
+func (h *FrameHub) Latest() *Frame {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.latest == nil {
+		return nil
+	}
+	return h.latest.Retain()
+}
+
+// Seq is the sequence number of the most recent frame, 0 before the first one.
+func (h *FrameHub) Seq() uint64 {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.seq
+}
+
+// Subscribe starts delivering frames into a channel that holds up to buffer of them.
+func (h *FrameHub) Subscribe(buffer int, policy DropPolicy) *FrameSubscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &FrameSubscription{hub: h, frames: make(chan *Frame, buffer), policy: policy}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.closed {
+		close(sub.frames)
+		return sub
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// Subscribers is how many subscriptions are open.
+func (h *FrameHub) Subscribers() int {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return len(h.subs)
+}
+
+// Close ends every subscription, their channels are closed once drained.
+func (h *FrameHub) Close() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.frames)
+	}
+	if h.latest != nil {
+		h.latest.Release()
+		h.latest = nil
+	}
+}
+
+// FrameSubscription is one consumer's feed of frames.
+type FrameSubscription struct {
+	hub     *FrameHub
+	frames  chan *Frame
+	policy  DropPolicy
+	dropped atomic.Uint64
+}
+
+// Frames is the feed. Every frame received from it must be Released.
+// It is closed when the subscription or the hub is.
+func (s *FrameSubscription) Frames() <-chan *Frame {
+	return s.frames
+}
+
+// Dropped is how many frames this subscriber missed because it fell behind.
+func (s *FrameSubscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// deliver is called by the hub with its lock held, so nothing else sends on or closes frames.
+func (s *FrameSubscription) deliver(frame *Frame) {
+	frame.Retain()
+	select {
+	case s.frames <- frame:
+		return
+	default:
+	}
+
+	s.dropped.Add(1)
+	if s.policy == DropNewest {
+		frame.Release()
+		return
+	}
+	// Make room by dropping the oldest, the reader may have taken it meanwhile
+	select {
+	case old := <-s.frames:
+		old.Release()
+	default:
+	}
+	s.frames <- frame
+}
+
+// Close stops the feed and releases any frames still waiting in it.
+func (s *FrameSubscription) Close() {
+	s.hub.mux.Lock()
+	defer s.hub.mux.Unlock()
+	if _, ok := s.hub.subs[s]; !ok {
+		return
+	}
+	delete(s.hub.subs, s)
+	close(s.frames)
+	for frame := range s.frames {
+		frame.Release()
+	}
+}
@@ -0,0 +1,123 @@
+package robot
+
+import (
+	"sync"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestFrameHub_Subscribers(t *testing.T) {
+	hub := NewFrameHub()
+	a := hub.Subscribe(10, DropOldest)
+	b := hub.Subscribe(10, DropNewest)
+
+	for i := 0; i < 3; i++ {
+		hub.Publish(gocv.NewMat(), nil)
+	}
+
+	for _, sub := range []*FrameSubscription{a, b} {
+		for want := uint64(1); want <= 3; want++ {
+			frame := <-sub.Frames()
+			if frame.Seq != want {
+				t.Errorf("got frame %d, want %d", frame.Seq, want)
+			}
+			frame.Release()
+		}
+	}
+	if hub.Seq() != 3 {
+		t.Errorf("Seq = %d, want 3", hub.Seq())
+	}
+
+	a.Close()
+	if hub.Subscribers() != 1 {
+		t.Errorf("%d subscribers after closing one, want 1", hub.Subscribers())
+	}
+	if _, open := <-a.Frames(); open {
+		t.Error("closed subscription's channel is still open")
+	}
+	a.Close() // closing twice is fine
+
+	hub.Close()
+	if _, open := <-b.Frames(); open {
+		t.Error("subscription still open after the hub closed")
+	}
+	if frame := hub.Publish(gocv.NewMat(), nil); frame != nil {
+		t.Error("a closed hub should not publish")
+	}
+}
+
+func TestFrameHub_DropPolicies(t *testing.T) {
+	hub := NewFrameHub()
+	oldest := hub.Subscribe(2, DropOldest)
+	newest := hub.Subscribe(2, DropNewest)
+
+	var frames []*Frame
+	for i := 0; i < 5; i++ {
+		frames = append(frames, hub.Publish(gocv.NewMat(), nil))
+	}
+
+	for _, tc := range []struct {
+		name string
+		sub  *FrameSubscription
+		want []uint64
+	}{
+		{"drop oldest", oldest, []uint64{4, 5}},
+		{"drop newest", newest, []uint64{1, 2}},
+	} {
+		if tc.sub.Dropped() != 3 {
+			t.Errorf("%v: dropped %d, want 3", tc.name, tc.sub.Dropped())
+		}
+		for _, want := range tc.want {
+			frame := <-tc.sub.Frames()
+			if frame.Seq != want {
+				t.Errorf("%v: got frame %d, want %d", tc.name, frame.Seq, want)
+			}
+			frame.Release()
+		}
+	}
+
+	// Only the latest frame is still referenced, by the hub
+	for _, frame := range frames[:4] {
+		if refs := frame.refs.Load(); refs != 0 {
+			t.Errorf("frame %d has %d references left, want 0", frame.Seq, refs)
+		}
+	}
+	latest := hub.Latest()
+	if latest != frames[4] || latest.refs.Load() != 2 {
+		t.Errorf("Latest = frame %d with %d references, want frame 5 with 2", latest.Seq, latest.refs.Load())
+	}
+	latest.Release()
+	hub.Close()
+	if refs := frames[4].refs.Load(); refs != 0 {
+		t.Errorf("last frame has %d references after the hub closed, want 0", refs)
+	}
+}
+
+func TestFrameHub_Concurrent(t *testing.T) {
+	hub := NewFrameHub()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		sub := hub.Subscribe(1+i, DropPolicy(i%2))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last uint64
+			for frame := range sub.Frames() {
+				if frame.Seq <= last {
+					t.Errorf("frame %d after frame %d", frame.Seq, last)
+				}
+				last = frame.Seq
+				frame.JPEG()
+				frame.Release()
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		hub.Publish(gocv.NewMat(), nil)
+	}
+	hub.Close()
+	wg.Wait()
+}
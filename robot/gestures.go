@@ -0,0 +1,259 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+	Gestures
+
+	A gesture is a short expressive movement made from wherever the arm is:
+	nodding yes, shaking no, looking around. Each one is a list of frames, each
+	frame is an offset from the starting joint angles and an optional pause.
+
+	  amplitude scales the offsets, 1 is the gesture as designed
+	  tempo     scales how fast it plays, 2 is twice as fast
+
+	No joint goes past its calibrated max velocity, so each gesture can only
+	be sped up as far as its moves allow, see Gesture.maxTempo.
+
+	Offsets are clamped to each joint's calibrated limits, so a gesture made
+	near the end of a joint's travel just comes out smaller on that side.
+	Most gestures return the arm to where it started, sleep leaves it slumped.
+
+	Joint directions: the base turns left as it increases and the wrist
+	(joint 4) tips the camera up as it increases.
+*/
+
+// Parameter ranges, anything outside is refused.
+// Not every gesture can be played as fast as MaxGestureTempo, see Gesture.maxTempo.
+const (
+	MinGestureAmplitude = 0.1
+	MaxGestureAmplitude = 2.0
+	MinGestureTempo     = 0.25
+	MaxGestureTempo     = 4.0
+)
+
+var (
+	ErrGestureNotFound      = errors.New("no such gesture")
+	ErrInvalidGestureParams = errors.New("invalid gesture parameters")
+)
+
+// GestureParams tune how a gesture is played. Zero values mean the defaults.
+type GestureParams struct {
+	Amplitude float64 `json:"amplitude"` // default 1
+	Tempo     float64 `json:"tempo"`     // default 1
+}
+
+// withDefaults fills in zero values and checks the ranges.
+func (p GestureParams) withDefaults() (GestureParams, error) {
+	if p.Amplitude == 0 {
+		p.Amplitude = 1
+	}
+	if p.Tempo == 0 {
+		p.Tempo = 1
+	}
+	if p.Amplitude < MinGestureAmplitude || p.Amplitude > MaxGestureAmplitude {
+		return p, fmt.Errorf("%w: amplitude %v is outside %v-%v", ErrInvalidGestureParams, p.Amplitude, MinGestureAmplitude, MaxGestureAmplitude)
+	}
+	if p.Tempo < MinGestureTempo || p.Tempo > MaxGestureTempo {
+		return p, fmt.Errorf("%w: tempo %v is outside %v-%v", ErrInvalidGestureParams, p.Tempo, MinGestureTempo, MaxGestureTempo)
+	}
+	return p, nil
+}
+
+// GestureFrame is one step of a gesture.
+type GestureFrame struct {
+	Offset [5]int        // degrees from the starting angles, before amplitude
+	Hold   time.Duration // pause after reaching the frame, before tempo
+}
+
+// Gesture is a named, parameterized movement.
+type Gesture struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	MaxTempo    float64        `json:"max_tempo"` // fastest it can be played, see maxTempo
+	Velocity    float64        `json:"-"`         // fraction of the joints' max velocity at tempo 1
+	Returns     bool           `json:"-"`         // goes back to the starting angles at the end
+	Frames      []GestureFrame `json:"-"`
+}
+
+// repeat returns frames n times over
+func repeat(n int, frames ...GestureFrame) []GestureFrame {
+	var all []GestureFrame
+	for i := 0; i < n; i++ {
+		all = append(all, frames...)
+	}
+	return all
+}
+
+var gestures = map[string]Gesture{
+	"nod": {
+		Name:        "nod",
+		Description: "nod yes, tipping the camera down and up",
+		Velocity:    0.6,
+		Returns:     true,
+		Frames: repeat(2,
+			GestureFrame{Offset: [5]int{0, 0, 0, 0, -15}},
+			GestureFrame{Offset: [5]int{0, 0, 0, 0, 10}},
+		),
+	},
+	"shake": {
+		Name:        "shake",
+		Description: "shake no, turning the base left and right",
+		Velocity:    0.6,
+		Returns:     true,
+		Frames: repeat(2,
+			GestureFrame{Offset: [5]int{20, 0, 0, 0, 0}},
+			GestureFrame{Offset: [5]int{-20, 0, 0, 0, 0}},
+		),
+	},
+	"look-around": {
+		Name:        "look-around",
+		Description: "look left, right and down, pausing at each",
+		Velocity:    0.4,
+		Returns:     true,
+		Frames: []GestureFrame{
+			{Offset: [5]int{40, 0, 0, 0, 10}, Hold: 600 * time.Millisecond},
+			{Offset: [5]int{-40, 0, 0, 0, 10}, Hold: 600 * time.Millisecond},
+			{Offset: [5]int{0, 0, 0, 0, -15}, Hold: 400 * time.Millisecond},
+		},
+	},
+	"happy": {
+		Name:        "happy",
+		Description: "a quick happy wiggle of the base and wrist",
+		Velocity:    1,
+		Returns:     true,
+		Frames: repeat(3,
+			GestureFrame{Offset: [5]int{10, 0, 0, 0, 10}},
+			GestureFrame{Offset: [5]int{-10, 0, 0, 0, -10}},
+		),
+	},
+	"wave": {
+		Name:        "wave",
+		Description: "lift the arm and wave the base side to side",
+		Velocity:    0.6,
+		Returns:     true,
+		Frames: append(
+			[]GestureFrame{{Offset: [5]int{0, 20, 0, 0, 10}}},
+			repeat(3,
+				GestureFrame{Offset: [5]int{15, 20, 0, 0, 10}},
+				GestureFrame{Offset: [5]int{-15, 20, 0, 0, 10}},
+			)...,
+		),
+	},
+	"sleep": {
+		Name:        "sleep",
+		Description: "slowly slump down, camera drooping, and stay there",
+		Velocity:    0.2,
+		Returns:     false,
+		Frames: []GestureFrame{
+			{Offset: [5]int{0, -20, 0, 0, -20}, Hold: 300 * time.Millisecond},
+			{Offset: [5]int{0, -30, 0, 0, -45}},
+		},
+	},
+}
+
+// maxTempo is the fastest g can be played: its moves can't go faster than the
+// joints' max velocity, and its pauses can't shrink more than MaxGestureTempo.
+func (g Gesture) maxTempo() float64 {
+	return math.Min(MaxGestureTempo, 1/g.Velocity)
+}
+
+// check fills in the defaults of params and checks they suit g.
+func (g Gesture) check(params GestureParams) (GestureParams, error) {
+	params, err := params.withDefaults()
+	if err != nil {
+		return params, err
+	}
+	if params.Tempo > g.maxTempo() {
+		return params, fmt.Errorf("%w: %v can be played at tempo %.2f at most, not %v", ErrInvalidGestureParams, g.Name, g.maxTempo(), params.Tempo)
+	}
+	return params, nil
+}
+
+// Gestures lists every gesture, sorted by name.
+func Gestures() []Gesture {
+	list := make([]Gesture, 0, len(gestures))
+	for _, gesture := range gestures {
+		gesture.MaxTempo = gesture.maxTempo()
+		list = append(list, gesture)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// LookupGesture finds a gesture by name.
+func LookupGesture(name string) (Gesture, error) {
+	gesture, ok := gestures[name]
+	if !ok {
+		return Gesture{}, ErrGestureNotFound
+	}
+	gesture.MaxTempo = gesture.maxTempo()
+	return gesture, nil
+}
+
+// targets works out the joint angles of every frame when played from origin.
+func (g Gesture) targets(origin [5]int, amplitude float64, cal ArmCalibration) [][5]int {
+	var targets [][5]int
+	for _, frame := range g.Frames {
+		var angles [5]int
+		for i, offset := range frame.Offset {
+			angles[i] = clampJoint(cal.Joints[i], origin[i]+int(math.Round(float64(offset)*amplitude)))
+		}
+		targets = append(targets, angles)
+	}
+	if g.Returns {
+		targets = append(targets, origin)
+	}
+	return targets
+}
+
+// Play returns a motion command that performs the gesture from wherever the arm is.
+func (g Gesture) Play(params GestureParams) MotionCommand {
+	return func(ctx context.Context, a *Arm) error {
+		params, err := g.check(params)
+		if err != nil {
+			return err
+		}
+		log.Printf("Gesture %v, amplitude %v tempo %v", g.Name, params.Amplitude, params.Tempo)
+
+		// Gestures set their own pace, whatever the last move's speed was,
+		// and leave it as it was for the jobs after them
+		defer a.SetSpeed(a.speed)
+		a.SetSpeed(0)
+		// check keeps this at most 1, the min only absorbs rounding
+		velocity := math.Min(1, g.Velocity*params.Tempo)
+
+		targets := g.targets(a.driver.CurrentAngles(), params.Amplitude, a.Calibration())
+		for n, angles := range targets {
+			if err := a.move(ctx, angles, velocity); err != nil {
+				return fmt.Errorf("gesture %v: %w", g.Name, err)
+			}
+			if n >= len(g.Frames) || g.Frames[n].Hold == 0 {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(float64(g.Frames[n].Hold) / params.Tempo)):
+			}
+		}
+		return nil
+	}
+}
+
+// Gesture performs a gesture by name, see Gesture.Play.
+func (a *Arm) Gesture(ctx context.Context, name string, params GestureParams) error {
+	gesture, err := LookupGesture(name)
+	if err != nil {
+		return err
+	}
+	return gesture.Play(params)(ctx, a)
+}
@@ -0,0 +1,105 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGesture_Targets(t *testing.T) {
+	cal := DefaultArmCalibration()
+	nod, _ := LookupGesture("nod")
+
+	origin := [5]int{90, 30, 30, 130, 130}
+	targets := nod.targets(origin, 2, cal)
+	if len(targets) != len(nod.Frames)+1 {
+		t.Fatalf("nod has %d targets, want a frame each and the way back", len(targets))
+	}
+	if targets[0] != [5]int{90, 30, 30, 130, 100} {
+		t.Errorf("first target at amplitude 2 = %v, want the wrist 30 down", targets[0])
+	}
+	if targets[len(targets)-1] != origin {
+		t.Errorf("nod ended at %v, want back at %v", targets[len(targets)-1], origin)
+	}
+
+	// Near the end of the wrist's travel the nod is cut short on that side
+	origin = [5]int{90, 30, 30, 130, 175}
+	for _, angles := range nod.targets(origin, 1, cal) {
+		if angles[4] > 180 {
+			t.Errorf("wrist target %v is past its limit", angles[4])
+		}
+	}
+
+	sleep, _ := LookupGesture("sleep")
+	targets = sleep.targets([5]int{90, 30, 30, 130, 130}, 1, cal)
+	if last := targets[len(targets)-1]; last != [5]int{90, 0, 30, 130, 85} {
+		t.Errorf("sleep ended at %v, want slumped at [90 0 30 130 85]", last)
+	}
+}
+
+func TestGesture_Play(t *testing.T) {
+	arm, _ := newTestArm(t)
+	origin := [5]int{90, 30, 30, 130, 130}
+	if err := arm.MoveToJoints(context.Background(), origin); err != nil {
+		t.Fatal(err)
+	}
+
+	shake, _ := LookupGesture("shake")
+	if err := arm.Gesture(context.Background(), "shake", GestureParams{Tempo: shake.MaxTempo}); err != nil {
+		t.Fatal(err)
+	}
+	if arm.driver.CurrentAngles() != origin {
+		t.Errorf("arm ended at %v, want back at %v", arm.driver.CurrentAngles(), origin)
+	}
+
+	// Faster than its moves can go
+	if err := arm.Gesture(context.Background(), "shake", GestureParams{Tempo: shake.MaxTempo + 0.1}); !errors.Is(err, ErrInvalidGestureParams) {
+		t.Errorf("shake too fast returned %v, want ErrInvalidGestureParams", err)
+	}
+	if arm.driver.CurrentAngles() != origin {
+		t.Errorf("a shake too fast moved the arm to %v", arm.driver.CurrentAngles())
+	}
+
+	if err := arm.Gesture(context.Background(), "dance", GestureParams{}); !errors.Is(err, ErrGestureNotFound) {
+		t.Errorf("unknown gesture returned %v, want ErrGestureNotFound", err)
+	}
+}
+
+func TestGestureParams(t *testing.T) {
+	params, err := GestureParams{}.withDefaults()
+	if err != nil || params.Amplitude != 1 || params.Tempo != 1 {
+		t.Errorf("zero params = %+v %v, want amplitude and tempo 1", params, err)
+	}
+	for _, bad := range []GestureParams{{Amplitude: 3}, {Amplitude: -1}, {Tempo: 0.1}, {Tempo: 5}} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidGestureParams) {
+			t.Errorf("%+v returned %v, want ErrInvalidGestureParams", bad, err)
+		}
+	}
+}
+
+func TestGesture_MaxTempo(t *testing.T) {
+	for _, gesture := range Gestures() {
+		if gesture.MaxTempo < 1 || gesture.MaxTempo > MaxGestureTempo || gesture.Velocity*gesture.MaxTempo > 1+1e-9 {
+			t.Errorf("%v max tempo = %v at velocity %v", gesture.Name, gesture.MaxTempo, gesture.Velocity)
+		}
+	}
+	happy, _ := LookupGesture("happy")
+	if _, err := happy.check(GestureParams{Tempo: 2}); !errors.Is(err, ErrInvalidGestureParams) {
+		t.Errorf("happy at tempo 2 returned %v, want ErrInvalidGestureParams", err)
+	}
+	sleep, _ := LookupGesture("sleep")
+	if params, err := sleep.check(GestureParams{Tempo: MaxGestureTempo}); err != nil || params.Amplitude != 1 {
+		t.Errorf("sleep at tempo %v = %+v, %v", MaxGestureTempo, params, err)
+	}
+}
+
+func TestGesture_KeepsSpeed(t *testing.T) {
+	arm, _ := newTestArm(t)
+	arm.SetSpeed(20)
+	if err := arm.Gesture(context.Background(), "nod", GestureParams{}); err != nil {
+		t.Fatal(err)
+	}
+	if arm.speed != 20 {
+		t.Errorf("speed after a gesture = %v, want it left at 20", arm.speed)
+	}
+}
@@ -0,0 +1,233 @@
+package robot
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+	Kinematic model of the arm
+
+	The origin is on the table, directly under the base servo's axis of rotation.
+	x points straight ahead of the robot (base servo at 90 degrees),
+	y points to the robot's left and z points up. Lengths are in cm.
+
+	The base servo yaws the whole arm, 90 degrees is straight ahead and larger
+	angles turn the arm to the left.
+
+	The other four joints pitch the arm in the vertical plane the base points it at.
+	Working from the shoulder out, the elevation of each link above horizontal is
+
+	  L1:     joint1
+	  L2:     joint1 - joint2
+	  L3:     joint1 - joint2 + (180 - joint3)
+	  camera: joint1 - joint2 + (180 - joint3) - (180 - joint4)
+
+	so with joint1 == joint2 and joint3 == joint4 == 180 - joint1 the two long links
+	rise together while the middle link and the camera stay level with the ground.
+
+	Inverse kinematics has one joint more than it needs, so it picks the elevation
+	of the middle link (L2), as close to level as it can get away with. That leaves
+	a two link problem for L1 and L3 once the camera link and L2 are taken off the
+	target, which has two answers: the elbow between L1 and L3 either above or
+	below the line from the shoulder to the wrist. ElbowConfig picks between them.
+*/
+
+// Pose is where the camera on the end of the arm is and where it is looking.
+type Pose struct {
+	X     float64 `json:"x"`     // cm ahead of the base
+	Y     float64 `json:"y"`     // cm to the left of the base
+	Z     float64 `json:"z"`     // cm above the table
+	Pitch float64 `json:"pitch"` // camera pitch in degrees, 0 is level and positive is looking up
+	Yaw   float64 `json:"yaw"`   // camera yaw in degrees, 0 is straight ahead and positive is to the left
+}
+
+func degToRad(deg float64) float64 { return deg * math.Pi / 180.0 }
+func radToDeg(rad float64) float64 { return rad * 180.0 / math.Pi }
+
+// linkElevations returns the elevation in degrees of L1, L2, L3 and the camera for a set of joint angles
+func linkElevations(angles [5]int) [4]float64 {
+	e1 := float64(angles[JOINT_1_SERVO])
+	e2 := e1 - float64(angles[JOINT_2_SERVO])
+	e3 := e2 + (180 - float64(angles[JOINT_3_SERVO]))
+	e4 := e3 - (180 - float64(angles[JOINT_4_SERVO]))
+	return [4]float64{e1, e2, e3, e4}
+}
+
+// ForwardKinematics computes the camera pose for the given joint angles.
+func (a *Arm) ForwardKinematics(angles [5]int) Pose {
+
+	elevations := linkElevations(angles)
+	lengths := [4]float64{a.L1, a.L2, a.L3, a.L4}
+
+	// Walk the chain in the arm's vertical plane
+	reach, height := 0.0, a.L0
+	for i, length := range lengths {
+		reach += length * math.Cos(degToRad(elevations[i]))
+		height += length * math.Sin(degToRad(elevations[i]))
+	}
+
+	// Then swing that plane around the base
+	yaw := float64(angles[BASE_SERVO]) - 90
+	return Pose{
+		X:     reach * math.Cos(degToRad(yaw)),
+		Y:     reach * math.Sin(degToRad(yaw)),
+		Z:     height,
+		Pitch: elevations[3],
+		Yaw:   yaw,
+	}
+}
+
+// Pose returns where the camera currently is, based on the last angles written to the servos.
+func (a *Arm) Pose() Pose {
+	return a.ForwardKinematics(a.driver.CurrentAngles())
+}
+
+// ElbowConfig picks which of the two inverse kinematics solutions to use.
+type ElbowConfig int
+
+const (
+	ElbowAuto ElbowConfig = iota // Elbow up if it can be reached that way, elbow down otherwise
+	ElbowUp                      // The L1/L3 elbow sits above the shoulder to wrist line
+	ElbowDown                    // The L1/L3 elbow sits below the shoulder to wrist line
+)
+
+func (e ElbowConfig) String() string {
+	switch e {
+	case ElbowUp:
+		return "up"
+	case ElbowDown:
+		return "down"
+	}
+	return "auto"
+}
+
+// ParseElbowConfig turns "auto", "up" or "down" into an ElbowConfig, an empty string is ElbowAuto.
+func ParseElbowConfig(s string) (ElbowConfig, error) {
+	switch s {
+	case "", "auto":
+		return ElbowAuto, nil
+	case "up":
+		return ElbowUp, nil
+	case "down":
+		return ElbowDown, nil
+	}
+	return ElbowAuto, fmt.Errorf("unknown elbow configuration %q, want auto, up or down", s)
+}
+
+// UnreachableError is returned when the arm can not put the camera where it was asked to.
+type UnreachableError struct {
+	Target Pose
+	Reason string
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("target (%.2f, %.2f, %.2f) pitch %.2f is unreachable: %s",
+		e.Target.X, e.Target.Y, e.Target.Z, e.Target.Pitch, e.Reason)
+}
+
+// maxMiddleLinkTilt is how far from level InverseKinematics will tilt L2 looking for a solution
+const maxMiddleLinkTilt = 90
+
+/*
+InverseKinematics solves for the joint angles that put the camera at target.X, Y, Z
+looking at target.Pitch. target.Yaw is ignored, the base always turns to face (x, y).
+*/
+func (a *Arm) InverseKinematics(target Pose, elbow ElbowConfig) ([5]int, error) {
+
+	if elbow == ElbowAuto {
+		angles, err := a.InverseKinematics(target, ElbowUp)
+		if err == nil {
+			return angles, nil
+		}
+		if angles, downErr := a.InverseKinematics(target, ElbowDown); downErr == nil {
+			return angles, nil
+		}
+		return angles, err
+	}
+
+	// Base yaw comes straight from (x, y). Directly above the base any yaw
+	// will do, so keep the base where it is.
+	reach := math.Hypot(target.X, target.Y)
+	yaw := 0.0
+	if reach > 1e-9 {
+		yaw = radToDeg(math.Atan2(target.Y, target.X))
+	} else if a.driver != nil {
+		yaw = float64(a.driver.CurrentAngles()[BASE_SERVO]) - 90
+	}
+	cal := a.Calibration()
+	base := int(math.Round(90 + yaw))
+	if joint := cal.Joints[BASE_SERVO]; !joint.Allows(base) {
+		return [5]int{}, &UnreachableError{Target: target, Reason: fmt.Sprintf("base would need %d degrees (%d-%d)", base, joint.MinAngle, joint.MaxAngle)}
+	}
+
+	// Take the camera link off the target to find the wrist, relative to the shoulder
+	pitch := degToRad(target.Pitch)
+	wristR := reach - a.L4*math.Cos(pitch)
+	wristZ := target.Z - a.L4*math.Sin(pitch) - a.L0
+
+	// Try L2 level first, then tilt it a degree at a time either way
+	reason := ""
+	for tilt := 0; tilt <= maxMiddleLinkTilt; tilt++ {
+		for _, e2 := range []int{-tilt, tilt} {
+			joints, err := a.solvePlanar(wristR, wristZ, target.Pitch, float64(e2), elbow, cal)
+			if err == nil {
+				return [5]int{base, joints[0], joints[1], joints[2], joints[3]}, nil
+			}
+			if reason == "" {
+				// Report why the level solution failed, it is the one people expect
+				reason = err.Error()
+			}
+			if tilt == 0 {
+				break
+			}
+		}
+	}
+
+	return [5]int{}, &UnreachableError{Target: target, Reason: reason}
+}
+
+/*
+solvePlanar solves joints 1-4 in the arm's vertical plane for a wrist at (r, z) from the shoulder,
+with the middle link at elevation e2 and the camera at pitch, all in degrees.
+*/
+func (a *Arm) solvePlanar(r, z, pitch, e2 float64, elbow ElbowConfig, cal ArmCalibration) ([4]int, error) {
+
+	// Take the middle link off to find the end of L3 ...
+	r -= a.L2 * math.Cos(degToRad(e2))
+	z -= a.L2 * math.Sin(degToRad(e2))
+
+	// ... which leaves a two link arm, L1 and L3, from the shoulder
+	d := math.Hypot(r, z)
+	if d > a.L1+a.L3 {
+		return [4]int{}, fmt.Errorf("%.2fcm out of reach", d-(a.L1+a.L3))
+	}
+	if d < math.Abs(a.L1-a.L3) {
+		return [4]int{}, fmt.Errorf("too close to the shoulder")
+	}
+
+	cosBend := (d*d - a.L1*a.L1 - a.L3*a.L3) / (2 * a.L1 * a.L3)
+	bend := math.Acos(math.Max(-1, math.Min(1, cosBend))) // e3 - e1
+	if elbow == ElbowUp {
+		bend = -bend
+	}
+	e1 := radToDeg(math.Atan2(z, r) - math.Atan2(a.L3*math.Sin(bend), a.L1+a.L3*math.Cos(bend)))
+	e3 := e1 + radToDeg(bend)
+
+	joints := [4]float64{
+		e1,                 // JOINT_1_SERVO, L1 elevation
+		e1 - e2,            // JOINT_2_SERVO, L2 relative to L1
+		180 - (e3 - e2),    // JOINT_3_SERVO, L3 relative to L2
+		180 - (e3 - pitch), // JOINT_4_SERVO, camera relative to L3
+	}
+
+	var angles [4]int
+	for i, joint := range joints {
+		angle := int(math.Round(joint))
+		if limits := cal.Joints[i+1]; !limits.Allows(angle) {
+			return [4]int{}, fmt.Errorf("joint %d would need %d degrees (%d-%d)", i+1, angle, limits.MinAngle, limits.MaxAngle)
+		}
+		angles[i] = angle
+	}
+	return angles, nil
+}
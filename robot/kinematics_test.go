@@ -0,0 +1,204 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+const poseTolerance = 1e-6
+
+func closeTo(a, b float64) bool { return math.Abs(a-b) < poseTolerance }
+
+func TestForwardKinematics(t *testing.T) {
+	arm := &Arm{L0: 3.0, L1: 10.3, L2: 2.8, L3: 10.3, L4: 2.3}
+	reach := arm.L1 + arm.L2 + arm.L3 + arm.L4
+	rise := 2 * arm.L1 * math.Sin(degToRad(30))
+
+	tests := []struct {
+		name   string
+		angles [5]int
+		want   Pose
+	}{
+		{
+			name:   "stretched out straight ahead",
+			angles: [5]int{90, 0, 0, 180, 180},
+			want:   Pose{X: reach, Y: 0, Z: arm.L0, Pitch: 0, Yaw: 0},
+		},
+		{
+			name:   "stretched out to the left",
+			angles: [5]int{180, 0, 0, 180, 180},
+			want:   Pose{X: 0, Y: reach, Z: arm.L0, Pitch: 0, Yaw: 90},
+		},
+		{
+			name:   "raised with a level camera",
+			angles: [5]int{90, 30, 30, 150, 150},
+			want: Pose{
+				X:     2*arm.L1*math.Cos(degToRad(30)) + arm.L2 + arm.L4,
+				Z:     arm.L0 + rise,
+				Pitch: 0,
+			},
+		},
+		{
+			name:   "shoulder straight up",
+			angles: [5]int{90, 90, 90, 180, 180},
+			want:   Pose{X: arm.L2 + arm.L3 + arm.L4, Z: arm.L0 + arm.L1},
+		},
+		{
+			name:   "camera tilted down",
+			angles: [5]int{90, 0, 0, 180, 150},
+			want: Pose{
+				X:     arm.L1 + arm.L2 + arm.L3 + arm.L4*math.Cos(degToRad(-30)),
+				Z:     arm.L0 + arm.L4*math.Sin(degToRad(-30)),
+				Pitch: -30,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := arm.ForwardKinematics(tt.angles)
+			if !closeTo(got.X, tt.want.X) || !closeTo(got.Y, tt.want.Y) || !closeTo(got.Z, tt.want.Z) ||
+				!closeTo(got.Pitch, tt.want.Pitch) || !closeTo(got.Yaw, tt.want.Yaw) {
+				t.Errorf("ForwardKinematics(%v) = %+v, want %+v", tt.angles, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArmPose_FollowsServos(t *testing.T) {
+	arm, _ := newTestArm(t)
+
+	if got, want := arm.Pose(), arm.ForwardKinematics([5]int{90, 0, 0, 180, 180}); got != want {
+		t.Errorf("initial Pose() = %+v, want %+v", got, want)
+	}
+
+	if err := arm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := arm.Pose(), arm.ForwardKinematics([5]int{90, 30, 30, 130, 130}); got != want {
+		t.Errorf("Pose() after Start = %+v, want %+v", got, want)
+	}
+}
+
+func TestInverseKinematics_RoundTrip(t *testing.T) {
+	arm := &Arm{L0: 3.0, L1: 10.3, L2: 2.8, L3: 10.3, L4: 2.3}
+
+	targets := []Pose{
+		{X: 20, Y: 0, Z: 10},
+		{X: 10, Y: 10, Z: 12},
+		{X: 0, Y: 20, Z: 8},
+		{X: 5, Y: -12, Z: 15},
+		{X: 18, Y: 2, Z: 10, Pitch: 20},
+		{X: 16, Y: 0, Z: 14, Pitch: -30},
+	}
+
+	for _, elbow := range []ElbowConfig{ElbowAuto, ElbowUp, ElbowDown} {
+		for _, target := range targets {
+			angles, err := arm.InverseKinematics(target, elbow)
+			if err != nil {
+				var unreachable *UnreachableError
+				if errors.As(err, &unreachable) && elbow != ElbowAuto {
+					// Not every target can be reached with both elbows inside the joint limits
+					continue
+				}
+				t.Errorf("InverseKinematics(%+v, %v) returned error: %v", target, elbow, err)
+				continue
+			}
+
+			// Angles are rounded to whole degrees, so allow a few mm
+			got := arm.ForwardKinematics(angles)
+			if math.Abs(got.X-target.X) > 0.5 || math.Abs(got.Y-target.Y) > 0.5 || math.Abs(got.Z-target.Z) > 0.5 ||
+				math.Abs(got.Pitch-target.Pitch) > 1 {
+				t.Errorf("InverseKinematics(%+v, %v) = %v which puts the camera at %+v", target, elbow, angles, got)
+			}
+		}
+	}
+}
+
+func TestInverseKinematics_BaseYaw(t *testing.T) {
+	arm := &Arm{L0: 3.0, L1: 10.3, L2: 2.8, L3: 10.3, L4: 2.3}
+
+	tests := []struct {
+		x, y float64
+		base int
+	}{
+		{20, 0, 90},
+		{0, 20, 180},
+		{0, -20, 0},
+		{14, 14, 135},
+	}
+
+	for _, tt := range tests {
+		angles, err := arm.InverseKinematics(Pose{X: tt.x, Y: tt.y, Z: 8}, ElbowAuto)
+		if err != nil {
+			t.Errorf("InverseKinematics(%v, %v) returned error: %v", tt.x, tt.y, err)
+			continue
+		}
+		if angles[BASE_SERVO] != tt.base {
+			t.Errorf("InverseKinematics(%v, %v) base = %d, want %d", tt.x, tt.y, angles[BASE_SERVO], tt.base)
+		}
+	}
+}
+
+func TestInverseKinematics_ElbowConfigs(t *testing.T) {
+	arm := &Arm{L0: 3.0, L1: 10.3, L2: 2.8, L3: 10.3, L4: 2.3}
+	target := Pose{X: 14, Y: 0, Z: 14}
+
+	up, err := arm.InverseKinematics(target, ElbowUp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := arm.InverseKinematics(target, ElbowDown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if up[JOINT_1_SERVO] <= down[JOINT_1_SERVO] {
+		t.Errorf("elbow up shoulder %d should be above elbow down shoulder %d", up[JOINT_1_SERVO], down[JOINT_1_SERVO])
+	}
+}
+
+func TestInverseKinematics_Unreachable(t *testing.T) {
+	arm := &Arm{L0: 3.0, L1: 10.3, L2: 2.8, L3: 10.3, L4: 2.3}
+
+	targets := []Pose{
+		{X: 100, Y: 0, Z: 10},  // too far
+		{X: -20, Y: 0, Z: 10},  // behind the robot
+		{X: 20, Y: 0, Z: -100}, // through the table
+	}
+
+	for _, target := range targets {
+		_, err := arm.InverseKinematics(target, ElbowAuto)
+		var unreachable *UnreachableError
+		if !errors.As(err, &unreachable) {
+			t.Errorf("InverseKinematics(%+v) error = %v, want an UnreachableError", target, err)
+		}
+	}
+}
+
+func TestMoveToTarget(t *testing.T) {
+	arm, _ := newTestArm(t)
+
+	if err := arm.MoveToTarget(context.Background(), 15, 5, 12); err != nil {
+		t.Fatalf("MoveToTarget returned error: %v", err)
+	}
+
+	pose := arm.Pose()
+	if math.Abs(pose.X-15) > 0.5 || math.Abs(pose.Y-5) > 0.5 || math.Abs(pose.Z-12) > 0.5 {
+		t.Errorf("after MoveToTarget(15, 5, 12) the camera is at %+v", pose)
+	}
+}
+
+func TestParseElbowConfig(t *testing.T) {
+	for s, want := range map[string]ElbowConfig{"": ElbowAuto, "auto": ElbowAuto, "up": ElbowUp, "down": ElbowDown} {
+		got, err := ParseElbowConfig(s)
+		if err != nil || got != want {
+			t.Errorf("ParseElbowConfig(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseElbowConfig("sideways"); err == nil {
+		t.Error("ParseElbowConfig(sideways) should return an error")
+	}
+}
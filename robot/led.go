@@ -2,6 +2,7 @@ package robot
 
 import (
 	"log"
+	"sync"
 
 	"github.com/warthog618/go-gpiocdev"
 )
@@ -10,7 +11,15 @@ type Leds struct {
 	chip *gpiocdev.Chip
 }
 
-func NewLedLine(pin int, label string) (*gpiocdev.Line, error) {
+// LedLine is an output line driving one of our status LEDs.
+// *gpiocdev.Line satisfies it on the Pi, simLed stands in for it in simulation.
+type LedLine interface {
+	SetValue(value int) error
+	Value() (int, error)
+	Close() error
+}
+
+func NewLedLine(pin int, label string) (LedLine, error) {
 
 	// Set the gpio pin to output low for now
 	// I'm just assuming that I'll never need a different chip
@@ -22,3 +31,30 @@ func NewLedLine(pin int, label string) (*gpiocdev.Line, error) {
 	}
 	return line, nil
 }
+
+/* simLed is a virtual LED that just remembers its value */
+type simLed struct {
+	mux   sync.Mutex
+	label string
+	value int
+}
+
+func NewSimLedLine(pin int, label string) (LedLine, error) {
+	log.Printf("SIM: %v on pin %d is virtual", label, pin)
+	return &simLed{label: label}, nil
+}
+
+func (l *simLed) SetValue(value int) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.value = value
+	return nil
+}
+
+func (l *simLed) Value() (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.value, nil
+}
+
+func (l *simLed) Close() error { return nil }
@@ -0,0 +1,586 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Markers
+
+	While it is on, the marker detector looks at a frame at most every
+	interval, in the background, for fiducials: ArUco markers, which carry a
+	number, and QR codes, which carry text.
+
+	Each marker found has the direction it is in, the yaw and pitch the camera
+	would turn through to face it, from the camera's calibration or, without
+	one, its field of view. With a calibration for the camera at the frame's
+	resolution, see camera_calibration.go, and the printed size of the
+	markers, it also has its pose: where it is in front of the camera, in mm
+	with x right, y down and z straight ahead, and how it is turned. With the
+	arm's pose that gives where it is on the bench, see locateMarkers.
+
+	When the markers in view change a markers_changed event is published.
+*/
+
+// Kinds of marker
+const (
+	MarkerArUco = "aruco"
+	MarkerQR    = "qr"
+)
+
+// Marker detector defaults, each can be overridden with GIZMATRON_MARKER* env vars or the API
+const (
+	DefaultMarkerDictionary = "4x4_50"
+	DefaultMarkerSize       = 50.0 // mm, the side of the black square
+	DefaultMarkerInterval   = 200 * time.Millisecond
+
+	markerQRMargin = 0.15 // of a QR code's size, kept around it when it's cut out to be decoded
+)
+
+// The ArUco dictionaries markers can be from, by name
+var markerDictionaries = map[string]gocv.ArucoDictionaryCode{
+	"4x4_50":         gocv.ArucoDict4x4_50,
+	"4x4_100":        gocv.ArucoDict4x4_100,
+	"4x4_250":        gocv.ArucoDict4x4_250,
+	"4x4_1000":       gocv.ArucoDict4x4_1000,
+	"5x5_50":         gocv.ArucoDict5x5_50,
+	"5x5_100":        gocv.ArucoDict5x5_100,
+	"5x5_250":        gocv.ArucoDict5x5_250,
+	"5x5_1000":       gocv.ArucoDict5x5_1000,
+	"6x6_50":         gocv.ArucoDict6x6_50,
+	"6x6_100":        gocv.ArucoDict6x6_100,
+	"6x6_250":        gocv.ArucoDict6x6_250,
+	"6x6_1000":       gocv.ArucoDict6x6_1000,
+	"7x7_50":         gocv.ArucoDict7x7_50,
+	"7x7_100":        gocv.ArucoDict7x7_100,
+	"7x7_250":        gocv.ArucoDict7x7_250,
+	"7x7_1000":       gocv.ArucoDict7x7_1000,
+	"original":       gocv.ArucoDictArucoOriginal,
+	"apriltag_16h5":  gocv.ArucoDictAprilTag_16h5,
+	"apriltag_25h9":  gocv.ArucoDictAprilTag_25h9,
+	"apriltag_36h10": gocv.ArucoDictAprilTag_36h10,
+	"apriltag_36h11": gocv.ArucoDictAprilTag_36h11,
+}
+
+var ErrInvalidMarkerConfig = errors.New("invalid marker config")
+
+// MarkerConfig sets up the marker detector. Zero values mean the defaults.
+type MarkerConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Kinds      []string `json:"kinds"`       // aruco and qr, both when empty
+	Dictionary string   `json:"dictionary"`  // the ArUco markers' dictionary, e.g. 4x4_50 or apriltag_36h11
+	SizeMm     float64  `json:"size_mm"`     // side of the printed ArUco markers, for their pose
+	QRSizeMm   float64  `json:"qr_size_mm"`  // side of the printed QR codes, 0 for no pose
+	IntervalMs int      `json:"interval_ms"` // look at a frame at most this often
+	Overlay    bool     `json:"overlay"`     // draw the markers into the stream
+}
+
+// withDefaults fills in zero values and checks the ranges.
+func (c MarkerConfig) withDefaults() (MarkerConfig, error) {
+	if len(c.Kinds) == 0 {
+		c.Kinds = []string{MarkerArUco, MarkerQR}
+	}
+	if c.Dictionary == "" {
+		c.Dictionary = DefaultMarkerDictionary
+	}
+	if c.SizeMm == 0 {
+		c.SizeMm = DefaultMarkerSize
+	}
+	if c.IntervalMs == 0 {
+		c.IntervalMs = int(DefaultMarkerInterval.Milliseconds())
+	}
+	for _, kind := range c.Kinds {
+		if kind != MarkerArUco && kind != MarkerQR {
+			return c, fmt.Errorf("%w: unknown kind %q, want aruco or qr", ErrInvalidMarkerConfig, kind)
+		}
+	}
+	if _, ok := markerDictionaries[c.Dictionary]; !ok {
+		return c, fmt.Errorf("%w: unknown dictionary %q", ErrInvalidMarkerConfig, c.Dictionary)
+	}
+	if c.SizeMm < 0 || c.QRSizeMm < 0 {
+		return c, fmt.Errorf("%w: sizes must be positive", ErrInvalidMarkerConfig)
+	}
+	if c.IntervalMs < 0 {
+		return c, fmt.Errorf("%w: interval %vms must be positive", ErrInvalidMarkerConfig, c.IntervalMs)
+	}
+	return c, nil
+}
+
+func (c MarkerConfig) interval() time.Duration {
+	return time.Duration(c.IntervalMs) * time.Millisecond
+}
+
+func (c MarkerConfig) wants(kind string) bool {
+	for _, k := range c.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// loadMarkerConfig loads the marker detector config from GIZMATRON_MARKER* env vars
+func loadMarkerConfig() MarkerConfig {
+	config := MarkerConfig{
+		Dictionary: DefaultMarkerDictionary,
+		SizeMm:     DefaultMarkerSize,
+		IntervalMs: int(DefaultMarkerInterval.Milliseconds()),
+	}
+	if enabled := os.Getenv("GIZMATRON_MARKERS"); enabled != "" {
+		if e, err := strconv.ParseBool(enabled); err == nil {
+			config.Enabled = e
+		} else {
+			log.Printf("Warning!! GIZMATRON_MARKERS %q is not true or false, marker detection is off", enabled)
+		}
+	}
+	if dictionary := os.Getenv("GIZMATRON_MARKER_DICTIONARY"); dictionary != "" {
+		if _, ok := markerDictionaries[dictionary]; ok {
+			config.Dictionary = dictionary
+		} else {
+			log.Printf("Warning!! GIZMATRON_MARKER_DICTIONARY %q is not an ArUco dictionary, using %v", dictionary, config.Dictionary)
+		}
+	}
+	if size := os.Getenv("GIZMATRON_MARKER_SIZE_MM"); size != "" {
+		if s, err := strconv.ParseFloat(size, 64); err == nil && s > 0 {
+			config.SizeMm = s
+		} else {
+			log.Printf("Warning!! GIZMATRON_MARKER_SIZE_MM %q is not a positive number of mm, using %v", size, config.SizeMm)
+		}
+	}
+	if size := os.Getenv("GIZMATRON_MARKER_QR_SIZE_MM"); size != "" {
+		if s, err := strconv.ParseFloat(size, 64); err == nil && s >= 0 {
+			config.QRSizeMm = s
+		} else {
+			log.Printf("Warning!! GIZMATRON_MARKER_QR_SIZE_MM %q is not a number of mm, using %v", size, config.QRSizeMm)
+		}
+	}
+	if interval := os.Getenv("GIZMATRON_MARKER_INTERVAL_MS"); interval != "" {
+		if ms, err := strconv.Atoi(interval); err == nil && ms > 0 {
+			config.IntervalMs = ms
+		} else {
+			log.Printf("Warning!! GIZMATRON_MARKER_INTERVAL_MS %q is not a positive number of ms, using %v", interval, config.IntervalMs)
+		}
+	}
+	if overlay := os.Getenv("GIZMATRON_MARKER_OVERLAY"); overlay != "" {
+		if o, err := strconv.ParseBool(overlay); err == nil {
+			config.Overlay = o
+		} else {
+			log.Printf("Warning!! GIZMATRON_MARKER_OVERLAY %q is not true or false, using %v", overlay, config.Overlay)
+		}
+	}
+	return config
+}
+
+// Bearing is how far the camera would turn to face something, in degrees, the same way round as a Pose.
+type Bearing struct {
+	Yaw   float64 `json:"yaw"`   // positive is to the left
+	Pitch float64 `json:"pitch"` // positive is up
+}
+
+// MarkerPose is where a marker is in front of the camera.
+type MarkerPose struct {
+	Translation [3]float64 `json:"translation"` // mm, x right, y down and z ahead of the camera
+	Rotation    [3]float64 `json:"rotation"`    // turns the marker's axes (x right, y up, z out of its face) into the camera's, an axis scaled by the angle in radians
+	Distance    float64    `json:"distance"`    // mm
+}
+
+// Position is a point in the robot's frame, in cm as a Pose is.
+type Position struct {
+	X float64 `json:"x"` // ahead of the base
+	Y float64 `json:"y"` // to the left of the base
+	Z float64 `json:"z"` // above the table
+}
+
+// Marker is an ArUco marker or QR code found in a frame.
+type Marker struct {
+	Kind    string         `json:"kind"`              // aruco or qr
+	ID      int            `json:"id"`                // an ArUco marker's number
+	Payload string         `json:"payload,omitempty"` // a QR code's text
+	Corners [4]image.Point `json:"corners"`           // frame pixels, clockwise from the top left as printed
+	Centre  image.Point    `json:"centre"`
+	Bearing Bearing        `json:"bearing"`
+	Pose    *MarkerPose    `json:"pose,omitempty"`  // with a calibrated camera and the marker's size
+	World   *Position      `json:"world,omitempty"` // with the pose and the arm's, where it is relative to the base
+}
+
+// key tells markers apart: the same key in two frames is the same marker
+func (m Marker) key() string {
+	if m.Kind == MarkerQR {
+		return MarkerQR + ":" + m.Payload
+	}
+	return MarkerArUco + ":" + strconv.Itoa(m.ID)
+}
+
+// MarkerResult is what the marker detector found in one frame.
+type MarkerResult struct {
+	Markers    []Marker    `json:"markers"`
+	Frame      image.Point `json:"frame"`      // frame size
+	Calibrated bool        `json:"calibrated"` // the camera's calibration was used
+	At         time.Time   `json:"at"`
+	TookMs     int64       `json:"took_ms"`
+}
+
+// keys returns the distinct keys of the markers found, sorted
+func (r MarkerResult) keys() []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, marker := range r.Markers {
+		if key := marker.key(); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MarkerStatus is a snapshot of the marker detector.
+type MarkerStatus struct {
+	Config MarkerConfig  `json:"config"`
+	Last   *MarkerResult `json:"last,omitempty"`
+}
+
+// cameraView is what is known about the camera a frame came from
+type cameraView struct {
+	Intrinsics *CameraIntrinsics // nil when it isn't calibrated at the frame's resolution
+	HFOV, VFOV float64           // degrees
+}
+
+// MarkerDetector finds ArUco markers and QR codes in frames, in the background.
+type MarkerDetector struct {
+	mux     sync.Mutex
+	config  MarkerConfig
+	finder  *markerFinder // made the first time a frame is looked at
+	running *markerFinder // the finder looking at a frame, nil when none is
+	lastRun time.Time
+	last    *MarkerResult
+}
+
+// NewMarkerDetector makes a detector, it only looks at frames while config.Enabled.
+func NewMarkerDetector(config MarkerConfig) (*MarkerDetector, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &MarkerDetector{config: config}, nil
+}
+
+// Configure changes the detector's config.
+func (d *MarkerDetector) Configure(config MarkerConfig) (MarkerConfig, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return config, err
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	// A frame still being looked at closes the old finder when it's done, see Offer
+	if d.finder != nil && d.finder != d.running {
+		d.finder.Close()
+	}
+	d.config, d.finder, d.last = config, nil, nil
+	log.Printf("Marker detection: enabled %v, %v, dictionary %v, %vmm, every %vms", config.Enabled, config.Kinds, config.Dictionary, config.SizeMm, config.IntervalMs)
+	return config, nil
+}
+
+// Enabled reports whether the detector is looking at frames.
+func (d *MarkerDetector) Enabled() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.config.Enabled
+}
+
+// Offer hands the detector a frame seen through view. If it isn't busy and
+// it's been long enough since the last one, it looks at a copy of img in the
+// background and publishes a markers_changed event to events if the markers
+// in view have changed. It reports whether it took the frame.
+func (d *MarkerDetector) Offer(img gocv.Mat, view cameraView, events *EventBus) bool {
+	d.mux.Lock()
+	if !d.config.Enabled || d.running != nil || img.Empty() || time.Since(d.lastRun) < d.config.interval() {
+		d.mux.Unlock()
+		return false
+	}
+	if d.finder == nil {
+		d.finder = newMarkerFinder(d.config)
+	}
+	d.running, d.lastRun = d.finder, time.Now()
+	finder, config := d.finder, d.config
+	d.mux.Unlock()
+
+	frame := img.Clone()
+	go func() {
+		defer frame.Close()
+		start := time.Now()
+		size := image.Pt(frame.Cols(), frame.Rows())
+		markers := finder.find(frame, config)
+		for i := range markers {
+			markers[i].Centre = markerCentre(markers[i].Corners)
+			markers[i].Bearing = bearing(markers[i].Centre, size, view)
+			if side := markerSide(markers[i], config); side > 0 && view.Intrinsics != nil {
+				markers[i].Pose = solveMarkerPose(markers[i].Corners, side, *view.Intrinsics)
+			}
+		}
+		result := &MarkerResult{Markers: markers, Frame: size, Calibrated: view.Intrinsics != nil, At: start, TookMs: time.Since(start).Milliseconds()}
+
+		d.mux.Lock()
+		d.running = nil
+		if finder != d.finder {
+			// Configured again while this frame was being looked at
+			finder.Close()
+			d.mux.Unlock()
+			return
+		}
+		changed := d.last == nil && len(markers) > 0 || d.last != nil && !equalStrings(d.last.keys(), result.keys())
+		d.last = result
+		d.mux.Unlock()
+
+		if changed {
+			events.Publish(EventMarkersChanged, result)
+		}
+	}()
+	return true
+}
+
+// Overlay reports the markers to draw into the stream, if any.
+func (d *MarkerDetector) Overlay() []Marker {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if !d.config.Enabled || !d.config.Overlay || d.last == nil {
+		return nil
+	}
+	return d.last.Markers
+}
+
+// Status reports the detector's config and what it last found.
+func (d *MarkerDetector) Status() MarkerStatus {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	status := MarkerStatus{Config: d.config}
+	status.Config.Kinds = append([]string(nil), d.config.Kinds...)
+	if d.last != nil {
+		last := *d.last
+		last.Markers = append([]Marker(nil), d.last.Markers...)
+		status.Last = &last
+	}
+	return status
+}
+
+// markerSide is how big marker is printed, in mm, 0 when that isn't known
+func markerSide(marker Marker, config MarkerConfig) float64 {
+	if marker.Kind == MarkerQR {
+		return config.QRSizeMm
+	}
+	return config.SizeMm
+}
+
+func markerCentre(corners [4]image.Point) image.Point {
+	var centre image.Point
+	for _, c := range corners {
+		centre = centre.Add(c)
+	}
+	return centre.Div(len(corners))
+}
+
+// bearing is the direction of pixel p in a frame of the given size
+func bearing(p image.Point, frame image.Point, view cameraView) Bearing {
+	if view.Intrinsics != nil {
+		x, y := view.Intrinsics.ray(p)
+		return Bearing{
+			Yaw:   radToDeg(-math.Atan(x)),
+			Pitch: radToDeg(-math.Atan2(y, math.Hypot(x, 1))),
+		}
+	}
+	if frame.X <= 0 || frame.Y <= 0 {
+		return Bearing{}
+	}
+	// Without a calibration the angle is taken to grow evenly across the frame, as face tracking does
+	ex := (float64(p.X) - float64(frame.X)/2) / (float64(frame.X) / 2)
+	ey := (float64(p.Y) - float64(frame.Y)/2) / (float64(frame.Y) / 2)
+	return Bearing{Yaw: -ex * view.HFOV / 2, Pitch: -ey * view.VFOV / 2}
+}
+
+// locateMarkers returns markers with where each one with a pose is, seen from a camera at camera.
+func locateMarkers(markers []Marker, camera Pose) []Marker {
+	located := make([]Marker, len(markers))
+	for i, marker := range markers {
+		if marker.Pose != nil {
+			world := cameraToBase(camera, marker.Pose.Translation)
+			marker.World = &world
+		}
+		located[i] = marker
+	}
+	return located
+}
+
+// cameraToBase turns t, mm in the camera's frame (x right, y down, z ahead),
+// into cm in the robot's for a camera at camera. The camera doesn't roll.
+func cameraToBase(camera Pose, t [3]float64) Position {
+	yaw, pitch := degToRad(camera.Yaw), degToRad(camera.Pitch)
+	ahead := [3]float64{math.Cos(pitch) * math.Cos(yaw), math.Cos(pitch) * math.Sin(yaw), math.Sin(pitch)}
+	right := [3]float64{math.Sin(yaw), -math.Cos(yaw), 0}
+	up := [3]float64{-math.Sin(pitch) * math.Cos(yaw), -math.Sin(pitch) * math.Sin(yaw), math.Cos(pitch)}
+
+	position := [3]float64{camera.X, camera.Y, camera.Z}
+	for i := range position {
+		position[i] += (t[0]*right[i] - t[1]*up[i] + t[2]*ahead[i]) / 10
+	}
+	return Position{X: position[0], Y: position[1], Z: position[2]}
+}
+
+// drawMarkers outlines the markers on img, ArUco markers in yellow and QR codes in magenta
+func drawMarkers(img *gocv.Mat, markers []Marker) {
+	for _, marker := range markers {
+		colour, label := color.RGBA{0, 255, 255, 0}, fmt.Sprintf("aruco %d", marker.ID)
+		if marker.Kind == MarkerQR {
+			colour, label = color.RGBA{255, 0, 255, 0}, marker.Payload
+			if len(label) > 24 {
+				label = label[:21] + "..."
+			}
+		}
+		for i, corner := range marker.Corners {
+			gocv.Line(img, corner, marker.Corners[(i+1)%4], colour, 2)
+		}
+		if marker.Pose != nil {
+			label += fmt.Sprintf(" %.0fmm", marker.Pose.Distance)
+		}
+		gocv.PutText(img, label, marker.Corners[0].Add(image.Pt(0, -6)), gocv.FontHersheySimplex, 0.5, colour, 1)
+	}
+}
+
+// solveMarkerPose finds where a square marker side mm across is from its corners in a frame seen with intrinsics
+func solveMarkerPose(corners [4]image.Point, side float64, intrinsics CameraIntrinsics) *MarkerPose {
+	// The corners of the marker around its centre, clockwise from the top left as OpenCV's IPPE_SQUARE wants them
+	h := float32(side / 2)
+	object := gocv.NewPoint3fVectorFromPoints([]gocv.Point3f{{X: -h, Y: h}, {X: h, Y: h}, {X: h, Y: -h}, {X: -h, Y: -h}})
+	defer object.Close()
+	points := make([]gocv.Point2f, len(corners))
+	for i, c := range corners {
+		points[i] = gocv.Point2f{X: float32(c.X), Y: float32(c.Y)}
+	}
+	imagePoints := gocv.NewPoint2fVectorFromPoints(points)
+	defer imagePoints.Close()
+
+	matrix, distortion := intrinsics.mats()
+	defer matrix.Close()
+	defer distortion.Close()
+	rvec, tvec := gocv.NewMat(), gocv.NewMat()
+	defer rvec.Close()
+	defer tvec.Close()
+	const solvePnPIPPESquare = 7 // cv::SOLVEPNP_IPPE_SQUARE
+	if !gocv.SolvePnP(object, imagePoints, matrix, distortion, &rvec, &tvec, false, solvePnPIPPESquare) || tvec.Empty() {
+		return nil
+	}
+
+	pose := &MarkerPose{}
+	for i := 0; i < 3; i++ {
+		pose.Translation[i] = tvec.GetDoubleAt(i, 0)
+		pose.Rotation[i] = rvec.GetDoubleAt(i, 0)
+	}
+	pose.Distance = math.Sqrt(pose.Translation[0]*pose.Translation[0] + pose.Translation[1]*pose.Translation[1] + pose.Translation[2]*pose.Translation[2])
+	return pose
+}
+
+// markerFinder holds the OpenCV detectors for a config
+type markerFinder struct {
+	aruco *gocv.ArucoDetector // nil when ArUco markers aren't wanted
+	qr    *gocv.QRCodeDetector
+}
+
+func newMarkerFinder(config MarkerConfig) *markerFinder {
+	f := &markerFinder{}
+	if config.wants(MarkerArUco) {
+		dictionary := gocv.GetPredefinedDictionary(markerDictionaries[config.Dictionary])
+		aruco := gocv.NewArucoDetectorWithParams(dictionary, gocv.NewArucoDetectorParameters())
+		f.aruco = &aruco
+	}
+	if config.wants(MarkerQR) {
+		qr := gocv.NewQRCodeDetector()
+		f.qr = &qr
+	}
+	return f
+}
+
+func (f *markerFinder) find(img gocv.Mat, config MarkerConfig) []Marker {
+	var markers []Marker
+	if f.aruco != nil {
+		corners, ids, _ := f.aruco.DetectMarkers(img)
+		for i, id := range ids {
+			if i >= len(corners) || len(corners[i]) != 4 {
+				continue
+			}
+			marker := Marker{Kind: MarkerArUco, ID: id}
+			for c, p := range corners[i] {
+				marker.Corners[c] = image.Pt(int(math.Round(float64(p.X))), int(math.Round(float64(p.Y))))
+			}
+			markers = append(markers, marker)
+		}
+	}
+	if f.qr != nil {
+		markers = append(markers, f.findQR(img)...)
+	}
+	return markers
+}
+
+// findQR finds every QR code in img and decodes each on its own
+func (f *markerFinder) findQR(img gocv.Mat) []Marker {
+	points := gocv.NewMat()
+	defer points.Close()
+	if !f.qr.DetectMulti(img, &points) {
+		return nil
+	}
+
+	frame := image.Rect(0, 0, img.Cols(), img.Rows())
+	var markers []Marker
+	// A row of four corners per code
+	for r := 0; r < points.Rows(); r++ {
+		marker := Marker{Kind: MarkerQR}
+		var bounds image.Rectangle
+		for c := 0; c < 4 && c < points.Cols(); c++ {
+			v := points.GetVecfAt(r, c)
+			if len(v) < 2 {
+				continue
+			}
+			marker.Corners[c] = image.Pt(int(math.Round(float64(v[0]))), int(math.Round(float64(v[1]))))
+			bounds = bounds.Union(image.Rectangle{Min: marker.Corners[c], Max: marker.Corners[c].Add(image.Pt(1, 1))})
+		}
+		margin := int(float64(max(bounds.Dx(), bounds.Dy())) * markerQRMargin)
+		bounds = bounds.Inset(-margin).Intersect(frame)
+		if bounds.Empty() {
+			continue
+		}
+
+		crop := img.Region(bounds)
+		found, straight := gocv.NewMat(), gocv.NewMat()
+		marker.Payload = f.qr.DetectAndDecode(crop, &found, &straight)
+		crop.Close()
+		found.Close()
+		straight.Close()
+		if marker.Payload != "" {
+			markers = append(markers, marker)
+		}
+	}
+	return markers
+}
+
+// Close releases the detectors.
+func (f *markerFinder) Close() {
+	if f.aruco != nil {
+		f.aruco.Close()
+	}
+	if f.qr != nil {
+		f.qr.Close()
+	}
+}
@@ -0,0 +1,162 @@
+package robot
+
+import (
+	"errors"
+	"image"
+	"math"
+	"testing"
+)
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+
+func TestMarkerConfig_WithDefaults(t *testing.T) {
+	config, err := MarkerConfig{}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults returned error: %v", err)
+	}
+	if !config.wants(MarkerArUco) || !config.wants(MarkerQR) || config.Dictionary != DefaultMarkerDictionary ||
+		config.SizeMm != DefaultMarkerSize || config.QRSizeMm != 0 || config.interval() != DefaultMarkerInterval {
+		t.Errorf("defaults = %+v", config)
+	}
+	qr, _ := MarkerConfig{Kinds: []string{MarkerQR}}.withDefaults()
+	if qr.wants(MarkerArUco) {
+		t.Errorf("%+v wants ArUco markers", qr)
+	}
+
+	for _, bad := range []MarkerConfig{
+		{Kinds: []string{"barcode"}},
+		{Dictionary: "3x3_10"},
+		{SizeMm: -5},
+		{QRSizeMm: -1},
+		{IntervalMs: -1},
+	} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidMarkerConfig) {
+			t.Errorf("%+v: err = %v, want %v", bad, err, ErrInvalidMarkerConfig)
+		}
+	}
+}
+
+func TestBearing(t *testing.T) {
+	frame := image.Pt(640, 480)
+
+	// From the field of view
+	view := cameraView{HFOV: 60, VFOV: 40}
+	if b := bearing(image.Pt(640, 240), frame, view); !near(b.Yaw, -30) || !near(b.Pitch, 0) {
+		t.Errorf("right edge = %+v, want yaw -30", b)
+	}
+	if b := bearing(image.Pt(320, 0), frame, view); !near(b.Yaw, 0) || !near(b.Pitch, 20) {
+		t.Errorf("top edge = %+v, want pitch 20", b)
+	}
+
+	// From the calibration, which knows the optical centre isn't quite the middle of the frame
+	view.Intrinsics = &CameraIntrinsics{Width: 640, Height: 480, CameraMatrix: [9]float64{500, 0, 300, 0, 500, 250, 0, 0, 1}}
+	if b := bearing(image.Pt(300, 250), frame, view); !near(b.Yaw, 0) || !near(b.Pitch, 0) {
+		t.Errorf("optical centre = %+v, want straight ahead", b)
+	}
+	if b := bearing(image.Pt(800, 250), frame, view); !near(b.Yaw, -45) || !near(b.Pitch, 0) {
+		t.Errorf("one focal length right = %+v, want yaw -45", b)
+	}
+	if b := bearing(image.Pt(300, 750), frame, view); !near(b.Yaw, 0) || !near(b.Pitch, -45) {
+		t.Errorf("one focal length down = %+v, want pitch -45", b)
+	}
+}
+
+func TestCameraToBase(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		camera Pose
+		t      [3]float64 // mm, x right, y down, z ahead
+		want   Position
+	}{
+		{"ahead", Pose{X: 10, Z: 20}, [3]float64{0, 0, 100}, Position{X: 20, Z: 20}},
+		{"right", Pose{X: 10, Z: 20}, [3]float64{50, 0, 0}, Position{X: 10, Y: -5, Z: 20}},
+		{"below", Pose{X: 10, Z: 20}, [3]float64{0, 50, 0}, Position{X: 10, Z: 15}},
+		{"looking left", Pose{X: 10, Z: 20, Yaw: 90}, [3]float64{0, 0, 100}, Position{X: 10, Y: 10, Z: 20}},
+		{"looking down", Pose{X: 10, Z: 20, Pitch: -90}, [3]float64{0, 0, 100}, Position{X: 10, Z: 10}},
+		{"looking down, top of the frame", Pose{X: 10, Z: 20, Pitch: -90}, [3]float64{0, -50, 100}, Position{X: 15, Z: 10}},
+	} {
+		got := cameraToBase(tc.camera, tc.t)
+		if !near(got.X, tc.want.X) || !near(got.Y, tc.want.Y) || !near(got.Z, tc.want.Z) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLocateMarkers(t *testing.T) {
+	markers := []Marker{
+		{Kind: MarkerArUco, ID: 3, Pose: &MarkerPose{Translation: [3]float64{0, 0, 200}}},
+		{Kind: MarkerQR, Payload: "bin 4"},
+	}
+	located := locateMarkers(markers, Pose{X: 10, Z: 20})
+	if located[0].World == nil || !near(located[0].World.X, 30) || located[1].World != nil {
+		t.Errorf("located = %+v", located)
+	}
+	if markers[0].World != nil {
+		t.Error("locateMarkers changed the markers it was given")
+	}
+}
+
+func TestMarkerResult_Keys(t *testing.T) {
+	corners := [4]image.Point{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	if c := markerCentre(corners); c != image.Pt(5, 5) {
+		t.Errorf("centre = %v", c)
+	}
+
+	result := MarkerResult{Markers: []Marker{
+		{Kind: MarkerQR, Payload: "bin 4"},
+		{Kind: MarkerArUco, ID: 7},
+		{Kind: MarkerArUco, ID: 7},
+	}}
+	if keys := result.keys(); !equalStrings(keys, []string{"aruco:7", "qr:bin 4"}) {
+		t.Errorf("keys = %v", keys)
+	}
+}
+
+func TestMarkerDetector_Configure(t *testing.T) {
+	d, err := NewMarkerDetector(MarkerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Enabled() {
+		t.Error("enabled by default")
+	}
+	d.last = &MarkerResult{Markers: []Marker{{Kind: MarkerArUco, ID: 1}}}
+	status := d.Status()
+	status.Last.Markers[0].ID = 2
+	status.Config.Kinds[0] = "changed"
+	if d.last.Markers[0].ID != 1 || d.config.Kinds[0] != MarkerArUco {
+		t.Error("changing the status changed the detector")
+	}
+
+	config, err := d.Configure(MarkerConfig{Enabled: true, Dictionary: "apriltag_36h11", SizeMm: 80, Overlay: true})
+	if err != nil {
+		t.Fatalf("Configure returned error: %v", err)
+	}
+	if !d.Enabled() || config.Dictionary != "apriltag_36h11" || config.SizeMm != 80 || d.Status().Last != nil {
+		t.Errorf("config = %+v, status = %+v", config, d.Status())
+	}
+	if _, err := d.Configure(MarkerConfig{Dictionary: "3x3_10"}); !errors.Is(err, ErrInvalidMarkerConfig) {
+		t.Errorf("Configure err = %v, want %v", err, ErrInvalidMarkerConfig)
+	}
+	if !d.Enabled() {
+		t.Error("a bad config changed the detector")
+	}
+}
+
+func TestLoadMarkerConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_MARKERS", "true")
+	t.Setenv("GIZMATRON_MARKER_DICTIONARY", "6x6_250")
+	t.Setenv("GIZMATRON_MARKER_SIZE_MM", "-40")
+	t.Setenv("GIZMATRON_MARKER_QR_SIZE_MM", "30")
+	t.Setenv("GIZMATRON_MARKER_INTERVAL_MS", "500")
+
+	config := loadMarkerConfig()
+	if !config.Enabled || config.Dictionary != "6x6_250" || config.SizeMm != DefaultMarkerSize || config.QRSizeMm != 30 || config.IntervalMs != 500 {
+		t.Errorf("config = %+v", config)
+	}
+
+	t.Setenv("GIZMATRON_MARKER_DICTIONARY", "3x3_10")
+	if config := loadMarkerConfig(); config.Dictionary != DefaultMarkerDictionary {
+		t.Errorf("dictionary = %v, want %v", config.Dictionary, DefaultMarkerDictionary)
+	}
+}
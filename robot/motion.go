@@ -0,0 +1,290 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Motion executor
+
+	Only one thing may drive the arm at a time. The MotionExecutor owns the arm:
+	every move is submitted to it as a job, the jobs wait in a queue and a
+	single goroutine runs them one after another. Submitting returns straight
+	away with a job ID that can be polled for the job's state or cancelled.
+
+	  queued -> running -> done
+	                    -> failed
+	                    -> cancelled   (a queued job can be cancelled too)
+*/
+
+// JobState is where a motion job is in its life.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Finished reports whether the job has stopped for good.
+func (s JobState) Finished() bool {
+	return s == JobDone || s == JobFailed || s == JobCancelled
+}
+
+const (
+	motionQueueDepth  = 32  // jobs waiting to run
+	motionJobsHistory = 100 // finished jobs kept around to be polled
+)
+
+var (
+	ErrQueueFull    = errors.New("motion queue is full")
+	ErrJobNotFound  = errors.New("no such job")
+	ErrMotionClosed = errors.New("motion executor is closed")
+)
+
+// MotionCommand is the work of a job. It has the arm to itself until it returns
+// and should give up as soon as ctx is cancelled.
+type MotionCommand func(ctx context.Context, a *Arm) error
+
+// Job is a snapshot of a motion job.
+type Job struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description"`
+	State       JobState   `json:"state"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Started     *time.Time `json:"started,omitempty"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+type motionJob struct {
+	Job
+	command MotionCommand
+	err     error
+	cancel  context.CancelFunc // set while running
+	done    chan struct{}      // closed once finished
+}
+
+// MotionExecutor runs motion jobs against an arm one at a time.
+type MotionExecutor struct {
+	arm   *Arm
+	queue chan *motionJob
+
+	mux      sync.Mutex
+	jobs     map[string]*motionJob
+	finished []string // IDs of finished jobs, oldest first
+	nextID   uint64
+	closed   bool
+
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewMotionExecutor starts an executor for the arm.
+func NewMotionExecutor(arm *Arm) *MotionExecutor {
+	ctx, stop := context.WithCancel(context.Background())
+	e := &MotionExecutor{
+		arm:     arm,
+		queue:   make(chan *motionJob, motionQueueDepth),
+		jobs:    make(map[string]*motionJob),
+		stop:    stop,
+		stopped: make(chan struct{}),
+	}
+	go e.run(ctx)
+	return e
+}
+
+// Submit queues a command and returns the new job.
+func (e *MotionExecutor) Submit(description string, command MotionCommand) (Job, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	if e.closed {
+		return Job{}, ErrMotionClosed
+	}
+	e.nextID++
+	job := &motionJob{
+		Job: Job{
+			ID:          strconv.FormatUint(e.nextID, 10),
+			Description: description,
+			State:       JobQueued,
+			Created:     time.Now(),
+		},
+		command: command,
+		done:    make(chan struct{}),
+	}
+
+	select {
+	case e.queue <- job:
+	default:
+		return Job{}, ErrQueueFull
+	}
+	e.jobs[job.ID] = job
+	log.Printf("MOTION: queued job %v: %v", job.ID, description)
+	return job.Job, nil
+}
+
+// Job returns the current state of a job.
+func (e *MotionExecutor) Job(id string) (Job, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	job, ok := e.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return job.Job, nil
+}
+
+// Cancel cancels a job. A queued job never runs, a running one stops where it is.
+// Cancelling a finished job does nothing.
+func (e *MotionExecutor) Cancel(id string) (Job, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	job, ok := e.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	e.cancelLocked(job)
+	return job.Job, nil
+}
+
+// CancelAll cancels every queued and running job.
+func (e *MotionExecutor) CancelAll() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, job := range e.jobs {
+		e.cancelLocked(job)
+	}
+}
+
+func (e *MotionExecutor) cancelLocked(job *motionJob) {
+	switch job.State {
+	case JobQueued:
+		// run skips it when it comes off the queue
+		e.finishLocked(job, JobCancelled, context.Canceled)
+	case JobRunning:
+		job.cancel()
+	}
+}
+
+// Wait blocks until the job has finished and returns it along with the error it failed with.
+// If ctx is cancelled first the job is cancelled too.
+func (e *MotionExecutor) Wait(ctx context.Context, id string) (Job, error) {
+	e.mux.Lock()
+	job, ok := e.jobs[id]
+	e.mux.Unlock()
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		e.Cancel(id)
+		<-job.done
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return job.Job, job.err
+}
+
+// Run submits a command and waits for it to finish.
+func (e *MotionExecutor) Run(ctx context.Context, description string, command MotionCommand) error {
+	job, err := e.Submit(description, command)
+	if err != nil {
+		return err
+	}
+	_, err = e.Wait(ctx, job.ID)
+	return err
+}
+
+// Close cancels everything and stops the executor.
+func (e *MotionExecutor) Close() {
+	e.mux.Lock()
+	e.closed = true
+	e.mux.Unlock()
+	e.CancelAll()
+	e.stop()
+	<-e.stopped
+}
+
+/* run is the only goroutine that ever moves the arm */
+func (e *MotionExecutor) run(ctx context.Context) {
+	defer close(e.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-e.queue:
+			e.runJob(ctx, job)
+		}
+	}
+}
+
+func (e *MotionExecutor) runJob(ctx context.Context, job *motionJob) {
+	e.mux.Lock()
+	if job.State != JobQueued {
+		// Cancelled while it was waiting
+		e.mux.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	now := time.Now()
+	job.State = JobRunning
+	job.Started = &now
+	job.cancel = cancel
+	e.mux.Unlock()
+
+	log.Printf("MOTION: running job %v: %v", job.ID, job.Description)
+	err := e.runCommand(ctx, job.command)
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	switch {
+	case err == nil:
+		e.finishLocked(job, JobDone, nil)
+	case ctx.Err() != nil && !errors.Is(err, ErrEmergencyStop):
+		e.finishLocked(job, JobCancelled, err)
+	default:
+		log.Printf("MOTION: job %v failed: %v", job.ID, err)
+		e.finishLocked(job, JobFailed, err)
+	}
+}
+
+// runCommand keeps a panicking command from taking the executor down with it
+func (e *MotionExecutor) runCommand(ctx context.Context, command MotionCommand) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("motion command panicked: %v", r)
+		}
+	}()
+	return command(ctx, e.arm)
+}
+
+func (e *MotionExecutor) finishLocked(job *motionJob, state JobState, err error) {
+	now := time.Now()
+	job.State = state
+	job.Finished = &now
+	job.err = err
+	if err != nil {
+		job.Error = err.Error()
+	}
+	close(job.done)
+
+	// Forget the oldest finished jobs
+	e.finished = append(e.finished, job.ID)
+	for len(e.finished) > motionJobsHistory {
+		delete(e.jobs, e.finished[0])
+		e.finished = e.finished[1:]
+	}
+}
@@ -0,0 +1,362 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Motion detection
+
+	While it is on, every frame goes through a MOG2 background subtractor
+	before face detection. The subtractor learns what the scene looks like;
+	pixels that don't fit are foreground. Frames are scaled down first, the
+	mask is cleaned up and the outlines of what's left become motion boxes.
+
+	  sensitivity  0-1, higher picks up smaller changes in brightness
+	  min area     boxes smaller than this, in frame pixels, are ignored as noise
+	  regions      only motion inside these parts of the frame counts, all of it when empty
+	  cooldown     no motion for this long and the motion has stopped
+
+	The score is the fraction of the watched part of the frame that moved.
+	Motion starting and stopping are published as events.
+*/
+
+// Motion detector defaults, each can be overridden with GIZMATRON_MOTION* env vars or the API
+const (
+	DefaultMotionSensitivity = 0.5
+	DefaultMotionMinArea     = 500 // frame pixels
+	DefaultMotionCooldown    = 2 * time.Second
+
+	motionWidth    = 320 // frames are scaled down to this width before looking for motion
+	motionHistory  = 300 // frames the background model remembers
+	motionLearning = 10  // frames to learn the background before reporting anything
+)
+
+var ErrInvalidMotionConfig = errors.New("invalid motion config")
+
+// MotionConfig tunes the motion detector. Zero values mean the defaults.
+type MotionConfig struct {
+	Enabled     bool              `json:"enabled"`
+	Sensitivity float64           `json:"sensitivity"` // 0-1
+	MinArea     int               `json:"min_area"`    // frame pixels
+	Regions     []image.Rectangle `json:"regions"`     // frame pixels, empty for the whole frame
+	Overlay     bool              `json:"overlay"`     // draw the motion boxes into the stream
+	CooldownMs  int               `json:"cooldown_ms"` // ms without motion before it has stopped
+}
+
+// withDefaults fills in zero values and checks the ranges.
+func (c MotionConfig) withDefaults() (MotionConfig, error) {
+	if c.Sensitivity == 0 {
+		c.Sensitivity = DefaultMotionSensitivity
+	}
+	if c.MinArea == 0 {
+		c.MinArea = DefaultMotionMinArea
+	}
+	if c.CooldownMs == 0 {
+		c.CooldownMs = int(DefaultMotionCooldown.Milliseconds())
+	}
+	if c.Sensitivity < 0 || c.Sensitivity > 1 {
+		return c, fmt.Errorf("%w: sensitivity %v is outside 0-1", ErrInvalidMotionConfig, c.Sensitivity)
+	}
+	if c.MinArea < 0 {
+		return c, fmt.Errorf("%w: min area %v must be positive", ErrInvalidMotionConfig, c.MinArea)
+	}
+	if c.CooldownMs < 0 {
+		return c, fmt.Errorf("%w: cooldown %vms must be positive", ErrInvalidMotionConfig, c.CooldownMs)
+	}
+	for _, region := range c.Regions {
+		if region.Empty() || region.Min.X < 0 || region.Min.Y < 0 {
+			return c, fmt.Errorf("%w: region %v is empty or off the frame", ErrInvalidMotionConfig, region)
+		}
+	}
+	return c, nil
+}
+
+func (c MotionConfig) cooldown() time.Duration {
+	return time.Duration(c.CooldownMs) * time.Millisecond
+}
+
+// varThreshold turns the sensitivity into MOG2's variance threshold, 8 at the most sensitive and 56 at the least
+func (c MotionConfig) varThreshold() float64 {
+	return 8 + (1-c.Sensitivity)*48
+}
+
+// loadMotionConfig loads the motion detector config from GIZMATRON_MOTION* env vars
+func loadMotionConfig() MotionConfig {
+	config := MotionConfig{
+		Sensitivity: DefaultMotionSensitivity,
+		MinArea:     DefaultMotionMinArea,
+		CooldownMs:  int(DefaultMotionCooldown.Milliseconds()),
+	}
+	if enabled := os.Getenv("GIZMATRON_MOTION"); enabled != "" {
+		if e, err := strconv.ParseBool(enabled); err == nil {
+			config.Enabled = e
+		} else {
+			log.Printf("Warning!! GIZMATRON_MOTION %q is not true or false, motion detection is off", enabled)
+		}
+	}
+	if sensitivity := os.Getenv("GIZMATRON_MOTION_SENSITIVITY"); sensitivity != "" {
+		if s, err := strconv.ParseFloat(sensitivity, 64); err == nil && s > 0 && s <= 1 {
+			config.Sensitivity = s
+		} else {
+			log.Printf("Warning!! GIZMATRON_MOTION_SENSITIVITY %q is not between 0 and 1, using %v", sensitivity, config.Sensitivity)
+		}
+	}
+	if minArea := os.Getenv("GIZMATRON_MOTION_MIN_AREA"); minArea != "" {
+		if a, err := strconv.Atoi(minArea); err == nil && a > 0 {
+			config.MinArea = a
+		} else {
+			log.Printf("Warning!! GIZMATRON_MOTION_MIN_AREA %q is not a positive number of pixels, using %v", minArea, config.MinArea)
+		}
+	}
+	if overlay := os.Getenv("GIZMATRON_MOTION_OVERLAY"); overlay != "" {
+		if o, err := strconv.ParseBool(overlay); err == nil {
+			config.Overlay = o
+		} else {
+			log.Printf("Warning!! GIZMATRON_MOTION_OVERLAY %q is not true or false, using %v", overlay, config.Overlay)
+		}
+	}
+	return config
+}
+
+// MotionResult is the motion found in one frame.
+type MotionResult struct {
+	Motion bool              `json:"motion"`
+	Score  float64           `json:"score"` // 0-1, the fraction of the watched frame that moved
+	Boxes  []image.Rectangle `json:"boxes"` // frame pixels
+	At     time.Time         `json:"at"`
+}
+
+// MotionStatus is a snapshot of the motion detector.
+type MotionStatus struct {
+	Config     MotionConfig  `json:"config"`
+	Active     bool          `json:"active"` // motion has started and not yet stopped
+	Last       *MotionResult `json:"last,omitempty"`
+	LastMotion *time.Time    `json:"last_motion,omitempty"`
+}
+
+// MotionDetector finds what moved between frames.
+type MotionDetector struct {
+	mux        sync.Mutex
+	config     MotionConfig
+	subtractor *gocv.BackgroundSubtractorMOG2
+	learned    int           // frames the current background model has seen
+	mask       gocv.Mat      // the regions, at the scaled down size
+	maskSize   image.Point   // the scaled down size the mask was made for, zero when there is none
+	active     bool          // motion started and hasn't stopped
+	last       *MotionResult // the latest frame's result
+	lastMotion time.Time     // when motion was last seen
+	kernel     gocv.Mat      // for dilating the foreground mask
+	kernelSize image.Point
+}
+
+// NewMotionDetector makes a detector, it only looks at frames while config.Enabled.
+func NewMotionDetector(config MotionConfig) (*MotionDetector, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &MotionDetector{config: config}, nil
+}
+
+// Configure changes the detector's config, a new config starts learning the background again.
+func (d *MotionDetector) Configure(config MotionConfig) (MotionConfig, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return config, err
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.reset()
+	d.config = config
+	if !config.Enabled {
+		d.active, d.last = false, nil
+	}
+	log.Printf("Motion detection: enabled %v, sensitivity %v, min area %v, %d regions", config.Enabled, config.Sensitivity, config.MinArea, len(config.Regions))
+	return config, nil
+}
+
+// reset throws away the background model and the mask, with d.mux held
+func (d *MotionDetector) reset() {
+	if d.subtractor != nil {
+		d.subtractor.Close()
+		d.subtractor = nil
+	}
+	if d.maskSize != (image.Point{}) {
+		d.mask.Close()
+		d.maskSize = image.Point{}
+	}
+	if d.kernelSize != (image.Point{}) {
+		d.kernel.Close()
+		d.kernelSize = image.Point{}
+	}
+	d.learned = 0
+}
+
+// Enabled reports whether the detector is looking at frames.
+func (d *MotionDetector) Enabled() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.config.Enabled
+}
+
+// Overlay reports whether motion boxes should be drawn into the stream.
+func (d *MotionDetector) Overlay() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.config.Enabled && d.config.Overlay
+}
+
+// Status reports what the detector has seen.
+func (d *MotionDetector) Status() MotionStatus {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	status := MotionStatus{Config: d.config, Active: d.active}
+	status.Config.Regions = append([]image.Rectangle(nil), d.config.Regions...)
+	if d.last != nil {
+		last := *d.last
+		status.Last = &last
+	}
+	if !d.lastMotion.IsZero() {
+		lastMotion := d.lastMotion
+		status.LastMotion = &lastMotion
+	}
+	return status
+}
+
+// Detect looks for motion in img, which it doesn't change. started and stopped
+// report whether motion started or stopped with this frame.
+func (d *MotionDetector) Detect(img gocv.Mat) (result MotionResult, started, stopped bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	result = MotionResult{At: time.Now()}
+	if !d.config.Enabled || img.Empty() {
+		return result, false, false
+	}
+
+	// Work on a small grey blurred copy, it's faster and ignores sensor noise
+	scale := 1.0
+	if img.Cols() > motionWidth {
+		scale = float64(motionWidth) / float64(img.Cols())
+	}
+	size := image.Point{int(float64(img.Cols()) * scale), int(float64(img.Rows()) * scale)}
+	small := gocv.NewMat()
+	defer small.Close()
+	gocv.Resize(img, &small, size, 0, 0, gocv.InterpolationArea)
+	gocv.CvtColor(small, &small, gocv.ColorBGRToGray)
+	gocv.GaussianBlur(small, &small, image.Point{5, 5}, 0, 0, gocv.BorderDefault)
+
+	if d.subtractor == nil {
+		subtractor := gocv.NewBackgroundSubtractorMOG2WithParams(motionHistory, d.config.varThreshold(), false)
+		d.subtractor = &subtractor
+	}
+	foreground := gocv.NewMat()
+	defer foreground.Close()
+	d.subtractor.Apply(small, &foreground)
+	if d.learned < motionLearning {
+		d.learned++
+		return result, false, false
+	}
+
+	gocv.Threshold(foreground, &foreground, 200, 255, gocv.ThresholdBinary)
+	watched := size.X * size.Y
+	if len(d.config.Regions) > 0 {
+		mask := d.regionMask(size, scale)
+		gocv.BitwiseAnd(foreground, mask, &foreground)
+		watched = gocv.CountNonZero(mask)
+	}
+	// Join up the pieces of whatever moved
+	if d.kernelSize == (image.Point{}) {
+		d.kernelSize = image.Point{5, 5}
+		d.kernel = gocv.GetStructuringElement(gocv.MorphRect, d.kernelSize)
+	}
+	gocv.Dilate(foreground, &foreground, d.kernel)
+
+	if watched > 0 {
+		result.Score = float64(gocv.CountNonZero(foreground)) / float64(watched)
+	}
+	result.Boxes = motionBoxes(foreground, scale, d.config.MinArea)
+	result.Motion = len(result.Boxes) > 0
+
+	started, stopped = d.update(result)
+	return result, started, stopped
+}
+
+// update keeps track of whether motion is going on, with d.mux held
+func (d *MotionDetector) update(result MotionResult) (started, stopped bool) {
+	d.last = &result
+	if result.Motion {
+		d.lastMotion = result.At
+		started = !d.active
+		d.active = true
+		return started, false
+	}
+	if d.active && result.At.Sub(d.lastMotion) >= d.config.cooldown() {
+		d.active = false
+		return false, true
+	}
+	return false, false
+}
+
+// regionMask is the regions drawn white on black at the scaled down size, with d.mux held
+func (d *MotionDetector) regionMask(size image.Point, scale float64) gocv.Mat {
+	if d.maskSize == size {
+		return d.mask
+	}
+	if d.maskSize != (image.Point{}) {
+		d.mask.Close()
+	}
+	d.mask = gocv.Zeros(size.Y, size.X, gocv.MatTypeCV8UC1)
+	d.maskSize = size
+	white := color.RGBA{255, 255, 255, 0}
+	for _, region := range d.config.Regions {
+		gocv.Rectangle(&d.mask, scaleRect(region, scale), white, -1)
+	}
+	return d.mask
+}
+
+// motionBoxes are the outlines of the foreground big enough to count, in frame pixels
+func motionBoxes(foreground gocv.Mat, scale float64, minArea int) []image.Rectangle {
+	contours := gocv.FindContours(foreground, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	var boxes []image.Rectangle
+	for i := 0; i < contours.Size(); i++ {
+		contour := contours.At(i)
+		// Areas shrink with the square of the scale
+		if gocv.ContourArea(contour)/(scale*scale) < float64(minArea) {
+			continue
+		}
+		boxes = append(boxes, scaleRect(gocv.BoundingRect(contour), 1/scale))
+	}
+	return boxes
+}
+
+// scaleRect scales a rectangle about the origin
+func scaleRect(r image.Rectangle, scale float64) image.Rectangle {
+	at := func(p image.Point) image.Point {
+		return image.Point{int(float64(p.X)*scale + 0.5), int(float64(p.Y)*scale + 0.5)}
+	}
+	return image.Rectangle{at(r.Min), at(r.Max)}
+}
+
+// drawMotion draws the motion boxes onto img
+func drawMotion(img *gocv.Mat, result MotionResult) {
+	red := color.RGBA{255, 0, 0, 0}
+	for _, box := range result.Boxes {
+		gocv.Rectangle(img, box, red, 2)
+	}
+}
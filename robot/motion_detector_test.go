@@ -0,0 +1,128 @@
+package robot
+
+import (
+	"errors"
+	"image"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func TestMotionConfig_WithDefaults(t *testing.T) {
+	config, err := MotionConfig{}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults returned error: %v", err)
+	}
+	if config.Sensitivity != DefaultMotionSensitivity || config.MinArea != DefaultMotionMinArea || config.cooldown() != DefaultMotionCooldown {
+		t.Errorf("defaults = %+v", config)
+	}
+
+	for _, bad := range []MotionConfig{
+		{Sensitivity: 1.5},
+		{Sensitivity: -0.1},
+		{MinArea: -1},
+		{CooldownMs: -5},
+		{Regions: []image.Rectangle{image.Rect(10, 10, 10, 50)}},
+		{Regions: []image.Rectangle{image.Rect(-5, 0, 50, 50)}},
+	} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidMotionConfig) {
+			t.Errorf("%+v: err = %v, want %v", bad, err, ErrInvalidMotionConfig)
+		}
+	}
+
+	if loose, tight := (MotionConfig{Sensitivity: 0.9}).varThreshold(), (MotionConfig{Sensitivity: 0.1}).varThreshold(); loose >= tight {
+		t.Errorf("higher sensitivity should mean a lower threshold, got %v and %v", loose, tight)
+	}
+}
+
+func TestMotionDetector_StartsAndStops(t *testing.T) {
+	d, err := NewMotionDetector(MotionConfig{Enabled: true, CooldownMs: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Now()
+	step := func(motion bool, after time.Duration) (bool, bool) {
+		at = at.Add(after)
+		d.mux.Lock()
+		defer d.mux.Unlock()
+		result := MotionResult{Motion: motion, At: at}
+		if motion {
+			result.Boxes = []image.Rectangle{image.Rect(0, 0, 40, 40)}
+		}
+		return d.update(result)
+	}
+
+	for i, tc := range []struct {
+		motion           bool
+		after            time.Duration
+		started, stopped bool
+	}{
+		{false, 0, false, false},
+		{true, 10 * time.Millisecond, true, false},
+		{true, 10 * time.Millisecond, false, false},
+		{false, 50 * time.Millisecond, false, false}, // still cooling down
+		{true, 10 * time.Millisecond, false, false},  // so this is the same motion
+		{false, 50 * time.Millisecond, false, false},
+		{false, 60 * time.Millisecond, false, true},
+		{false, 10 * time.Millisecond, false, false},
+	} {
+		started, stopped := step(tc.motion, tc.after)
+		if started != tc.started || stopped != tc.stopped {
+			t.Errorf("step %d: started %v stopped %v, want %v %v", i, started, stopped, tc.started, tc.stopped)
+		}
+	}
+	if status := d.Status(); status.Active || status.LastMotion == nil || status.Last == nil {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestMotionDetector_Configure(t *testing.T) {
+	d, _ := NewMotionDetector(MotionConfig{})
+	if d.Enabled() {
+		t.Fatal("detector enabled without being asked")
+	}
+	// Disabled, frames go straight through
+	if result, started, _ := d.Detect(gocv.NewMat()); result.Motion || started {
+		t.Errorf("disabled detector found motion: %+v", result)
+	}
+
+	region := image.Rect(0, 0, 320, 240)
+	config, err := d.Configure(MotionConfig{Enabled: true, Overlay: true, Regions: []image.Rectangle{region}})
+	if err != nil || !d.Enabled() || !d.Overlay() || config.MinArea != DefaultMotionMinArea {
+		t.Fatalf("Configure = %+v, %v", config, err)
+	}
+	status := d.Status()
+	status.Config.Regions[0] = image.Rectangle{}
+	if d.Status().Config.Regions[0] != region {
+		t.Error("Status shares its regions with the detector")
+	}
+
+	if _, err := d.Configure(MotionConfig{Enabled: true, Sensitivity: 2}); err == nil || !d.Overlay() {
+		t.Errorf("a bad config should be refused and leave the old one, err %v", err)
+	}
+}
+
+func TestScaleRect(t *testing.T) {
+	r := image.Rect(10, 20, 110, 220)
+	if got, want := scaleRect(r, 0.5), image.Rect(5, 10, 55, 110); got != want {
+		t.Errorf("scaleRect(%v, 0.5) = %v, want %v", r, got, want)
+	}
+	r = image.Rect(12, 20, 112, 220)
+	if got := scaleRect(scaleRect(r, 0.25), 4); got != r {
+		t.Errorf("scaling down and back up gave %v, want %v", got, r)
+	}
+}
+
+func TestLoadMotionConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_MOTION", "true")
+	t.Setenv("GIZMATRON_MOTION_SENSITIVITY", "0.8")
+	t.Setenv("GIZMATRON_MOTION_MIN_AREA", "nope")
+	t.Setenv("GIZMATRON_MOTION_OVERLAY", "true")
+
+	config := loadMotionConfig()
+	if !config.Enabled || config.Sensitivity != 0.8 || config.MinArea != DefaultMotionMinArea || !config.Overlay {
+		t.Errorf("config = %+v", config)
+	}
+}
@@ -0,0 +1,152 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestExecutor(t *testing.T) (*MotionExecutor, *Arm) {
+	t.Helper()
+	arm, _ := newTestArm(t)
+	e := NewMotionExecutor(arm)
+	t.Cleanup(e.Close)
+	return e, arm
+}
+
+// blockingCommand runs until ctx is cancelled, started is closed once it is running
+func blockingCommand(started chan struct{}) MotionCommand {
+	return func(ctx context.Context, a *Arm) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+}
+
+func TestMotionExecutor_RunsJobsInOrder(t *testing.T) {
+	e, _ := newTestExecutor(t)
+
+	var mux sync.Mutex
+	var order []int
+	var ids []string
+	for i := 0; i < 3; i++ {
+		i := i
+		job, err := e.Submit("step", func(ctx context.Context, a *Arm) error {
+			mux.Lock()
+			defer mux.Unlock()
+			order = append(order, i)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State != JobQueued {
+			t.Errorf("new job state = %v, want %v", job.State, JobQueued)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	job, err := e.Wait(context.Background(), ids[2])
+	if err != nil || job.State != JobDone {
+		t.Fatalf("last job = %v %v, want done", job.State, err)
+	}
+	if job.Started == nil || job.Finished == nil {
+		t.Error("a finished job should have its start and finish times")
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("jobs ran in order %v, want [0 1 2]", order)
+	}
+}
+
+func TestMotionExecutor_Cancel(t *testing.T) {
+	e, _ := newTestExecutor(t)
+
+	started := make(chan struct{})
+	running, _ := e.Submit("block", blockingCommand(started))
+	queued, _ := e.Submit("never runs", func(ctx context.Context, a *Arm) error {
+		t.Error("a cancelled job should never run")
+		return nil
+	})
+	<-started
+
+	if job, _ := e.Job(running.ID); job.State != JobRunning {
+		t.Errorf("job state = %v, want %v", job.State, JobRunning)
+	}
+	if job, err := e.Cancel(queued.ID); err != nil || job.State != JobCancelled {
+		t.Errorf("cancelled queued job = %v %v, want cancelled", job.State, err)
+	}
+	if _, err := e.Cancel(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job, err := e.Wait(context.Background(), running.ID); job.State != JobCancelled || !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled running job = %v %v, want cancelled", job.State, err)
+	}
+
+	if _, err := e.Cancel("nope"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Cancel of unknown job returned %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestMotionExecutor_Failed(t *testing.T) {
+	e, _ := newTestExecutor(t)
+
+	// An out of limits move fails
+	err := e.Run(context.Background(), "bad move", func(ctx context.Context, a *Arm) error {
+		return a.moveTo(ctx, [5]int{90, 0, 0, 180, 200})
+	})
+	var limitErr *JointLimitError
+	if !errors.As(err, &limitErr) {
+		t.Errorf("Run returned %v, want a JointLimitError", err)
+	}
+
+	// and so does a panic, without taking the executor down
+	job, _ := e.Submit("panic", func(ctx context.Context, a *Arm) error { panic("boom") })
+	if job, err := e.Wait(context.Background(), job.ID); job.State != JobFailed || err == nil {
+		t.Errorf("panicking job = %v %v, want failed", job.State, err)
+	}
+	if err := e.Run(context.Background(), "ok", func(ctx context.Context, a *Arm) error { return nil }); err != nil {
+		t.Errorf("executor should keep running after a failed job: %v", err)
+	}
+}
+
+func TestMotionExecutor_WaitCancelsOnContext(t *testing.T) {
+	e, _ := newTestExecutor(t)
+
+	started := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := e.Run(ctx, "block", func(ctx context.Context, a *Arm) error {
+		return blockingCommand(started)(ctx, a)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v, want context.Canceled", err)
+	}
+}
+
+func TestMotionExecutor_EmergencyStopFails(t *testing.T) {
+	e, arm := newTestExecutor(t)
+	arm.driver.SetCalibration(DefaultArmCalibration())
+
+	job, _ := e.Submit("slow move", func(ctx context.Context, a *Arm) error {
+		return a.moveTo(ctx, [5]int{0, 90, 90, 90, 90})
+	})
+	time.Sleep(5 * trajectoryTick)
+	arm.EmergencyStop(false)
+
+	if job, err := e.Wait(context.Background(), job.ID); job.State != JobFailed || !errors.Is(err, ErrEmergencyStop) {
+		t.Errorf("e-stopped job = %v %v, want failed with ErrEmergencyStop", job.State, err)
+	}
+}
+
+func TestMotionExecutor_Closed(t *testing.T) {
+	arm, _ := newTestArm(t)
+	e := NewMotionExecutor(arm)
+	e.Close()
+	if _, err := e.Submit("late", func(ctx context.Context, a *Arm) error { return nil }); !errors.Is(err, ErrMotionClosed) {
+		t.Errorf("Submit after Close returned %v, want ErrMotionClosed", err)
+	}
+}
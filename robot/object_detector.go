@@ -0,0 +1,636 @@
+package robot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Object detection
+
+	While it is on, the object detector looks at a frame at most every
+	interval, in the background so the stream doesn't wait for it. It runs an
+	OpenCV DNN model on the CPU, one of two kinds:
+
+	  ssd   MobileNet-SSD, the Caffe model trained on the 20 VOC classes
+	        (person, cat, dog, bottle, chair...), fast enough for a Pi
+	  yolo  a YOLOv5 or YOLOv8 model exported to ONNX, trained on the 80 COCO
+	        classes unless a labels file says otherwise; better, and slower
+
+	The model is loaded when the detector is configured, or in the background
+	the first time it is offered a frame, which can take seconds on a Pi.
+	Frames are skipped until it's ready.
+
+	Each run's labeled boxes are kept for the status and, with the overlay on,
+	drawn into every frame until the next run. When what is in view changes,
+	the labels seen differ from the last run's, an objects_changed event is
+	published.
+*/
+
+// Object detection model formats
+const (
+	ObjectFormatSSD  = "ssd"
+	ObjectFormatYOLO = "yolo"
+)
+
+// Object detector defaults, each can be overridden with GIZMATRON_OBJECTS* env vars or the API
+const (
+	DefaultObjectFormat     = ObjectFormatSSD
+	DefaultObjectConfidence = 0.5
+	DefaultObjectNMS        = 0.45
+	DefaultObjectInterval   = 500 * time.Millisecond
+
+	objectSSDInput  = 300 // MobileNet-SSD looks at frames scaled to 300x300
+	objectYOLOInput = 640 // and YOLO at 640x640
+)
+
+// Where each format's model is looked for when no path is configured
+var defaultObjectModels = map[string][2]string{
+	ObjectFormatSSD:  {"models/MobileNetSSD_deploy.caffemodel", "models/MobileNetSSD_deploy.prototxt"},
+	ObjectFormatYOLO: {"models/yolov8n.onnx", ""},
+}
+
+// The classes each format's default model was trained on, in the order it numbers them
+var (
+	vocLabels = []string{
+		"background", "aeroplane", "bicycle", "bird", "boat", "bottle", "bus", "car", "cat", "chair", "cow",
+		"diningtable", "dog", "horse", "motorbike", "person", "pottedplant", "sheep", "sofa", "train", "tvmonitor",
+	}
+	cocoLabels = []string{
+		"person", "bicycle", "car", "motorcycle", "airplane", "bus", "train", "truck", "boat", "traffic light",
+		"fire hydrant", "stop sign", "parking meter", "bench", "bird", "cat", "dog", "horse", "sheep", "cow",
+		"elephant", "bear", "zebra", "giraffe", "backpack", "umbrella", "handbag", "tie", "suitcase", "frisbee",
+		"skis", "snowboard", "sports ball", "kite", "baseball bat", "baseball glove", "skateboard", "surfboard", "tennis racket", "bottle",
+		"wine glass", "cup", "fork", "knife", "spoon", "bowl", "banana", "apple", "sandwich", "orange",
+		"broccoli", "carrot", "hot dog", "pizza", "donut", "cake", "chair", "couch", "potted plant", "bed",
+		"dining table", "toilet", "tv", "laptop", "mouse", "remote", "keyboard", "cell phone", "microwave", "oven",
+		"toaster", "sink", "refrigerator", "book", "clock", "vase", "scissors", "teddy bear", "hair drier", "toothbrush",
+	}
+)
+
+var ErrInvalidObjectConfig = errors.New("invalid object detector config")
+
+// ObjectDetectorConfig picks the object detection model and tunes it. Zero values mean the defaults.
+type ObjectDetectorConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Format      string   `json:"format"`       // ssd or yolo
+	Model       string   `json:"model"`        // model file, the format's default when empty
+	ModelConfig string   `json:"model_config"` // network description for models that need one, ssd's prototxt
+	Labels      string   `json:"labels"`       // file of class names one per line, the format's default classes when empty
+	Confidence  float64  `json:"confidence"`   // 0-1, weaker detections are dropped
+	NMS         float64  `json:"nms"`          // 0-1, overlap above which boxes of the same class are merged
+	IntervalMs  int      `json:"interval_ms"`  // look at a frame at most this often
+	Classes     []string `json:"classes"`      // only report these, all of them when empty
+	Overlay     bool     `json:"overlay"`      // draw the boxes into the stream
+}
+
+// withDefaults fills in zero values and checks the ranges.
+func (c ObjectDetectorConfig) withDefaults() (ObjectDetectorConfig, error) {
+	if c.Format == "" {
+		c.Format = DefaultObjectFormat
+	}
+	if c.Confidence == 0 {
+		c.Confidence = DefaultObjectConfidence
+	}
+	if c.NMS == 0 {
+		c.NMS = DefaultObjectNMS
+	}
+	if c.IntervalMs == 0 {
+		c.IntervalMs = int(DefaultObjectInterval.Milliseconds())
+	}
+	defaults, ok := defaultObjectModels[c.Format]
+	if !ok {
+		return c, fmt.Errorf("%w: unknown format %q, want ssd or yolo", ErrInvalidObjectConfig, c.Format)
+	}
+	if c.Confidence < 0 || c.Confidence > 1 {
+		return c, fmt.Errorf("%w: confidence %v is outside 0-1", ErrInvalidObjectConfig, c.Confidence)
+	}
+	if c.NMS < 0 || c.NMS > 1 {
+		return c, fmt.Errorf("%w: nms %v is outside 0-1", ErrInvalidObjectConfig, c.NMS)
+	}
+	if c.IntervalMs < 0 {
+		return c, fmt.Errorf("%w: interval %vms must be positive", ErrInvalidObjectConfig, c.IntervalMs)
+	}
+	if c.Model == "" {
+		c.Model = defaults[0]
+		if c.ModelConfig == "" {
+			c.ModelConfig = defaults[1]
+		}
+	}
+	return c, nil
+}
+
+func (c ObjectDetectorConfig) interval() time.Duration {
+	return time.Duration(c.IntervalMs) * time.Millisecond
+}
+
+// loadObjectDetectorConfig loads the object detector config from GIZMATRON_OBJECTS* env vars
+func loadObjectDetectorConfig() ObjectDetectorConfig {
+	config := ObjectDetectorConfig{
+		Format:     DefaultObjectFormat,
+		Confidence: DefaultObjectConfidence,
+		NMS:        DefaultObjectNMS,
+		IntervalMs: int(DefaultObjectInterval.Milliseconds()),
+	}
+	if enabled := os.Getenv("GIZMATRON_OBJECTS"); enabled != "" {
+		if e, err := strconv.ParseBool(enabled); err == nil {
+			config.Enabled = e
+		} else {
+			log.Printf("Warning!! GIZMATRON_OBJECTS %q is not true or false, object detection is off", enabled)
+		}
+	}
+	if format := os.Getenv("GIZMATRON_OBJECTS_FORMAT"); format != "" {
+		if _, ok := defaultObjectModels[format]; ok {
+			config.Format = format
+		} else {
+			log.Printf("Warning!! GIZMATRON_OBJECTS_FORMAT %q is not ssd or yolo, using %v", format, config.Format)
+		}
+	}
+	config.Model = os.Getenv("GIZMATRON_OBJECTS_MODEL")
+	config.ModelConfig = os.Getenv("GIZMATRON_OBJECTS_MODEL_CONFIG")
+	config.Labels = os.Getenv("GIZMATRON_OBJECTS_LABELS")
+	if confidence := os.Getenv("GIZMATRON_OBJECTS_CONFIDENCE"); confidence != "" {
+		if c, err := strconv.ParseFloat(confidence, 64); err == nil && c > 0 && c <= 1 {
+			config.Confidence = c
+		} else {
+			log.Printf("Warning!! GIZMATRON_OBJECTS_CONFIDENCE %q is not between 0 and 1, using %v", confidence, config.Confidence)
+		}
+	}
+	if interval := os.Getenv("GIZMATRON_OBJECTS_INTERVAL_MS"); interval != "" {
+		if ms, err := strconv.Atoi(interval); err == nil && ms > 0 {
+			config.IntervalMs = ms
+		} else {
+			log.Printf("Warning!! GIZMATRON_OBJECTS_INTERVAL_MS %q is not a positive number of ms, using %v", interval, config.IntervalMs)
+		}
+	}
+	if overlay := os.Getenv("GIZMATRON_OBJECTS_OVERLAY"); overlay != "" {
+		if o, err := strconv.ParseBool(overlay); err == nil {
+			config.Overlay = o
+		} else {
+			log.Printf("Warning!! GIZMATRON_OBJECTS_OVERLAY %q is not true or false, using %v", overlay, config.Overlay)
+		}
+	}
+	return config
+}
+
+// DetectedObject is something the object detector found in a frame.
+type DetectedObject struct {
+	Label      string          `json:"label"`
+	Class      int             `json:"class"`      // the model's number for the label
+	Confidence float64         `json:"confidence"` // 0-1
+	Box        image.Rectangle `json:"box"`        // frame pixels
+}
+
+// ObjectResult is what the object detector found in one frame.
+type ObjectResult struct {
+	Objects []DetectedObject `json:"objects"`
+	At      time.Time        `json:"at"`
+	TookMs  int64            `json:"took_ms"` // how long the model took
+}
+
+// labels returns the distinct labels found, sorted
+func (r ObjectResult) labels() []string {
+	seen := map[string]bool{}
+	var labels []string
+	for _, object := range r.Objects {
+		if !seen[object.Label] {
+			seen[object.Label] = true
+			labels = append(labels, object.Label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// ObjectStatus is a snapshot of the object detector.
+type ObjectStatus struct {
+	Config  ObjectDetectorConfig `json:"config"`
+	Loaded  bool                 `json:"loaded"`            // the model has been loaded
+	Loading bool                 `json:"loading,omitempty"` // the model is being loaded in the background
+	Error   string               `json:"error,omitempty"`   // why the model couldn't be loaded
+	Last    *ObjectResult        `json:"last,omitempty"`
+}
+
+// objectModel is a loaded object detection model
+type objectModel interface {
+	detect(img gocv.Mat, config ObjectDetectorConfig) []DetectedObject
+	Close()
+}
+
+// ObjectDetector finds labeled objects in frames, in the background.
+type ObjectDetector struct {
+	mux     sync.Mutex
+	config  ObjectDetectorConfig
+	model   objectModel // nil until loaded
+	labels  []string    // the model's class names
+	err     error       // why the model couldn't be loaded, it isn't tried again until the next Configure
+	loading int         // the generation of the model being loaded in the background, 0 when none is
+	gen     int         // goes up with every Configure, a model loaded for an older one is thrown away
+	running objectModel // the model looking at a frame, nil when none is
+	lastRun time.Time
+	last    *ObjectResult
+
+	load func(ObjectDetectorConfig) (objectModel, []string, error) // loads a model, loadObjectModel when nil
+}
+
+// NewObjectDetector makes a detector, it only looks at frames while config.Enabled
+// and loads its model the first time it does.
+func NewObjectDetector(config ObjectDetectorConfig) (*ObjectDetector, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectDetector{config: config}, nil
+}
+
+func (d *ObjectDetector) loadModel(config ObjectDetectorConfig) (objectModel, []string, error) {
+	if d.load != nil {
+		return d.load(config)
+	}
+	return loadObjectModel(config)
+}
+
+// Configure changes the detector's config. When it's enabled the model is
+// loaded straight away, and if it can't be the detector carries on as it was.
+func (d *ObjectDetector) Configure(config ObjectDetectorConfig) (ObjectDetectorConfig, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return config, err
+	}
+	var model objectModel
+	var labels []string
+	if config.Enabled {
+		if model, labels, err = d.loadModel(config); err != nil {
+			return config, fmt.Errorf("%w: %v", ErrInvalidObjectConfig, err)
+		}
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	// A frame still being looked at closes the old model when it's done, see Offer
+	if d.model != nil && d.model != d.running {
+		d.model.Close()
+	}
+	d.config, d.model, d.labels, d.err = config, model, labels, nil
+	d.gen++
+	d.loading = 0
+	d.last = nil
+	log.Printf("Object detection: enabled %v, %v model %v, confidence %v, every %vms", config.Enabled, config.Format, config.Model, config.Confidence, config.IntervalMs)
+	return config, nil
+}
+
+// Enabled reports whether the detector is looking at frames.
+func (d *ObjectDetector) Enabled() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.config.Enabled
+}
+
+// Offer hands the detector a frame. If it isn't busy and it's been long enough
+// since the last one, it looks at a copy of img in the background and
+// publishes an objects_changed event to events if what's in view has changed.
+// It reports whether it took the frame.
+func (d *ObjectDetector) Offer(img gocv.Mat, events *EventBus) bool {
+	d.mux.Lock()
+	if !d.config.Enabled || d.running != nil || d.err != nil || d.loading != 0 {
+		d.mux.Unlock()
+		return false
+	}
+	if d.model == nil {
+		// Offer is called from the capture, which can't wait seconds for a model
+		d.gen++
+		d.loading = d.gen
+		go d.loadInBackground(d.config, d.gen)
+		d.mux.Unlock()
+		return false
+	}
+	if img.Empty() || time.Since(d.lastRun) < d.config.interval() {
+		d.mux.Unlock()
+		return false
+	}
+	d.running, d.lastRun = d.model, time.Now()
+	model, config, labels := d.model, d.config, d.labels
+	d.mux.Unlock()
+
+	frame := img.Clone()
+	go func() {
+		defer frame.Close()
+		start := time.Now()
+		objects := filterObjects(model.detect(frame, config), labels, config)
+		result := &ObjectResult{Objects: objects, At: start, TookMs: time.Since(start).Milliseconds()}
+
+		d.mux.Lock()
+		d.running = nil
+		if model != d.model {
+			// Configured with another model while this one was running
+			model.Close()
+			d.mux.Unlock()
+			return
+		}
+		changed := d.last == nil && len(objects) > 0 || d.last != nil && !equalStrings(d.last.labels(), result.labels())
+		d.last = result
+		d.mux.Unlock()
+
+		if changed {
+			events.Publish(EventObjectsChanged, result)
+		}
+	}()
+	return true
+}
+
+// loadInBackground loads the model for config, unless the detector has been configured since gen
+func (d *ObjectDetector) loadInBackground(config ObjectDetectorConfig, gen int) {
+	model, labels, err := d.loadModel(config)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if gen != d.gen {
+		if model != nil {
+			model.Close()
+		}
+		return
+	}
+	d.loading = 0
+	if err != nil {
+		log.Printf("Error !! Could not load the %v object detector, no objects will be found: %v", config.Format, err)
+		d.err = err
+		return
+	}
+	d.model, d.labels = model, labels
+}
+
+// Overlay reports the boxes to draw into the stream, if any.
+func (d *ObjectDetector) Overlay() []DetectedObject {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if !d.config.Enabled || !d.config.Overlay || d.last == nil {
+		return nil
+	}
+	return d.last.Objects
+}
+
+// Status reports the detector's config and what it last found.
+func (d *ObjectDetector) Status() ObjectStatus {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	status := ObjectStatus{Config: d.config, Loaded: d.model != nil, Loading: d.loading != 0}
+	status.Config.Classes = append([]string(nil), d.config.Classes...)
+	if d.err != nil {
+		status.Error = d.err.Error()
+	}
+	if d.last != nil {
+		last := *d.last
+		status.Last = &last
+	}
+	return status
+}
+
+// filterObjects names the objects, drops the ones not asked for and merges overlapping boxes
+func filterObjects(objects []DetectedObject, labels []string, config ObjectDetectorConfig) []DetectedObject {
+	wanted := map[string]bool{}
+	for _, class := range config.Classes {
+		wanted[class] = true
+	}
+
+	var kept []DetectedObject
+	for _, object := range objects {
+		if object.Confidence < config.Confidence {
+			continue
+		}
+		if object.Class >= 0 && object.Class < len(labels) {
+			object.Label = labels[object.Class]
+		} else {
+			object.Label = strconv.Itoa(object.Class)
+		}
+		if len(wanted) > 0 && !wanted[object.Label] {
+			continue
+		}
+		kept = append(kept, object)
+	}
+	return nms(kept, config.NMS)
+}
+
+// nms keeps the most confident of each group of boxes of the same class that overlap by more than threshold
+func nms(objects []DetectedObject, threshold float64) []DetectedObject {
+	sort.SliceStable(objects, func(i, j int) bool { return objects[i].Confidence > objects[j].Confidence })
+	var kept []DetectedObject
+	for _, object := range objects {
+		overlaps := false
+		for _, k := range kept {
+			if k.Class == object.Class && iou(k.Box, object.Box) > threshold {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			kept = append(kept, object)
+		}
+	}
+	return kept
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// drawObjects boxes and labels the objects on img in green
+func drawObjects(img *gocv.Mat, objects []DetectedObject) {
+	green := color.RGBA{0, 255, 0, 0}
+	for _, object := range objects {
+		gocv.Rectangle(img, object.Box, green, 2)
+		label := fmt.Sprintf("%s %.2f", object.Label, object.Confidence)
+		gocv.PutText(img, label, image.Pt(object.Box.Min.X, max(object.Box.Min.Y-6, 12)), gocv.FontHersheySimplex, 0.5, green, 1)
+	}
+}
+
+// readLabels reads a file of class names, one per line
+func readLabels(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var labels []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		labels = append(labels, strings.TrimSpace(scanner.Text()))
+	}
+	return labels, scanner.Err()
+}
+
+// loadObjectModel reads config's model, and its labels, from disk
+func loadObjectModel(config ObjectDetectorConfig) (objectModel, []string, error) {
+	labels := vocLabels
+	if config.Format == ObjectFormatYOLO {
+		labels = cocoLabels
+	}
+	if config.Labels != "" {
+		var err error
+		if labels, err = readLabels(config.Labels); err != nil {
+			return nil, nil, fmt.Errorf("object labels: %w", err)
+		}
+	}
+
+	for _, path := range []string{config.Model, config.ModelConfig} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil, fmt.Errorf("object model: %w", err)
+		}
+	}
+	net := gocv.ReadNet(config.Model, config.ModelConfig)
+	if net.Empty() {
+		net.Close()
+		return nil, nil, fmt.Errorf("could not load %v model %v", config.Format, config.Model)
+	}
+	net.SetPreferableBackend(gocv.NetBackendDefault)
+	net.SetPreferableTarget(gocv.NetTargetCPU)
+
+	if config.Format == ObjectFormatYOLO {
+		return &yoloObjects{net: net}, labels, nil
+	}
+	return &ssdObjects{net: net}, labels, nil
+}
+
+// ssdObjects finds objects with MobileNet-SSD
+type ssdObjects struct {
+	net gocv.Net
+}
+
+func (s *ssdObjects) detect(img gocv.Mat, config ObjectDetectorConfig) []DetectedObject {
+	blob := gocv.BlobFromImage(img, 1/127.5, image.Pt(objectSSDInput, objectSSDInput), gocv.NewScalar(127.5, 127.5, 127.5, 0), false, false)
+	defer blob.Close()
+	s.net.SetInput(blob, "")
+	out := s.net.Forward("")
+	defer out.Close()
+
+	values, err := out.DataPtrFloat32()
+	if err != nil {
+		return nil
+	}
+	return parseSSD(values, image.Pt(img.Cols(), img.Rows()), config.Confidence)
+}
+
+func (s *ssdObjects) Close() {
+	s.net.Close()
+}
+
+// parseSSD reads an SSD's detections: 7 floats each, the image, the class,
+// the confidence and then the box as fractions of the frame
+func parseSSD(values []float32, frame image.Point, minConfidence float64) []DetectedObject {
+	bounds := image.Rectangle{Max: frame}
+	var objects []DetectedObject
+	for i := 0; i+7 <= len(values); i += 7 {
+		confidence := float64(values[i+2])
+		if confidence < minConfidence {
+			continue
+		}
+		box := image.Rect(
+			int(values[i+3]*float32(frame.X)),
+			int(values[i+4]*float32(frame.Y)),
+			int(values[i+5]*float32(frame.X)),
+			int(values[i+6]*float32(frame.Y)),
+		).Intersect(bounds)
+		if !box.Empty() {
+			objects = append(objects, DetectedObject{Class: int(values[i+1]), Confidence: confidence, Box: box})
+		}
+	}
+	return objects
+}
+
+// yoloObjects finds objects with a YOLOv5 or YOLOv8 ONNX model
+type yoloObjects struct {
+	net gocv.Net
+}
+
+func (y *yoloObjects) detect(img gocv.Mat, config ObjectDetectorConfig) []DetectedObject {
+	blob := gocv.BlobFromImage(img, 1/255.0, image.Pt(objectYOLOInput, objectYOLOInput), gocv.NewScalar(0, 0, 0, 0), true, false)
+	defer blob.Close()
+	y.net.SetInput(blob, "")
+	out := y.net.Forward("")
+	defer out.Close()
+
+	size := out.Size()
+	if len(size) != 3 {
+		return nil
+	}
+	values, err := out.DataPtrFloat32()
+	if err != nil {
+		return nil
+	}
+	return parseYOLO(values, size[1], size[2], image.Pt(img.Cols(), img.Rows()), objectYOLOInput, config.Confidence)
+}
+
+func (y *yoloObjects) Close() {
+	y.net.Close()
+}
+
+// parseYOLO reads a YOLO model's output, rows by cols. YOLOv5 gives a row per
+// candidate of its box's centre, width and height, how sure it is there's an
+// object there and then a score per class. YOLOv8 leaves out the objectness
+// and gives them the other way round, a row per value and a column per candidate.
+func parseYOLO(values []float32, rows, cols int, frame image.Point, input int, minConfidence float64) []DetectedObject {
+	if len(values) < rows*cols {
+		return nil
+	}
+	v8 := rows < cols
+	candidates, attributes := rows, cols
+	at := func(i, a int) float32 { return values[i*cols+a] }
+	if v8 {
+		candidates, attributes = cols, rows
+		at = func(i, a int) float32 { return values[a*cols+i] }
+	}
+	firstClass := 5
+	if v8 {
+		firstClass = 4
+	}
+
+	bounds := image.Rectangle{Max: frame}
+	scaleX, scaleY := float32(frame.X)/float32(input), float32(frame.Y)/float32(input)
+	var objects []DetectedObject
+	for i := 0; i < candidates; i++ {
+		objectness := float32(1)
+		if !v8 {
+			objectness = at(i, 4)
+		}
+		class, score := -1, float32(0)
+		for a := firstClass; a < attributes; a++ {
+			if s := at(i, a); s > score {
+				class, score = a-firstClass, s
+			}
+		}
+		confidence := float64(objectness * score)
+		if class < 0 || confidence < minConfidence {
+			continue
+		}
+		cx, cy, w, h := at(i, 0)*scaleX, at(i, 1)*scaleY, at(i, 2)*scaleX, at(i, 3)*scaleY
+		box := image.Rect(int(cx-w/2), int(cy-h/2), int(cx+w/2), int(cy+h/2)).Intersect(bounds)
+		if !box.Empty() {
+			objects = append(objects, DetectedObject{Class: class, Confidence: confidence, Box: box})
+		}
+	}
+	return objects
+}
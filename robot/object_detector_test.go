@@ -0,0 +1,281 @@
+package robot
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+// fakeObjectModel finds the same objects in every frame
+type fakeObjectModel struct {
+	objects []DetectedObject
+	closed  bool
+}
+
+func (m *fakeObjectModel) detect(img gocv.Mat, config ObjectDetectorConfig) []DetectedObject {
+	return m.objects
+}
+func (m *fakeObjectModel) Close() { m.closed = true }
+
+func TestObjectDetectorConfig_WithDefaults(t *testing.T) {
+	config, err := ObjectDetectorConfig{}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults returned error: %v", err)
+	}
+	if config.Format != ObjectFormatSSD || config.Confidence != DefaultObjectConfidence || config.NMS != DefaultObjectNMS ||
+		config.interval() != DefaultObjectInterval || config.ModelConfig != defaultObjectModels[ObjectFormatSSD][1] {
+		t.Errorf("defaults = %+v", config)
+	}
+
+	yolo, _ := ObjectDetectorConfig{Format: ObjectFormatYOLO}.withDefaults()
+	if yolo.Model != defaultObjectModels[ObjectFormatYOLO][0] || yolo.ModelConfig != "" {
+		t.Errorf("yolo defaults = %+v", yolo)
+	}
+	own, _ := ObjectDetectorConfig{Model: "ssd.onnx"}.withDefaults()
+	if own.ModelConfig != "" {
+		t.Errorf("a model of its own shouldn't get the default prototxt: %+v", own)
+	}
+
+	for _, bad := range []ObjectDetectorConfig{
+		{Format: "rcnn"},
+		{Confidence: 1.5},
+		{NMS: -0.1},
+		{IntervalMs: -1},
+	} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidObjectConfig) {
+			t.Errorf("%+v: err = %v, want %v", bad, err, ErrInvalidObjectConfig)
+		}
+	}
+}
+
+func TestParseSSD(t *testing.T) {
+	values := []float32{
+		0, 15, 0.9, 0.1, 0.2, 0.5, 0.6, // a person
+		0, 8, 0.3, 0, 0, 0.5, 0.5, // not sure enough
+		0, 5, 0.8, 0.9, 0.9, 1.2, 1.2, // a bottle partly off the frame
+		0, 5, 0.8, 1.1, 1.1, 1.2, 1.2, // all off it
+	}
+	objects := parseSSD(values, image.Pt(200, 100), 0.5)
+	if len(objects) != 2 {
+		t.Fatalf("found %+v, want 2 objects", objects)
+	}
+	if objects[0].Class != 15 || objects[0].Box != image.Rect(20, 20, 100, 60) {
+		t.Errorf("person = %+v", objects[0])
+	}
+	if objects[1].Box != image.Rect(180, 90, 200, 100) {
+		t.Errorf("bottle = %+v, want it clipped to the frame", objects[1])
+	}
+}
+
+func TestParseYOLO(t *testing.T) {
+	// Candidates over 2 classes: box centre, size, then the class scores. Real
+	// models give thousands, which is how the two layouts are told apart.
+	candidates := [][]float32{
+		{320, 320, 64, 128, 0.1, 0.9},
+		{100, 100, 10, 10, 0.2, 0.3},
+	}
+	for len(candidates) < 8 {
+		candidates = append(candidates, make([]float32, 6))
+	}
+	frame := image.Pt(1280, 640)
+	want := DetectedObject{Class: 1, Confidence: 0.9, Box: image.Rect(576, 256, 704, 384)}
+
+	// YOLOv8 gives a row per value and a column per candidate
+	var v8 []float32
+	for a := range candidates[0] {
+		for i := range candidates {
+			v8 = append(v8, candidates[i][a])
+		}
+	}
+	objects := parseYOLO(v8, 6, 8, frame, 640, 0.5)
+	if len(objects) != 1 || objects[0].Class != want.Class || objects[0].Box != want.Box {
+		t.Errorf("v8 found %+v, want %+v", objects, want)
+	}
+
+	// YOLOv5 gives a row per candidate, with how sure it is there's an object before the class scores
+	var v5 []float32
+	for _, c := range candidates {
+		v5 = append(v5, c[:4]...)
+		v5 = append(v5, 0.5)
+		v5 = append(v5, c[4:]...)
+	}
+	objects = parseYOLO(v5, 8, 7, frame, 640, 0.4)
+	if len(objects) != 1 || objects[0].Box != want.Box || objects[0].Confidence < 0.44 || objects[0].Confidence > 0.46 {
+		t.Errorf("v5 found %+v, want %+v at 0.45", objects, want)
+	}
+
+	if objects := parseYOLO(v8[:5], 6, 8, frame, 640, 0.5); objects != nil {
+		t.Errorf("short output found %+v", objects)
+	}
+}
+
+func TestFilterObjects(t *testing.T) {
+	config := ObjectDetectorConfig{Confidence: 0.5, NMS: 0.45}
+	labels := []string{"person", "cup"}
+	found := []DetectedObject{
+		{Class: 0, Confidence: 0.7, Box: image.Rect(0, 0, 100, 100)},
+		{Class: 0, Confidence: 0.9, Box: image.Rect(5, 5, 100, 100)},   // the same person, more sure
+		{Class: 1, Confidence: 0.8, Box: image.Rect(10, 10, 100, 100)}, // a cup in the same place is kept
+		{Class: 1, Confidence: 0.4, Box: image.Rect(200, 200, 220, 220)},
+		{Class: 7, Confidence: 0.6, Box: image.Rect(300, 300, 320, 320)},
+	}
+
+	objects := filterObjects(append([]DetectedObject(nil), found...), labels, config)
+	if len(objects) != 3 {
+		t.Fatalf("kept %+v, want 3 objects", objects)
+	}
+	if objects[0].Label != "person" || objects[0].Confidence != 0.9 || objects[1].Label != "cup" || objects[2].Label != "7" {
+		t.Errorf("kept %+v", objects)
+	}
+
+	config.Classes = []string{"cup"}
+	objects = filterObjects(append([]DetectedObject(nil), found...), labels, config)
+	if len(objects) != 1 || objects[0].Label != "cup" {
+		t.Errorf("kept %+v, want only the cup", objects)
+	}
+}
+
+func TestObjectDetector_Configure(t *testing.T) {
+	d, err := NewObjectDetector(ObjectDetectorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads := 0
+	d.load = func(ObjectDetectorConfig) (objectModel, []string, error) {
+		loads++
+		return &fakeObjectModel{}, vocLabels, nil
+	}
+
+	// Off, there's no model to load
+	if _, err := d.Configure(ObjectDetectorConfig{Format: ObjectFormatYOLO}); err != nil || loads != 0 {
+		t.Fatalf("Configure = %v, loaded %d times", err, loads)
+	}
+	config, err := d.Configure(ObjectDetectorConfig{Enabled: true, Overlay: true})
+	if err != nil || loads != 1 {
+		t.Fatalf("Configure = %v, loaded %d times", err, loads)
+	}
+	if status := d.Status(); !status.Loaded || status.Config.Format != ObjectFormatSSD || status.Config.IntervalMs != config.IntervalMs {
+		t.Errorf("status = %+v", status)
+	}
+	if d.Overlay() != nil {
+		t.Error("overlay before anything was found")
+	}
+	d.last = &ObjectResult{Objects: []DetectedObject{{Label: "cat"}}, At: time.Now()}
+	if len(d.Overlay()) != 1 {
+		t.Error("no overlay of what was found")
+	}
+
+	// A model that can't be loaded leaves the detector as it was
+	old := d.model.(*fakeObjectModel)
+	d.load = func(ObjectDetectorConfig) (objectModel, []string, error) { return nil, nil, os.ErrNotExist }
+	if _, err := d.Configure(ObjectDetectorConfig{Enabled: true, Format: ObjectFormatYOLO}); !errors.Is(err, ErrInvalidObjectConfig) {
+		t.Errorf("Configure err = %v, want %v", err, ErrInvalidObjectConfig)
+	}
+	if status := d.Status(); status.Config.Format != ObjectFormatSSD || !status.Loaded || old.closed {
+		t.Errorf("status = %+v, want the old config and model", status)
+	}
+}
+
+func TestObjectDetector_LoadsInBackground(t *testing.T) {
+	d, _ := NewObjectDetector(ObjectDetectorConfig{Enabled: true})
+	release := make(chan struct{})
+	model := &fakeObjectModel{}
+	d.load = func(ObjectDetectorConfig) (objectModel, []string, error) {
+		<-release
+		return model, vocLabels, nil
+	}
+	img := gocv.NewMat()
+	defer img.Close()
+
+	// The frame isn't held up by the load, nor are the frames after it
+	if d.Offer(img, nil) || d.Offer(img, nil) {
+		t.Error("took a frame before the model was loaded")
+	}
+	if status := d.Status(); !status.Loading || status.Loaded {
+		t.Errorf("status = %+v, want loading", status)
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for !d.Status().Loaded && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if status := d.Status(); status.Loading || !status.Loaded {
+		t.Errorf("status = %+v, want loaded", status)
+	}
+
+	// A load overtaken by Configure is thrown away
+	d, _ = NewObjectDetector(ObjectDetectorConfig{Enabled: true})
+	release = make(chan struct{})
+	started := make(chan struct{})
+	stale := &fakeObjectModel{}
+	var loads atomic.Int32
+	d.load = func(ObjectDetectorConfig) (objectModel, []string, error) {
+		if loads.Add(1) == 1 {
+			close(started)
+			<-release
+			return stale, vocLabels, nil
+		}
+		return model, vocLabels, nil
+	}
+	d.Offer(img, nil)
+	<-started
+	if _, err := d.Configure(ObjectDetectorConfig{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	deadline = time.Now().Add(time.Second)
+	for {
+		d.mux.Lock()
+		closed := stale.closed
+		current, loading := d.model, d.loading
+		d.mux.Unlock()
+		if closed || time.Now().After(deadline) {
+			if !closed || current != model || loading != 0 {
+				t.Errorf("model = %v, loading %v, stale closed %v, want the configured one", current, loading, closed)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoadObjectModel_Missing(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.onnx")
+	if _, _, err := loadObjectModel(ObjectDetectorConfig{Format: ObjectFormatYOLO, Model: missing}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("err = %v, want %v", err, os.ErrNotExist)
+	}
+
+	labels := filepath.Join(t.TempDir(), "labels.txt")
+	if err := os.WriteFile(labels, []byte("gizmo\nwidget\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readLabels(labels); err != nil || len(got) != 2 || got[1] != "widget" {
+		t.Errorf("readLabels = %v %v", got, err)
+	}
+}
+
+func TestLoadObjectDetectorConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_OBJECTS", "true")
+	t.Setenv("GIZMATRON_OBJECTS_FORMAT", "yolo")
+	t.Setenv("GIZMATRON_OBJECTS_MODEL", "/models/yolov5s.onnx")
+	t.Setenv("GIZMATRON_OBJECTS_CONFIDENCE", "0.3")
+	t.Setenv("GIZMATRON_OBJECTS_INTERVAL_MS", "soon")
+	t.Setenv("GIZMATRON_OBJECTS_OVERLAY", "1")
+
+	config := loadObjectDetectorConfig()
+	if !config.Enabled || config.Format != ObjectFormatYOLO || config.Model != "/models/yolov5s.onnx" || config.Confidence != 0.3 ||
+		config.IntervalMs != int(DefaultObjectInterval.Milliseconds()) || !config.Overlay {
+		t.Errorf("config = %+v", config)
+	}
+
+	t.Setenv("GIZMATRON_OBJECTS_FORMAT", "rcnn")
+	if config := loadObjectDetectorConfig(); config.Format != DefaultObjectFormat {
+		t.Errorf("format = %v, want %v", config.Format, DefaultObjectFormat)
+	}
+}
@@ -0,0 +1,291 @@
+package robot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Known people
+
+	Each person enrolled is a name and a few face embeddings, the vectors the
+	face recognizer turns a face into. Two pictures of the same face give
+	vectors pointing nearly the same way, so a face is matched to whoever has
+	the sample with the highest cosine similarity to it.
+
+	People are saved to a JSON file, GIZMATRON_PEOPLE (people.json by default).
+	It holds no pictures, only the embeddings, but they are still biometric
+	data about whoever was enrolled.
+*/
+
+// MaxPersonSamples is how many embeddings are kept for a person, enrolling more drops the oldest.
+const MaxPersonSamples = 20
+
+var (
+	ErrPersonNotFound    = errors.New("no such person")
+	ErrInvalidPersonName = errors.New("names are 1-64 letters, digits, spaces or . ' - _")
+	ErrInvalidEnrollment = errors.New("invalid enrollment")
+)
+
+var personNamePattern = regexp.MustCompile(`^[A-Za-z0-9 ._'-]{1,64}$`)
+
+// Person is someone the robot knows.
+type Person struct {
+	Name     string    `json:"name"`
+	Samples  int       `json:"samples"` // embeddings enrolled
+	Enrolled time.Time `json:"enrolled"`
+	Updated  time.Time `json:"updated"`
+}
+
+// storedPerson is a person as they are saved
+type storedPerson struct {
+	Name       string      `json:"name"`
+	Enrolled   time.Time   `json:"enrolled"`
+	Updated    time.Time   `json:"updated"`
+	Embeddings [][]float32 `json:"embeddings"` // normalized to length 1
+}
+
+func (p *storedPerson) person() Person {
+	return Person{Name: p.Name, Samples: len(p.Embeddings), Enrolled: p.Enrolled, Updated: p.Updated}
+}
+
+// PeopleStore holds the people enrolled and keeps them saved to a file.
+type PeopleStore struct {
+	mux    sync.Mutex
+	path   string
+	people map[string]*storedPerson
+}
+
+// checkPersonName reports whether name can be enrolled
+func checkPersonName(name string) error {
+	if !personNamePattern.MatchString(name) {
+		return ErrInvalidPersonName
+	}
+	return nil
+}
+
+// NewPeopleStore loads the people saved at path. A missing file just means nobody has been enrolled yet.
+func NewPeopleStore(path string) (*PeopleStore, error) {
+	s := &PeopleStore{path: path, people: make(map[string]*storedPerson)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+
+	var people []*storedPerson
+	if err := json.Unmarshal(data, &people); err != nil {
+		return s, fmt.Errorf("invalid people file %v: %w", path, err)
+	}
+	for _, p := range people {
+		if err := checkPersonName(p.Name); err != nil {
+			log.Printf("Warning!! skipping person %q in %v: %v", p.Name, path, err)
+			continue
+		}
+		if len(p.Embeddings) == 0 {
+			log.Printf("Warning!! skipping person %q in %v: no samples", p.Name, path)
+			continue
+		}
+		s.people[p.Name] = p
+	}
+	return s, nil
+}
+
+// loadPeopleStore loads the file named by GIZMATRON_PEOPLE.
+// The robot should always come up, so a broken file leaves nobody enrolled.
+func loadPeopleStore() *PeopleStore {
+	path := os.Getenv("GIZMATRON_PEOPLE")
+	if path == "" {
+		path = "people.json"
+	}
+
+	people, err := NewPeopleStore(path)
+	if err != nil {
+		log.Printf("Warning!! Could not load people, nobody is enrolled: %v", err)
+	}
+	return people
+}
+
+// List returns everyone enrolled, by name.
+func (s *PeopleStore) List() []Person {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	people := make([]Person, 0, len(s.people))
+	for _, p := range s.people {
+		people = append(people, p.person())
+	}
+	sort.Slice(people, func(i, j int) bool { return people[i].Name < people[j].Name })
+	return people
+}
+
+// Len is how many people are enrolled.
+func (s *PeopleStore) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.people)
+}
+
+// Get returns the person enrolled under name.
+func (s *PeopleStore) Get(name string) (Person, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	p, ok := s.people[name]
+	if !ok {
+		return Person{}, ErrPersonNotFound
+	}
+	return p.person(), nil
+}
+
+// Enroll adds embeddings to name, enrolling them if they are new, and writes the store out.
+func (s *PeopleStore) Enroll(name string, embeddings [][]float32) (Person, error) {
+	if err := checkPersonName(name); err != nil {
+		return Person{}, err
+	}
+	if len(embeddings) == 0 {
+		return Person{}, fmt.Errorf("%w: no samples of %v", ErrInvalidEnrollment, name)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	size := len(embeddings[0])
+	for _, p := range s.people {
+		size = len(p.Embeddings[0])
+		break
+	}
+	normalized := make([][]float32, len(embeddings))
+	for i, embedding := range embeddings {
+		if len(embedding) != size {
+			return Person{}, fmt.Errorf("%w: a sample is %d long, the enrolled ones are %d", ErrInvalidEnrollment, len(embedding), size)
+		}
+		normalized[i] = normalize(embedding)
+	}
+
+	now := time.Now()
+	previous, existed := s.people[name]
+	p := &storedPerson{Name: name, Enrolled: now, Updated: now}
+	if existed {
+		p.Enrolled = previous.Enrolled
+		p.Embeddings = append(p.Embeddings, previous.Embeddings...)
+	}
+	p.Embeddings = append(p.Embeddings, normalized...)
+	if len(p.Embeddings) > MaxPersonSamples {
+		p.Embeddings = p.Embeddings[len(p.Embeddings)-MaxPersonSamples:]
+	}
+
+	s.people[name] = p
+	if err := s.writeLocked(); err != nil {
+		// Keep memory and disk the same
+		if existed {
+			s.people[name] = previous
+		} else {
+			delete(s.people, name)
+		}
+		return Person{}, err
+	}
+	return p.person(), nil
+}
+
+// Delete forgets name and writes the store out.
+func (s *PeopleStore) Delete(name string) (Person, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	p, ok := s.people[name]
+	if !ok {
+		return Person{}, ErrPersonNotFound
+	}
+	delete(s.people, name)
+	if err := s.writeLocked(); err != nil {
+		s.people[name] = p
+		return Person{}, err
+	}
+	return p.person(), nil
+}
+
+// Match returns the person with the sample most like embedding and how alike they are,
+// from -1 to 1. The name is empty when nobody is enrolled.
+func (s *PeopleStore) Match(embedding []float32) (string, float64) {
+	embedding = normalize(embedding)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	best, similarity := "", -1.0
+	for name, p := range s.people {
+		for _, sample := range p.Embeddings {
+			if len(sample) != len(embedding) {
+				continue
+			}
+			if sim := dot(sample, embedding); sim > similarity {
+				best, similarity = name, sim
+			}
+		}
+	}
+	return best, similarity
+}
+
+// normalize returns v scaled to length 1
+func normalize(v []float32) []float32 {
+	length := math.Sqrt(dot(v, v))
+	n := make([]float32, len(v))
+	if length == 0 {
+		return n
+	}
+	for i, x := range v {
+		n[i] = float32(float64(x) / length)
+	}
+	return n
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// writeLocked saves everyone, to a temporary file first so a crash can't leave half a file behind.
+func (s *PeopleStore) writeLocked() error {
+	people := make([]*storedPerson, 0, len(s.people))
+	for _, p := range s.people {
+		people = append(people, p)
+	}
+	sort.Slice(people, func(i, j int) bool { return people[i].Name < people[j].Name })
+
+	data, err := json.Marshal(people)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".people-*.json")
+	if err != nil {
+		return fmt.Errorf("could not save people: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save people: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save people: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not save people: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package robot
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newTestPeopleStore(t *testing.T) (*PeopleStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "people.json")
+	people, err := NewPeopleStore(path)
+	if err != nil {
+		t.Fatalf("NewPeopleStore returned error: %v", err)
+	}
+	return people, path
+}
+
+func TestPeopleStore_EnrollAndReload(t *testing.T) {
+	people, path := newTestPeopleStore(t)
+
+	ara, err := people.Enroll("ara", [][]float32{{1, 0, 0}, {2, 0.2, 0}})
+	if err != nil || ara.Name != "ara" || ara.Samples != 2 {
+		t.Fatalf("Enroll = %+v, %v", ara, err)
+	}
+	if _, err := people.Enroll("Sam O'Neil", [][]float32{{0, 1, 0}}); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	more, _ := people.Enroll("ara", [][]float32{{1, 0, 0.1}})
+	if more.Samples != 3 || !more.Enrolled.Equal(ara.Enrolled) {
+		t.Errorf("enrolling again = %+v, want 3 samples and the first enrollment time", more)
+	}
+
+	reloaded, err := NewPeopleStore(path)
+	if err != nil {
+		t.Fatalf("reload returned error: %v", err)
+	}
+	list := reloaded.List()
+	if len(list) != 2 || list[0].Name != "Sam O'Neil" || list[1].Name != "ara" || list[1].Samples != 3 {
+		t.Errorf("reloaded = %+v", list)
+	}
+	if name, similarity := reloaded.Match([]float32{0, 3, 0}); name != "Sam O'Neil" || similarity < 0.99 {
+		t.Errorf("Match = %v %v, want Sam O'Neil", name, similarity)
+	}
+}
+
+func TestPeopleStore_Match(t *testing.T) {
+	people, _ := newTestPeopleStore(t)
+	if name, _ := people.Match([]float32{1, 0}); name != "" {
+		t.Errorf("Match with nobody enrolled = %q", name)
+	}
+
+	people.Enroll("a", [][]float32{{1, 0}})
+	people.Enroll("b", [][]float32{{0, 1}, {-1, 0}})
+	for _, tc := range []struct {
+		embedding  []float32
+		name       string
+		similarity float64
+	}{
+		{[]float32{5, 0}, "a", 1},
+		{[]float32{0, 0.5}, "b", 1},
+		{[]float32{-1, 0}, "b", 1},
+		{[]float32{1, 0.5}, "a", 0.8944},
+	} {
+		name, similarity := people.Match(tc.embedding)
+		if name != tc.name || similarity < tc.similarity-0.001 || similarity > tc.similarity+0.001 {
+			t.Errorf("Match(%v) = %v %v, want %v %v", tc.embedding, name, similarity, tc.name, tc.similarity)
+		}
+	}
+}
+
+func TestPeopleStore_Invalid(t *testing.T) {
+	people, _ := newTestPeopleStore(t)
+	people.Enroll("ara", [][]float32{{1, 0, 0}})
+
+	if _, err := people.Enroll("../etc", [][]float32{{1, 0, 0}}); !errors.Is(err, ErrInvalidPersonName) {
+		t.Errorf("bad name err = %v, want %v", err, ErrInvalidPersonName)
+	}
+	if _, err := people.Enroll("sam", nil); !errors.Is(err, ErrInvalidEnrollment) {
+		t.Errorf("no samples err = %v, want %v", err, ErrInvalidEnrollment)
+	}
+	if _, err := people.Enroll("sam", [][]float32{{1, 0}}); !errors.Is(err, ErrInvalidEnrollment) {
+		t.Errorf("wrong size err = %v, want %v", err, ErrInvalidEnrollment)
+	}
+	if len(people.List()) != 1 {
+		t.Errorf("List = %+v, want just ara", people.List())
+	}
+}
+
+func TestPeopleStore_SamplesAreCapped(t *testing.T) {
+	people, _ := newTestPeopleStore(t)
+	for i := 0; i < MaxPersonSamples+5; i++ {
+		people.Enroll("ara", [][]float32{{1, float32(i)}})
+	}
+	if ara, _ := people.Get("ara"); ara.Samples != MaxPersonSamples {
+		t.Errorf("samples = %d, want %d", ara.Samples, MaxPersonSamples)
+	}
+}
+
+func TestPeopleStore_Delete(t *testing.T) {
+	people, path := newTestPeopleStore(t)
+	people.Enroll("ara", [][]float32{{1, 0}})
+
+	if deleted, err := people.Delete("ara"); err != nil || deleted.Name != "ara" {
+		t.Errorf("Delete = %+v, %v", deleted, err)
+	}
+	if _, err := people.Delete("ara"); !errors.Is(err, ErrPersonNotFound) {
+		t.Errorf("second Delete err = %v, want %v", err, ErrPersonNotFound)
+	}
+	if reloaded, _ := NewPeopleStore(path); reloaded.Len() != 0 {
+		t.Errorf("reloaded %d people, want none", reloaded.Len())
+	}
+}
@@ -0,0 +1,245 @@
+package robot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+/*
+	Named poses
+
+	A named pose is a set of joint angles the arm can be sent back to by name,
+	e.g. "home", "start" or "look-left". Poses are stored as joint angles so they
+	come back exactly as they were saved, whichever way they were taught.
+
+	A few poses are built in. Saving a pose with a built in name overrides it,
+	deleting it brings the built in one back. Everything that isn't a built in
+	default is saved to a JSON file, GIZMATRON_POSES (poses.json by default).
+*/
+
+const (
+	PoseHome  = "home"  // where the arm parks, its calibrated home
+	PoseStart = "start" // where the arm goes when the robot starts
+)
+
+// DefaultStartAngles is the start pose when none has been saved.
+var DefaultStartAngles = [5]int{
+	90,  // BASE_SERVO
+	30,  // JOINT_1_SERVO
+	30,  // JOINT_2_SERVO
+	130, // JOINT_3_SERVO
+	130, // JOINT_4_SERVO
+}
+
+var (
+	ErrPoseNotFound    = errors.New("no such pose")
+	ErrInvalidPoseName = errors.New("pose names are 1-64 letters, digits, '-' or '_'")
+)
+
+var poseNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// NamedPose is a set of joint angles saved under a name.
+type NamedPose struct {
+	Name    string `json:"name"`
+	Joints  [5]int `json:"joints"`
+	Builtin bool   `json:"builtin,omitempty"` // true while it is still the built in default
+}
+
+// PoseLibrary holds the named poses and keeps them saved to a file.
+type PoseLibrary struct {
+	mux      sync.Mutex
+	path     string
+	builtins map[string][5]int
+	saved    map[string][5]int
+}
+
+// builtinPoses are the defaults for an arm with the given calibration.
+func builtinPoses(cal ArmCalibration) map[string][5]int {
+	home := cal.HomeAngles()
+	look := func(base, wrist int) [5]int {
+		return [5]int{base, DefaultStartAngles[1], DefaultStartAngles[2], DefaultStartAngles[3], wrist}
+	}
+	return map[string][5]int{
+		PoseHome:     home,
+		PoseStart:    DefaultStartAngles,
+		"look-up":    look(90, 160),
+		"look-down":  look(90, 100),
+		"look-left":  look(135, DefaultStartAngles[4]),
+		"look-right": look(45, DefaultStartAngles[4]),
+	}
+}
+
+// NewPoseLibrary loads the poses saved at path on top of the built in ones.
+// A missing file just means nothing has been saved yet.
+func NewPoseLibrary(path string, cal ArmCalibration) (*PoseLibrary, error) {
+	l := &PoseLibrary{
+		path:     path,
+		builtins: builtinPoses(cal),
+		saved:    make(map[string][5]int),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+
+	var poses []NamedPose
+	if err := json.Unmarshal(data, &poses); err != nil {
+		return l, fmt.Errorf("invalid poses file %v: %w", path, err)
+	}
+	for _, pose := range poses {
+		if !poseNamePattern.MatchString(pose.Name) {
+			log.Printf("Warning!! skipping pose %q in %v: %v", pose.Name, path, ErrInvalidPoseName)
+			continue
+		}
+		l.saved[pose.Name] = pose.Joints
+	}
+	return l, nil
+}
+
+// loadPoseLibrary loads the file named by GIZMATRON_POSES.
+// The robot should always come up, so a broken file leaves just the built in poses.
+func loadPoseLibrary(cal ArmCalibration) *PoseLibrary {
+	path := os.Getenv("GIZMATRON_POSES")
+	if path == "" {
+		path = "poses.json"
+	}
+
+	poses, err := NewPoseLibrary(path, cal)
+	if err != nil {
+		log.Printf("Warning!! Could not load poses, using the built in ones: %v", err)
+	}
+	return poses
+}
+
+// Get returns the pose saved under name.
+func (l *PoseLibrary) Get(name string) (NamedPose, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.getLocked(name)
+}
+
+func (l *PoseLibrary) getLocked(name string) (NamedPose, error) {
+	if joints, ok := l.saved[name]; ok {
+		return NamedPose{Name: name, Joints: joints}, nil
+	}
+	if joints, ok := l.builtins[name]; ok {
+		return NamedPose{Name: name, Joints: joints, Builtin: true}, nil
+	}
+	return NamedPose{}, ErrPoseNotFound
+}
+
+// List returns every pose, sorted by name.
+func (l *PoseLibrary) List() []NamedPose {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	names := make(map[string]bool)
+	for name := range l.builtins {
+		names[name] = true
+	}
+	for name := range l.saved {
+		names[name] = true
+	}
+
+	poses := make([]NamedPose, 0, len(names))
+	for name := range names {
+		pose, _ := l.getLocked(name)
+		poses = append(poses, pose)
+	}
+	sort.Slice(poses, func(i, j int) bool { return poses[i].Name < poses[j].Name })
+	return poses
+}
+
+// Save stores the joint angles under name and writes the library out.
+// The angles are not checked here, that is up to the caller.
+func (l *PoseLibrary) Save(name string, joints [5]int) (NamedPose, error) {
+	if !poseNamePattern.MatchString(name) {
+		return NamedPose{}, ErrInvalidPoseName
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	previous, existed := l.saved[name]
+	l.saved[name] = joints
+	if err := l.writeLocked(); err != nil {
+		// Keep memory and disk the same
+		if existed {
+			l.saved[name] = previous
+		} else {
+			delete(l.saved, name)
+		}
+		return NamedPose{}, err
+	}
+	return NamedPose{Name: name, Joints: joints}, nil
+}
+
+// Delete removes a saved pose. Deleting a built in pose brings back its default,
+// so it returns what name now refers to, if anything.
+func (l *PoseLibrary) Delete(name string) (*NamedPose, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	previous, ok := l.saved[name]
+	if !ok {
+		if _, builtin := l.builtins[name]; builtin {
+			pose, _ := l.getLocked(name)
+			return &pose, nil
+		}
+		return nil, ErrPoseNotFound
+	}
+
+	delete(l.saved, name)
+	if err := l.writeLocked(); err != nil {
+		l.saved[name] = previous
+		return nil, err
+	}
+
+	if pose, err := l.getLocked(name); err == nil {
+		return &pose, nil
+	}
+	return nil, nil
+}
+
+// writeLocked saves every pose that isn't a built in default.
+// It writes to a temporary file first so a crash can't leave half a file behind.
+func (l *PoseLibrary) writeLocked() error {
+	poses := make([]NamedPose, 0, len(l.saved))
+	for name, joints := range l.saved {
+		poses = append(poses, NamedPose{Name: name, Joints: joints})
+	}
+	sort.Slice(poses, func(i, j int) bool { return poses[i].Name < poses[j].Name })
+
+	data, err := json.MarshalIndent(poses, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".poses-*.json")
+	if err != nil {
+		return fmt.Errorf("could not save poses: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save poses: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save poses: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("could not save poses: %w", err)
+	}
+	return nil
+}
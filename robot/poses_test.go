@@ -0,0 +1,106 @@
+package robot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestPoseLibrary(t *testing.T) (*PoseLibrary, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "poses.json")
+	poses, err := NewPoseLibrary(path, DefaultArmCalibration())
+	if err != nil {
+		t.Fatalf("NewPoseLibrary returned error: %v", err)
+	}
+	return poses, path
+}
+
+func TestPoseLibrary_Builtins(t *testing.T) {
+	poses, path := newTestPoseLibrary(t)
+
+	home, err := poses.Get(PoseHome)
+	if err != nil || !home.Builtin || home.Joints != DefaultArmCalibration().HomeAngles() {
+		t.Errorf("home = %+v %v, want the calibrated home", home, err)
+	}
+	if start, _ := poses.Get(PoseStart); start.Joints != DefaultStartAngles {
+		t.Errorf("start = %v, want %v", start.Joints, DefaultStartAngles)
+	}
+	if _, err := poses.Get("nope"); !errors.Is(err, ErrPoseNotFound) {
+		t.Errorf("Get of unknown pose returned %v, want ErrPoseNotFound", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Error("nothing should be written until a pose is saved")
+	}
+}
+
+func TestPoseLibrary_SaveAndReload(t *testing.T) {
+	poses, path := newTestPoseLibrary(t)
+
+	wave := [5]int{45, 60, 60, 120, 90}
+	if _, err := poses.Save("wave", wave); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := poses.Save(PoseHome, [5]int{90, 10, 10, 170, 170}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewPoseLibrary(path, DefaultArmCalibration())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pose, err := reloaded.Get("wave"); err != nil || pose.Joints != wave || pose.Builtin {
+		t.Errorf("reloaded wave = %+v %v, want %v", pose, err, wave)
+	}
+	if pose, _ := reloaded.Get(PoseHome); pose.Builtin || pose.Joints != [5]int{90, 10, 10, 170, 170} {
+		t.Errorf("reloaded home = %+v, want the saved override", pose)
+	}
+	if n := len(reloaded.List()); n != len(builtinPoses(DefaultArmCalibration()))+1 {
+		t.Errorf("List() has %d poses, want the built in ones plus wave", n)
+	}
+}
+
+func TestPoseLibrary_Delete(t *testing.T) {
+	poses, _ := newTestPoseLibrary(t)
+
+	poses.Save("wave", [5]int{45, 60, 60, 120, 90})
+	if pose, err := poses.Delete("wave"); err != nil || pose != nil {
+		t.Errorf("Delete(wave) = %v %v, want nothing left", pose, err)
+	}
+	if _, err := poses.Get("wave"); !errors.Is(err, ErrPoseNotFound) {
+		t.Error("wave should be gone")
+	}
+
+	// Deleting an overridden built in brings the default back
+	poses.Save(PoseStart, [5]int{90, 45, 45, 120, 120})
+	if pose, err := poses.Delete(PoseStart); err != nil || pose == nil || !pose.Builtin || pose.Joints != DefaultStartAngles {
+		t.Errorf("Delete(start) = %+v %v, want the built in start", pose, err)
+	}
+
+	if _, err := poses.Delete("nope"); !errors.Is(err, ErrPoseNotFound) {
+		t.Errorf("Delete of unknown pose returned %v, want ErrPoseNotFound", err)
+	}
+}
+
+func TestPoseLibrary_InvalidName(t *testing.T) {
+	poses, _ := newTestPoseLibrary(t)
+	for _, name := range []string{"", "../etc", "has space"} {
+		if _, err := poses.Save(name, DefaultStartAngles); !errors.Is(err, ErrInvalidPoseName) {
+			t.Errorf("Save(%q) returned %v, want ErrInvalidPoseName", name, err)
+		}
+	}
+}
+
+func TestPoseLibrary_BadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "poses.json")
+	os.WriteFile(path, []byte("not json"), 0o644)
+
+	poses, err := NewPoseLibrary(path, DefaultArmCalibration())
+	if err == nil {
+		t.Error("NewPoseLibrary should report a broken file")
+	}
+	if _, err := poses.Get(PoseHome); err != nil {
+		t.Error("the built in poses should still be there")
+	}
+}
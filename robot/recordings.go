@@ -0,0 +1,444 @@
+package robot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+	Recordings
+
+	A recording writes the camera's frames to an MJPEG AVI file in the
+	recordings directory, from its own frame subscription so it never holds
+	up the camera or the stream. One recording runs at a time. It stops when
+	asked, or when it reaches its duration or size limit, whichever comes
+	first. Starting a recording rotates the directory: the oldest files go
+	once there are more than the configured number kept. Clips are written
+	to the same directory and rotated with them, see ClipRecorder.
+*/
+
+// Recording defaults, each can be overridden with GIZMATRON_RECORDING* env vars
+const (
+	DefaultRecordingsDir        = "recordings"
+	DefaultRecordingMaxDuration = 5 * time.Minute
+	DefaultRecordingMaxBytes    = 500 << 20
+	DefaultRecordingsKeep       = 20
+
+	recordingExt       = ".avi"
+	recordingCodec     = "MJPG"
+	recordingSizeCheck = time.Second // how often the file size is checked against the limit
+)
+
+var (
+	ErrAlreadyRecording      = errors.New("already recording")
+	ErrNotRecording          = errors.New("not recording")
+	ErrRecordingNotFound     = errors.New("recording not found")
+	ErrInvalidRecordingLimit = errors.New("invalid recording limit")
+)
+
+// Why a recording stopped
+const (
+	RecordingStopped  = "stopped"  // asked to
+	RecordingDuration = "duration" // reached its duration limit
+	RecordingSize     = "size"     // reached its size limit
+	RecordingFailed   = "failed"   // the file couldn't be written, see Error
+)
+
+// RecordingsConfig is where recordings go and how big they may get.
+type RecordingsConfig struct {
+	Dir         string
+	MaxDuration time.Duration // longest a recording may run
+	MaxBytes    int64         // biggest a recording file may get
+	Keep        int           // most recordings kept in Dir, the oldest are deleted
+}
+
+// loadRecordingsConfig loads the recordings config from GIZMATRON_RECORDINGS and friends
+func loadRecordingsConfig() RecordingsConfig {
+	config := RecordingsConfig{
+		Dir:         DefaultRecordingsDir,
+		MaxDuration: DefaultRecordingMaxDuration,
+		MaxBytes:    DefaultRecordingMaxBytes,
+		Keep:        DefaultRecordingsKeep,
+	}
+	if dir := os.Getenv("GIZMATRON_RECORDINGS"); dir != "" {
+		config.Dir = dir
+	}
+	if seconds := os.Getenv("GIZMATRON_RECORDING_MAX_SECONDS"); seconds != "" {
+		if s, err := strconv.Atoi(seconds); err == nil && s > 0 {
+			config.MaxDuration = time.Duration(s) * time.Second
+		} else {
+			log.Printf("Warning!! GIZMATRON_RECORDING_MAX_SECONDS %q is not a positive number of seconds, using %v", seconds, config.MaxDuration)
+		}
+	}
+	if mb := os.Getenv("GIZMATRON_RECORDING_MAX_MB"); mb != "" {
+		if m, err := strconv.Atoi(mb); err == nil && m > 0 {
+			config.MaxBytes = int64(m) << 20
+		} else {
+			log.Printf("Warning!! GIZMATRON_RECORDING_MAX_MB %q is not a positive number of MB, using %v", mb, config.MaxBytes>>20)
+		}
+	}
+	if keep := os.Getenv("GIZMATRON_RECORDINGS_KEEP"); keep != "" {
+		if k, err := strconv.Atoi(keep); err == nil && k > 0 {
+			config.Keep = k
+		} else {
+			log.Printf("Warning!! GIZMATRON_RECORDINGS_KEEP %q is not a positive number, using %v", keep, config.Keep)
+		}
+	}
+	return config
+}
+
+// RecordingLimits cap one recording, zero values mean the configured maximums.
+// They can only be lower than the maximums, never higher.
+type RecordingLimits struct {
+	MaxSeconds int `json:"max_seconds"`
+	MaxMB      int `json:"max_mb"`
+}
+
+// Recording is one recording file, or the one being recorded.
+type Recording struct {
+	Name       string     `json:"name"` // file name in the recordings directory
+	Active     bool       `json:"active"`
+	Bytes      int64      `json:"bytes"`
+	Started    *time.Time `json:"started,omitempty"`
+	Stopped    *time.Time `json:"stopped,omitempty"`
+	Frames     int        `json:"frames,omitempty"`
+	StopReason string     `json:"stop_reason,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Trigger    string     `json:"trigger,omitempty"` // what a clip was recorded for, see ClipRecorder
+}
+
+// Recorder records the frames from a hub.
+type Recorder struct {
+	hub    *FrameHub
+	config RecordingsConfig
+	fps    float64
+
+	mux     sync.Mutex
+	current *recordingSession
+	history map[string]Recording // recordings made since the recorder started
+}
+
+type recordingSession struct {
+	mux       sync.Mutex
+	recording Recording
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+func (s *recordingSession) snapshot() Recording {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.recording
+}
+
+// NewRecorder records frames from hub at fps into the config's directory.
+func NewRecorder(hub *FrameHub, config RecordingsConfig, fps int) *Recorder {
+	if fps <= 0 {
+		fps = 30
+	}
+	return &Recorder{hub: hub, config: config, fps: float64(fps), history: make(map[string]Recording)}
+}
+
+// Start starts a new recording.
+func (r *Recorder) Start(limits RecordingLimits) (Recording, error) {
+	maxDuration, maxBytes, err := r.limits(limits)
+	if err != nil {
+		return Recording{}, err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.current != nil {
+		return Recording{}, ErrAlreadyRecording
+	}
+
+	now := time.Now()
+	name, err := r.reserve("rec", now)
+	if err != nil {
+		return Recording{}, err
+	}
+	session := &recordingSession{
+		recording: Recording{Name: name, Active: true, Started: &now},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	r.current = session
+
+	log.Printf("Recording to %v, for up to %v or %vMB", session.recording.Name, maxDuration, maxBytes>>20)
+	// Subscribe before returning so no frame after Start is missed
+	frames := r.hub.Subscribe(int(r.fps), DropNewest)
+	go r.record(session, frames, maxDuration, maxBytes)
+	return session.snapshot(), nil
+}
+
+// limits works out a recording's limits from what was asked for and the configured maximums
+func (r *Recorder) limits(limits RecordingLimits) (time.Duration, int64, error) {
+	maxDuration, maxBytes := r.config.MaxDuration, r.config.MaxBytes
+	if limits.MaxSeconds < 0 || limits.MaxMB < 0 {
+		return 0, 0, fmt.Errorf("%w: limits must be positive", ErrInvalidRecordingLimit)
+	}
+	if limits.MaxSeconds > 0 {
+		maxDuration = min(maxDuration, time.Duration(limits.MaxSeconds)*time.Second)
+	}
+	if limits.MaxMB > 0 {
+		maxBytes = min(maxBytes, int64(limits.MaxMB)<<20)
+	}
+	return maxDuration, maxBytes, nil
+}
+
+// reserve makes room for a new recording and names it, with r.mux held
+func (r *Recorder) reserve(prefix string, at time.Time) (string, error) {
+	if err := os.MkdirAll(r.config.Dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create the recordings directory: %w", err)
+	}
+	r.rotate(r.config.Keep - 1)
+	return r.newName(prefix, at), nil
+}
+
+// newName names a recording after when it started, and never reuses a name
+func (r *Recorder) newName(prefix string, at time.Time) string {
+	base := prefix + "-" + at.Format("20060102-150405")
+	name := base + recordingExt
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(r.config.Dir, name)); errors.Is(err, os.ErrNotExist) {
+			return name
+		}
+		name = fmt.Sprintf("%v-%d%v", base, n, recordingExt)
+	}
+}
+
+// record writes frames to the session's file until it is stopped or reaches a limit
+func (r *Recorder) record(session *recordingSession, frames *FrameSubscription, maxDuration time.Duration, maxBytes int64) {
+	defer close(session.done)
+	defer frames.Close()
+
+	path := filepath.Join(r.config.Dir, session.recording.Name)
+	var writer *gocv.VideoWriter
+	reason, failure := RecordingStopped, error(nil)
+
+	deadline := time.NewTimer(maxDuration)
+	defer deadline.Stop()
+	var lastCheck time.Time // checked on the first frame, and every so often after
+
+record:
+	for {
+		select {
+		case <-session.stop:
+			break record
+
+		case <-deadline.C:
+			reason = RecordingDuration
+			break record
+
+		case frame, ok := <-frames.Frames():
+			if !ok {
+				break record
+			}
+			// The file is opened on the first frame, which gives its size
+			if writer == nil {
+				w, err := gocv.VideoWriterFile(path, recordingCodec, r.fps, frame.Mat.Cols(), frame.Mat.Rows(), true)
+				if err != nil {
+					frame.Release()
+					reason, failure = RecordingFailed, fmt.Errorf("could not open %v: %w", path, err)
+					break record
+				}
+				writer = w
+			}
+			err := writer.Write(frame.Mat)
+			frame.Release()
+			if err != nil {
+				reason, failure = RecordingFailed, fmt.Errorf("could not write %v: %w", path, err)
+				break record
+			}
+
+			session.mux.Lock()
+			session.recording.Frames++
+			session.mux.Unlock()
+
+			if time.Since(lastCheck) >= recordingSizeCheck {
+				lastCheck = time.Now()
+				if r.updateSize(session, path) >= maxBytes {
+					reason = RecordingSize
+					break record
+				}
+			}
+		}
+	}
+
+	if writer != nil {
+		if err := writer.Close(); err != nil && failure == nil {
+			reason, failure = RecordingFailed, fmt.Errorf("could not finish %v: %w", path, err)
+		}
+	}
+	r.updateSize(session, path)
+
+	now := time.Now()
+	session.mux.Lock()
+	session.recording.Active = false
+	session.recording.Stopped = &now
+	session.recording.StopReason = reason
+	if failure != nil {
+		session.recording.Error = failure.Error()
+		log.Printf("Error !! Recording %v: %v", session.recording.Name, failure)
+	}
+	recording := session.recording
+	session.mux.Unlock()
+
+	log.Printf("Recording %v %v after %d frames, %d bytes", recording.Name, reason, recording.Frames, recording.Bytes)
+	r.mux.Lock()
+	r.history[recording.Name] = recording
+	r.current = nil
+	r.mux.Unlock()
+}
+
+// remember keeps what is known about a recording made some other way than Start, e.g. a clip
+func (r *Recorder) remember(recording Recording) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.history[recording.Name] = recording
+}
+
+// updateSize records how big the session's file is, and returns it
+func (r *Recorder) updateSize(session *recordingSession, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	session.mux.Lock()
+	defer session.mux.Unlock()
+	session.recording.Bytes = info.Size()
+	return info.Size()
+}
+
+// Stop stops the current recording and returns it once its file is finished.
+func (r *Recorder) Stop() (Recording, error) {
+	r.mux.Lock()
+	session := r.current
+	r.mux.Unlock()
+	if session == nil {
+		return Recording{}, ErrNotRecording
+	}
+
+	// It may have stopped on its own meanwhile, or be being stopped by someone else
+	session.stopOnce.Do(func() { close(session.stop) })
+	<-session.done
+	return session.snapshot(), nil
+}
+
+// Current returns the recording in progress, if there is one.
+func (r *Recorder) Current() (Recording, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.current == nil {
+		return Recording{}, false
+	}
+	return r.current.snapshot(), true
+}
+
+// List returns every recording in the directory, newest first, with the one in progress.
+func (r *Recorder) List() ([]Recording, error) {
+	files, err := r.files()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var current Recording
+	if r.current != nil {
+		current = r.current.snapshot()
+	}
+
+	recordings := []Recording{}
+	if current.Name != "" {
+		recordings = append(recordings, current)
+	}
+	for _, file := range files {
+		if file.Name() == current.Name {
+			continue
+		}
+		recording, ok := r.history[file.Name()]
+		if !ok {
+			recording = Recording{Name: file.Name()}
+			if modified := file.ModTime(); !modified.IsZero() {
+				recording.Stopped = &modified
+			}
+		}
+		recording.Bytes = file.Size()
+		recordings = append(recordings, recording)
+	}
+	return recordings, nil
+}
+
+// files are the recording files in the directory, newest first
+func (r *Recorder) files() ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(r.config.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), recordingExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime().Equal(files[j].ModTime()) {
+			return files[i].ModTime().After(files[j].ModTime())
+		}
+		return files[i].Name() > files[j].Name()
+	})
+	return files, nil
+}
+
+// rotate deletes the oldest recordings until at most keep are left, with r.mux held
+func (r *Recorder) rotate(keep int) {
+	files, err := r.files()
+	if err != nil {
+		log.Printf("Warning!! Could not rotate recordings: %v", err)
+		return
+	}
+	for _, file := range files[min(len(files), max(keep, 0)):] {
+		if r.current != nil && file.Name() == r.current.recording.Name || r.history[file.Name()].Active {
+			continue
+		}
+		log.Printf("Deleting old recording %v", file.Name())
+		if err := os.Remove(filepath.Join(r.config.Dir, file.Name())); err != nil {
+			log.Printf("Warning!! Could not delete old recording %v: %v", file.Name(), err)
+		}
+		delete(r.history, file.Name())
+	}
+}
+
+// Path returns where the named recording's file is, for downloading it.
+func (r *Recorder) Path(name string) (string, error) {
+	if filepath.Base(name) != name || !strings.HasSuffix(name, recordingExt) {
+		return "", ErrRecordingNotFound
+	}
+	path := filepath.Join(r.config.Dir, name)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", ErrRecordingNotFound
+	}
+	return path, nil
+}
@@ -0,0 +1,176 @@
+package robot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func newTestRecorder(t *testing.T, config RecordingsConfig) (*Recorder, *FrameHub) {
+	t.Helper()
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+	if config.MaxDuration == 0 {
+		config.MaxDuration = time.Minute
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = DefaultRecordingMaxBytes
+	}
+	if config.Keep == 0 {
+		config.Keep = DefaultRecordingsKeep
+	}
+	hub := NewFrameHub()
+	t.Cleanup(hub.Close)
+	return NewRecorder(hub, config, 30), hub
+}
+
+// waitForFrames publishes frames until the recording has written n of them
+func waitForFrames(t *testing.T, r *Recorder, hub *FrameHub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		recording, ok := r.Current()
+		if !ok || recording.Frames >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recorded %d frames, want %d", recording.Frames, n)
+		}
+		hub.Publish(gocv.NewMat(), nil)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRecorder_StartStop(t *testing.T) {
+	r, hub := newTestRecorder(t, RecordingsConfig{})
+
+	if _, err := r.Stop(); !errors.Is(err, ErrNotRecording) {
+		t.Errorf("Stop with nothing recording = %v, want %v", err, ErrNotRecording)
+	}
+
+	started, err := r.Start(RecordingLimits{})
+	if err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if !started.Active || started.Started == nil {
+		t.Errorf("started recording = %+v", started)
+	}
+	if _, err := r.Start(RecordingLimits{}); !errors.Is(err, ErrAlreadyRecording) {
+		t.Errorf("second Start = %v, want %v", err, ErrAlreadyRecording)
+	}
+
+	waitForFrames(t, r, hub, 3)
+	stopped, err := r.Stop()
+	if err != nil {
+		t.Fatalf("Stop returned error: %v", err)
+	}
+	if stopped.Active || stopped.StopReason != RecordingStopped || stopped.Frames < 3 || stopped.Bytes == 0 {
+		t.Errorf("stopped recording = %+v", stopped)
+	}
+	if hub.Subscribers() != 0 {
+		t.Errorf("recording left %d subscriptions open", hub.Subscribers())
+	}
+
+	list, err := r.List()
+	if err != nil || len(list) != 1 || list[0].Name != started.Name || list[0].Frames != stopped.Frames {
+		t.Fatalf("List = %+v, %v", list, err)
+	}
+	if path, err := r.Path(started.Name); err != nil || filepath.Base(path) != started.Name {
+		t.Errorf("Path = %v, %v", path, err)
+	}
+}
+
+func TestRecorder_Limits(t *testing.T) {
+	t.Run("duration", func(t *testing.T) {
+		r, _ := newTestRecorder(t, RecordingsConfig{MaxDuration: 50 * time.Millisecond})
+		if _, err := r.Start(RecordingLimits{MaxSeconds: 60}); err != nil {
+			t.Fatalf("Start returned error: %v", err)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if _, ok := r.Current(); ok {
+			t.Fatal("recording still running past its duration")
+		}
+		list, _ := r.List()
+		// No frames were published, so there is no file to list
+		if len(list) != 0 {
+			t.Errorf("List = %+v", list)
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		r, hub := newTestRecorder(t, RecordingsConfig{MaxBytes: 512})
+		started, err := r.Start(RecordingLimits{})
+		if err != nil {
+			t.Fatalf("Start returned error: %v", err)
+		}
+		waitForFrames(t, r, hub, 10)
+		list, _ := r.List()
+		if len(list) != 1 || list[0].Name != started.Name || list[0].StopReason != RecordingSize {
+			t.Errorf("List = %+v, want one recording stopped for its size", list)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		r, _ := newTestRecorder(t, RecordingsConfig{})
+		if _, err := r.Start(RecordingLimits{MaxMB: -1}); !errors.Is(err, ErrInvalidRecordingLimit) {
+			t.Errorf("Start with a negative limit = %v, want %v", err, ErrInvalidRecordingLimit)
+		}
+	})
+}
+
+func TestRecorder_Rotates(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{"rec-a.avi", "rec-b.avi", "rec-c.avi"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, modified, modified)
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep me"), 0644)
+
+	r, hub := newTestRecorder(t, RecordingsConfig{Dir: dir, Keep: 2})
+	started, err := r.Start(RecordingLimits{})
+	if err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	waitForFrames(t, r, hub, 1)
+	r.Stop()
+
+	list, _ := r.List()
+	if len(list) != 2 || list[0].Name != started.Name || list[1].Name != "rec-c.avi" {
+		t.Errorf("List = %+v, want the new recording and the newest old one", list)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("rotation deleted a file that isn't a recording: %v", err)
+	}
+}
+
+func TestRecorder_Path(t *testing.T) {
+	r, _ := newTestRecorder(t, RecordingsConfig{})
+	for _, name := range []string{"missing.avi", "../recordings.avi", "notes.txt", ""} {
+		if _, err := r.Path(name); !errors.Is(err, ErrRecordingNotFound) {
+			t.Errorf("Path(%q) = %v, want %v", name, err, ErrRecordingNotFound)
+		}
+	}
+}
+
+func TestLoadRecordingsConfig(t *testing.T) {
+	t.Setenv("GIZMATRON_RECORDINGS", "/tmp/clips")
+	t.Setenv("GIZMATRON_RECORDING_MAX_SECONDS", "90")
+	t.Setenv("GIZMATRON_RECORDING_MAX_MB", "-4")
+	t.Setenv("GIZMATRON_RECORDINGS_KEEP", "5")
+
+	config := loadRecordingsConfig()
+	want := RecordingsConfig{Dir: "/tmp/clips", MaxDuration: 90 * time.Second, MaxBytes: DefaultRecordingMaxBytes, Keep: 5}
+	if config != want {
+		t.Errorf("config = %+v, want %+v", config, want)
+	}
+}
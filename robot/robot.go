@@ -1,11 +1,14 @@
 package robot
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"os"
+	"sync"
 	"time"
-
-	"github.com/warthog618/go-gpiocdev"
 )
 
 const (
@@ -15,6 +18,25 @@ const (
 
 )
 
+// HardwareProfile picks between the real hardware on the Pi and a fully virtual robot
+type HardwareProfile string
+
+const (
+	ProfileHardware  HardwareProfile = "hardware"
+	ProfileSimulated HardwareProfile = "simulated"
+)
+
+// ErrUnknownProfile is returned for a hardware profile that is neither of the above
+var ErrUnknownProfile = errors.New("unknown hardware profile")
+
+// ProfileFromEnv reads the hardware profile from GIZMATRON_PROFILE, defaulting to real hardware
+func ProfileFromEnv() HardwareProfile {
+	if profile := os.Getenv("GIZMATRON_PROFILE"); profile != "" {
+		return HardwareProfile(profile)
+	}
+	return ProfileHardware
+}
+
 type Device struct {
 	Name          string
 	Status        string
@@ -29,24 +51,55 @@ type Robot struct {
 	IsRunning     bool
 	IsOperational bool
 	State         bool // depreciated
-	runningled    *gpiocdev.Line
-	Serverled     *gpiocdev.Line
-	armled        *gpiocdev.Line
+	Profile       HardwareProfile
+	runningled    LedLine
+	Serverled     LedLine
+	armMux        sync.RWMutex // guards armled, arm and motion, see reinitArm
+	armled        LedLine
 	arm           *Arm
+	motion        *MotionExecutor // the only thing that moves the arm
+	poses         *PoseLibrary
+	routines      *RoutineLibrary
+	trackMux      sync.Mutex
+	tracking      *trackingSession
+	recorder      *Recorder
+	clips         *ClipRecorder
 	Camera        *Cam
+	Events        *EventBus  // what the robot notices, see EventBus
+	devicesMux    sync.Mutex // guards the devices in Devices once the robot is up, see DeviceStatus
 	Devices       map[string]*Device
 	log           *log.Logger
 }
 
 func InitRobot(botlog *log.Logger) (*Robot, error) {
+	return InitRobotWithProfile(botlog, ProfileFromEnv())
+}
+
+/*
+InitRobotWithProfile initializes the robot against the given hardware profile.
+
+With ProfileSimulated the arm driver runs on a FakePCA9685, the LEDs are
+virtual and the camera generates its own frames, everything else
+(device status, the api, start/stop) behaves the same as on the Pi.
+
+Any other profile is refused with ErrUnknownProfile rather than guessed at,
+a typo of simulated must not end up driving the real servos.
+*/
+func InitRobotWithProfile(botlog *log.Logger, profile HardwareProfile) (*Robot, error) {
+
+	if profile != ProfileHardware && profile != ProfileSimulated {
+		return nil, fmt.Errorf("%w %q, want %q or %q", ErrUnknownProfile, profile, ProfileHardware, ProfileSimulated)
+	}
 
 	robot := &Robot{
 		Name:    "Gizmatron",
+		Profile: profile,
 		Devices: make(map[string]*Device),
 		log:     botlog,
 	}
 
 	/* Start our devices*/
+	robot.log.Printf("Hardware profile: %v", profile)
 	robot.log.Println("Initalizing Gizmatron Devices ...")
 
 	err := robot.initDevices()
@@ -84,7 +137,7 @@ func (r *Robot) initDevices() error {
 		Name:   "runningLed",
 		Status: "Operational",
 	}
-	runningled, runLedErr := NewLedLine(RUNNING_LED, "Running LED")
+	runningled, runLedErr := r.newLedLine(RUNNING_LED, "Running LED")
 	if runLedErr != nil {
 		r.Devices["runningLed"].Status = "Not Operational"
 		r.Devices["runningLed"].Error = runLedErr.Error()
@@ -98,7 +151,7 @@ func (r *Robot) initDevices() error {
 		Status: "Operational",
 	}
 
-	arm, err := InitArm()
+	arm, err := r.initArm()
 	if err != nil {
 		errmsg := fmt.Sprintf("Warning!! Failed to initialize arm!: %v", err)
 		r.log.Print(errmsg)
@@ -109,6 +162,8 @@ func (r *Robot) initDevices() error {
 
 	// Only configure arm peripherals if arm initialized successfully
 	if arm != nil && arm.IsOperational {
+		r.motion = NewMotionExecutor(arm)
+
 		r.Devices["ArmLed"] = &Device{
 			Name:          "ArmLed",
 			Status:        "Operational",
@@ -116,7 +171,7 @@ func (r *Robot) initDevices() error {
 			IsOperational: true,
 		}
 
-		armled, armLedErr := NewLedLine(ARM_LED, "Arm LED")
+		armled, armLedErr := r.newLedLine(ARM_LED, "Arm LED")
 		if armLedErr != nil {
 			errMsg := fmt.Sprintf("Warning!! Arm LED Failed: %v", armLedErr)
 			r.log.Print(errMsg)
@@ -127,6 +182,14 @@ func (r *Robot) initDevices() error {
 
 	}
 
+	/* Load our named poses, home depends on the arm's calibration */
+	cal := DefaultArmCalibration()
+	if arm != nil {
+		cal = arm.Calibration()
+	}
+	r.poses = loadPoseLibrary(cal)
+	r.routines = loadRoutineLibrary()
+
 	/* Set up pur camera */
 	r.Devices["Camera"] = &Device{
 		Name:   "Camera",
@@ -134,6 +197,12 @@ func (r *Robot) initDevices() error {
 	}
 	var camerr error
 	r.Camera, camerr = InitCam()
+	r.Events = NewEventBus()
+	r.Camera.Events = r.Events
+	// A simulated robot has no camera, but can still be pointed at a test pattern or a file
+	if r.Profile == ProfileSimulated && !r.Camera.Config.Backend.Virtual() {
+		r.Camera.Config.Backend = BackendSimulated
+	}
 	if camerr != nil {
 		r.Devices["Camera"].Status = "Not Operational"
 		r.Devices["Camera"].Error = camerr.Error()
@@ -141,11 +210,16 @@ func (r *Robot) initDevices() error {
 	}
 	//defer r.Camera.Stop()
 	r.Devices["Camera"].Data = map[string]interface{}{
-		"Detecting":   r.Camera.DetectFaces,
-		"Operational": r.Camera.IsOperational,
+		"Detecting":   r.Camera.DetectingFaces(),
+		"Operational": r.Camera.Started(),
 	}
+	// The camera's watchdog keeps the device up to date as it drops out and reconnects
+	r.Camera.onHealth = r.updateCameraDevice
+	r.recorder = NewRecorder(r.Camera.Frames, loadRecordingsConfig(), r.Camera.Config.FPS)
+	r.clips = NewClipRecorder(r.Camera.Frames, r.recorder, r.Events, loadClipsConfig())
+	go r.watchMotion()
 
-	if r.Camera.IsOperational {
+	if r.Camera.Started() {
 		//go r.Camera.RunCamera()
 		//go r.Camera.Start()
 
@@ -155,23 +229,117 @@ func (r *Robot) initDevices() error {
 	return nil
 }
 
+/* watchMotion keeps Devices["Camera"] up to date as motion starts and stops and objects and markers come and go */
+func (r *Robot) watchMotion() {
+	events, _ := r.Events.Subscribe(4)
+	for event := range events {
+		if event.Type == EventMotionStarted || event.Type == EventMotionStopped || event.Type == EventObjectsChanged || event.Type == EventMarkersChanged {
+			r.updateCameraDevice(r.Camera.Health())
+		}
+	}
+}
+
+/* updateCameraDevice reports the camera's health and motion in Devices["Camera"] */
+func (r *Robot) updateCameraDevice(health CameraHealth) {
+	r.devicesMux.Lock()
+	defer r.devicesMux.Unlock()
+
+	device := r.Devices["Camera"]
+	device.IsOperational = health.State == CameraStreaming || health.State == CameraStarting
+	device.IsRunning = health.State == CameraStreaming
+	switch health.State {
+	case CameraReconnecting:
+		device.Status = "Reconnecting"
+	case CameraStopped:
+		device.Status = "Stopped"
+	default:
+		device.Status = "Operational"
+	}
+	device.Error = health.LastError
+
+	data := map[string]interface{}{
+		"Detecting":   r.Camera.DetectingFaces(),
+		"Operational": device.IsOperational,
+		"State":       health.State,
+		"Reconnects":  health.Reconnects,
+		"LastError":   health.LastError,
+	}
+	if health.LastFrame != nil {
+		data["LastFrame"] = *health.LastFrame
+	}
+	if motion := r.Camera.Motion.Status(); motion.Config.Enabled {
+		data["Motion"] = motion.Active
+		if motion.Last != nil {
+			data["MotionScore"] = motion.Last.Score
+		}
+	}
+	if objects := r.Camera.Objects.Status(); objects.Config.Enabled && objects.Last != nil {
+		data["Objects"] = objects.Last.labels()
+	}
+	if markers := r.Camera.Markers.Status(); markers.Config.Enabled && markers.Last != nil {
+		data["Markers"] = markers.Last.keys()
+	}
+	device.Data = data
+}
+
+/* newLedLine requests a real or a virtual LED depending on the profile */
+func (r *Robot) newLedLine(pin int, label string) (LedLine, error) {
+	if r.Profile == ProfileSimulated {
+		return NewSimLedLine(pin, label)
+	}
+	return NewLedLine(pin, label)
+}
+
+/* initArm brings up the arm on the PCA9685, or on a fake one when simulating */
+func (r *Robot) initArm() (*Arm, error) {
+	if r.Profile == ProfileSimulated {
+		driver, err := NewPCA9685DriverOnBus(NewFakePCA9685())
+		if err != nil {
+			return nil, err
+		}
+		driver.SetCalibration(loadArmCalibration())
+		return NewArm(driver)
+	}
+	return InitArm()
+}
+
 func (r *Robot) Start() (bool, error) {
 
 	log.Println("Starting Arm and Camera...")
 
-	if r.arm != nil && r.arm.IsOperational {
-		r.armled.SetValue(1)
-		if ok := r.arm.Start(); ok != nil {
+	if r.EmergencyStopped() {
+		return r.IsRunning, ErrEmergencyStop
+	}
+
+	arm, motion := r.armParts()
+	armled := r.armLed()
+	if arm != nil && arm.IsOperational {
+		if armled != nil {
+			armled.SetValue(1)
+		}
+		start := DefaultStartAngles
+		if pose, err := r.poses.Get(PoseStart); err == nil {
+			start = pose.Joints
+		}
+		if ok := motion.Run(context.Background(), "start", func(ctx context.Context, a *Arm) error {
+			return a.StartAt(ctx, start)
+		}); ok != nil {
 			errMsg := fmt.Sprintf("Error Failed to move arm to starting position :%v", ok)
 			log.Print(errMsg)
-			r.Devices["ArmLed"].Error = errMsg
+			r.setDeviceError("ArmLed", errMsg)
 		}
 
+		// Then whatever routines the robot should always do when it starts
+		for _, name := range startRoutines() {
+			if _, err := r.PlayRoutine(name, 1); err != nil {
+				log.Printf("Error Failed to queue start routine %v: %v", name, err)
+			}
+		}
 	}
 
-	if r.Camera.IsOperational {
+	if r.Camera.Started() {
 		// TODO: This should probably have an error handler
-		//r.Camera.DetectFaces = true
+		//r.Camera.SetDetectFaces(true)
 		//log.Printf("Detecting Faces")
 		//go r.Camera.Start()
 		log.Printf("Turning on Camera")
@@ -184,16 +352,28 @@ func (r *Robot) Start() (bool, error) {
 func (r *Robot) Stop() (bool, error) {
 	log.Println("Stoping Arm and Camera")
 
-	if r.arm != nil && r.arm.IsOperational {
-		r.armled.SetValue(0)
-		if ok := r.arm.Stop(); ok != nil {
+	arm, motion := r.armParts()
+	armled := r.armLed()
+	if arm != nil && arm.IsOperational {
+		if armled != nil {
+			armled.SetValue(0)
+		}
+		// Whatever the arm is doing or has queued up, stopping wins
+		motion.CancelAll()
+		home := arm.Calibration().HomeAngles()
+		if pose, err := r.poses.Get(PoseHome); err == nil {
+			home = pose.Joints
+		}
+		if ok := motion.Run(context.Background(), "stop", func(ctx context.Context, a *Arm) error {
+			return a.StopAt(ctx, home)
+		}); ok != nil {
 			errMsg := fmt.Sprintf("Error Faild to return arm to default positon:%v", ok)
 			log.Print(errMsg)
-			r.Devices["ArmLed"].Error = errMsg
+			r.setDeviceError("ArmLed", errMsg)
 		}
 	}
 
-	if r.Camera.IsOperational && r.Camera.IsRunning {
+	if r.Camera.Started() {
 		//r.Camera.Stop()
 		log.Printf("Turning off Camera")
 	}
@@ -201,20 +381,788 @@ func (r *Robot) Stop() (bool, error) {
 	return r.IsRunning, nil
 }
 
-func (r *Robot) MoveToTarget(x, y, z float64, speed time.Duration) error {
-	if r.arm == nil || !r.arm.IsOperational {
+func (r *Robot) MoveToTarget(ctx context.Context, x, y, z float64, speed time.Duration) error {
+	return r.MoveToPose(ctx, Pose{X: x, Y: y, Z: z}, ElbowAuto, speed)
+}
+
+// MoveToPose moves the camera to target and waits for it to get there, see SubmitMove.
+// Cancelling ctx cancels the move.
+func (r *Robot) MoveToPose(ctx context.Context, target Pose, elbow ElbowConfig, speed time.Duration) error {
+	job, err := r.SubmitMove(target, elbow, speed)
+	if err != nil {
+		return err
+	}
+	_, motion := r.armParts()
+	if _, err := motion.Wait(ctx, job.ID); err != nil {
+		return fmt.Errorf("failed to move arm to target position: %w", err)
+	}
+	return nil
+}
+
+// SubmitMove queues a move of the camera to target and returns its job straight away.
+// The target is solved before it is queued, so an unreachable target comes back here
+// as an *UnreachableError. While the e-stop is engaged moves are refused with ErrEmergencyStop.
+func (r *Robot) SubmitMove(target Pose, elbow ElbowConfig, speed time.Duration) (Job, error) {
+	arm, motion := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return Job{}, fmt.Errorf("arm is not operational")
+	}
+	if arm.EmergencyStopped() {
+		return Job{}, ErrEmergencyStop
+	}
+
+	angles, err := arm.InverseKinematics(target, elbow)
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to move arm to target position: %w", err)
+	}
+
+	description := fmt.Sprintf("move to (%.2f, %.2f, %.2f) pitch %.2f elbow %v speed %v", target.X, target.Y, target.Z, target.Pitch, elbow, speed)
+	return motion.Submit(description, func(ctx context.Context, a *Arm) error {
+		// The speed is this move's alone, the jobs after it keep their own
+		defer a.SetSpeed(a.speed)
+		a.SetSpeed(speed)
+		return a.moveTo(ctx, angles)
+	})
+}
+
+// InverseKinematics solves the joint angles that put the camera at target, see Arm.InverseKinematics.
+func (r *Robot) InverseKinematics(target Pose, elbow ElbowConfig) ([5]int, error) {
+	arm, _ := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return [5]int{}, fmt.Errorf("arm is not operational")
+	}
+	return arm.InverseKinematics(target, elbow)
+}
+
+// Poses returns every named pose.
+func (r *Robot) Poses() []NamedPose {
+	return r.poses.List()
+}
+
+// NamedPose returns the pose saved under name.
+func (r *Robot) NamedPose(name string) (NamedPose, error) {
+	return r.poses.Get(name)
+}
+
+// SavePose saves joint angles under name, they have to be inside the arm's limits.
+func (r *Robot) SavePose(name string, joints [5]int) (NamedPose, error) {
+	arm, _ := r.armParts()
+	cal := DefaultArmCalibration()
+	if arm != nil {
+		cal = arm.Calibration()
+	}
+	for i, angle := range joints {
+		if joint := cal.Joints[i]; !joint.Allows(angle) {
+			return NamedPose{}, &JointLimitError{Joint: i, Angle: angle, Min: joint.MinAngle, Max: joint.MaxAngle}
+		}
+	}
+	return r.poses.Save(name, joints)
+}
+
+// SaveCurrentPose saves wherever the arm is now under name.
+func (r *Robot) SaveCurrentPose(name string) (NamedPose, error) {
+	arm, _ := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return NamedPose{}, fmt.Errorf("arm is not operational")
+	}
+	return r.SavePose(name, arm.driver.CurrentAngles())
+}
+
+// DeletePose deletes a saved pose, see PoseLibrary.Delete.
+func (r *Robot) DeletePose(name string) (*NamedPose, error) {
+	return r.poses.Delete(name)
+}
+
+// GoToPose queues a move to a named pose and returns its job.
+func (r *Robot) GoToPose(name string, speed time.Duration) (Job, error) {
+	arm, motion := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return Job{}, fmt.Errorf("arm is not operational")
+	}
+	if arm.EmergencyStopped() {
+		return Job{}, ErrEmergencyStop
+	}
+	pose, err := r.poses.Get(name)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return motion.Submit(fmt.Sprintf("go to pose %v %v speed %v", pose.Name, pose.Joints, speed), func(ctx context.Context, a *Arm) error {
+		defer a.SetSpeed(a.speed)
+		a.SetSpeed(speed)
+		return a.MoveToJoints(ctx, pose.Joints)
+	})
+}
+
+// StartTeaching starts recording every move the arm makes into a routine called name.
+func (r *Robot) StartTeaching(name string) error {
+	arm, _ := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return fmt.Errorf("arm is not operational")
+	}
+	return arm.StartTeaching(name)
+}
+
+// StopTeaching stops recording and saves the routine that was taught.
+func (r *Robot) StopTeaching() (Routine, error) {
+	arm, _ := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return Routine{}, ErrNotTeaching
+	}
+	routine, err := arm.StopTeaching()
+	if err != nil {
+		return Routine{}, err
+	}
+	return routine, r.routines.Save(routine)
+}
+
+// Teaching returns the routine recorded so far, if the arm is being taught.
+func (r *Robot) Teaching() (Routine, bool) {
+	arm, _ := r.armParts()
+	if arm == nil {
+		return Routine{}, false
+	}
+	return arm.Teaching()
+}
+
+// Routines summarizes every saved routine.
+func (r *Robot) Routines() []RoutineSummary {
+	return r.routines.List()
+}
+
+// Routine loads a saved routine.
+func (r *Robot) Routine(name string) (Routine, error) {
+	return r.routines.Get(name)
+}
+
+// DeleteRoutine deletes a saved routine.
+func (r *Robot) DeleteRoutine(name string) error {
+	return r.routines.Delete(name)
+}
+
+// PlayRoutine queues a replay of a saved routine, scale times as fast, and returns its job.
+func (r *Robot) PlayRoutine(name string, scale float64) (Job, error) {
+	arm, motion := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return Job{}, fmt.Errorf("arm is not operational")
+	}
+	if scale < MinRoutineScale || scale > MaxRoutineScale {
+		return Job{}, fmt.Errorf("scale %v is outside %v-%v", scale, MinRoutineScale, MaxRoutineScale)
+	}
+	if arm.EmergencyStopped() {
+		return Job{}, ErrEmergencyStop
+	}
+
+	routine, err := r.routines.Get(name)
+	if err != nil {
+		return Job{}, err
+	}
+	if err := routine.Validate(arm.Calibration()); err != nil {
+		return Job{}, fmt.Errorf("can't play routine %v: %w", name, err)
+	}
+	return motion.Submit(fmt.Sprintf("play routine %v at %vx", name, scale), routine.Play(scale))
+}
+
+// PerformGesture queues a gesture and returns its job.
+func (r *Robot) PerformGesture(name string, params GestureParams) (Job, error) {
+	arm, motion := r.armParts()
+	gesture, err := LookupGesture(name)
+	if err != nil {
+		return Job{}, err
+	}
+	if _, err := gesture.check(params); err != nil {
+		return Job{}, err
+	}
+	if arm == nil || !arm.IsOperational {
+		return Job{}, fmt.Errorf("arm is not operational")
+	}
+	if arm.EmergencyStopped() {
+		return Job{}, ErrEmergencyStop
+	}
+	return motion.Submit(fmt.Sprintf("gesture %v", name), gesture.Play(params))
+}
+
+// Job returns the state of a motion job.
+func (r *Robot) Job(id string) (Job, error) {
+	_, motion := r.armParts()
+	if motion == nil {
+		return Job{}, ErrJobNotFound
+	}
+	return motion.Job(id)
+}
+
+// CancelJob cancels a queued or running motion job.
+func (r *Robot) CancelJob(id string) (Job, error) {
+	_, motion := r.armParts()
+	if motion == nil {
+		return Job{}, ErrJobNotFound
+	}
+	return motion.Cancel(id)
+}
+
+// ArmPose returns where the camera on the end of the arm currently is.
+func (r *Robot) ArmPose() (Pose, error) {
+	arm, _ := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return Pose{}, fmt.Errorf("arm is not operational")
+	}
+	return arm.Pose(), nil
+}
+
+/* trackingSession is face tracking while it runs */
+type trackingSession struct {
+	tracker *FaceTracker
+	job     Job
+	done    chan struct{} // closed once the job has finished and been cleaned up
+}
+
+// StartTracking starts pointing the camera at faces, see FaceTracker.
+// The camera has to be streaming for there to be any faces to follow.
+func (r *Robot) StartTracking(config TrackingConfig) (TrackingStatus, error) {
+	arm, motion := r.armParts()
+	if arm == nil || !arm.IsOperational {
+		return TrackingStatus{}, fmt.Errorf("arm is not operational")
+	}
+	if arm.EmergencyStopped() {
+		return TrackingStatus{}, ErrEmergencyStop
+	}
+
+	r.trackMux.Lock()
+	defer r.trackMux.Unlock()
+	if r.tracking != nil {
+		return TrackingStatus{}, ErrAlreadyTracking
+	}
+
+	var lostPose *[5]int
+	if config.LostPose != "" {
+		pose, err := r.poses.Get(config.LostPose)
+		if err != nil {
+			return TrackingStatus{}, err
+		}
+		lostPose = &pose.Joints
+	}
+	tracker, err := NewFaceTracker(config, lostPose)
+	if err != nil {
+		return TrackingStatus{}, err
+	}
+
+	// Faces are found for as long as tracking runs, without touching whether
+	// face detection was turned on
+	faces, unsubscribe := r.Camera.SubscribeFaces()
+	release := r.Camera.requestFaces()
+
+	job, err := motion.Submit("face tracking", tracker.Track(faces))
+	if err != nil {
+		unsubscribe()
+		release()
+		return TrackingStatus{}, err
+	}
+
+	session := &trackingSession{tracker: tracker, job: job, done: make(chan struct{})}
+	r.tracking = session
+
+	// However the job ends (stopped, cancelled, the e-stop) tracking is over
+	go func() {
+		defer close(session.done)
+		motion.Wait(context.Background(), job.ID)
+		unsubscribe()
+		release()
+
+		r.trackMux.Lock()
+		defer r.trackMux.Unlock()
+		if r.tracking == session {
+			r.tracking = nil
+		}
+	}()
+
+	status := tracker.Status()
+	status.Job = job.ID
+	return status, nil
+}
+
+// StopTracking stops face tracking and waits for the arm to be let go.
+func (r *Robot) StopTracking() error {
+	_, motion := r.armParts()
+	r.trackMux.Lock()
+	session := r.tracking
+	r.trackMux.Unlock()
+	if session == nil {
+		return ErrNotTracking
+	}
+
+	if _, err := motion.Cancel(session.job.ID); err != nil {
+		return err
+	}
+	<-session.done
+	return nil
+}
+
+// TrackingStatus reports what face tracking is doing.
+func (r *Robot) TrackingStatus() TrackingStatus {
+	r.trackMux.Lock()
+	defer r.trackMux.Unlock()
+	if r.tracking == nil {
+		return TrackingStatus{}
+	}
+	status := r.tracking.tracker.Status()
+	status.Job = r.tracking.job.ID
+	return status
+}
+
+// EmergencyStop halts the arm and latches until ClearEmergencyStop, see Arm.EmergencyStop.
+func (r *Robot) EmergencyStop(cutPower bool) error {
+	arm, motion := r.armParts()
+	armled := r.armLed()
+	if arm == nil || !arm.IsOperational {
+		return fmt.Errorf("arm is not operational")
+	}
+	// Halting the arm comes first, it stays halted even if its power can't be cut
+	err := arm.EmergencyStop(cutPower)
+	// Nothing queued up should run once the e-stop is cleared
+	motion.CancelAll()
+	if armled != nil {
+		armled.SetValue(0)
+	}
+	r.IsRunning = false
+	if err != nil {
+		return fmt.Errorf("failed to cut servo power: %w", err)
+	}
+	return nil
+}
+
+// ClearEmergencyStop releases the e-stop.
+func (r *Robot) ClearEmergencyStop() error {
+	arm, _ := r.armParts()
+	if arm == nil || !arm.IsOperational {
 		return fmt.Errorf("arm is not operational")
 	}
+	arm.ClearEmergencyStop()
+	return nil
+}
+
+// EmergencyStopped reports whether the e-stop is engaged.
+func (r *Robot) EmergencyStopped() bool {
+	arm, _ := r.armParts()
+	return arm != nil && arm.EmergencyStopped()
+}
+
+/*
+Reset tries to get the robot back to a working state without restarting it,
+e.g. after a brown-out.
+
+An arm that never came up is initialized again. One that did is reset and
+slowly re-homed, see Arm.Reset, after anything queued for it is cancelled.
+Either way the latched errors in Devices are cleared and the robot is left
+stopped. Devices that never came up ("Not Operational") keep theirs, they
+still aren't working, and a camera that is still reconnecting reports its
+error again on its next attempt. The e-stop is not cleared, while it is
+engaged the arm can't re-home.
+*/
+func (r *Robot) Reset(ctx context.Context) error {
+
+	log.Println("Resetting Gizmatron...")
+
+	arm, motion := r.armParts()
+	var err error
+	if arm == nil || motion == nil {
+		err = r.reinitArm()
+	} else {
+		motion.CancelAll()
+		err = motion.Run(ctx, "reset", func(ctx context.Context, a *Arm) error {
+			return a.Reset(ctx)
+		})
+	}
+
+	// Whatever happened before the reset is history now
+	r.devicesMux.Lock()
+	for _, device := range r.Devices {
+		if device.Status != "Not Operational" {
+			device.Error = ""
+		}
+	}
+	device := r.Devices["Arm"]
+	if device != nil && err != nil {
+		device.Error = fmt.Sprintf("Error Failed to reset arm: %v", err)
+	} else if device != nil {
+		device.Status = "Operational"
+		device.Error = ""
+	}
+	r.devicesMux.Unlock()
+
+	if err != nil {
+		log.Printf("Error Failed to reset arm: %v", err)
+		return err
+	}
+	if armled := r.armLed(); armled != nil {
+		armled.SetValue(0)
+	}
+	r.IsRunning = false
+	log.Println("Gizmatron reset complete.")
+	return nil
+}
 
-	r.arm.SetSpeed(speed)
+/* armParts returns the arm and the executor that moves it, both nil if the arm never came up */
+func (r *Robot) armParts() (*Arm, *MotionExecutor) {
+	r.armMux.RLock()
+	defer r.armMux.RUnlock()
+	return r.arm, r.motion
+}
 
-	log.Printf("Moving arm to target position: (%f, %f, %f) with speed: %v", x, y, z, speed)
+/* armLed returns the arm's LED, nil if it never came up */
+func (r *Robot) armLed() LedLine {
+	r.armMux.RLock()
+	defer r.armMux.RUnlock()
+	return r.armled
+}
 
-	if err := r.arm.MoveToTarget(x, y, z); err != nil {
-		return fmt.Errorf("failed to move arm to target position: %v", err)
+/*
+reinitArm has another go at bringing up an arm that failed to initialize.
+Everything that uses the arm gets it from armParts, so the new one is
+swapped in under armMux.
+*/
+func (r *Robot) reinitArm() error {
+	r.armMux.Lock()
+	defer r.armMux.Unlock()
+	if r.arm != nil && r.motion != nil {
+		// Another reset got there first
+		return nil
 	}
 
+	arm, err := r.initArm()
+	if err != nil {
+		r.devicesMux.Lock()
+		r.Devices["Arm"].Status = "Not Operational"
+		r.devicesMux.Unlock()
+		return err
+	}
+	r.arm = arm
+	r.motion = NewMotionExecutor(arm)
+	if r.armled == nil {
+		armled, armLedErr := r.newLedLine(ARM_LED, "Arm LED")
+		device := &Device{Name: "ArmLed", Status: "Operational", IsRunning: true, IsOperational: true}
+		if armLedErr != nil {
+			device.Status = "Not Operational"
+			device.Error = armLedErr.Error()
+		}
+		r.devicesMux.Lock()
+		r.Devices["ArmLed"] = device
+		r.devicesMux.Unlock()
+		r.armled = armled
+	}
 	return nil
 }
 
-func (r *Robot) Reset() error { return nil }
+/*
+DeviceStatus returns a copy of Devices, safe to hand out while the camera's
+watchdog and Reset keep updating the devices themselves.
+*/
+func (r *Robot) DeviceStatus() map[string]*Device {
+	r.devicesMux.Lock()
+	defer r.devicesMux.Unlock()
+	devices := make(map[string]*Device, len(r.Devices))
+	for name, device := range r.Devices {
+		device := *device
+		device.Data = maps.Clone(device.Data)
+		devices[name] = &device
+	}
+	return devices
+}
+
+/* setDeviceError records err against the named device, if there is one */
+func (r *Robot) setDeviceError(name, err string) {
+	r.devicesMux.Lock()
+	defer r.devicesMux.Unlock()
+	if device := r.Devices[name]; device != nil {
+		device.Error = err
+	}
+}
+
+// StartRecording starts recording the camera, see Recorder.
+func (r *Robot) StartRecording(limits RecordingLimits) (Recording, error) {
+	if !r.Camera.Started() {
+		return Recording{}, ErrCameraNotRunning
+	}
+	return r.recorder.Start(limits)
+}
+
+// StopRecording stops the recording in progress and returns it once its file is finished.
+func (r *Robot) StopRecording() (Recording, error) {
+	return r.recorder.Stop()
+}
+
+// Recordings lists the recordings, newest first, with the one in progress.
+func (r *Robot) Recordings() ([]Recording, error) {
+	return r.recorder.List()
+}
+
+// RecordingPath returns the file of the named recording.
+func (r *Robot) RecordingPath(name string) (string, error) {
+	return r.recorder.Path(name)
+}
+
+// RecordClip records a clip of the moments around now, see ClipRecorder.
+func (r *Robot) RecordClip(reason string) (Recording, error) {
+	if !r.Camera.Started() {
+		return Recording{}, ErrCameraNotRunning
+	}
+	return r.clips.Trigger(reason)
+}
+
+// ClipsStatus reports what the clip recorder is holding and doing.
+func (r *Robot) ClipsStatus() ClipsStatus {
+	return r.clips.Status()
+}
+
+// MotionStatus reports what the motion detector has seen.
+func (r *Robot) MotionStatus() MotionStatus {
+	return r.Camera.Motion.Status()
+}
+
+// ConfigureMotion changes the motion detector's config, it is turned on and off with config.Enabled.
+func (r *Robot) ConfigureMotion(config MotionConfig) (MotionStatus, error) {
+	wasActive := r.Camera.Motion.Status().Active
+	if _, err := r.Camera.Motion.Configure(config); err != nil {
+		return MotionStatus{}, err
+	}
+	// Motion that was going on has stopped as far as anyone listening is concerned
+	status := r.Camera.Motion.Status()
+	if wasActive && !status.Active {
+		r.Events.Publish(EventMotionStopped, MotionResult{At: time.Now()})
+	}
+	return status, nil
+}
+
+// FaceDetectorStatus reports the face detector's config and the faces it last found.
+func (r *Robot) FaceDetectorStatus() FaceDetectorStatus {
+	return r.Camera.Faces.Status()
+}
+
+// ConfigureFaceDetector switches the face detector to config, loading its model.
+// Face detection itself is still turned on and off with Camera.SetDetectFaces.
+func (r *Robot) ConfigureFaceDetector(config FaceDetectorConfig) (FaceDetectorStatus, error) {
+	if _, err := r.Camera.Faces.Configure(config); err != nil {
+		return FaceDetectorStatus{}, err
+	}
+	return r.Camera.Faces.Status(), nil
+}
+
+// ObjectStatus reports the object detector's config and what it last found.
+func (r *Robot) ObjectStatus() ObjectStatus {
+	return r.Camera.Objects.Status()
+}
+
+// ConfigureObjects changes the object detector's config, it is turned on and off with config.Enabled.
+func (r *Robot) ConfigureObjects(config ObjectDetectorConfig) (ObjectStatus, error) {
+	if _, err := r.Camera.Objects.Configure(config); err != nil {
+		return ObjectStatus{}, err
+	}
+	return r.Camera.Objects.Status(), nil
+}
+
+// MarkerStatus reports the marker detector's config and the markers it last found,
+// with where each one is relative to the base when its pose and the arm's are known.
+func (r *Robot) MarkerStatus() MarkerStatus {
+	status := r.Camera.Markers.Status()
+	if status.Last == nil {
+		return status
+	}
+	if camera, err := r.ArmPose(); err == nil {
+		status.Last.Markers = locateMarkers(status.Last.Markers, camera)
+	}
+	return status
+}
+
+// ConfigureMarkers changes the marker detector's config, it is turned on and off with config.Enabled.
+func (r *Robot) ConfigureMarkers(config MarkerConfig) (MarkerStatus, error) {
+	if _, err := r.Camera.Markers.Configure(config); err != nil {
+		return MarkerStatus{}, err
+	}
+	return r.MarkerStatus(), nil
+}
+
+// VisionStatus reports every stage of the camera's vision pipeline.
+func (r *Robot) VisionStatus() VisionStatus {
+	return VisionStatus{
+		DetectFaces: r.Camera.DetectingFaces(),
+		Motion:      r.Camera.Motion.Status(),
+		Faces:       r.Camera.Faces.Status(),
+		Recognition: r.Camera.Recognizer.Status(),
+		Objects:     r.Camera.Objects.Status(),
+		Markers:     r.MarkerStatus(),
+	}
+}
+
+// CalibrationStatus reports the camera calibration under way, if there is one, and the ones saved.
+func (r *Robot) CalibrationStatus() CalibrationStatus {
+	status := CalibrationStatus{
+		Calibrations: r.Camera.Calibrations.List(),
+		Undistort:    r.Camera.Undistort.Enabled(),
+	}
+	if session, ok := r.Camera.Calibrator.Session(); ok {
+		status.Session = &session
+	}
+	return status
+}
+
+// StartCalibration starts calibrating the camera in use with board, throwing away any calibration under way.
+func (r *Robot) StartCalibration(board CalibrationBoard) (CalibrationStatus, error) {
+	if _, err := r.Camera.Calibrator.Start(board, r.Camera.backend()); err != nil {
+		return CalibrationStatus{}, err
+	}
+	return r.CalibrationStatus(), nil
+}
+
+// CaptureCalibration waits for n more views of the board from the camera. Whoever is
+// holding it has to move it between views; the ones taken are kept even if not all n are.
+func (r *Robot) CaptureCalibration(n int) (CalibrationStatus, error) {
+	if !r.Camera.Started() {
+		return CalibrationStatus{}, ErrCameraNotRunning
+	}
+	before, done, err := r.Camera.Calibrator.Capture(n)
+	if err != nil {
+		return CalibrationStatus{}, err
+	}
+
+	select {
+	case <-done:
+	case <-time.After(calibrationCaptureTimeout):
+		r.Camera.Calibrator.StopCapture()
+	}
+	session, ok := r.Camera.Calibrator.Session()
+	if !ok {
+		return CalibrationStatus{}, ErrNotCalibrating
+	}
+	if got := session.Views - before.Views; got < n {
+		return CalibrationStatus{}, fmt.Errorf("%w: captured %d of %d views in %v, is the whole board in view?", ErrInvalidCalibration, got, n, calibrationCaptureTimeout)
+	}
+	return r.CalibrationStatus(), nil
+}
+
+// FinishCalibration works out the camera's intrinsics from the views captured and saves them.
+func (r *Robot) FinishCalibration() (CameraIntrinsics, error) {
+	intrinsics, err := r.Camera.Calibrator.Finish(r.Camera.Calibrations.Put)
+	if err == nil {
+		r.log.Printf("Calibrated the camera at %dx%d from %d views, the error is %.2f pixels", intrinsics.Width, intrinsics.Height, intrinsics.Frames, intrinsics.Error)
+	}
+	return intrinsics, err
+}
+
+// CancelCalibration throws away the calibration under way.
+func (r *Robot) CancelCalibration() error {
+	return r.Camera.Calibrator.Cancel()
+}
+
+// DeleteCalibration forgets the camera's calibration for backend at width x height.
+func (r *Robot) DeleteCalibration(backend CameraBackend, width, height int) (CameraIntrinsics, error) {
+	return r.Camera.Calibrations.Delete(backend, width, height)
+}
+
+// SetUndistort turns taking the lens distortion out of frames on or off.
+func (r *Robot) SetUndistort(undistort bool) CalibrationStatus {
+	r.Camera.Undistort.SetEnabled(undistort)
+	return r.CalibrationStatus()
+}
+
+// Enrolling people from the camera, see EnrollPerson
+const (
+	enrollCaptureInterval = 300 * time.Millisecond // between samples taken from the camera, so they differ a little
+	enrollCaptureTimeout  = 15 * time.Second       // to get them all
+)
+
+// People returns everyone enrolled.
+func (r *Robot) People() []Person {
+	return r.Camera.Recognizer.People.List()
+}
+
+// Person returns the person enrolled under name.
+func (r *Robot) Person(name string) (Person, error) {
+	return r.Camera.Recognizer.People.Get(name)
+}
+
+// RecognitionStatus reports the face recognizer's config and whether its model is loaded.
+func (r *Robot) RecognitionStatus() RecognitionStatus {
+	return r.Camera.Recognizer.Status()
+}
+
+// EnrollPerson enrolls name, or adds samples to them, from pictures and from
+// capture frames of the live camera. Every picture must have exactly one face
+// in it; frames from the camera that don't are skipped.
+func (r *Robot) EnrollPerson(name string, images [][]byte, capture int) (Person, error) {
+	if err := checkPersonName(name); err != nil {
+		return Person{}, err
+	}
+	if len(images) == 0 && capture <= 0 {
+		return Person{}, fmt.Errorf("%w: send sample images or a number of samples to capture", ErrInvalidEnrollment)
+	}
+	if capture < 0 || len(images)+capture > MaxPersonSamples {
+		return Person{}, fmt.Errorf("%w: at most %d samples at a time", ErrInvalidEnrollment, MaxPersonSamples)
+	}
+
+	recognizer := r.Camera.Recognizer
+	var embeddings [][]float32
+	for i, data := range images {
+		embedding, err := recognizer.SampleImage(r.Camera.Faces, data)
+		if err != nil {
+			return Person{}, fmt.Errorf("image %d: %w", i+1, err)
+		}
+		embeddings = append(embeddings, embedding)
+	}
+	if capture > 0 {
+		captured, err := r.captureSamples(capture)
+		if err != nil {
+			return Person{}, err
+		}
+		embeddings = append(embeddings, captured...)
+	}
+
+	person, err := recognizer.People.Enroll(name, embeddings)
+	if err == nil {
+		r.log.Printf("Enrolled %v, %d samples", person.Name, person.Samples)
+	}
+	return person, err
+}
+
+// captureSamples takes n face samples from the camera's frames
+func (r *Robot) captureSamples(n int) ([][]float32, error) {
+	if !r.Camera.Started() {
+		return nil, ErrCameraNotRunning
+	}
+	sub := r.Camera.Frames.Subscribe(1, DropOldest)
+	defer sub.Close()
+
+	deadline := time.After(enrollCaptureTimeout)
+	var embeddings [][]float32
+	var next time.Time
+	lastErr := errors.New("no frames")
+	for len(embeddings) < n {
+		select {
+		case frame, ok := <-sub.Frames():
+			if !ok {
+				return nil, ErrCameraNotRunning
+			}
+			if time.Now().Before(next) {
+				frame.Release()
+				continue
+			}
+			embedding, err := r.Camera.Recognizer.Sample(r.Camera.Faces, frame.Mat)
+			frame.Release()
+			if errors.Is(err, ErrNoFaceRecognizer) {
+				return nil, err
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			embeddings = append(embeddings, embedding)
+			next = time.Now().Add(enrollCaptureInterval)
+		case <-deadline:
+			return nil, fmt.Errorf("%w: captured %d of %d samples in %v, the last frame: %v", ErrInvalidEnrollment, len(embeddings), n, enrollCaptureTimeout, lastErr)
+		}
+	}
+	return embeddings, nil
+}
+
+// DeletePerson forgets the person enrolled under name.
+func (r *Robot) DeletePerson(name string) (Person, error) {
+	return r.Camera.Recognizer.People.Delete(name)
+}
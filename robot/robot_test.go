@@ -0,0 +1,198 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func newSimulatedRobot(t *testing.T) *Robot {
+	t.Helper()
+	t.Setenv("GIZMATRON_POSES", filepath.Join(t.TempDir(), "poses.json"))
+	t.Setenv("GIZMATRON_ROUTINES", t.TempDir())
+	t.Setenv("GIZMATRON_RECORDINGS", t.TempDir())
+	t.Setenv("GIZMATRON_PEOPLE", filepath.Join(t.TempDir(), "people.json"))
+	t.Setenv("GIZMATRON_CAMERA_CALIBRATION", filepath.Join(t.TempDir(), "camera_calibration.json"))
+	bot, err := InitRobotWithProfile(log.New(io.Discard, "", 0), ProfileSimulated)
+	if err != nil {
+		t.Fatalf("InitRobotWithProfile returned error: %v", err)
+	}
+	return bot
+}
+
+func TestInitRobotWithProfile_Simulated(t *testing.T) {
+	bot := newSimulatedRobot(t)
+
+	if bot.Profile != ProfileSimulated {
+		t.Errorf("Profile = %q, want %q", bot.Profile, ProfileSimulated)
+	}
+	if !bot.IsOperational {
+		t.Error("simulated robot should be operational")
+	}
+	for _, name := range []string{"runningLed", "Arm", "ArmLed", "Camera"} {
+		device, ok := bot.Devices[name]
+		if !ok {
+			t.Errorf("device %s missing", name)
+			continue
+		}
+		if device.Status != "Operational" {
+			t.Errorf("device %s status = %q (%s), want Operational", name, device.Status, device.Error)
+		}
+	}
+	if bot.Camera.Config.Backend != BackendSimulated {
+		t.Errorf("camera backend = %q, want %q", bot.Camera.Config.Backend, BackendSimulated)
+	}
+	if value, _ := bot.runningled.Value(); value != 1 {
+		t.Errorf("running LED = %d, want 1", value)
+	}
+}
+
+func TestInitRobotWithProfile_Unknown(t *testing.T) {
+	bot, err := InitRobotWithProfile(log.New(io.Discard, "", 0), "simulatd")
+	if !errors.Is(err, ErrUnknownProfile) || bot != nil {
+		t.Errorf("InitRobotWithProfile = %v, %v, want ErrUnknownProfile", bot, err)
+	}
+}
+
+func TestSimulatedRobotStartStop(t *testing.T) {
+	bot := newSimulatedRobot(t)
+	bot.arm.SetSpeed(0)
+	bot.arm.driver.SetCalibration(fastCalibration())
+
+	if running, err := bot.Start(); err != nil || !running {
+		t.Fatalf("Start() = %v, %v", running, err)
+	}
+	if value, _ := bot.armled.Value(); value != 1 {
+		t.Errorf("arm LED = %d, want 1 after Start", value)
+	}
+	if !bot.arm.IsRunning {
+		t.Error("arm should be running after Start")
+	}
+
+	if running, err := bot.Stop(); err != nil || running {
+		t.Fatalf("Stop() = %v, %v", running, err)
+	}
+	if value, _ := bot.armled.Value(); value != 0 {
+		t.Errorf("arm LED = %d, want 0 after Stop", value)
+	}
+}
+
+func TestSimulatedRobot_MovesKeepSpeed(t *testing.T) {
+	bot := newSimulatedRobot(t)
+	bot.arm.driver.SetCalibration(fastCalibration())
+	bot.arm.SetSpeed(0)
+
+	if _, err := bot.SavePose("lookout", [5]int{100, 90, 90, 90, 90}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := bot.GoToPose("lookout", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bot.motion.Wait(context.Background(), job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.MoveToPose(context.Background(), bot.arm.Pose(), ElbowAuto, 1); err != nil {
+		t.Fatal(err)
+	}
+	if bot.arm.speed != 0 {
+		t.Errorf("speed after the moves = %v, want it left at 0", bot.arm.speed)
+	}
+}
+
+func TestSimulatedRobot_NoArmLed(t *testing.T) {
+	bot := newSimulatedRobot(t)
+	bot.arm.SetSpeed(0)
+	bot.arm.driver.SetCalibration(fastCalibration())
+	// As when the LED's GPIO line can't be had
+	bot.armled = nil
+
+	if running, err := bot.Start(); err != nil || !running {
+		t.Fatalf("Start() = %v, %v", running, err)
+	}
+	if err := bot.EmergencyStop(false); err != nil {
+		t.Fatalf("EmergencyStop returned error: %v", err)
+	}
+	if !bot.EmergencyStopped() || bot.IsRunning {
+		t.Error("the e-stop didn't halt the robot")
+	}
+	bot.ClearEmergencyStop()
+	if running, err := bot.Stop(); err != nil || running {
+		t.Fatalf("Stop() = %v, %v", running, err)
+	}
+}
+
+func TestSimulatedRobotReset(t *testing.T) {
+	bot := newSimulatedRobot(t)
+	bot.arm.driver.SetCalibration(fastCalibration())
+	bot.Devices["ArmLed"].Error = "Error Failed to move arm to starting position"
+	bot.IsRunning = true
+
+	if err := bot.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset returned error: %v", err)
+	}
+	if bot.Devices["ArmLed"].Error != "" {
+		t.Errorf("ArmLed error = %q, want it cleared", bot.Devices["ArmLed"].Error)
+	}
+	if bot.IsRunning {
+		t.Error("robot should be stopped after Reset")
+	}
+	if bot.arm.driver.CurrentAngles() != bot.arm.Calibration().HomeAngles() {
+		t.Errorf("arm at %v after Reset, want home", bot.arm.driver.CurrentAngles())
+	}
+}
+
+func TestSimulatedRobotReset_ReinitializesArm(t *testing.T) {
+	bot := newSimulatedRobot(t)
+	bot.arm, bot.motion = nil, nil
+	bot.Devices["Camera"].Status = "Reconnecting"
+	bot.Devices["Camera"].Error = "no frames"
+	bot.Devices["runningLed"].Status = "Not Operational"
+	bot.Devices["runningLed"].Error = "no such line"
+
+	// Whatever asks after the arm while it comes back sees the old one or the new one
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			bot.EmergencyStopped()
+			bot.Job("nothing")
+			bot.DeviceStatus()
+		}
+	}()
+	if err := bot.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset returned error: %v", err)
+	}
+	<-done
+
+	if arm, motion := bot.armParts(); arm == nil || motion == nil {
+		t.Fatal("Reset didn't bring the arm back")
+	}
+	if err := bot.Devices["Camera"].Error; err != "" {
+		t.Errorf("Camera error = %q, want it cleared", err)
+	}
+	if err := bot.Devices["runningLed"].Error; err == "" {
+		t.Error("the error of a device that never came up was cleared")
+	}
+}
+
+func TestDeviceStatus_IsACopy(t *testing.T) {
+	bot := newSimulatedRobot(t)
+	devices := bot.DeviceStatus()
+	devices["Camera"].Error = "no frames"
+	devices["Camera"].Data["Detecting"] = true
+	if bot.Devices["Camera"].Error != "" || bot.Devices["Camera"].Data["Detecting"] != false {
+		t.Errorf("changing the status changed the device: %+v", bot.Devices["Camera"])
+	}
+}
+
+func TestInitRobotWithProfile_SimulatedKeepsVirtualCamera(t *testing.T) {
+	t.Setenv("GIZMATRON_CAMERA_BACKEND", string(BackendTestPattern))
+	bot := newSimulatedRobot(t)
+	if bot.Camera.Config.Backend != BackendTestPattern {
+		t.Errorf("camera backend = %v, want %v", bot.Camera.Config.Backend, BackendTestPattern)
+	}
+}
@@ -0,0 +1,351 @@
+package robot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Teach and replay
+
+	While the arm is being taught, every move it is told to make (from the api,
+	a named pose, a gesture, anything that goes through the arm) is recorded
+	as a step: the joint targets, the speed and when the move was asked for.
+	Re-homing the arm after a reset is recovery, not part of a routine, and
+	isn't recorded.
+	When teaching stops the steps are saved as a named routine, one JSON file
+	per routine in GIZMATRON_ROUTINES (the routines directory by default).
+
+	Replaying a routine issues the same moves at the same times, or scaled:
+	at scale 2 everything happens twice as fast, at 0.5 half as fast.
+
+	Routines named in GIZMATRON_START_ROUTINES (comma separated) are queued
+	up to run, in order, every time the robot starts.
+*/
+
+// Replay scales outside this range are refused
+const (
+	MinRoutineScale = 0.1
+	MaxRoutineScale = 10.0
+)
+
+var (
+	ErrRoutineNotFound    = errors.New("no such routine")
+	ErrInvalidRoutineName = errors.New("routine names are 1-64 letters, digits, '-' or '_'")
+	ErrAlreadyTeaching    = errors.New("the arm is already being taught")
+	ErrNotTeaching        = errors.New("the arm is not being taught")
+	ErrEmptyRoutine       = errors.New("nothing was recorded")
+)
+
+// RoutineStep is one recorded move.
+type RoutineStep struct {
+	AtMs          int64   `json:"at_ms"`                    // when the move was asked for, ms after the routine started
+	Joints        [5]int  `json:"joints"`                   // joint targets of the move
+	SpeedMs       int     `json:"speed_ms"`                 // the arm's speed setting for the move, ms per degree
+	VelocityScale float64 `json:"velocity_scale,omitempty"` // fraction of the joints' max velocity the move ran at, 0 for all of it
+}
+
+// velocityScale is the step's VelocityScale, routines saved before it was recorded ran at 1
+func (s RoutineStep) velocityScale() float64 {
+	if s.VelocityScale == 0 {
+		return 1
+	}
+	return s.VelocityScale
+}
+
+// Routine is a recorded sequence of moves.
+type Routine struct {
+	Name  string        `json:"name"`
+	Steps []RoutineStep `json:"steps"`
+}
+
+// Duration is how long after starting the last move is asked for.
+func (r Routine) Duration() time.Duration {
+	if len(r.Steps) == 0 {
+		return 0
+	}
+	return time.Duration(r.Steps[len(r.Steps)-1].AtMs) * time.Millisecond
+}
+
+// Validate checks the routine can be replayed on an arm with this calibration.
+func (r Routine) Validate(cal ArmCalibration) error {
+	if !poseNamePattern.MatchString(r.Name) {
+		return ErrInvalidRoutineName
+	}
+	if len(r.Steps) == 0 {
+		return ErrEmptyRoutine
+	}
+	var last int64
+	for n, step := range r.Steps {
+		if step.AtMs < last {
+			return fmt.Errorf("step %d at %dms is before the step before it", n, step.AtMs)
+		}
+		last = step.AtMs
+		if step.VelocityScale < 0 || step.VelocityScale > 1 {
+			return fmt.Errorf("step %d velocity scale %v is outside 0-1", n, step.VelocityScale)
+		}
+		for i, angle := range step.Joints {
+			if joint := cal.Joints[i]; !joint.Allows(angle) {
+				return &JointLimitError{Joint: i, Angle: angle, Min: joint.MinAngle, Max: joint.MaxAngle}
+			}
+		}
+	}
+	return nil
+}
+
+// Play returns a motion command that replays the routine, scale times as fast.
+func (r Routine) Play(scale float64) MotionCommand {
+	return func(ctx context.Context, a *Arm) error {
+		log.Printf("Playing routine %v at %vx", r.Name, scale)
+
+		// Every step sets its own speed, the jobs after the routine keep theirs
+		defer a.SetSpeed(a.speed)
+		started := time.Now()
+		for _, step := range r.Steps {
+			at := time.Duration(float64(step.AtMs)/scale) * time.Millisecond
+			if wait := at - time.Since(started); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+
+			// The speed setting carries the replay's scale when there is one,
+			// otherwise the velocity scale does, as far as the joints allow
+			speed := time.Duration(step.SpeedMs)
+			velocity := step.velocityScale()
+			if speed > 0 {
+				speed = time.Duration(float64(speed) / scale)
+				if speed < 1 {
+					speed = 1
+				}
+			} else {
+				velocity = math.Min(1, velocity*scale)
+			}
+			a.SetSpeed(speed)
+			if err := a.move(ctx, step.Joints, velocity); err != nil {
+				return fmt.Errorf("routine %v: %w", r.Name, err)
+			}
+		}
+		return nil
+	}
+}
+
+/* routineRecorder collects the moves of the routine being taught */
+type routineRecorder struct {
+	routine Routine
+	started time.Time
+}
+
+func (rec *routineRecorder) record(joints [5]int, speed time.Duration, velocityScale float64) {
+	rec.routine.Steps = append(rec.routine.Steps, RoutineStep{
+		AtMs:          time.Since(rec.started).Milliseconds(),
+		Joints:        joints,
+		SpeedMs:       int(speed),
+		VelocityScale: velocityScale,
+	})
+}
+
+// StartTeaching starts recording every move the arm is told to make into a routine called name.
+// The first step is wherever the arm is now, so a replay starts from the same place.
+func (a *Arm) StartTeaching(name string) error {
+	if !poseNamePattern.MatchString(name) {
+		return ErrInvalidRoutineName
+	}
+
+	a.recordMux.Lock()
+	defer a.recordMux.Unlock()
+	if a.recorder != nil {
+		return ErrAlreadyTeaching
+	}
+
+	a.recorder = &routineRecorder{routine: Routine{Name: name}, started: time.Now()}
+	a.recorder.record(a.driver.CurrentAngles(), defaultArmSpeed, 1)
+	log.Printf("Teaching routine %v", name)
+	return nil
+}
+
+// StopTeaching stops recording and returns the routine that was taught.
+func (a *Arm) StopTeaching() (Routine, error) {
+	a.recordMux.Lock()
+	defer a.recordMux.Unlock()
+	if a.recorder == nil {
+		return Routine{}, ErrNotTeaching
+	}
+
+	routine := a.recorder.routine
+	a.recorder = nil
+	log.Printf("Taught routine %v, %d steps over %v", routine.Name, len(routine.Steps), routine.Duration())
+	return routine, nil
+}
+
+// Teaching returns the routine recorded so far, if the arm is being taught.
+func (a *Arm) Teaching() (Routine, bool) {
+	a.recordMux.Lock()
+	defer a.recordMux.Unlock()
+	if a.recorder == nil {
+		return Routine{}, false
+	}
+	routine := a.recorder.routine
+	routine.Steps = append([]RoutineStep(nil), routine.Steps...)
+	return routine, true
+}
+
+// recordMove adds a move to the routine being taught, if any
+func (a *Arm) recordMove(joints [5]int, velocityScale float64) {
+	a.recordMux.Lock()
+	defer a.recordMux.Unlock()
+	if a.recorder != nil {
+		a.recorder.record(joints, a.speed, velocityScale)
+	}
+}
+
+// RoutineSummary describes a saved routine without its steps.
+type RoutineSummary struct {
+	Name       string `json:"name"`
+	Steps      int    `json:"steps"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// RoutineLibrary keeps routines as JSON files in a directory.
+type RoutineLibrary struct {
+	mux sync.Mutex
+	dir string
+}
+
+// NewRoutineLibrary uses dir for routine files, it is created when the first routine is saved.
+func NewRoutineLibrary(dir string) *RoutineLibrary {
+	return &RoutineLibrary{dir: dir}
+}
+
+// loadRoutineLibrary uses the directory named by GIZMATRON_ROUTINES.
+func loadRoutineLibrary() *RoutineLibrary {
+	dir := os.Getenv("GIZMATRON_ROUTINES")
+	if dir == "" {
+		dir = "routines"
+	}
+	return NewRoutineLibrary(dir)
+}
+
+// startRoutines are the routines named by GIZMATRON_START_ROUTINES.
+func startRoutines() []string {
+	var names []string
+	for _, name := range strings.Split(os.Getenv("GIZMATRON_START_ROUTINES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (l *RoutineLibrary) path(name string) string {
+	return filepath.Join(l.dir, name+".json")
+}
+
+// Get loads a routine.
+func (l *RoutineLibrary) Get(name string) (Routine, error) {
+	if !poseNamePattern.MatchString(name) {
+		return Routine{}, ErrRoutineNotFound
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	data, err := os.ReadFile(l.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return Routine{}, ErrRoutineNotFound
+	}
+	if err != nil {
+		return Routine{}, err
+	}
+
+	var routine Routine
+	if err := json.Unmarshal(data, &routine); err != nil {
+		return Routine{}, fmt.Errorf("invalid routine file %v: %w", l.path(name), err)
+	}
+	routine.Name = name
+	return routine, nil
+}
+
+// List summarizes every saved routine, sorted by name. Files that can't be read are skipped.
+func (l *RoutineLibrary) List() []RoutineSummary {
+	files, _ := filepath.Glob(filepath.Join(l.dir, "*.json"))
+
+	summaries := []RoutineSummary{}
+	for _, file := range files {
+		routine, err := l.Get(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			continue
+		}
+		summaries = append(summaries, RoutineSummary{
+			Name:       routine.Name,
+			Steps:      len(routine.Steps),
+			DurationMs: routine.Duration().Milliseconds(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	return summaries
+}
+
+// Save writes a routine, replacing any routine with the same name.
+func (l *RoutineLibrary) Save(routine Routine) error {
+	if !poseNamePattern.MatchString(routine.Name) {
+		return ErrInvalidRoutineName
+	}
+
+	data, err := json.MarshalIndent(routine, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if err := os.MkdirAll(l.dir, 0o755); err != nil {
+		return fmt.Errorf("could not save routine: %w", err)
+	}
+	// Write to a temporary file first so a crash can't leave half a routine behind
+	tmp, err := os.CreateTemp(l.dir, ".routine-*.json")
+	if err != nil {
+		return fmt.Errorf("could not save routine: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save routine: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save routine: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path(routine.Name)); err != nil {
+		return fmt.Errorf("could not save routine: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a routine.
+func (l *RoutineLibrary) Delete(name string) error {
+	if !poseNamePattern.MatchString(name) {
+		return ErrRoutineNotFound
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	err := os.Remove(l.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrRoutineNotFound
+	}
+	return err
+}
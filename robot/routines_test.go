@@ -0,0 +1,150 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTeaching_RecordsMoves(t *testing.T) {
+	arm, _ := newTestArm(t)
+
+	if err := arm.StartTeaching("wave"); err != nil {
+		t.Fatal(err)
+	}
+	if err := arm.StartTeaching("again"); !errors.Is(err, ErrAlreadyTeaching) {
+		t.Errorf("StartTeaching twice returned %v, want ErrAlreadyTeaching", err)
+	}
+
+	moves := [][5]int{{90, 30, 30, 130, 130}, {45, 60, 60, 120, 90}}
+	for _, joints := range moves {
+		if err := arm.MoveToJoints(context.Background(), joints); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routine, err := arm.StopTeaching()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routine.Name != "wave" || len(routine.Steps) != 3 {
+		t.Fatalf("taught %+v, want wave with the start and two moves", routine)
+	}
+	if routine.Steps[0].Joints != [5]int{90, 0, 0, 180, 180} {
+		t.Errorf("first step = %v, want where the arm was", routine.Steps[0].Joints)
+	}
+	for i, joints := range moves {
+		if routine.Steps[i+1].Joints != joints {
+			t.Errorf("step %d = %v, want %v", i+1, routine.Steps[i+1].Joints, joints)
+		}
+	}
+	if err := routine.Validate(arm.Calibration()); err != nil {
+		t.Errorf("taught routine doesn't validate: %v", err)
+	}
+
+	if _, err := arm.StopTeaching(); !errors.Is(err, ErrNotTeaching) {
+		t.Errorf("StopTeaching twice returned %v, want ErrNotTeaching", err)
+	}
+}
+
+func TestRoutine_PlayScaled(t *testing.T) {
+	arm, chip := newTestArm(t)
+	routine := Routine{Name: "wave", Steps: []RoutineStep{
+		{AtMs: 0, Joints: [5]int{90, 30, 30, 130, 130}},
+		{AtMs: 200, Joints: [5]int{45, 60, 60, 120, 90}},
+	}}
+
+	started := time.Now()
+	if err := routine.Play(2)(context.Background(), arm); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(started); took < 100*time.Millisecond || took > 250*time.Millisecond {
+		t.Errorf("at 2x a 200ms routine took %v, want about 100ms", took)
+	}
+	if arm.driver.CurrentAngles() != routine.Steps[1].Joints {
+		t.Errorf("arm ended at %v, want %v", arm.driver.CurrentAngles(), routine.Steps[1].Joints)
+	}
+	if _, off := chip.Channel(BASE_SERVO); off != pulseFor(45) {
+		t.Errorf("base pulse = %d, want %d", off, pulseFor(45))
+	}
+}
+
+func TestTeaching_RecordsVelocityScale(t *testing.T) {
+	arm, _ := newTestArm(t)
+	arm.SetSpeed(1)
+	arm.StartTeaching("sleepy")
+	if err := arm.Gesture(context.Background(), "sleep", GestureParams{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := arm.Reset(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	routine, _ := arm.StopTeaching()
+
+	sleep, _ := LookupGesture("sleep")
+	if len(routine.Steps) != 1+len(sleep.Frames) {
+		t.Fatalf("taught %d steps, want the start and the gesture's %d, not the reset's", len(routine.Steps), len(sleep.Frames))
+	}
+	for _, step := range routine.Steps[1:] {
+		if step.SpeedMs != 0 || step.VelocityScale != sleep.Velocity {
+			t.Errorf("step = %+v, want the gesture's velocity %v", step, sleep.Velocity)
+		}
+	}
+
+	// Replaying it leaves the speed alone
+	if err := routine.Play(1)(context.Background(), arm); err != nil {
+		t.Fatal(err)
+	}
+	if arm.speed != 1 {
+		t.Errorf("speed after a replay = %v, want it left at 1", arm.speed)
+	}
+}
+
+func TestRoutine_Validate(t *testing.T) {
+	cal := DefaultArmCalibration()
+	for _, tc := range []struct {
+		routine Routine
+		want    string
+	}{
+		{Routine{Name: "empty"}, "empty"},
+		{Routine{Name: "bad name!", Steps: []RoutineStep{{}}}, "bad name"},
+		{Routine{Name: "backwards", Steps: []RoutineStep{{AtMs: 100}, {AtMs: 50}}}, "backwards"},
+		{Routine{Name: "limits", Steps: []RoutineStep{{Joints: [5]int{90, 0, 0, 180, 200}}}}, "limits"},
+		{Routine{Name: "too-fast", Steps: []RoutineStep{{Joints: [5]int{90, 0, 0, 180, 180}, VelocityScale: 1.5}}}, "too fast"},
+	} {
+		if err := tc.routine.Validate(cal); err == nil {
+			t.Errorf("%v routine should not validate", tc.want)
+		}
+	}
+}
+
+func TestRoutineLibrary(t *testing.T) {
+	routines := NewRoutineLibrary(t.TempDir())
+
+	routine := Routine{Name: "wave", Steps: []RoutineStep{
+		{AtMs: 0, Joints: [5]int{90, 30, 30, 130, 130}, SpeedMs: 10},
+		{AtMs: 1500, Joints: [5]int{45, 60, 60, 120, 90}, SpeedMs: 5},
+	}}
+	if err := routines.Save(routine); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := routines.Get("wave")
+	if err != nil || len(got.Steps) != 2 || got.Steps[1] != routine.Steps[1] {
+		t.Errorf("Get(wave) = %+v %v, want %+v", got, err, routine)
+	}
+	if list := routines.List(); len(list) != 1 || list[0].Name != "wave" || list[0].Steps != 2 || list[0].DurationMs != 1500 {
+		t.Errorf("List() = %+v", list)
+	}
+
+	if err := routines.Delete("wave"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := routines.Get("wave"); !errors.Is(err, ErrRoutineNotFound) {
+		t.Errorf("Get of deleted routine returned %v, want ErrRoutineNotFound", err)
+	}
+	if _, err := routines.Get("../poses"); !errors.Is(err, ErrRoutineNotFound) {
+		t.Errorf("Get outside the library returned %v, want ErrRoutineNotFound", err)
+	}
+}
@@ -0,0 +1,66 @@
+package robot
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+simulatedSource is a FrameSource that makes up its frames,
+so the camera pipeline and the video endpoints work without a camera.
+Each frame is a flat gray image stamped with a frame counter and the time.
+*/
+type simulatedSource struct {
+	width  int
+	height int
+	frames int
+	closed bool
+}
+
+func newSimulatedSource(width, height int) *simulatedSource {
+	return &simulatedSource{width: width, height: height}
+}
+
+func (s *simulatedSource) Read(m *gocv.Mat) bool {
+	if s.closed {
+		return false
+	}
+	s.frames++
+
+	frame := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(64, 64, 64, 0), s.height, s.width, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	white := color.RGBA{255, 255, 255, 0}
+	gocv.PutText(&frame, "GIZMATRON SIMULATED CAMERA", image.Point{20, 40}, gocv.FontHersheySimplex, 0.8, white, 2)
+	gocv.PutText(&frame, fmt.Sprintf("frame %d", s.frames), image.Point{20, 80}, gocv.FontHersheySimplex, 0.7, white, 1)
+	gocv.PutText(&frame, time.Now().Format(time.RFC3339), image.Point{20, 115}, gocv.FontHersheySimplex, 0.7, white, 1)
+
+	frame.CopyTo(m)
+	return true
+}
+
+func (s *simulatedSource) Set(prop gocv.VideoCaptureProperties, param float64) {
+	switch prop {
+	case gocv.VideoCaptureFrameWidth:
+		s.width = int(param)
+	case gocv.VideoCaptureFrameHeight:
+		s.height = int(param)
+	}
+}
+
+func (s *simulatedSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+// openSimulated points the camera at a simulated source
+func (c *Cam) openSimulated() {
+	log.Printf("CAMERA: Using simulated camera %dx%d", c.Config.Width, c.Config.Height)
+	c.webcam = newSimulatedSource(c.Config.Width, c.Config.Height)
+	c.Backend = BackendSimulated
+}
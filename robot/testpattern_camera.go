@@ -0,0 +1,130 @@
+package robot
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+/*
+testPatternSource is a FrameSource that draws its frames: a ball bouncing
+side to side, a square bouncing up and down, a frame counter and the time.
+Something is always moving, so motion detection and the stream can be
+checked by eye. With a face it also draws a simple face drifting around
+the frame, for face detection and tracking to find.
+*/
+type testPatternSource struct {
+	width  int
+	height int
+	face   bool
+	frames int
+	closed bool
+}
+
+func newTestPatternSource(width, height int, face bool) *testPatternSource {
+	return &testPatternSource{width: width, height: height, face: face}
+}
+
+// bounce goes from 0 up to max and back down again as n counts up, by step each time
+func bounce(n, step, max int) int {
+	if max <= 0 {
+		return 0
+	}
+	pos := (n * step) % (2 * max)
+	if pos > max {
+		pos = 2*max - pos
+	}
+	return pos
+}
+
+// ballAt is the centre of the ball in frame n
+func (s *testPatternSource) ballAt(n int) image.Point {
+	const radius = 30
+	return image.Point{radius + bounce(n, 8, s.width-2*radius), s.height / 2}
+}
+
+// squareAt is the square in frame n
+func (s *testPatternSource) squareAt(n int) image.Rectangle {
+	const size = 60
+	x := s.width - size - 20
+	y := bounce(n, 5, s.height-size)
+	return image.Rect(x, y, x+size, y+size)
+}
+
+// faceAt is the box around the face in frame n, it drifts slowly so a tracker has to follow it
+func (s *testPatternSource) faceAt(n int) image.Rectangle {
+	size := s.height / 3
+	x := s.width/4 + bounce(n, 2, s.width/2-size)
+	y := s.height/4 + bounce(n, 1, s.height/2-size)
+	return image.Rect(x, y, x+size, y+size)
+}
+
+func (s *testPatternSource) Read(m *gocv.Mat) bool {
+	if s.closed {
+		return false
+	}
+	s.frames++
+	n := s.frames
+
+	frame := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(60, 30, 20, 0), s.height, s.width, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	white := color.RGBA{255, 255, 255, 0}
+	gocv.Circle(&frame, s.ballAt(n), 30, color.RGBA{0, 200, 255, 0}, -1)
+	gocv.Rectangle(&frame, s.squareAt(n), color.RGBA{0, 255, 0, 0}, -1)
+	if s.face {
+		drawFace(&frame, s.faceAt(n))
+	}
+
+	gocv.PutText(&frame, "GIZMATRON TEST PATTERN", image.Point{20, 40}, gocv.FontHersheySimplex, 0.8, white, 2)
+	gocv.PutText(&frame, fmt.Sprintf("frame %d", n), image.Point{20, 80}, gocv.FontHersheySimplex, 0.7, white, 1)
+	gocv.PutText(&frame, time.Now().Format(time.RFC3339Nano), image.Point{20, 115}, gocv.FontHersheySimplex, 0.7, white, 1)
+
+	frame.CopyTo(m)
+	return true
+}
+
+// drawFace draws a plain frontal face filling box: head, eyes, brows, nose and mouth
+func drawFace(img *gocv.Mat, box image.Rectangle) {
+	skin := color.RGBA{150, 180, 220, 0}
+	dark := color.RGBA{40, 40, 40, 0}
+
+	size := box.Dx()
+	centre := box.Min.Add(box.Max).Div(2)
+	at := func(dx, dy int) image.Point { // offsets in hundredths of the face's size
+		return image.Point{centre.X + dx*size/100, centre.Y + dy*size/100}
+	}
+
+	gocv.Circle(img, centre, size/2, skin, -1)
+	for _, side := range []int{-1, 1} {
+		gocv.Circle(img, at(side*18, -10), size/12, dark, -1)
+		gocv.Line(img, at(side*28, -24), at(side*8, -22), dark, max(1, size/40))
+	}
+	gocv.Line(img, at(0, -4), at(0, 10), dark, max(1, size/50))
+	gocv.Line(img, at(-16, 24), at(16, 24), dark, max(1, size/30))
+}
+
+func (s *testPatternSource) Set(prop gocv.VideoCaptureProperties, param float64) {
+	switch prop {
+	case gocv.VideoCaptureFrameWidth:
+		s.width = int(param)
+	case gocv.VideoCaptureFrameHeight:
+		s.height = int(param)
+	}
+}
+
+func (s *testPatternSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+// openTestPattern points the camera at a generated test pattern
+func (c *Cam) openTestPattern() {
+	log.Printf("CAMERA: Using test pattern %dx%d, face: %v", c.Config.Width, c.Config.Height, c.Config.TestPatternFace)
+	c.webcam = newTestPatternSource(c.Config.Width, c.Config.Height, c.Config.TestPatternFace)
+	c.Backend = BackendTestPattern
+}
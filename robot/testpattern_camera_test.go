@@ -0,0 +1,58 @@
+package robot
+
+import (
+	"image"
+	"testing"
+)
+
+func TestBounce(t *testing.T) {
+	for _, tc := range []struct{ n, step, max, want int }{
+		{0, 10, 100, 0},
+		{5, 10, 100, 50},
+		{10, 10, 100, 100},
+		{15, 10, 100, 50},
+		{20, 10, 100, 0},
+		{25, 10, 100, 50},
+		{7, 10, 0, 0},
+	} {
+		if got := bounce(tc.n, tc.step, tc.max); got != tc.want {
+			t.Errorf("bounce(%d, %d, %d) = %d, want %d", tc.n, tc.step, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestTestPattern_StaysInFrame(t *testing.T) {
+	s := newTestPatternSource(640, 480, true)
+	frame := image.Rect(0, 0, 640, 480)
+
+	moved := false
+	for n := 0; n < 1000; n++ {
+		ball := s.ballAt(n)
+		if !ball.In(frame) {
+			t.Fatalf("ball at %v in frame %d is outside %v", ball, n, frame)
+		}
+		if !s.squareAt(n).In(frame) || !s.faceAt(n).In(frame) {
+			t.Fatalf("square %v or face %v in frame %d is outside %v", s.squareAt(n), s.faceAt(n), n, frame)
+		}
+		if s.faceAt(n) != s.faceAt(0) {
+			moved = true
+		}
+	}
+	if !moved {
+		t.Error("the face never moved")
+	}
+}
+
+func TestLoadCameraConfig_VirtualBackends(t *testing.T) {
+	t.Setenv("GIZMATRON_CAMERA_BACKEND", "testpattern")
+	t.Setenv("GIZMATRON_CAMERA_TESTPATTERN_FACE", "true")
+	t.Setenv("GIZMATRON_CAMERA_FILE", "/tmp/clip.mp4")
+
+	config := loadCameraConfig()
+	if config.Backend != BackendTestPattern || !config.TestPatternFace || config.File != "/tmp/clip.mp4" {
+		t.Errorf("config = %+v", config)
+	}
+	if !config.Backend.Virtual() || BackendV4L2.Virtual() {
+		t.Error("testpattern should be virtual and v4l2 not")
+	}
+}
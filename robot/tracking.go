@@ -0,0 +1,293 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+	Face tracking
+
+	While tracking is on the camera's face detections drive the arm, keeping
+	the largest face in the middle of the picture. The face's offset from the
+	centre of the frame is turned into an angle with the camera's field of
+	view: left/right turns the base, up/down tips the wrist (joint 4).
+
+	  deadband      offsets smaller than this, as a fraction of half the frame, are left alone
+	  gain          fraction of the offset corrected per step, below 1 so it doesn't overshoot
+	  max slew      fastest the tracker will turn a joint, degrees per second
+	  lost timeout  no face for this long and the target is lost: the arm goes to
+	                the lost pose, if there is one, and waits for a face
+
+	Tracking runs as a single motion job, so cancelling the job, stopping the
+	robot or the e-stop all stop it too.
+*/
+
+// Tracker defaults, each can be overridden when tracking is started
+const (
+	DefaultTrackingDeadband    = 0.08
+	DefaultTrackingGain        = 0.5
+	DefaultTrackingMaxSlew     = 45 // degrees per second
+	DefaultTrackingLostTimeout = 2 * time.Second
+
+	trackingTick = 100 * time.Millisecond // how often the tracker checks for a lost target
+)
+
+var (
+	ErrAlreadyTracking       = errors.New("already tracking faces")
+	ErrNotTracking           = errors.New("not tracking faces")
+	ErrInvalidTrackingConfig = errors.New("invalid tracking config")
+)
+
+// FaceDetection is what the camera found in one frame.
+type FaceDetection struct {
+	Faces []image.Rectangle // in frame pixels
+	Frame image.Point       // frame size
+	HFOV  float64           // horizontal field of view of the camera, degrees
+	VFOV  float64           // vertical field of view of the camera, degrees
+	At    time.Time
+}
+
+// largest returns the biggest face, if any.
+func (d FaceDetection) largest() (image.Rectangle, bool) {
+	var face image.Rectangle
+	for _, r := range d.Faces {
+		if r.Dx()*r.Dy() > face.Dx()*face.Dy() {
+			face = r
+		}
+	}
+	return face, !face.Empty()
+}
+
+// TrackingConfig tunes the tracker. Zero values mean the defaults.
+type TrackingConfig struct {
+	Deadband      float64 `json:"deadband"`        // 0-1, fraction of half the frame
+	Gain          float64 `json:"gain"`            // 0-1
+	MaxSlew       float64 `json:"max_slew"`        // degrees per second
+	LostTimeoutMs int     `json:"lost_timeout_ms"` // ms without a face before the target is lost
+	LostPose      string  `json:"lost_pose"`       // named pose to go to when the target is lost, empty to stay put
+}
+
+// withDefaults fills in zero values and checks the ranges.
+func (c TrackingConfig) withDefaults() (TrackingConfig, error) {
+	if c.Deadband == 0 {
+		c.Deadband = DefaultTrackingDeadband
+	}
+	if c.Gain == 0 {
+		c.Gain = DefaultTrackingGain
+	}
+	if c.MaxSlew == 0 {
+		c.MaxSlew = DefaultTrackingMaxSlew
+	}
+	if c.LostTimeoutMs == 0 {
+		c.LostTimeoutMs = int(DefaultTrackingLostTimeout.Milliseconds())
+	}
+	if c.Deadband < 0 || c.Deadband >= 1 {
+		return c, fmt.Errorf("%w: deadband %v is outside 0-1", ErrInvalidTrackingConfig, c.Deadband)
+	}
+	if c.Gain < 0 || c.Gain > 1 {
+		return c, fmt.Errorf("%w: gain %v is outside 0-1", ErrInvalidTrackingConfig, c.Gain)
+	}
+	if c.MaxSlew < 0 {
+		return c, fmt.Errorf("%w: max slew %v must be positive", ErrInvalidTrackingConfig, c.MaxSlew)
+	}
+	if c.LostTimeoutMs < 0 {
+		return c, fmt.Errorf("%w: lost timeout %vms must be positive", ErrInvalidTrackingConfig, c.LostTimeoutMs)
+	}
+	return c, nil
+}
+
+func (c TrackingConfig) lostTimeout() time.Duration {
+	return time.Duration(c.LostTimeoutMs) * time.Millisecond
+}
+
+// correction is how far to turn the base and tip the wrist, in degrees, to bring
+// face towards the centre of the frame without going faster than the max slew over dt.
+func (c TrackingConfig) correction(d FaceDetection, face image.Rectangle, dt time.Duration) (base, wrist float64) {
+	if d.Frame.X <= 0 || d.Frame.Y <= 0 {
+		return 0, 0
+	}
+	centre := face.Min.Add(face.Max).Div(2)
+	// -1 at the left/top edge, 1 at the right/bottom
+	ex := (float64(centre.X) - float64(d.Frame.X)/2) / (float64(d.Frame.X) / 2)
+	ey := (float64(centre.Y) - float64(d.Frame.Y)/2) / (float64(d.Frame.Y) / 2)
+
+	step := c.MaxSlew * dt.Seconds()
+	limit := func(angle float64) float64 {
+		return math.Max(-step, math.Min(step, angle))
+	}
+	// The base turns left as it increases and the wrist tips up,
+	// so a face right of or below the centre means turning them down
+	if math.Abs(ex) > c.Deadband {
+		base = limit(-ex * d.HFOV / 2 * c.Gain)
+	}
+	if math.Abs(ey) > c.Deadband {
+		wrist = limit(-ey * d.VFOV / 2 * c.Gain)
+	}
+	return base, wrist
+}
+
+// slew turns corrections into the whole degrees a joint moves, carrying what
+// rounding leaves over to the next one so a slow max slew still gets there.
+type slew float64
+
+func (s *slew) step(correction float64) int {
+	if correction == 0 {
+		// Inside the deadband, a left over fraction mustn't creep the arm on later
+		*s = 0
+		return 0
+	}
+	total := float64(*s) + correction
+	whole := math.Round(total)
+	*s = slew(total - whole)
+	return int(whole)
+}
+
+// TrackingState is what the tracker is doing.
+type TrackingState string
+
+const (
+	TrackingSearching TrackingState = "searching" // no face seen yet
+	TrackingLocked    TrackingState = "tracking"  // following a face
+	TrackingLost      TrackingState = "lost"      // the face has gone
+)
+
+// TrackingStatus is a snapshot of face tracking.
+type TrackingStatus struct {
+	Enabled  bool             `json:"enabled"`
+	State    TrackingState    `json:"state,omitempty"`
+	Job      string           `json:"job,omitempty"`
+	Target   *image.Rectangle `json:"target,omitempty"`
+	LastSeen *time.Time       `json:"last_seen,omitempty"`
+	Config   *TrackingConfig  `json:"config,omitempty"`
+}
+
+// FaceTracker points the arm at faces.
+type FaceTracker struct {
+	config   TrackingConfig
+	lostPose *[5]int
+
+	mux      sync.Mutex
+	state    TrackingState
+	target   image.Rectangle
+	lastSeen time.Time
+}
+
+// NewFaceTracker makes a tracker, lostPose is where the arm goes when the face is lost, nil to stay put.
+func NewFaceTracker(config TrackingConfig, lostPose *[5]int) (*FaceTracker, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return &FaceTracker{config: config, lostPose: lostPose, state: TrackingSearching}, nil
+}
+
+// Status reports what the tracker is doing.
+func (t *FaceTracker) Status() TrackingStatus {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	config := t.config
+	status := TrackingStatus{Enabled: true, State: t.state, Config: &config}
+	if t.state == TrackingLocked {
+		target := t.target
+		status.Target = &target
+	}
+	if !t.lastSeen.IsZero() {
+		lastSeen := t.lastSeen
+		status.LastSeen = &lastSeen
+	}
+	return status
+}
+
+func (t *FaceTracker) setState(state TrackingState) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.state != state {
+		log.Printf("Face tracking: %v", state)
+	}
+	t.state = state
+}
+
+// Track returns a motion command that follows the faces in detections until it is cancelled.
+func (t *FaceTracker) Track(detections <-chan FaceDetection) MotionCommand {
+	return func(ctx context.Context, a *Arm) error {
+		log.Printf("Tracking faces, deadband %v gain %v max slew %v°/s", t.config.Deadband, t.config.Gain, t.config.MaxSlew)
+
+		// Tracking sets its own pace and leaves the speed as it was for the jobs after it
+		defer a.SetSpeed(a.speed)
+		a.SetSpeed(0)
+		ticker := time.NewTicker(trackingTick)
+		defer ticker.Stop()
+
+		lastMove := time.Now()
+		var baseSlew, wristSlew slew
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+
+			case <-ticker.C:
+				if err := t.checkLost(ctx, a); err != nil {
+					return err
+				}
+
+			case d := <-detections:
+				face, ok := d.largest()
+				if !ok {
+					continue
+				}
+				t.mux.Lock()
+				t.state, t.target, t.lastSeen = TrackingLocked, face, d.At
+				t.mux.Unlock()
+
+				// Slew over the time since the last correction, but never more
+				// than a tick's worth after the arm has been still for a while
+				dt := min(time.Since(lastMove), trackingTick)
+				lastMove = time.Now()
+				base, wrist := t.config.correction(d, face, dt)
+
+				cal := a.Calibration()
+				angles := a.driver.CurrentAngles()
+				target := angles
+				target[BASE_SERVO] = clampJoint(cal.Joints[BASE_SERVO], angles[BASE_SERVO]+baseSlew.step(base))
+				target[JOINT_4_SERVO] = clampJoint(cal.Joints[JOINT_4_SERVO], angles[JOINT_4_SERVO]+wristSlew.step(wrist))
+				if target == angles {
+					continue
+				}
+				if err := a.move(ctx, target, 1); err != nil {
+					return fmt.Errorf("face tracking: %w", err)
+				}
+			}
+		}
+	}
+}
+
+// checkLost gives up on the target once it hasn't been seen for the lost timeout.
+func (t *FaceTracker) checkLost(ctx context.Context, a *Arm) error {
+	t.mux.Lock()
+	lost := t.state == TrackingLocked && time.Since(t.lastSeen) > t.config.lostTimeout()
+	t.mux.Unlock()
+	if !lost {
+		return nil
+	}
+
+	t.setState(TrackingLost)
+	if t.lostPose == nil {
+		return nil
+	}
+	if err := a.move(ctx, *t.lostPose, 1); err != nil {
+		return fmt.Errorf("face tracking: %w", err)
+	}
+	return nil
+}
+
+func clampJoint(joint JointCalibration, angle int) int {
+	return max(joint.MinAngle, min(joint.MaxAngle, angle))
+}
@@ -0,0 +1,209 @@
+package robot
+
+import (
+	"context"
+	"errors"
+	"image"
+	"testing"
+	"time"
+)
+
+// detection of one 40x40 face centred at x, y in a 640x480 frame
+func detection(x, y int) FaceDetection {
+	return FaceDetection{
+		Faces: []image.Rectangle{image.Rect(x-20, y-20, x+20, y+20)},
+		Frame: image.Point{640, 480},
+		HFOV:  60,
+		VFOV:  45,
+		At:    time.Now(),
+	}
+}
+
+func TestTrackingConfig_Correction(t *testing.T) {
+	config, _ := TrackingConfig{Gain: 1, MaxSlew: 1000}.withDefaults()
+
+	for _, tc := range []struct {
+		name        string
+		x, y        int
+		base, wrist float64
+	}{
+		{"centred", 320, 240, 0, 0},
+		{"inside the deadband", 330, 250, 0, 0},
+		{"right edge", 640, 240, -30, 0},
+		{"left half way", 160, 240, 15, 0},
+		{"bottom edge", 320, 480, 0, -22.5},
+		{"top half way", 320, 120, 0, 11.25},
+	} {
+		d := detection(tc.x, tc.y)
+		base, wrist := config.correction(d, d.Faces[0], time.Second)
+		if base != tc.base || wrist != tc.wrist {
+			t.Errorf("%v: correction = %v, %v, want %v, %v", tc.name, base, wrist, tc.base, tc.wrist)
+		}
+	}
+
+	// The max slew caps each step however far off the face is
+	config.MaxSlew = 10
+	d := detection(640, 480)
+	base, wrist := config.correction(d, d.Faces[0], 100*time.Millisecond)
+	if base != -1 || wrist != -1 {
+		t.Errorf("slew limited correction = %v, %v, want -1, -1", base, wrist)
+	}
+}
+
+func TestSlew(t *testing.T) {
+	// 5°/s at 30fps is a sixth of a degree a frame, it still adds up
+	var s slew
+	moved := 0
+	for i := 0; i < 30; i++ {
+		moved += s.step(5.0 / 30)
+	}
+	if moved != 5 {
+		t.Errorf("moved %d° in a second at 5°/s, want 5", moved)
+	}
+
+	s.step(0.4)
+	if s.step(0) != 0 || s != 0 {
+		t.Errorf("inside the deadband the left over %v should be dropped", s)
+	}
+}
+
+func TestTrackingConfig_Validate(t *testing.T) {
+	for _, bad := range []TrackingConfig{{Deadband: 1}, {Gain: 2}, {MaxSlew: -1}, {LostTimeoutMs: -5}} {
+		if _, err := bad.withDefaults(); !errors.Is(err, ErrInvalidTrackingConfig) {
+			t.Errorf("%+v returned %v, want ErrInvalidTrackingConfig", bad, err)
+		}
+	}
+}
+
+func TestFaceDetection_Largest(t *testing.T) {
+	d := FaceDetection{Faces: []image.Rectangle{
+		image.Rect(0, 0, 10, 10),
+		image.Rect(100, 100, 150, 150),
+		image.Rect(200, 200, 220, 220),
+	}}
+	if face, ok := d.largest(); !ok || face != image.Rect(100, 100, 150, 150) {
+		t.Errorf("largest = %v %v", face, ok)
+	}
+	if _, ok := (FaceDetection{}).largest(); ok {
+		t.Error("no faces should have no largest")
+	}
+}
+
+func TestFaceTracker_FollowsAndLoses(t *testing.T) {
+	arm, _ := newTestArm(t)
+	start := [5]int{90, 30, 30, 130, 130}
+	if err := arm.MoveToJoints(context.Background(), start); err != nil {
+		t.Fatal(err)
+	}
+
+	arm.SetSpeed(20)
+
+	lostPose := [5]int{90, 30, 30, 130, 100}
+	tracker, err := NewFaceTracker(TrackingConfig{LostTimeoutMs: 200}, &lostPose)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	faces := make(chan FaceDetection, 1)
+	done := make(chan error)
+	go func() { done <- tracker.Track(faces)(ctx, arm) }()
+
+	// A face up and to the right, the base should turn right and the wrist up
+	for i := 0; i < 5; i++ {
+		faces <- detection(600, 40)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status := tracker.Status(); status.State != TrackingLocked || status.Target == nil {
+		t.Errorf("status = %+v, want tracking a target", status)
+	}
+	angles := arm.driver.CurrentAngles()
+	if angles[BASE_SERVO] >= start[BASE_SERVO] || angles[JOINT_4_SERVO] <= start[JOINT_4_SERVO] {
+		t.Errorf("arm at %v after a face up and right of %v, want the base lower and the wrist higher", angles, start)
+	}
+
+	// Then the face goes away
+	deadline := time.Now().Add(2 * time.Second)
+	for tracker.Status().State != TrackingLost && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if state := tracker.Status().State; state != TrackingLost {
+		t.Fatalf("state = %v after the face went, want %v", state, TrackingLost)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if angles := arm.driver.CurrentAngles(); angles != lostPose {
+		t.Errorf("arm at %v after losing the face, want the lost pose %v", angles, lostPose)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Track returned %v, want context.Canceled", err)
+	}
+	if arm.speed != 20 {
+		t.Errorf("speed after tracking = %v, want it left at 20", arm.speed)
+	}
+}
+
+func TestRobot_Tracking(t *testing.T) {
+	bot := newSimulatedRobot(t)
+
+	status, err := bot.StartTracking(TrackingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Enabled || status.State != TrackingSearching || status.Job == "" {
+		t.Errorf("status = %+v, want searching in a job", status)
+	}
+	if !bot.Camera.DetectingFaces() {
+		t.Error("tracking should turn on face detection")
+	}
+	if _, err := bot.StartTracking(TrackingConfig{}); !errors.Is(err, ErrAlreadyTracking) {
+		t.Errorf("StartTracking twice returned %v, want ErrAlreadyTracking", err)
+	}
+
+	if err := bot.StopTracking(); err != nil {
+		t.Fatal(err)
+	}
+	if status := bot.TrackingStatus(); status.Enabled {
+		t.Errorf("status = %+v after stopping, want disabled", status)
+	}
+	if bot.Camera.DetectingFaces() {
+		t.Error("stopping tracking should put face detection back off")
+	}
+
+	// Face detection turned on while tracking stays on after it
+	if _, err := bot.StartTracking(TrackingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	bot.Camera.SetDetectFaces(true)
+	if err := bot.StopTracking(); err != nil {
+		t.Fatal(err)
+	}
+	if !bot.Camera.DetectingFaces() {
+		t.Error("stopping tracking turned off the face detection turned on while it ran")
+	}
+	bot.Camera.SetDetectFaces(false)
+	if err := bot.StopTracking(); !errors.Is(err, ErrNotTracking) {
+		t.Errorf("StopTracking twice returned %v, want ErrNotTracking", err)
+	}
+
+	if _, err := bot.StartTracking(TrackingConfig{LostPose: "nowhere"}); !errors.Is(err, ErrPoseNotFound) {
+		t.Errorf("unknown lost pose returned %v, want ErrPoseNotFound", err)
+	}
+
+	// The e-stop ends tracking like any other job
+	if _, err := bot.StartTracking(TrackingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.EmergencyStop(false); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for bot.TrackingStatus().Enabled && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bot.TrackingStatus().Enabled {
+		t.Error("tracking still enabled after the e-stop")
+	}
+}
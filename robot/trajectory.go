@@ -0,0 +1,160 @@
+package robot
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+/*
+	Coordinated joint trajectories
+
+	Rather than moving one servo at a time, a move plans a single trajectory for
+	all five joints so they start and finish together. Every joint follows the
+	same normalized trapezoidal velocity profile s(t), going from 0 to 1, scaled
+	by how far that joint has to go:
+
+	  angle_i(t) = start_i + (end_i - start_i) * s(t)
+
+	s(t) accelerates, cruises and decelerates. Its peak velocity and acceleration
+	are picked so that no joint goes over its own max velocity and acceleration,
+	which means the joint with the furthest to go relative to its limits sets
+	the pace and everything else moves proportionally slower.
+	When there isn't room to reach cruising speed the profile is a triangle.
+*/
+
+// trajectoryTick is how often the servos are updated while following a trajectory.
+// It matches the 50Hz PWM frame of the servos.
+const trajectoryTick = 20 * time.Millisecond
+
+// Trajectory is a planned coordinated move of all five joints.
+type Trajectory struct {
+	Start    [5]int
+	End      [5]int
+	Duration time.Duration
+
+	velocity  float64 // peak of s'(t), per second
+	accel     float64 // s''(t) while speeding up and slowing down, per second squared
+	accelTime float64 // seconds spent speeding up, and again slowing down
+}
+
+/*
+PlanTrajectory plans a coordinated move from start to end.
+maxVelocity and maxAcceleration are per joint, in degrees per second (squared).
+*/
+func PlanTrajectory(start, end [5]int, maxVelocity, maxAcceleration [5]float64) Trajectory {
+
+	t := Trajectory{Start: start, End: end}
+
+	// The largest profile velocity and acceleration every joint can keep up with
+	velocity, accel := math.Inf(1), math.Inf(1)
+	for i := range start {
+		distance := math.Abs(float64(end[i] - start[i]))
+		if distance == 0 {
+			continue
+		}
+		velocity = math.Min(velocity, maxVelocity[i]/distance)
+		accel = math.Min(accel, maxAcceleration[i]/distance)
+	}
+	if math.IsInf(velocity, 1) {
+		// Nothing to move
+		return t
+	}
+
+	if velocity*velocity/accel >= 1 {
+		// Triangle, we never get up to cruising speed
+		t.accelTime = math.Sqrt(1 / accel)
+		velocity = accel * t.accelTime
+		t.Duration = time.Duration(2 * t.accelTime * float64(time.Second))
+	} else {
+		t.accelTime = velocity / accel
+		t.Duration = time.Duration((1/velocity + t.accelTime) * float64(time.Second))
+	}
+	t.velocity = velocity
+	t.accel = accel
+
+	return t
+}
+
+// progress returns s(t), how far along the move is from 0 to 1.
+func (t Trajectory) progress(elapsed time.Duration) float64 {
+	total := t.Duration.Seconds()
+	now := elapsed.Seconds()
+
+	switch {
+	case total == 0 || now >= total:
+		return 1
+	case now <= 0:
+		return 0
+	case now < t.accelTime:
+		// Speeding up
+		return 0.5 * t.accel * now * now
+	case now <= total-t.accelTime:
+		// Cruising
+		return 0.5*t.accel*t.accelTime*t.accelTime + t.velocity*(now-t.accelTime)
+	default:
+		// Slowing down, mirror of speeding up
+		left := total - now
+		return 1 - 0.5*t.accel*left*left
+	}
+}
+
+// AnglesAt returns where every joint should be, to the nearest degree, elapsed into the move.
+func (t Trajectory) AnglesAt(elapsed time.Duration) [5]int {
+	s := t.progress(elapsed)
+
+	var angles [5]int
+	for i := range angles {
+		angles[i] = t.Start[i] + int(math.Round(float64(t.End[i]-t.Start[i])*s))
+	}
+	return angles
+}
+
+// motionLimits returns the max velocity and acceleration of every joint.
+// A speed (ms per degree) set on the arm caps the velocity further.
+func (a *Arm) motionLimits() (velocity, accel [5]float64) {
+	cal := a.Calibration()
+	for i, joint := range cal.Joints {
+		velocity[i] = joint.MaxVelocity
+		accel[i] = joint.MaxAcceleration
+		if a.speed > 0 {
+			velocity[i] = math.Min(velocity[i], 1000/float64(a.speed))
+		}
+	}
+	return velocity, accel
+}
+
+// followTrajectory drives the servos along a trajectory, in real time.
+// It checks ctx every tick and returns its error, leaving the servos where they got to.
+func (a *Arm) followTrajectory(ctx context.Context, t Trajectory) error {
+
+	last := t.Start
+	started := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		elapsed := time.Since(started)
+		angles := t.AnglesAt(elapsed)
+
+		for i, angle := range angles {
+			if angle == last[i] {
+				continue
+			}
+			if err := a.driver.setServoPulse(i, angle); err != nil {
+				return err
+			}
+			a.driver.setCurrentAngle(i, angle)
+			last[i] = angle
+		}
+
+		if elapsed >= t.Duration {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(trajectoryTick):
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package robot
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func uniformLimits(velocity, accel float64) (v, a [5]float64) {
+	for i := range v {
+		v[i] = velocity
+		a[i] = accel
+	}
+	return v, a
+}
+
+func TestPlanTrajectory_Trapezoid(t *testing.T) {
+	v, a := uniformLimits(90, 360)
+	traj := PlanTrajectory([5]int{90, 0, 0, 180, 180}, [5]int{90, 180, 0, 180, 180}, v, a)
+
+	// 180 degrees at 90 deg/s, with 0.25s each way to get up to speed
+	want := 2*time.Second + 250*time.Millisecond
+	if math.Abs(traj.Duration.Seconds()-want.Seconds()) > 1e-6 {
+		t.Errorf("Duration = %v, want %v", traj.Duration, want)
+	}
+}
+
+func TestPlanTrajectory_Triangle(t *testing.T) {
+	v, a := uniformLimits(90, 360)
+	traj := PlanTrajectory([5]int{90, 0, 0, 180, 180}, [5]int{90, 10, 0, 180, 180}, v, a)
+
+	// 10 degrees never gets up to 90 deg/s: 5 degrees speeding up, 5 slowing down
+	want := 2 * math.Sqrt(5.0/(0.5*360))
+	if math.Abs(traj.Duration.Seconds()-want) > 1e-6 {
+		t.Errorf("Duration = %v, want %vs", traj.Duration, want)
+	}
+}
+
+func TestPlanTrajectory_NothingToMove(t *testing.T) {
+	v, a := uniformLimits(90, 360)
+	traj := PlanTrajectory([5]int{90, 30, 30, 130, 130}, [5]int{90, 30, 30, 130, 130}, v, a)
+
+	if traj.Duration != 0 {
+		t.Errorf("Duration = %v, want 0", traj.Duration)
+	}
+	if traj.AnglesAt(0) != traj.End {
+		t.Errorf("AnglesAt(0) = %v, want %v", traj.AnglesAt(0), traj.End)
+	}
+}
+
+func TestTrajectory_JointsMoveTogether(t *testing.T) {
+	v, a := uniformLimits(90, 360)
+	v[JOINT_3_SERVO] = 30 // one slow joint sets the pace for everyone
+	start := [5]int{90, 0, 0, 180, 180}
+	end := [5]int{150, 30, 60, 130, 100}
+	traj := PlanTrajectory(start, end, v, a)
+
+	if traj.AnglesAt(0) != start {
+		t.Errorf("AnglesAt(0) = %v, want %v", traj.AnglesAt(0), start)
+	}
+	if traj.AnglesAt(traj.Duration) != end {
+		t.Errorf("AnglesAt(Duration) = %v, want %v", traj.AnglesAt(traj.Duration), end)
+	}
+
+	// Half way through time every joint is half way through its move
+	half := traj.AnglesAt(traj.Duration / 2)
+	for i := range half {
+		if want := (start[i] + end[i]) / 2; math.Abs(float64(half[i]-want)) > 1 {
+			t.Errorf("joint %d half way = %d, want %d", i, half[i], want)
+		}
+	}
+}
+
+func TestTrajectory_RespectsLimits(t *testing.T) {
+	v, a := uniformLimits(90, 360)
+	v[BASE_SERVO], a[BASE_SERVO] = 45, 90
+	start := [5]int{0, 0, 0, 180, 180}
+	end := [5]int{180, 90, 45, 90, 135}
+	traj := PlanTrajectory(start, end, v, a)
+
+	// Sample the continuous profile finely and check every joint's velocity
+	const steps = 2000
+	dt := traj.Duration.Seconds() / steps
+	prev := 0.0
+	for n := 1; n <= steps; n++ {
+		s := traj.progress(time.Duration(float64(n) * dt * float64(time.Second)))
+		if s < prev {
+			t.Fatalf("progress went backwards at step %d", n)
+		}
+		speed := (s - prev) / dt
+		for i := range start {
+			jointSpeed := speed * math.Abs(float64(end[i]-start[i]))
+			if jointSpeed > v[i]*1.01 {
+				t.Fatalf("joint %d moving at %.1f deg/s, limit %.1f", i, jointSpeed, v[i])
+			}
+		}
+		prev = s
+	}
+}
+
+func TestUpdateArm_MovesJointsTogether(t *testing.T) {
+	arm, chip := newTestArm(t)
+	cal := fastCalibration()
+	for i := range cal.Joints {
+		cal.Joints[i].MaxVelocity = 600
+		cal.Joints[i].MaxAcceleration = 12000
+	}
+	arm.driver.SetCalibration(cal)
+	chip.ResetWrites()
+
+	arm.jointTargetAngles = [5]int{90, 60, 60, 120, 120}
+	if err := arm.UpdateArm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if arm.driver.CurrentAngles() != arm.jointTargetAngles {
+		t.Errorf("CurrentAngles() = %v, want %v", arm.driver.CurrentAngles(), arm.jointTargetAngles)
+	}
+
+	// Interleaved writes: joint 4 starts moving before joint 1 is done
+	writes := chip.Writes()
+	firstJoint4, lastJoint1 := -1, -1
+	for n, w := range writes {
+		switch w.Register {
+		case LED0_ON_L + 4*JOINT_1_SERVO + 3:
+			lastJoint1 = n
+		case LED0_ON_L + 4*JOINT_4_SERVO + 3:
+			if firstJoint4 < 0 {
+				firstJoint4 = n
+			}
+		}
+	}
+	if firstJoint4 < 0 || lastJoint1 < 0 || firstJoint4 > lastJoint1 {
+		t.Errorf("joints did not move together, joint 4 first written at %d, joint 1 last written at %d", firstJoint4, lastJoint1)
+	}
+}
@@ -0,0 +1,27 @@
+package robot
+
+/*
+	Vision
+
+	Every frame the camera reads goes through the vision stages in turn
+	before it is published, see Cam.publish:
+
+	  motion   background subtraction, motion_started and motion_stopped events
+	  objects  a DNN model every so often, objects_changed events
+	  markers  ArUco markers and QR codes every so often, markers_changed events
+	  faces    while Cam.DetectingFaces, with the people in view recognized
+	           and person_seen events
+
+	Motion, objects and markers look at the frame as it came from the camera,
+	then each stage that has an overlay turned on draws it in.
+*/
+
+// VisionStatus is a snapshot of every vision stage.
+type VisionStatus struct {
+	DetectFaces bool               `json:"detect_faces"` // faces are looked for in every frame
+	Motion      MotionStatus       `json:"motion"`
+	Faces       FaceDetectorStatus `json:"faces"`
+	Recognition RecognitionStatus  `json:"recognition"`
+	Objects     ObjectStatus       `json:"objects"`
+	Markers     MarkerStatus       `json:"markers"`
+}
@@ -1,14 +1,16 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/arabenjamin/gizmatron/robot"
-	"gocv.io/x/gocv"
 )
 
 func error_handler(resp http.ResponseWriter, req *http.Request) {}
@@ -43,6 +45,12 @@ func get_status(resp http.ResponseWriter, req *http.Request) {
 
 	status := fmt.Sprintf("%v current status is Operational: %v \nand Running: %v", bot.Name, bot.IsOperational, bot.IsRunning)
 
+	// The pose is null when the arm is not operational
+	var armPose interface{}
+	if pose, err := bot.ArmPose(); err == nil {
+		armPose = pose
+	}
+
 	thisRequest := map[string]interface{}{
 		"time":           time.Now().Unix(),
 		"client_address": req.RemoteAddr,
@@ -53,7 +61,9 @@ func get_status(resp http.ResponseWriter, req *http.Request) {
 
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"device_status": bot.DeviceStatus(),
+		"arm_pose":      armPose,
+		"estop":         bot.EmergencyStopped(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
@@ -62,12 +72,46 @@ func get_status(resp http.ResponseWriter, req *http.Request) {
 	respond(resp, thisResponse)
 }
 
-func get_video(resp http.ResponseWriter, req *http.Request) {
+// Limits on what a video client can ask for
+const (
+	maxVideoWidth       = 1920
+	defaultVideoQuality = 80
+)
+
+// videoOptions are the fps, width and JPEG quality a client asked for in the query.
+// fps defaults to the camera's, width to the frame's and quality to defaultVideoQuality.
+func videoOptions(req *http.Request, cameraFPS int) (fps, width, quality int, err error) {
+	fps, width, quality = cameraFPS, 0, defaultVideoQuality
+
+	query := req.URL.Query()
+	for _, param := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"fps", &fps, 1, cameraFPS},
+		{"width", &width, 16, maxVideoWidth},
+		{"quality", &quality, 1, 100},
+	} {
+		raw := query.Get(param.name)
+		if raw == "" {
+			continue
+		}
+		n, convErr := strconv.Atoi(raw)
+		if convErr != nil || n < param.min || n > param.max {
+			return 0, 0, 0, fmt.Errorf("%v must be a whole number from %d to %d", param.name, param.min, param.max)
+		}
+		*param.value = n
+	}
+	return fps, width, quality, nil
+}
 
-	// TODO: The below is really bad, and needs to be refactored
+// get_video streams the camera as MJPEG. Each client gets its own frame
+// subscription and can ask for a lower ?fps=, a smaller ?width= (the height
+// keeps the aspect ratio) and a JPEG ?quality=, so several clients can watch
+// without the Pi encoding and sending every frame at full size for each one.
+func get_video(resp http.ResponseWriter, req *http.Request) {
 
-	resp.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
-	resp.Header().Set("Transfer-Encoding", "chunked")
 	// TODO: Build camera running light on pysical Robot
 	/* Turn on video light*/
 	bot := req.Context().Value("bot").(*robot.Robot)
@@ -86,7 +130,7 @@ func get_video(resp http.ResponseWriter, req *http.Request) {
 
 		thisResponse := map[string]interface{}{
 			"status":        status,
-			"device_status": bot.Devices,
+			"device_status": bot.DeviceStatus(),
 			"botname":       bot.Name,
 			"this_request":  thisRequest,
 		}
@@ -96,7 +140,7 @@ func get_video(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !bot.Camera.IsRunning {
+	if !bot.Camera.Started() {
 		log.Printf("The camera is not running")
 		status = "The camera is not running"
 		thisRequest := map[string]interface{}{
@@ -109,7 +153,7 @@ func get_video(resp http.ResponseWriter, req *http.Request) {
 
 		thisResponse := map[string]interface{}{
 			"status":        status,
-			"device_status": bot.Devices,
+			"device_status": bot.DeviceStatus(),
 			"botname":       bot.Name,
 			"this_request":  thisRequest,
 		}
@@ -119,23 +163,67 @@ func get_video(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	/* Log camera state */
-	if bot.Camera.IsOperational && bot.Camera.IsRunning {
-		log.Print("Camera is operational, running and the buffer is not empty, streaming video feed ...")
-		// return bot.Camera.Stream
-		for {
-
-			//jpegBytes := bot.Camera.Buf
-			if bot.Camera.Buf != nil || len(bot.Camera.Buf) > 0 {
-				// Write the frame to the HTTP response
-				fmt.Fprintf(resp, "--frame\r\n")
-				fmt.Fprintf(resp, "Content-Type: image/jpeg\r\n")
-				fmt.Fprintf(resp, "Content-Length: %d\r\n\r\n", len(bot.Camera.Buf))
-				//bot.Camera.Stream.ServeHTTP(resp, req)
-				resp.Write(bot.Camera.Buf)
-				fmt.Fprintf(resp, "\r\n")
+	cameraFPS := bot.Camera.Config.FPS
+	if cameraFPS <= 0 {
+		cameraFPS = 30
+	}
+	fps, width, quality, err := videoOptions(req, cameraFPS)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Streaming video to %v at %d fps, width %d, quality %d", req.RemoteAddr, fps, width, quality)
+	resp.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+	resp.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Only ever the newest frame waits for us, anything older is stale by the time we get to it
+	sub := bot.Camera.Frames.Subscribe(1, robot.DropOldest)
+	defer sub.Close()
+
+	interval := time.Second / time.Duration(fps)
+	var next time.Time
+	for {
+		select {
+		case <-req.Context().Done():
+			log.Printf("Video client %v went away", req.RemoteAddr)
+			return
+
+		case frame, ok := <-sub.Frames():
+			if !ok {
+				return
+			}
+			// Skip frames that come in faster than the client wants them
+			if frame.Time.Before(next) {
+				frame.Release()
+				continue
+			}
+			// A little early is fine, the camera's own timing jitters
+			next = frame.Time.Add(interval * 9 / 10)
+
+			jpegBytes, err := frame.JPEGAt(width, quality)
+			frame.Release()
+			if err != nil {
+				log.Printf("Error encoding image: %v", err)
+				continue
 			}
 
+			// Write the frame to the HTTP response
+			fmt.Fprintf(resp, "--frame\r\n")
+			fmt.Fprintf(resp, "Content-Type: image/jpeg\r\n")
+			fmt.Fprintf(resp, "Content-Length: %d\r\n\r\n", len(jpegBytes))
+			resp.Write(jpegBytes)
+			if _, err := fmt.Fprintf(resp, "\r\n"); err != nil {
+				return
+			}
+			flusher.Flush()
 		}
 	}
 }
@@ -145,7 +233,7 @@ func start_stream(resp http.ResponseWriter, req *http.Request) {
 	bot := req.Context().Value("bot").(*robot.Robot)
 
 	status := fmt.Sprintf("Camera is operational, running and the buffer is not empty, serving video ...")
-	if !bot.Camera.IsRunning {
+	if !bot.Camera.Started() {
 		log.Printf("Requesting camera feed ...")
 		//go bot.Camera.RunCamera()
 		go bot.Camera.Start()
@@ -161,7 +249,7 @@ func start_stream(resp http.ResponseWriter, req *http.Request) {
 	}
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"device_status": bot.DeviceStatus(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
@@ -175,11 +263,12 @@ func stop_stream(resp http.ResponseWriter, req *http.Request) {
 	bot := req.Context().Value("bot").(*robot.Robot)
 
 	status := fmt.Sprintf("Camera is running and will be stopped")
-	if !bot.Camera.IsRunning {
+	if !bot.Camera.Started() {
 		status = fmt.Sprintf("Camera is not running, there's no stream to stop.")
 	}
 
-	if bot.Camera.IsOperational && bot.Camera.IsRunning {
+	// A camera that is reconnecting isn't operational, but can still be stopped
+	if bot.Camera.Started() {
 		log.Printf("Stoping camera stream...")
 		bot.Camera.Stop()
 		status = "Camera stream stopped"
@@ -194,7 +283,7 @@ func stop_stream(resp http.ResponseWriter, req *http.Request) {
 	}
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"device_status": bot.DeviceStatus(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
@@ -220,7 +309,7 @@ func set_facedetect(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	bot := req.Context().Value("bot").(*robot.Robot)
-	bot.Camera.DetectFaces = requestData.Enable
+	bot.Camera.SetDetectFaces(requestData.Enable)
 
 	status := "Face detection disabled"
 	if requestData.Enable {
@@ -237,7 +326,7 @@ func set_facedetect(resp http.ResponseWriter, req *http.Request) {
 
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"device_status": bot.DeviceStatus(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
@@ -266,7 +355,7 @@ func start_bot(resp http.ResponseWriter, req *http.Request) {
 
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"device_status": bot.DeviceStatus(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
@@ -294,7 +383,7 @@ func stop_bot(resp http.ResponseWriter, req *http.Request) {
 
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"device_status": bot.DeviceStatus(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
@@ -303,6 +392,44 @@ func stop_bot(resp http.ResponseWriter, req *http.Request) {
 	respond(resp, thisResponse)
 }
 
+// reset_bot resets the robot and waits for the arm to re-home, see Robot.Reset.
+func reset_bot(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The re-home is slow, it carries on even if the client stops waiting for it
+	if err := bot.Reset(context.Background()); err != nil {
+		if errors.Is(err, robot.ErrEmergencyStop) {
+			http.Error(resp, robot.ErrEmergencyStop.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(resp, fmt.Sprintf("Failed to reset: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	status := fmt.Sprintf("%v current status is Operational: %v \nand Running: %v", bot.Name, bot.IsOperational, bot.IsRunning)
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"status":        status,
+		"device_status": bot.DeviceStatus(),
+		"botname":       bot.Name,
+		"this_request":  thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
 func move_arm(resp http.ResponseWriter, req *http.Request) {
 	bot := req.Context().Value("bot").(*robot.Robot)
 
@@ -315,6 +442,8 @@ func move_arm(resp http.ResponseWriter, req *http.Request) {
 		X     float64 `json:"x"`
 		Y     float64 `json:"y"`
 		Z     float64 `json:"z"`
+		Pitch float64 `json:"pitch"`
+		Elbow string  `json:"elbow"`
 		Speed int     `json:"speed"`
 	}
 
@@ -323,12 +452,34 @@ func move_arm(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	elbow, err := robot.ParseElbowConfig(requestData.Elbow)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if !bot.IsOperational || !bot.IsRunning {
 		http.Error(resp, "Robot is not operational or not running", http.StatusServiceUnavailable)
 		return
 	}
 
-	if err := bot.MoveToTarget(requestData.X, requestData.Y, requestData.Z, time.Duration(requestData.Speed)); err != nil {
+	target := robot.Pose{X: requestData.X, Y: requestData.Y, Z: requestData.Z, Pitch: requestData.Pitch}
+	// The move is queued, the client polls /api/v1/jobs/{id} to see how it went
+	job, err := bot.SubmitMove(target, elbow, time.Duration(requestData.Speed))
+	if err != nil {
+		var unreachable *robot.UnreachableError
+		if errors.As(err, &unreachable) {
+			http.Error(resp, unreachable.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, robot.ErrEmergencyStop) {
+			http.Error(resp, robot.ErrEmergencyStop.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, robot.ErrQueueFull) {
+			http.Error(resp, err.Error(), http.StatusTooManyRequests)
+			return
+		}
 		http.Error(resp, "Failed to move arm", http.StatusInternalServerError)
 		return
 	}
@@ -344,34 +495,1221 @@ func move_arm(resp http.ResponseWriter, req *http.Request) {
 
 	thisResponse := map[string]interface{}{
 		"status":        status,
-		"device_status": bot.Devices,
+		"job":           job,
+		"device_status": bot.DeviceStatus(),
 		"botname":       bot.Name,
 		"this_request":  thisRequest,
 	}
 
 	//logReq(req)
+	respondWithStatus(resp, http.StatusAccepted, thisResponse)
+}
+
+// motion_job reports (GET) or cancels (DELETE) a motion job queued by bot-move.
+func motion_job(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var job robot.Job
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		job, err = bot.Job(req.PathValue("id"))
+	case http.MethodDelete:
+		job, err = bot.CancelJob(req.PathValue("id"))
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"job":          job,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
 	respond(resp, thisResponse)
 }
 
-func take_picture(resp http.ResponseWriter, req *http.Request) {
+// list_poses lists every named pose.
+func list_poses(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"poses":        bot.Poses(),
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
 
+// named_pose gets (GET), saves (PUT) or deletes (DELETE) a named pose.
+//
+// A pose is saved from exactly one of
+//
+//	{"joints": [90, 30, 30, 130, 130]}                   joint angles
+//	{"pose": {"x": 15, "y": 5, "z": 12}, "elbow": "up"}  a camera position, solved with IK
+//	{"current": true}                                    wherever the arm is now
+func named_pose(resp http.ResponseWriter, req *http.Request) {
 	bot := req.Context().Value("bot").(*robot.Robot)
+	name := req.PathValue("name")
+
+	var pose *robot.NamedPose
+	switch req.Method {
+	case http.MethodGet:
+		found, err := bot.NamedPose(name)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusNotFound)
+			return
+		}
+		pose = &found
+
+	case http.MethodPut:
+		var requestData struct {
+			Joints  *[5]int     `json:"joints"`
+			Pose    *robot.Pose `json:"pose"`
+			Elbow   string      `json:"elbow"`
+			Current bool        `json:"current"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
 
-	/* Log camera state */
-	if bot.Camera.IsOperational && bot.Camera.IsRunning && !bot.Camera.ImgMat.Empty() {
-		log.Print("Camera is operational, running and the buffer is not empty, serving video")
+		var saved robot.NamedPose
+		var err error
+		switch {
+		case requestData.Joints != nil && requestData.Pose == nil && !requestData.Current:
+			saved, err = bot.SavePose(name, *requestData.Joints)
+		case requestData.Pose != nil && requestData.Joints == nil && !requestData.Current:
+			elbow, elbowErr := robot.ParseElbowConfig(requestData.Elbow)
+			if elbowErr != nil {
+				http.Error(resp, elbowErr.Error(), http.StatusBadRequest)
+				return
+			}
+			var joints [5]int
+			joints, err = bot.InverseKinematics(*requestData.Pose, elbow)
+			if err == nil {
+				saved, err = bot.SavePose(name, joints)
+			}
+		case requestData.Current && requestData.Joints == nil && requestData.Pose == nil:
+			saved, err = bot.SaveCurrentPose(name)
+		default:
+			http.Error(resp, "Give exactly one of joints, pose or current", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			armError(resp, err)
+			return
+		}
+		pose = &saved
+
+	case http.MethodDelete:
+		var err error
+		if pose, err = bot.DeletePose(name); err != nil {
+			armError(resp, err)
+			return
+		}
+
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"pose":         pose,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
+// go_to_pose queues a move to a named pose, like bot-move it answers with the job.
+func go_to_pose(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestData struct {
+		Speed int `json:"speed"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !bot.IsOperational || !bot.IsRunning {
+		http.Error(resp, "Robot is not operational or not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	job, err := bot.GoToPose(req.PathValue("name"), time.Duration(requestData.Speed))
+	if err != nil {
+		armError(resp, err)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"job":          job,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respondWithStatus(resp, http.StatusAccepted, thisResponse)
+}
+
+// teach reports (GET), starts (POST) or stops and saves (DELETE) teaching the arm a routine.
+// While teaching every move the arm makes is recorded.
+func teach(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var routine robot.Routine
+	switch req.Method {
+	case http.MethodGet:
+		routine, _ = bot.Teaching()
+	case http.MethodPost:
+		var requestData struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := bot.StartTeaching(requestData.Name); err != nil {
+			armError(resp, err)
+			return
+		}
+		routine, _ = bot.Teaching()
+	case http.MethodDelete:
+		var err error
+		if routine, err = bot.StopTeaching(); err != nil {
+			armError(resp, err)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, teaching := bot.Teaching()
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"teaching":     teaching,
+		"routine":      routine,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
+// list_routines summarizes every saved routine.
+func list_routines(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"routines":     bot.Routines(),
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
+// routine gets (GET) or deletes (DELETE) a saved routine.
+func routine(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+	name := req.PathValue("name")
+
+	thisResponse := map[string]interface{}{
+		"botname": bot.Name,
+	}
+	switch req.Method {
+	case http.MethodGet:
+		found, err := bot.Routine(name)
+		if err != nil {
+			armError(resp, err)
+			return
+		}
+		thisResponse["routine"] = found
+	case http.MethodDelete:
+		if err := bot.DeleteRoutine(name); err != nil {
+			armError(resp, err)
+			return
+		}
+		thisResponse["deleted"] = name
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisResponse["this_request"] = map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	respond(resp, thisResponse)
+}
+
+// play_routine queues a replay of a saved routine, like bot-move it answers with the job.
+func play_routine(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestData := struct {
+		Scale float64 `json:"scale"`
+	}{Scale: 1}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if requestData.Scale < robot.MinRoutineScale || requestData.Scale > robot.MaxRoutineScale {
+		http.Error(resp, fmt.Sprintf("scale must be between %v and %v", robot.MinRoutineScale, robot.MaxRoutineScale), http.StatusBadRequest)
+		return
+	}
+
+	if !bot.IsOperational || !bot.IsRunning {
+		http.Error(resp, "Robot is not operational or not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	job, err := bot.PlayRoutine(req.PathValue("name"), requestData.Scale)
+	if err != nil {
+		armError(resp, err)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
 	}
-	if !bot.Camera.ImgMat.Empty() {
-		resp.Header().Set("Content-Type", "image/jpeg")
 
-		buf, _ := gocv.IMEncode(".jpg", bot.Camera.ImgMat)
-		jpegBytes := buf.GetBytes()
+	thisResponse := map[string]interface{}{
+		"job":          job,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respondWithStatus(resp, http.StatusAccepted, thisResponse)
+}
+
+// list_gestures lists the gestures the arm can make.
+func list_gestures(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"gestures":     robot.Gestures(),
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
+// gesture queues a gesture, like bot-move it answers with the job.
+func gesture(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var params robot.GestureParams
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !bot.IsOperational || !bot.IsRunning {
+		http.Error(resp, "Robot is not operational or not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	job, err := bot.PerformGesture(req.PathValue("name"), params)
+	if err != nil {
+		armError(resp, err)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"job":          job,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respondWithStatus(resp, http.StatusAccepted, thisResponse)
+}
+
+// track starts (POST), stops (DELETE) or reports (GET) face tracking.
+// The POST body is optional, anything left out of it uses the tracker's defaults.
+func track(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var config robot.TrackingConfig
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+				http.Error(resp, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if !bot.IsOperational || !bot.IsRunning {
+			http.Error(resp, "Robot is not operational or not running", http.StatusServiceUnavailable)
+			return
+		}
+		if _, err := bot.StartTracking(config); err != nil {
+			armError(resp, err)
+			return
+		}
+	case http.MethodDelete:
+		if err := bot.StopTracking(); err != nil {
+			armError(resp, err)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"tracking":     bot.TrackingStatus(),
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
+// armError maps the errors from the arm, its poses, routines, gestures and tracking onto status codes
+func armError(resp http.ResponseWriter, err error) {
+	var unreachable *robot.UnreachableError
+	var limit *robot.JointLimitError
+	switch {
+	case errors.Is(err, robot.ErrPoseNotFound), errors.Is(err, robot.ErrRoutineNotFound), errors.Is(err, robot.ErrGestureNotFound):
+		http.Error(resp, err.Error(), http.StatusNotFound)
+	case errors.Is(err, robot.ErrInvalidPoseName), errors.Is(err, robot.ErrInvalidRoutineName), errors.Is(err, robot.ErrInvalidGestureParams),
+		errors.Is(err, robot.ErrInvalidTrackingConfig):
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, robot.ErrAlreadyTeaching), errors.Is(err, robot.ErrNotTeaching),
+		errors.Is(err, robot.ErrAlreadyTracking), errors.Is(err, robot.ErrNotTracking):
+		http.Error(resp, err.Error(), http.StatusConflict)
+	case errors.As(err, &unreachable), errors.As(err, &limit):
+		http.Error(resp, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, robot.ErrEmergencyStop):
+		http.Error(resp, err.Error(), http.StatusConflict)
+	case errors.Is(err, robot.ErrQueueFull):
+		http.Error(resp, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// estop engages (POST), clears (DELETE) or reports (GET) the emergency stop.
+// Once engaged the e-stop stays latched, every move is refused until it is cleared.
+func estop(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var requestData struct {
+			CutPower bool `json:"cut_power"`
+		}
+		// The body is optional, an e-stop should never be refused over a bad request
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+				log.Printf("ESTOP: ignoring bad request body: %v", err)
+			}
+		}
+		if err := bot.EmergencyStop(requestData.CutPower); err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := bot.ClearEmergencyStop(); err != nil {
+			http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := fmt.Sprintf("%v current status is Operational: %v \nand Running: %v", bot.Name, bot.IsOperational, bot.IsRunning)
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+
+	thisResponse := map[string]interface{}{
+		"status":        status,
+		"estop":         bot.EmergencyStopped(),
+		"device_status": bot.DeviceStatus(),
+		"botname":       bot.Name,
+		"this_request":  thisRequest,
+	}
+
+	respond(resp, thisResponse)
+}
+
+func take_picture(resp http.ResponseWriter, req *http.Request) {
+
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	/* Log camera state */
+	frame := bot.Camera.Frames.Latest()
+	if frame == nil {
+		http.Error(resp, "No frame from the camera yet", http.StatusServiceUnavailable)
+		return
+	}
+	defer frame.Release()
+	log.Print("Camera is operational, running and the buffer is not empty, serving video")
+
+	jpegBytes, err := frame.JPEG()
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "image/jpeg")
+
+	// Write the frame to the HTTP response
+	fmt.Fprintf(resp, "--frame\r\n")
+	fmt.Fprintf(resp, "Content-Type: image/jpeg\r\n")
+	fmt.Fprintf(resp, "Content-Length: %d\r\n\r\n", len(jpegBytes))
+	resp.Write(jpegBytes)
+	fmt.Fprintf(resp, "\r\n")
+}
+
+// recordings lists (GET), starts (POST) and stops (DELETE) recordings of the camera.
+func recordings(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		list, err := bot.Recordings()
+		if err != nil {
+			cameraError(resp, err)
+			return
+		}
+		thisResponse["recordings"] = list
+		respond(resp, thisResponse)
+
+	case http.MethodPost:
+		var limits robot.RecordingLimits
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&limits); err != nil {
+				http.Error(resp, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		recording, err := bot.StartRecording(limits)
+		if err != nil {
+			cameraError(resp, err)
+			return
+		}
+		thisResponse["recording"] = recording
+		respondWithStatus(resp, http.StatusCreated, thisResponse)
+
+	case http.MethodDelete:
+		recording, err := bot.StopRecording()
+		if err != nil {
+			cameraError(resp, err)
+			return
+		}
+		thisResponse["recording"] = recording
+		respond(resp, thisResponse)
+
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// download_recording sends a recording's file, it can be fetched while it is still being recorded.
+func download_recording(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.PathValue("name")
+	path, err := bot.RecordingPath(name)
+	if err != nil {
+		cameraError(resp, err)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "video/x-msvideo")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(resp, req, path)
+}
+
+// clips reports the clip recorder (GET) or records a clip of the moments around now (POST).
+func clips(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		thisResponse["clips"] = bot.ClipsStatus()
+		respond(resp, thisResponse)
+
+	case http.MethodPost:
+		var requestData struct {
+			Reason string `json:"reason"`
+		}
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+				http.Error(resp, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+		if requestData.Reason == "" {
+			requestData.Reason = robot.ClipTriggerAPI
+		}
+		clip, err := bot.RecordClip(requestData.Reason)
+		if err != nil {
+			cameraError(resp, err)
+			return
+		}
+		// The clip is finished once its post-roll is over
+		thisResponse["clip"] = clip
+		respondWithStatus(resp, http.StatusAccepted, thisResponse)
+
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// motion reports (GET) or replaces (PUT) the motion detector's config, which turns it on and off.
+func motion(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var status robot.MotionStatus
+	switch req.Method {
+	case http.MethodGet:
+		status = bot.MotionStatus()
+	case http.MethodPut:
+		var config robot.MotionConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if status, err = bot.ConfigureMotion(config); err != nil {
+			cameraError(resp, err)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"motion":       status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// faces reports the face detector's config and latest faces, or switches it to another detector.
+func faces(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var status robot.FaceDetectorStatus
+	switch req.Method {
+	case http.MethodGet:
+		status = bot.FaceDetectorStatus()
+	case http.MethodPut:
+		var config robot.FaceDetectorConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if status, err = bot.ConfigureFaceDetector(config); err != nil {
+			cameraError(resp, err)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"faces":        status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// objects reports the object detector's config and what it last found, or reconfigures it.
+func objects(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var status robot.ObjectStatus
+	switch req.Method {
+	case http.MethodGet:
+		status = bot.ObjectStatus()
+	case http.MethodPut:
+		var config robot.ObjectDetectorConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if status, err = bot.ConfigureObjects(config); err != nil {
+			cameraError(resp, err)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"objects":      status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// markers reports the ArUco markers and QR codes last found, or reconfigures the marker detector.
+func markers(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var status robot.MarkerStatus
+	switch req.Method {
+	case http.MethodGet:
+		status = bot.MarkerStatus()
+	case http.MethodPut:
+		var config robot.MarkerConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if status, err = bot.ConfigureMarkers(config); err != nil {
+			cameraError(resp, err)
+			return
+		}
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"markers":      status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// calibration reports the camera's calibrations, turns undistortion on or off,
+// or forgets the calibration for the ?backend=, ?width= and ?height= given.
+func calibration(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var status robot.CalibrationStatus
+	switch req.Method {
+	case http.MethodGet:
+		status = bot.CalibrationStatus()
+	case http.MethodPut:
+		var requestData struct {
+			Undistort *bool `json:"undistort"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil || requestData.Undistort == nil {
+			http.Error(resp, "Invalid request body, it needs undistort", http.StatusBadRequest)
+			return
+		}
+		status = bot.SetUndistort(*requestData.Undistort)
+	case http.MethodDelete:
+		query := req.URL.Query()
+		width, widthErr := strconv.Atoi(query.Get("width"))
+		height, heightErr := strconv.Atoi(query.Get("height"))
+		if query.Get("backend") == "" || widthErr != nil || heightErr != nil {
+			http.Error(resp, "backend, width and height are required", http.StatusBadRequest)
+			return
+		}
+		if _, err := bot.DeleteCalibration(robot.CameraBackend(query.Get("backend")), width, height); err != nil {
+			cameraError(resp, err)
+			return
+		}
+		status = bot.CalibrationStatus()
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"calibration":  status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// calibration_session starts calibrating the camera with the chessboard posted, or throws the calibration under way away.
+func calibration_session(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var status robot.CalibrationStatus
+	switch req.Method {
+	case http.MethodGet:
+		status = bot.CalibrationStatus()
+	case http.MethodPost:
+		var board robot.CalibrationBoard
+		if err := json.NewDecoder(req.Body).Decode(&board); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if status, err = bot.StartCalibration(board); err != nil {
+			cameraError(resp, err)
+			return
+		}
+	case http.MethodDelete:
+		if err := bot.CancelCalibration(); err != nil {
+			cameraError(resp, err)
+			return
+		}
+		status = bot.CalibrationStatus()
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"calibration":  status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// calibration_capture waits for more views of the chessboard from the camera.
+func calibration_capture(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var requestData struct {
+		Views int `json:"views"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+		http.Error(resp, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	status, err := bot.CaptureCalibration(requestData.Views)
+	if err != nil {
+		cameraError(resp, err)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"calibration":  status,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// calibration_finish works out the camera's intrinsics from the views captured and saves them.
+func calibration_finish(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	intrinsics, err := bot.FinishCalibration()
+	if err != nil {
+		cameraError(resp, err)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"intrinsics":   intrinsics,
+		"calibration":  bot.CalibrationStatus(),
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// vision reports every stage of the camera's vision pipeline at once.
+func vision(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"vision":       bot.VisionStatus(),
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// people lists the people enrolled (GET) or enrolls someone (POST), from
+//
+//	{"name": "ara", "images": ["<base64 JPEG>", ...]}  pictures with one face in each
+//	{"name": "ara", "capture": 5}                     5 samples of the face in front of the camera
+//
+// or both. Enrolling someone already enrolled adds to their samples.
+func people(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		thisResponse["people"] = bot.People()
+		thisResponse["recognition"] = bot.RecognitionStatus()
+		respond(resp, thisResponse)
+
+	case http.MethodPost:
+		var requestData struct {
+			Name    string   `json:"name"`
+			Images  [][]byte `json:"images"`
+			Capture int      `json:"capture"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&requestData); err != nil {
+			http.Error(resp, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		person, err := bot.EnrollPerson(requestData.Name, requestData.Images, requestData.Capture)
+		if err != nil {
+			cameraError(resp, err)
+			return
+		}
+		thisResponse["person"] = person
+		respondWithStatus(resp, http.StatusCreated, thisResponse)
+
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// person gets (GET) or forgets (DELETE) someone enrolled.
+func person(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	var found robot.Person
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		found, err = bot.Person(req.PathValue("name"))
+	case http.MethodDelete:
+		found, err = bot.DeletePerson(req.PathValue("name"))
+	default:
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		cameraError(resp, err)
+		return
+	}
+
+	thisRequest := map[string]interface{}{
+		"time":           time.Now().Unix(),
+		"client_address": req.RemoteAddr,
+		"resource":       req.URL.Path,
+		"user_agent":     req.Header["User-Agent"],
+		"client":         clientHash(req),
+	}
+	thisResponse := map[string]interface{}{
+		"person":       found,
+		"botname":      bot.Name,
+		"this_request": thisRequest,
+	}
+	respond(resp, thisResponse)
+}
+
+// events streams what the robot notices as server-sent events, optionally only the ?type= given.
+func events(resp http.ResponseWriter, req *http.Request) {
+	bot := req.Context().Value("bot").(*robot.Robot)
+
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	wanted := map[string]bool{}
+	for _, eventType := range req.URL.Query()["type"] {
+		wanted[eventType] = true
+	}
+
+	subscription, unsubscribe := bot.Events.Subscribe(16)
+	defer unsubscribe()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event := <-subscription:
+			if len(wanted) > 0 && !wanted[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error !! Could not encode %v event: %v", event.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
 
-		// Write the frame to the HTTP response
-		fmt.Fprintf(resp, "--frame\r\n")
-		fmt.Fprintf(resp, "Content-Type: image/jpeg\r\n")
-		fmt.Fprintf(resp, "Content-Length: %d\r\n\r\n", len(jpegBytes))
-		resp.Write(jpegBytes)
-		fmt.Fprintf(resp, "\r\n")
+// cameraError maps the errors from the camera and what records and watches it onto status codes
+func cameraError(resp http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, robot.ErrRecordingNotFound), errors.Is(err, robot.ErrPersonNotFound),
+		errors.Is(err, robot.ErrCalibrationNotFound):
+		http.Error(resp, err.Error(), http.StatusNotFound)
+	case errors.Is(err, robot.ErrInvalidRecordingLimit), errors.Is(err, robot.ErrInvalidMotionConfig),
+		errors.Is(err, robot.ErrInvalidFaceConfig), errors.Is(err, robot.ErrInvalidPersonName),
+		errors.Is(err, robot.ErrInvalidEnrollment), errors.Is(err, robot.ErrInvalidObjectConfig),
+		errors.Is(err, robot.ErrInvalidMarkerConfig), errors.Is(err, robot.ErrInvalidCalibration):
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, robot.ErrAlreadyRecording), errors.Is(err, robot.ErrNotRecording),
+		errors.Is(err, robot.ErrNotCalibrating), errors.Is(err, robot.ErrCalibrationBusy):
+		http.Error(resp, err.Error(), http.StatusConflict)
+	case errors.Is(err, robot.ErrCameraNotRunning), errors.Is(err, robot.ErrNoFaceRecognizer):
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -1,12 +1,44 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/arabenjamin/gizmatron/robot"
+	"gocv.io/x/gocv"
 )
 
+func newSimulatedBot(t *testing.T) *robot.Robot {
+	t.Helper()
+	t.Setenv("GIZMATRON_POSES", filepath.Join(t.TempDir(), "poses.json"))
+	t.Setenv("GIZMATRON_ROUTINES", t.TempDir())
+	t.Setenv("GIZMATRON_RECORDINGS", t.TempDir())
+	t.Setenv("GIZMATRON_PEOPLE", filepath.Join(t.TempDir(), "people.json"))
+	t.Setenv("GIZMATRON_CAMERA_CALIBRATION", filepath.Join(t.TempDir(), "camera_calibration.json"))
+	bot, err := robot.InitRobotWithProfile(log.New(io.Discard, "", 0), robot.ProfileSimulated)
+	if err != nil {
+		t.Fatalf("Could not initialize simulated robot: %v", err)
+	}
+	return bot
+}
+
+// serve runs a request through a handler the same way server.Start wires it up
+func serve(bot *robot.Robot, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	Chain(handler, logger(log.New(io.Discard, "", 0)), robotware(bot)).ServeHTTP(rr, req)
+	return rr
+}
+
 func TestPing(t *testing.T) {
 	req, err := http.NewRequest("GET", "/ping", nil)
 	if err != nil {
@@ -118,3 +150,765 @@ func TestContentType(t *testing.T) {
 		t.Errorf("Expected Content-Type 'application/json', got '%s'", contentType)
 	}
 }
+
+func TestGetStatus_SimulatedRobot(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("GET", "/api/v1/bot-status", nil)
+	rr := serve(bot, get_status, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var response struct {
+		BotName      string                  `json:"botname"`
+		DeviceStatus map[string]robot.Device `json:"device_status"`
+		ArmPose      *robot.Pose             `json:"arm_pose"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Could not parse response: %v", err)
+	}
+
+	if response.BotName != "Gizmatron" {
+		t.Errorf("Expected botname 'Gizmatron', got '%v'", response.BotName)
+	}
+	if response.DeviceStatus["Arm"].Status != "Operational" {
+		t.Errorf("Expected simulated arm to be Operational, got '%v'", response.DeviceStatus["Arm"].Status)
+	}
+	if response.ArmPose == nil {
+		t.Error("Expected arm_pose for an operational arm")
+	}
+}
+
+func TestMoveArm_UnreachableTarget(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	body := strings.NewReader(`{"x": 100, "y": 0, "z": 10}`)
+	req, _ := http.NewRequest("POST", "/api/v1/bot-move", body)
+	rr := serve(bot, move_arm, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestMoveArm_BadElbow(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	body := strings.NewReader(`{"x": 15, "y": 0, "z": 10, "elbow": "sideways"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/bot-move", body)
+	rr := serve(bot, move_arm, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEstop(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	req, _ := http.NewRequest("POST", "/api/v1/estop", strings.NewReader(`{"cut_power": true}`))
+	if rr := serve(bot, estop, req); rr.Code != http.StatusOK {
+		t.Fatalf("engaging the e-stop returned %v", rr.Code)
+	}
+	if !bot.EmergencyStopped() {
+		t.Fatal("e-stop should be engaged")
+	}
+
+	// Moves are refused until the e-stop is cleared
+	bot.IsRunning = true
+	req, _ = http.NewRequest("POST", "/api/v1/bot-move", strings.NewReader(`{"x": 15, "y": 5, "z": 12}`))
+	if rr := serve(bot, move_arm, req); rr.Code != http.StatusConflict {
+		t.Errorf("move while e-stopped returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/estop", nil)
+	if rr := serve(bot, estop, req); rr.Code != http.StatusOK {
+		t.Fatalf("clearing the e-stop returned %v", rr.Code)
+	}
+	if bot.EmergencyStopped() {
+		t.Error("e-stop should be cleared")
+	}
+}
+
+func TestMoveArm_ReturnsJob(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	req, _ := http.NewRequest("POST", "/api/v1/bot-move", strings.NewReader(`{"x": 15, "y": 5, "z": 12}`))
+	rr := serve(bot, move_arm, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var moved struct {
+		Job robot.Job `json:"job"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &moved); err != nil {
+		t.Fatal(err)
+	}
+	if moved.Job.ID == "" {
+		t.Fatal("bot-move should return a job ID")
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/jobs/"+moved.Job.ID, nil)
+	req.SetPathValue("id", moved.Job.ID)
+	if rr := serve(bot, motion_job, req); rr.Code != http.StatusOK {
+		t.Errorf("GET job returned %v", rr.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/jobs/"+moved.Job.ID, nil)
+	req.SetPathValue("id", moved.Job.ID)
+	if rr := serve(bot, motion_job, req); rr.Code != http.StatusOK {
+		t.Errorf("DELETE job returned %v", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/jobs/nope", nil)
+	req.SetPathValue("id", "nope")
+	if rr := serve(bot, motion_job, req); rr.Code != http.StatusNotFound {
+		t.Errorf("GET unknown job returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestNamedPose_SaveGoDelete(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	req, _ := http.NewRequest("PUT", "/api/v1/poses/wave", strings.NewReader(`{"joints": [45, 60, 60, 120, 90]}`))
+	req.SetPathValue("name", "wave")
+	if rr := serve(bot, named_pose, req); rr.Code != http.StatusOK {
+		t.Fatalf("PUT pose returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/poses/wave", nil)
+	req.SetPathValue("name", "wave")
+	rr := serve(bot, named_pose, req)
+	var got struct {
+		Pose robot.NamedPose `json:"pose"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || got.Pose.Joints != [5]int{45, 60, 60, 120, 90} {
+		t.Errorf("GET pose = %+v %v", got.Pose, err)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/poses/wave/go", nil)
+	req.SetPathValue("name", "wave")
+	if rr := serve(bot, go_to_pose, req); rr.Code != http.StatusAccepted {
+		t.Errorf("go to pose returned %v, want %v", rr.Code, http.StatusAccepted)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/poses/wave", nil)
+	req.SetPathValue("name", "wave")
+	if rr := serve(bot, named_pose, req); rr.Code != http.StatusOK {
+		t.Errorf("DELETE pose returned %v", rr.Code)
+	}
+	req, _ = http.NewRequest("POST", "/api/v1/poses/wave/go", nil)
+	req.SetPathValue("name", "wave")
+	if rr := serve(bot, go_to_pose, req); rr.Code != http.StatusNotFound {
+		t.Errorf("go to deleted pose returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestNamedPose_BadRequests(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"joints": [90, 0, 0, 180, 200]}`, http.StatusUnprocessableEntity},
+		{`{"pose": {"x": 100, "y": 0, "z": 10}}`, http.StatusUnprocessableEntity},
+		{`{"joints": [90, 0, 0, 180, 180], "current": true}`, http.StatusBadRequest},
+		{`{}`, http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest("PUT", "/api/v1/poses/bad", strings.NewReader(tc.body))
+		req.SetPathValue("name", "bad")
+		if rr := serve(bot, named_pose, req); rr.Code != tc.want {
+			t.Errorf("PUT %v returned %v, want %v", tc.body, rr.Code, tc.want)
+		}
+	}
+}
+
+func TestTeachAndPlay(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	req, _ := http.NewRequest("POST", "/api/v1/teach", strings.NewReader(`{"name": "look"}`))
+	if rr := serve(bot, teach, req); rr.Code != http.StatusOK {
+		t.Fatalf("start teaching returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/poses/look-left/go", strings.NewReader(`{"speed": 1}`))
+	req.SetPathValue("name", "look-left")
+	rr := serve(bot, go_to_pose, req)
+	var moved struct {
+		Job robot.Job `json:"job"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &moved)
+	for job, _ := bot.Job(moved.Job.ID); !job.State.Finished(); job, _ = bot.Job(moved.Job.ID) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/teach", nil)
+	rr = serve(bot, teach, req)
+	var taught struct {
+		Teaching bool          `json:"teaching"`
+		Routine  robot.Routine `json:"routine"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &taught); err != nil || taught.Teaching || len(taught.Routine.Steps) != 2 {
+		t.Fatalf("stop teaching = %v %+v %v", rr.Code, taught, err)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/routines/look/play", strings.NewReader(`{"scale": 2}`))
+	req.SetPathValue("name", "look")
+	if rr := serve(bot, play_routine, req); rr.Code != http.StatusAccepted {
+		t.Errorf("play routine returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/routines/look/play", strings.NewReader(`{"scale": 100}`))
+	req.SetPathValue("name", "look")
+	if rr := serve(bot, play_routine, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("play at scale 100 returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/routines/nope", nil)
+	req.SetPathValue("name", "nope")
+	if rr := serve(bot, routine, req); rr.Code != http.StatusNotFound {
+		t.Errorf("GET unknown routine returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestGestures(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	req, _ := http.NewRequest("GET", "/api/v1/gestures", nil)
+	rr := serve(bot, list_gestures, req)
+	var listed struct {
+		Gestures []robot.Gesture `json:"gestures"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || len(listed.Gestures) == 0 {
+		t.Fatalf("list gestures = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/gestures/nod", strings.NewReader(`{"amplitude": 0.5, "tempo": 1.5}`))
+	req.SetPathValue("name", "nod")
+	if rr := serve(bot, gesture, req); rr.Code != http.StatusAccepted {
+		t.Errorf("nod returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/gestures/nod", strings.NewReader(`{"tempo": 10}`))
+	req.SetPathValue("name", "nod")
+	if rr := serve(bot, gesture, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("nod at tempo 10 returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/gestures/dance", nil)
+	req.SetPathValue("name", "dance")
+	if rr := serve(bot, gesture, req); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown gesture returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+
+	req, _ := http.NewRequest("POST", "/api/v1/track", strings.NewReader(`{"gain": 0.3}`))
+	rr := serve(bot, track, req)
+	var started struct {
+		Tracking robot.TrackingStatus `json:"tracking"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil || !started.Tracking.Enabled || started.Tracking.Config.Gain != 0.3 {
+		t.Fatalf("start tracking = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/track", nil)
+	if rr := serve(bot, track, req); rr.Code != http.StatusConflict {
+		t.Errorf("start tracking twice returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/track", nil)
+	if rr := serve(bot, track, req); rr.Code != http.StatusOK {
+		t.Errorf("stop tracking returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/track", strings.NewReader(`{"deadband": 2}`))
+	if rr := serve(bot, track, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("deadband 2 returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestResetBot(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("POST", "/api/v1/bot-reset", nil)
+	if rr := serve(bot, reset_bot, req); rr.Code != http.StatusOK {
+		t.Fatalf("bot-reset returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	// A client that stops waiting doesn't stop the re-home
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ = http.NewRequestWithContext(ctx, "POST", "/api/v1/bot-reset", nil)
+	if rr := serve(bot, reset_bot, req); rr.Code != http.StatusOK {
+		t.Errorf("bot-reset for a client that went away returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/bot-reset", nil)
+	if rr := serve(bot, reset_bot, req); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET bot-reset returned %v, want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestVideoOptions(t *testing.T) {
+	for _, tc := range []struct {
+		query               string
+		fps, width, quality int
+		bad                 bool
+	}{
+		{query: "", fps: 30, width: 0, quality: defaultVideoQuality},
+		{query: "fps=5&width=320&quality=50", fps: 5, width: 320, quality: 50},
+		{query: "fps=60", bad: true},
+		{query: "fps=0", bad: true},
+		{query: "width=abc", bad: true},
+		{query: "quality=101", bad: true},
+	} {
+		req, _ := http.NewRequest("GET", "/api/v1/video?"+tc.query, nil)
+		fps, width, quality, err := videoOptions(req, 30)
+		if tc.bad {
+			if err == nil {
+				t.Errorf("%q should be refused", tc.query)
+			}
+			continue
+		}
+		if err != nil || fps != tc.fps || width != tc.width || quality != tc.quality {
+			t.Errorf("%q = %v %v %v %v, want %v %v %v", tc.query, fps, width, quality, err, tc.fps, tc.width, tc.quality)
+		}
+	}
+}
+
+func TestGetVideo_RateAndDisconnect(t *testing.T) {
+	bot := newSimulatedBot(t)
+	bot.IsRunning = true
+	go bot.Camera.Start()
+	defer bot.Camera.Stop()
+	for deadline := time.Now().Add(time.Second); !bot.Camera.Started(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("camera never started")
+		}
+	}
+	// The robot's own subscribers, e.g. the clip recorder
+	subscribers := bot.Camera.Frames.Subscribers()
+
+	// Frames come in at about 100 fps
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				bot.Camera.Frames.Publish(gocv.NewMat(), nil)
+			}
+		}
+	}()
+
+	server := httptest.NewServer(Chain(get_video, logger(log.New(io.Discard, "", 0)), robotware(bot)))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/video?fps=5", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "multipart/x-mixed-replace; boundary=frame" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body) // until the context times out
+	resp.Body.Close()
+
+	if parts := bytes.Count(body, []byte("--frame\r\n")); parts < 3 || parts > 7 {
+		t.Errorf("got %d frames in a second at 5 fps", parts)
+	}
+
+	// Once the client has gone its subscription should be too
+	deadline := time.Now().Add(time.Second)
+	for bot.Camera.Frames.Subscribers() != subscribers && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := bot.Camera.Frames.Subscribers(); n != subscribers {
+		t.Errorf("%d subscribers left after the client went away, want %d", n, subscribers)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/video?fps=100", nil)
+	if rr := serve(bot, get_video, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("fps=100 returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRecordings(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("POST", "/api/v1/recordings", nil)
+	if rr := serve(bot, recordings, req); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("recording with the camera off returned %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	go bot.Camera.Start()
+	defer bot.Camera.Stop()
+	for deadline := time.Now().Add(time.Second); !bot.Camera.Started(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("camera never started")
+		}
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/recordings", strings.NewReader(`{"max_seconds": 30}`))
+	rr := serve(bot, recordings, req)
+	var started struct {
+		Recording robot.Recording `json:"recording"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); rr.Code != http.StatusCreated || err != nil || !started.Recording.Active {
+		t.Fatalf("start recording = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/recordings", nil)
+	if rr := serve(bot, recordings, req); rr.Code != http.StatusConflict {
+		t.Errorf("recording twice returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	// The simulated camera has nothing to show, so hand the recording a frame
+	bot.Camera.Frames.Publish(gocv.NewMat(), nil)
+	time.Sleep(20 * time.Millisecond)
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/recordings", nil)
+	if rr := serve(bot, recordings, req); rr.Code != http.StatusOK {
+		t.Fatalf("stop recording returned %v: %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/recordings", nil)
+	rr = serve(bot, recordings, req)
+	var listed struct {
+		Recordings []robot.Recording `json:"recordings"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || len(listed.Recordings) != 1 || listed.Recordings[0].Name != started.Recording.Name {
+		t.Fatalf("list recordings = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/recordings/"+started.Recording.Name, nil)
+	req.SetPathValue("name", started.Recording.Name)
+	rr = serve(bot, download_recording, req)
+	if rr.Code != http.StatusOK || rr.Body.Len() == 0 || !strings.Contains(rr.Header().Get("Content-Disposition"), started.Recording.Name) {
+		t.Errorf("download = %v, %d bytes, headers %v", rr.Code, rr.Body.Len(), rr.Header())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/recordings/nope.avi", nil)
+	req.SetPathValue("name", "nope.avi")
+	if rr := serve(bot, download_recording, req); rr.Code != http.StatusNotFound {
+		t.Errorf("download of a missing recording returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestClips(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("POST", "/api/v1/clips", nil)
+	if rr := serve(bot, clips, req); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("clip with the camera off returned %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	go bot.Camera.Start()
+	defer bot.Camera.Stop()
+	for deadline := time.Now().Add(time.Second); !bot.Camera.Started(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("camera never started")
+		}
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/clips", strings.NewReader(`{"reason": "doorbell"}`))
+	rr := serve(bot, clips, req)
+	var triggered struct {
+		Clip robot.Recording `json:"clip"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &triggered); rr.Code != http.StatusAccepted || err != nil || triggered.Clip.Trigger != "doorbell" {
+		t.Fatalf("record clip = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/clips", nil)
+	rr = serve(bot, clips, req)
+	var status struct {
+		Clips robot.ClipsStatus `json:"clips"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil || status.Clips.Clip == nil || status.Clips.Clip.Name != triggered.Clip.Name {
+		t.Errorf("clips status = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+}
+
+func TestMotion(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/vision/motion", strings.NewReader(`{"enabled": true, "sensitivity": 0.7, "regions": [{"Min": {"X": 0, "Y": 0}, "Max": {"X": 320, "Y": 240}}]}`))
+	rr := serve(bot, motion, req)
+	var configured struct {
+		Motion robot.MotionStatus `json:"motion"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &configured); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("configure motion = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if config := configured.Motion.Config; !config.Enabled || config.Sensitivity != 0.7 || len(config.Regions) != 1 || config.MinArea != robot.DefaultMotionMinArea {
+		t.Errorf("config = %+v", config)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/vision/motion", nil)
+	if rr := serve(bot, motion, req); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"sensitivity":0.7`) {
+		t.Errorf("motion status = %v %v", rr.Code, rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("PUT", "/api/v1/vision/motion", strings.NewReader(`{"enabled": true, "sensitivity": 3}`))
+	if rr := serve(bot, motion, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("sensitivity 3 returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestFaces(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("GET", "/api/v1/vision/faces", nil)
+	rr := serve(bot, faces, req)
+	var status struct {
+		Faces robot.FaceDetectorStatus `json:"faces"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("face detector status = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if status.Faces.Config.Detector != robot.DefaultFaceDetector {
+		t.Errorf("detector = %v, want %v", status.Faces.Config.Detector, robot.DefaultFaceDetector)
+	}
+
+	for _, body := range []string{
+		`{"detector": "lbp"}`,
+		`{"confidence": 1.5}`,
+		`{"detector": "yunet", "model": "/no/such/model.onnx"}`,
+	} {
+		req, _ := http.NewRequest("PUT", "/api/v1/vision/faces", strings.NewReader(body))
+		if rr := serve(bot, faces, req); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestObjects(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/vision/objects", strings.NewReader(`{"format": "yolo", "classes": ["person", "cup"]}`))
+	rr := serve(bot, objects, req)
+	var status struct {
+		Objects robot.ObjectStatus `json:"objects"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("configure objects = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if config := status.Objects.Config; config.Format != robot.ObjectFormatYOLO || config.Confidence != robot.DefaultObjectConfidence || len(config.Classes) != 2 {
+		t.Errorf("config = %+v", config)
+	}
+
+	for _, body := range []string{
+		`{"format": "rcnn"}`,
+		`{"confidence": 1.5}`,
+		`{"enabled": true, "model": "/no/such/model.onnx"}`,
+	} {
+		req, _ := http.NewRequest("PUT", "/api/v1/vision/objects", strings.NewReader(body))
+		if rr := serve(bot, objects, req); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/vision", nil)
+	rr = serve(bot, vision, req)
+	var overview struct {
+		Vision robot.VisionStatus `json:"vision"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &overview); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("vision = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if overview.Vision.Objects.Config.Format != robot.ObjectFormatYOLO || overview.Vision.Faces.Config.Detector != robot.DefaultFaceDetector {
+		t.Errorf("vision = %+v", overview.Vision)
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/vision/markers", strings.NewReader(`{"kinds": ["aruco"], "dictionary": "6x6_250", "size_mm": 80}`))
+	rr := serve(bot, markers, req)
+	var status struct {
+		Markers robot.MarkerStatus `json:"markers"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("configure markers = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if config := status.Markers.Config; config.Dictionary != "6x6_250" || config.SizeMm != 80 || len(config.Kinds) != 1 || config.IntervalMs == 0 {
+		t.Errorf("config = %+v", config)
+	}
+
+	for _, body := range []string{
+		`{"kinds": ["barcode"]}`,
+		`{"dictionary": "3x3_10"}`,
+		`{"size_mm": -1}`,
+	} {
+		req, _ := http.NewRequest("PUT", "/api/v1/vision/markers", strings.NewReader(body))
+		if rr := serve(bot, markers, req); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s returned %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/vision/markers", nil)
+	if rr := serve(bot, markers, req); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"6x6_250"`) {
+		t.Errorf("markers = %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/vision/calibration", strings.NewReader(`{"undistort": true}`))
+	rr := serve(bot, calibration, req)
+	var status struct {
+		Calibration robot.CalibrationStatus `json:"calibration"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("undistort = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if !status.Calibration.Undistort || status.Calibration.Session != nil || len(status.Calibration.Calibrations) != 0 {
+		t.Errorf("status = %+v", status.Calibration)
+	}
+	for _, tc := range []struct {
+		method, url, body string
+		want              int
+	}{
+		{"PUT", "/api/v1/vision/calibration", `{}`, http.StatusBadRequest},
+		{"DELETE", "/api/v1/vision/calibration?backend=v4l2&width=640", "", http.StatusBadRequest},
+		{"DELETE", "/api/v1/vision/calibration?backend=v4l2&width=640&height=480", "", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if rr := serve(bot, calibration, req); rr.Code != tc.want {
+			t.Errorf("%v %v returned %v, want %v", tc.method, tc.url, rr.Code, tc.want)
+		}
+	}
+
+	// Nothing to capture into or finish before a session is started
+	req, _ = http.NewRequest("POST", "/api/v1/vision/calibration/finish", nil)
+	if rr := serve(bot, calibration_finish, req); rr.Code != http.StatusConflict {
+		t.Errorf("finish without a session returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/vision/calibration/session", strings.NewReader(`{"cols": 7, "rows": 7}`))
+	if rr := serve(bot, calibration_session, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("a square board returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	req, _ = http.NewRequest("POST", "/api/v1/vision/calibration/session", strings.NewReader(`{"square_mm": 30}`))
+	rr = serve(bot, calibration_session, req)
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("start = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if session := status.Calibration.Session; session == nil || session.Board.Cols != robot.DefaultBoardCols || session.Board.SquareMm != 30 {
+		t.Errorf("session = %+v", session)
+	}
+
+	// The simulated camera isn't running
+	req, _ = http.NewRequest("POST", "/api/v1/vision/calibration/capture", strings.NewReader(`{"views": 5}`))
+	if rr := serve(bot, calibration_capture, req); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("capture returned %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	req, _ = http.NewRequest("POST", "/api/v1/vision/calibration/finish", nil)
+	if rr := serve(bot, calibration_finish, req); rr.Code != http.StatusBadRequest {
+		t.Errorf("finish without views returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/vision/calibration/session", nil)
+	if rr := serve(bot, calibration_session, req); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), `"session"`) {
+		t.Errorf("cancel = %v %v", rr.Code, rr.Body.String())
+	}
+	req, _ = http.NewRequest("DELETE", "/api/v1/vision/calibration/session", nil)
+	if rr := serve(bot, calibration_session, req); rr.Code != http.StatusConflict {
+		t.Errorf("cancelling nothing returned %v, want %v", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestPeople(t *testing.T) {
+	bot := newSimulatedBot(t)
+
+	req, _ := http.NewRequest("GET", "/api/v1/people", nil)
+	rr := serve(bot, people, req)
+	var listed struct {
+		People      []robot.Person          `json:"people"`
+		Recognition robot.RecognitionStatus `json:"recognition"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("people = %v %v %v", rr.Code, rr.Body.String(), err)
+	}
+	if len(listed.People) != 0 || listed.Recognition.Config.Threshold != robot.DefaultFaceMatchThreshold {
+		t.Errorf("people = %+v", listed)
+	}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"name": "../ara", "capture": 1}`, http.StatusBadRequest},
+		{`{"name": "ara"}`, http.StatusBadRequest},
+		{`{"name": "ara", "images": ["bm90IGEgcGljdHVyZQ=="]}`, http.StatusBadRequest},
+		{`{"name": "ara", "capture": 3}`, http.StatusServiceUnavailable},
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/people", strings.NewReader(tc.body))
+		if rr := serve(bot, people, req); rr.Code != tc.want {
+			t.Errorf("%s returned %v, want %v", tc.body, rr.Code, tc.want)
+		}
+	}
+
+	for _, method := range []string{"GET", "DELETE"} {
+		req, _ := http.NewRequest(method, "/api/v1/people/ara", nil)
+		req.SetPathValue("name", "ara")
+		if rr := serve(bot, person, req); rr.Code != http.StatusNotFound {
+			t.Errorf("%v of nobody returned %v, want %v", method, rr.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	bot := newSimulatedBot(t)
+	server := httptest.NewServer(Chain(events, logger(log.New(io.Discard, "", 0)), robotware(bot)))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/events?type="+robot.EventMotionStarted, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	// Only the type asked for comes through
+	bot.Events.Publish(robot.EventMotionStopped, nil)
+	bot.Events.Publish(robot.EventMotionStarted, robot.MotionResult{Motion: true, Score: 0.25})
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "event: "+robot.EventMotionStarted+"\n" {
+		t.Fatalf("first line = %q, %v", line, err)
+	}
+	line, _ = reader.ReadString('\n')
+	var event robot.Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil || event.Type != robot.EventMotionStarted {
+		t.Errorf("data = %q, %v", line, err)
+	}
+}
@@ -48,11 +48,15 @@ func robotware(bot *robot.Robot) Middleware {
 }
 
 func respond(res http.ResponseWriter, payload map[string]interface{}) {
+	respondWithStatus(res, http.StatusOK, payload)
+}
+
+func respondWithStatus(res http.ResponseWriter, code int, payload map[string]interface{}) {
 
 	json_resp, _ := json.Marshal(payload)
 	res.Header().Set("Content-Type", "application/json")
 	res.Header().Set("Access-Control-Allow-Origin", "*")
-	res.WriteHeader(http.StatusOK)
+	res.WriteHeader(code)
 	res.Write(json_resp)
 }
 
@@ -99,12 +103,40 @@ func Start(bot *robot.Robot, serverlog *log.Logger) error {
 	mux.HandleFunc("/api/v1/bot-status", Chain(get_status, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/bot-start", Chain(start_bot, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/bot-stop", Chain(stop_bot, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/bot-reset", Chain(reset_bot, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/bot-move", Chain(move_arm, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/jobs/{id}", Chain(motion_job, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/poses", Chain(list_poses, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/poses/{name}", Chain(named_pose, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/poses/{name}/go", Chain(go_to_pose, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/teach", Chain(teach, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/routines", Chain(list_routines, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/routines/{name}", Chain(routine, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/routines/{name}/play", Chain(play_routine, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/gestures", Chain(list_gestures, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/gestures/{name}", Chain(gesture, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/track", Chain(track, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/estop", Chain(estop, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/detectfaces", Chain(set_facedetect, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/video", Chain(get_video, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/start/stream", Chain(start_stream, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/stop/stream", Chain(stop_stream, logger(serverlog), robotware(bot)))
 	mux.HandleFunc("/api/v1/takepicture", Chain(take_picture, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/recordings", Chain(recordings, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/recordings/{name}", Chain(download_recording, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/clips", Chain(clips, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision", Chain(vision, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/motion", Chain(motion, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/faces", Chain(faces, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/objects", Chain(objects, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/markers", Chain(markers, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/calibration", Chain(calibration, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/calibration/session", Chain(calibration_session, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/calibration/capture", Chain(calibration_capture, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/vision/calibration/finish", Chain(calibration_finish, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/people", Chain(people, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/people/{name}", Chain(person, logger(serverlog), robotware(bot)))
+	mux.HandleFunc("/api/v1/events", Chain(events, logger(serverlog), robotware(bot)))
 	//mux.Handle("/stream", bot.Camera.Stream)
 
 	err := http.ListenAndServe(":8080", mux)